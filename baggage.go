@@ -0,0 +1,98 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc/metadata"
+)
+
+// BaggageHeader is the W3C header, and gRPC metadata key, carrying the
+// baggage of a request.
+const BaggageHeader = "baggage"
+
+// baggageMetadata forwards the baggage received at the HTTP edge to the
+// gRPC call made by the gateway.
+func baggageMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	items := parseBaggage(r.Header.Get(BaggageHeader))
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.Context().ForeachBaggageItem(func(k, v string) bool {
+			if _, ok := items[k]; !ok {
+				items[k] = v
+			}
+			return true
+		})
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	return metadata.Pairs(BaggageHeader, formatBaggage(items))
+}
+
+// Baggage returns the baggage items received by a gRPC handler, whether
+// they were sent by a gRPC client or forwarded from an HTTP request.
+func Baggage(ctx context.Context) map[string]string {
+	items := map[string]string{}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md.Get(BaggageHeader) {
+			for k, v := range parseBaggage(v) {
+				items[k] = v
+			}
+		}
+	}
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.Context().ForeachBaggageItem(func(k, v string) bool {
+			if _, ok := items[k]; !ok {
+				items[k] = v
+			}
+			return true
+		})
+	}
+
+	return items
+}
+
+// parseBaggage decodes a W3C baggage header, ignoring malformed members and
+// any member properties.
+func parseBaggage(header string) map[string]string {
+	items := map[string]string{}
+
+	for _, member := range strings.Split(header, ",") {
+		member = strings.TrimSpace(strings.SplitN(member, ";", 2)[0])
+
+		kv := strings.SplitN(member, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		k := strings.TrimSpace(kv[0])
+		v, err := url.PathUnescape(strings.TrimSpace(kv[1]))
+		if k == "" || err != nil {
+			continue
+		}
+
+		items[k] = v
+	}
+
+	return items
+}
+
+func formatBaggage(items map[string]string) string {
+	members := make([]string, 0, len(items))
+	for k, v := range items {
+		members = append(members, k+"="+url.PathEscape(v))
+	}
+
+	sort.Strings(members)
+
+	return strings.Join(members, ",")
+}
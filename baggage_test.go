@@ -0,0 +1,124 @@
+package drudge
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestParseBaggage(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]string
+	}{
+		{name: "empty", want: map[string]string{}},
+		{name: "members", header: "tenant=acme, user = 42", want: map[string]string{"tenant": "acme", "user": "42"}},
+		{name: "properties", header: "tenant=acme;ttl=3", want: map[string]string{"tenant": "acme"}},
+		{name: "escaped", header: "path=a%2Cb%20c", want: map[string]string{"path": "a,b c"}},
+		{name: "malformed", header: "novalue,=nokey,bad=%zz,ok=1", want: map[string]string{"ok": "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseBaggage(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBaggage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatBaggage(t *testing.T) {
+	items := map[string]string{"user": "42", "path": "a,b c"}
+
+	got := formatBaggage(items)
+	if got != "path=a%2Cb%20c,user=42" {
+		t.Errorf("formatBaggage() = %s", got)
+	}
+
+	if back := parseBaggage(got); !reflect.DeepEqual(back, items) {
+		t.Errorf("parseBaggage(formatBaggage()) = %v, want %v", back, items)
+	}
+}
+
+// withBaggageSpan returns ctx with a span carrying the baggage items.
+func withBaggageSpan(ctx context.Context, items map[string]string) context.Context {
+	if len(items) == 0 {
+		return ctx
+	}
+
+	span := mocktracer.New().StartSpan("test")
+	for k, v := range items {
+		span.SetBaggageItem(k, v)
+	}
+
+	return opentracing.ContextWithSpan(ctx, span)
+}
+
+func TestBaggageMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		span   map[string]string
+		want   metadata.MD
+	}{
+		{name: "none"},
+		{name: "header", header: "tenant=acme", want: metadata.Pairs(BaggageHeader, "tenant=acme")},
+		{name: "span", span: map[string]string{"user": "42"}, want: metadata.Pairs(BaggageHeader, "user=42")},
+		{
+			name:   "header first",
+			header: "tenant=acme",
+			span:   map[string]string{"tenant": "other", "user": "42"},
+			want:   metadata.Pairs(BaggageHeader, "tenant=acme,user=42"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/users", nil)
+			if tt.header != "" {
+				r.Header.Set(BaggageHeader, tt.header)
+			}
+
+			if got := baggageMetadata(withBaggageSpan(context.Background(), tt.span), r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("baggageMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBaggage(t *testing.T) {
+	tests := []struct {
+		name string
+		md   metadata.MD
+		span map[string]string
+		want map[string]string
+	}{
+		{name: "none", want: map[string]string{}},
+		{name: "metadata", md: metadata.Pairs(BaggageHeader, "tenant=acme", BaggageHeader, "user=42"), want: map[string]string{"tenant": "acme", "user": "42"}},
+		{
+			name: "metadata first",
+			md:   metadata.Pairs(BaggageHeader, "tenant=acme"),
+			span: map[string]string{"tenant": "other", "region": "eu"},
+			want: map[string]string{"tenant": "acme", "region": "eu"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tt.md)
+			}
+
+			if got := Baggage(withBaggageSpan(ctx, tt.span)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Baggage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package drudge
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// CircuitBreakerState records the state of the gateway's circuit
+	// breaker, 0 when closed, 1 when half-open and 2 when open.
+	CircuitBreakerState = stats.Int64("drudge/grpc/circuit_breaker_state", "State of the circuit breaker", stats.UnitDimensionless)
+
+	CircuitBreakerView = &view.View{
+		Name:        CircuitBreakerState.Name(),
+		Measure:     CircuitBreakerState,
+		Description: CircuitBreakerState.Description(),
+		Aggregation: view.LastValue(),
+	}
+)
+
+// BreakerConfig configures a circuit breaker, zero values fall back to
+// DefaultBreakerConfig.
+type BreakerConfig struct {
+	// Failures is the number of consecutive failed calls opening the breaker.
+	Failures int
+
+	// OpenTimeout is how long calls fail fast before the breaker lets
+	// probes through.
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of calls let through after OpenTimeout,
+	// as many successes close the breaker while a failure opens it again.
+	HalfOpenProbes int
+}
+
+// DefaultBreakerConfig is used for the unset fields of a BreakerConfig.
+var DefaultBreakerConfig = BreakerConfig{
+	Failures:       5,
+	OpenTimeout:    30 * time.Second,
+	HalfOpenProbes: 1,
+}
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.Failures <= 0 {
+		c.Failures = DefaultBreakerConfig.Failures
+	}
+
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = DefaultBreakerConfig.OpenTimeout
+	}
+
+	if c.HalfOpenProbes <= 0 {
+		c.HalfOpenProbes = DefaultBreakerConfig.HalfOpenProbes
+	}
+
+	return c
+}
+
+// WithCircuitBreaker fails calls fast with Unavailable once the server keeps
+// failing, instead of piling them up.
+func WithCircuitBreaker(c BreakerConfig) DialOption {
+	return func(o *dialOptions) {
+		b := newBreaker(c)
+		o.unary = append(o.unary, b.unaryInterceptor())
+		o.stream = append(o.stream, b.streamInterceptor())
+	}
+}
+
+type breakerState int64
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+type breaker struct {
+	cfg BreakerConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probes    int
+	successes int
+}
+
+func newBreaker(c BreakerConfig) *breaker {
+	b := &breaker{
+		cfg: c.withDefaults(),
+		now: time.Now,
+	}
+	b.record()
+
+	return b
+}
+
+func (b *breaker) unaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		if err := b.allow(); err != nil {
+			return err
+		}
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		b.done(err)
+
+		return err
+	}
+}
+
+// streamInterceptor only accounts for the stream being established.
+func (b *breaker) streamInterceptor() grpc.StreamClientInterceptor {
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		if err := b.allow(); err != nil {
+			return nil, err
+		}
+
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		b.done(err)
+
+		return cs, err
+	}
+}
+
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.OpenTimeout {
+			return status.Error(codes.Unavailable, "circuit breaker is open")
+		}
+
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenProbes {
+			return status.Error(codes.Unavailable, "circuit breaker is half-open")
+		}
+
+		b.probes++
+	}
+
+	return nil
+}
+
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := isBackendFailure(err)
+
+	switch b.state {
+	case breakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+
+		b.failures++
+		if b.failures >= b.cfg.Failures {
+			b.setState(breakerOpen)
+		}
+	case breakerHalfOpen:
+		if failed {
+			b.setState(breakerOpen)
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenProbes {
+			b.setState(breakerClosed)
+		}
+	}
+}
+
+// setState moves the breaker to s, resetting the counters of the state.
+func (b *breaker) setState(s breakerState) {
+	b.state = s
+	b.failures, b.probes, b.successes = 0, 0, 0
+	if s == breakerOpen {
+		b.openedAt = b.now()
+	}
+
+	b.record()
+}
+
+func (b *breaker) record() {
+	MeasureInt(context.Background(), CircuitBreakerState, int64(b.state))
+}
+
+// isBackendFailure reports whether err means the server is failing, as
+// opposed to the call being rejected.
+func isBackendFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.DataLoss:
+		return true
+	default:
+		return false
+	}
+}
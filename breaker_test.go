@@ -0,0 +1,182 @@
+package drudge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBreaker(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	notFound := status.Error(codes.NotFound, "no such user")
+
+	// step is a call made after the clock advanced by wait.
+	type step struct {
+		wait    time.Duration
+		err     error
+		want    codes.Code
+		invoked bool
+	}
+
+	tests := []struct {
+		name      string
+		cfg       BreakerConfig
+		steps     []step
+		wantState breakerState
+	}{
+		{
+			name: "opens after consecutive failures",
+			cfg:  BreakerConfig{Failures: 2, OpenTimeout: time.Minute},
+			steps: []step{
+				{err: unavailable, want: codes.Unavailable, invoked: true},
+				{err: unavailable, want: codes.Unavailable, invoked: true},
+				{want: codes.Unavailable},
+			},
+			wantState: breakerOpen,
+		},
+		{
+			name: "success resets the failures",
+			cfg:  BreakerConfig{Failures: 2, OpenTimeout: time.Minute},
+			steps: []step{
+				{err: unavailable, want: codes.Unavailable, invoked: true},
+				{want: codes.OK, invoked: true},
+				{err: unavailable, want: codes.Unavailable, invoked: true},
+			},
+			wantState: breakerClosed,
+		},
+		{
+			name: "rejections aren't failures",
+			cfg:  BreakerConfig{Failures: 1, OpenTimeout: time.Minute},
+			steps: []step{
+				{err: notFound, want: codes.NotFound, invoked: true},
+				{err: notFound, want: codes.NotFound, invoked: true},
+			},
+			wantState: breakerClosed,
+		},
+		{
+			name: "probe closes",
+			cfg:  BreakerConfig{Failures: 1, OpenTimeout: time.Minute},
+			steps: []step{
+				{err: unavailable, want: codes.Unavailable, invoked: true},
+				{wait: time.Minute, want: codes.OK, invoked: true},
+				{want: codes.OK, invoked: true},
+			},
+			wantState: breakerClosed,
+		},
+		{
+			name: "failed probe opens again",
+			cfg:  BreakerConfig{Failures: 1, OpenTimeout: time.Minute},
+			steps: []step{
+				{err: unavailable, want: codes.Unavailable, invoked: true},
+				{wait: time.Minute, err: unavailable, want: codes.Unavailable, invoked: true},
+				{wait: time.Second, want: codes.Unavailable},
+			},
+			wantState: breakerOpen,
+		},
+		{
+			name: "probes needed",
+			cfg:  BreakerConfig{Failures: 1, OpenTimeout: time.Minute, HalfOpenProbes: 2},
+			steps: []step{
+				{err: unavailable, want: codes.Unavailable, invoked: true},
+				{wait: time.Minute, want: codes.OK, invoked: true},
+			},
+			wantState: breakerHalfOpen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(0, 0)
+			b := newBreaker(tt.cfg)
+			b.now = func() time.Time { return now }
+
+			for i, s := range tt.steps {
+				now = now.Add(s.wait)
+
+				invoked := false
+				err := b.unaryInterceptor()(context.Background(), "/pkg.Users/Get", nil, nil, nil,
+					func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+						invoked = true
+						return s.err
+					})
+
+				if status.Code(err) != s.want {
+					t.Errorf("step %d: code = %s, want %s", i, status.Code(err), s.want)
+				}
+
+				if invoked != s.invoked {
+					t.Errorf("step %d: invoked = %t, want %t", i, invoked, s.invoked)
+				}
+			}
+
+			if b.state != tt.wantState {
+				t.Errorf("state = %d, want %d", b.state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestBreakerHalfOpenLimitsProbes(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBreaker(BreakerConfig{Failures: 1, OpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	b.done(status.Error(codes.Unavailable, "down"))
+	now = now.Add(time.Minute)
+
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe = %v", err)
+	}
+
+	// The probe is still in flight.
+	if err := b.allow(); status.Code(err) != codes.Unavailable {
+		t.Errorf("second call = %v, want Unavailable", err)
+	}
+}
+
+func TestBreakerStream(t *testing.T) {
+	b := newBreaker(BreakerConfig{Failures: 1, OpenTimeout: time.Minute})
+
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+
+	for i, want := range []string{"down", "circuit breaker is open"} {
+		_, err := b.streamInterceptor()(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Users/Watch", streamer)
+		if msg := status.Convert(err).Message(); msg != want {
+			t.Errorf("call %d: %q, want %q", i, msg, want)
+		}
+	}
+}
+
+func TestBreakerConfigDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  BreakerConfig
+		want BreakerConfig
+	}{
+		{name: "zero", want: DefaultBreakerConfig},
+		{
+			name: "set",
+			cfg:  BreakerConfig{Failures: 3, OpenTimeout: time.Second, HalfOpenProbes: 2},
+			want: BreakerConfig{Failures: 3, OpenTimeout: time.Second, HalfOpenProbes: 2},
+		},
+		{
+			name: "partial",
+			cfg:  BreakerConfig{Failures: 3},
+			want: BreakerConfig{Failures: 3, OpenTimeout: DefaultBreakerConfig.OpenTimeout, HalfOpenProbes: DefaultBreakerConfig.HalfOpenProbes},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.withDefaults(); got != tt.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
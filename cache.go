@@ -0,0 +1,339 @@
+package drudge
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a gateway response kept by a CacheStore.
+type CachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// Stored is when the response was cached, reported by the Age header.
+	Stored time.Time
+}
+
+// CacheStore keeps the cached gateway responses. Entries expire after their
+// TTL.
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, r *CachedResponse, ttl time.Duration)
+}
+
+// DefaultCacheSize is the number of responses kept by the default store.
+const DefaultCacheSize = 1024
+
+// DefaultCacheTTL is how long responses without max-age are cached when no
+// TTL is given.
+const DefaultCacheTTL = time.Minute
+
+// DefaultCacheMaxBody is the largest response body cached when no limit is
+// given.
+const DefaultCacheMaxBody = 1 << 20
+
+// DefaultCacheVary are the request headers the responses vary by when none
+// are given. Credentials are included so users never share entries.
+var DefaultCacheVary = []string{"Accept", "Accept-Encoding", "Authorization", "Cookie"}
+
+// CacheConfig configures the cache of the gateway's GET responses.
+type CacheConfig struct {
+	// Store defaults to an in-memory LRU of DefaultCacheSize responses.
+	Store CacheStore
+
+	// TTL is how long responses without a max-age directive are cached,
+	// defaulting to DefaultCacheTTL.
+	TTL time.Duration
+
+	// Vary lists the request headers which are part of the cache key,
+	// defaulting to DefaultCacheVary.
+	Vary []string
+
+	// MaxBody is the largest response body cached, defaulting to
+	// DefaultCacheMaxBody.
+	MaxBody int
+}
+
+func (c CacheConfig) withDefaults() CacheConfig {
+	if c.Store == nil {
+		c.Store = NewLRUCache(DefaultCacheSize)
+	}
+
+	if c.TTL <= 0 {
+		c.TTL = DefaultCacheTTL
+	}
+
+	if c.Vary == nil {
+		c.Vary = DefaultCacheVary
+	}
+
+	if c.MaxBody <= 0 {
+		c.MaxBody = DefaultCacheMaxBody
+	}
+
+	return c
+}
+
+// cacheResponses serves repeated GET requests from the store, reporting
+// X-Cache: HIT or MISS. Only 2xx responses are cached, honoring the
+// no-store, no-cache, private and max-age directives of Cache-Control.
+func cacheResponses(c CacheConfig, h http.Handler) http.Handler {
+	c = c.withDefaults()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		req := cacheDirectives(r.Header)
+		if req.noStore {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := c.key(r)
+		if !req.noCache {
+			if cached, ok := c.Store.Get(key); ok {
+				serveCached(w, cached)
+				return
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+
+		cw := &cacheWriter{ResponseWriter: w, max: c.MaxBody}
+		h.ServeHTTP(cw, r)
+
+		ttl, ok := c.ttl(cw)
+		if !ok {
+			return
+		}
+
+		header := cloneHeader(w.Header())
+		header.Del("X-Cache")
+
+		c.Store.Set(key, &CachedResponse{
+			Status: cw.status(),
+			Header: header,
+			Body:   cw.body.Bytes(),
+			Stored: time.Now(),
+		}, ttl)
+	})
+}
+
+// key identifies the response by path, sorted query and the vary headers.
+func (c CacheConfig) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.URL.Path)
+	b.WriteByte('?')
+	b.WriteString(r.URL.Query().Encode())
+
+	for _, h := range c.Vary {
+		b.WriteByte('\n')
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header[http.CanonicalHeaderKey(h)], ","))
+	}
+
+	return b.String()
+}
+
+// ttl returns how long the response can be cached, false when it can't.
+func (c CacheConfig) ttl(cw *cacheWriter) (time.Duration, bool) {
+	if cw.overflow || cw.status() < 200 || cw.status() > 299 {
+		return 0, false
+	}
+
+	if cw.Header().Get("Set-Cookie") != "" {
+		return 0, false
+	}
+
+	d := cacheDirectives(cw.Header())
+	switch {
+	case d.noStore, d.noCache, d.private:
+		return 0, false
+	case d.maxAge >= 0:
+		return d.maxAge, d.maxAge > 0
+	default:
+		return c.TTL, true
+	}
+}
+
+func serveCached(w http.ResponseWriter, cached *CachedResponse) {
+	for k, vs := range cached.Header {
+		w.Header()[k] = append([]string(nil), vs...)
+	}
+
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(cached.Stored).Seconds())))
+	w.WriteHeader(cached.Status)
+	_, _ = w.Write(cached.Body)
+}
+
+// directives are the Cache-Control directives the cache honors.
+type directives struct {
+	noStore bool
+	noCache bool
+	private bool
+
+	// maxAge is negative when absent.
+	maxAge time.Duration
+}
+
+func cacheDirectives(h http.Header) directives {
+	d := directives{maxAge: -1}
+
+	for _, v := range h["Cache-Control"] {
+		for _, part := range strings.Split(v, ",") {
+			name, value := strings.TrimSpace(part), ""
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+
+			switch strings.ToLower(name) {
+			case "no-store":
+				d.noStore = true
+			case "no-cache":
+				d.noCache = true
+			case "private":
+				d.private = true
+			case "max-age", "s-maxage":
+				if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+					d.maxAge = time.Duration(secs) * time.Second
+				}
+			}
+		}
+	}
+
+	return d
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, vs := range h {
+		c[k] = append([]string(nil), vs...)
+	}
+
+	return c
+}
+
+// cacheWriter keeps a copy of the response, up to max bytes of body.
+type cacheWriter struct {
+	http.ResponseWriter
+	code     int
+	body     bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (cw *cacheWriter) status() int {
+	if cw.code == 0 {
+		return http.StatusOK
+	}
+
+	return cw.code
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.code == 0 {
+		cw.code = code
+	}
+
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.overflow {
+		if cw.body.Len()+len(b) > cw.max {
+			cw.overflow = true
+			cw.body.Reset()
+		} else {
+			cw.body.Write(b)
+		}
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses flowing when the underlying writer supports it.
+func (cw *cacheWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lruCache is an in-memory CacheStore evicting the least recently used
+// responses beyond its size.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	resp    *CachedResponse
+	expires time.Time
+}
+
+// NewLRUCache returns an in-memory CacheStore keeping up to size responses.
+func NewLRUCache(size int) CacheStore {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+
+	return &lruCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*lruEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+
+	return e.resp, true
+}
+
+func (c *lruCache) Set(key string, r *CachedResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &lruEntry{key: key, resp: r, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(e)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
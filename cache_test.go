@@ -0,0 +1,234 @@
+package drudge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheResponses(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        CacheConfig
+		method     string
+		reqHeaders [2]map[string]string
+		status     int
+		respHeader map[string]string
+		body       string
+		wantCalls  int
+		wantCache  string
+	}{
+		{name: "hit", method: http.MethodGet, wantCalls: 1, wantCache: "HIT"},
+		{name: "not GET", method: http.MethodPost, wantCalls: 2},
+		{name: "error", method: http.MethodGet, status: http.StatusNotFound, wantCalls: 2, wantCache: "MISS"},
+		{name: "no-store response", method: http.MethodGet, respHeader: map[string]string{"Cache-Control": "no-store"}, wantCalls: 2, wantCache: "MISS"},
+		{name: "private", method: http.MethodGet, respHeader: map[string]string{"Cache-Control": "private, max-age=60"}, wantCalls: 2, wantCache: "MISS"},
+		{name: "max-age=0", method: http.MethodGet, respHeader: map[string]string{"Cache-Control": "max-age=0"}, wantCalls: 2, wantCache: "MISS"},
+		{name: "max-age", method: http.MethodGet, respHeader: map[string]string{"Cache-Control": `public, s-maxage="60"`}, wantCalls: 1, wantCache: "HIT"},
+		{name: "cookie", method: http.MethodGet, respHeader: map[string]string{"Set-Cookie": "s=1"}, wantCalls: 2, wantCache: "MISS"},
+		{name: "too large", cfg: CacheConfig{MaxBody: 2}, method: http.MethodGet, body: "abc", wantCalls: 2, wantCache: "MISS"},
+		{
+			name:       "no-store request",
+			method:     http.MethodGet,
+			reqHeaders: [2]map[string]string{nil, {"Cache-Control": "no-store"}},
+			wantCalls:  2,
+		},
+		{
+			name:       "no-cache request",
+			method:     http.MethodGet,
+			reqHeaders: [2]map[string]string{nil, {"Cache-Control": "no-cache"}},
+			wantCalls:  2,
+			wantCache:  "MISS",
+		},
+		{
+			name:       "other user",
+			method:     http.MethodGet,
+			reqHeaders: [2]map[string]string{{"Authorization": "Bearer a"}, {"Authorization": "Bearer b"}},
+			wantCalls:  2,
+			wantCache:  "MISS",
+		},
+		{
+			name:       "vary",
+			cfg:        CacheConfig{Vary: []string{"x-tenant"}},
+			method:     http.MethodGet,
+			reqHeaders: [2]map[string]string{{"X-Tenant": "a"}, {"X-Tenant": "b"}},
+			wantCalls:  2,
+			wantCache:  "MISS",
+		},
+		{
+			name:       "not varying",
+			cfg:        CacheConfig{Vary: []string{}},
+			method:     http.MethodGet,
+			reqHeaders: [2]map[string]string{{"Authorization": "Bearer a"}, {"Authorization": "Bearer b"}},
+			wantCalls:  1,
+			wantCache:  "HIT",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.body
+			if body == "" {
+				body = `{"id":1}`
+			}
+
+			calls := 0
+			h := cacheResponses(tt.cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				for k, v := range tt.respHeader {
+					w.Header().Set(k, v)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				_, _ = w.Write([]byte(body))
+			}))
+
+			var w *httptest.ResponseRecorder
+			for _, headers := range tt.reqHeaders {
+				r := httptest.NewRequest(tt.method, "/v1/users/1?b=2&a=1", nil)
+				for k, v := range headers {
+					r.Header.Set(k, v)
+				}
+
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+
+			if got := w.Header().Get("X-Cache"); got != tt.wantCache {
+				t.Errorf("X-Cache = %q, want %q", got, tt.wantCache)
+			}
+
+			if w.Body.String() != body {
+				t.Errorf("body = %q, want %q", w.Body, body)
+			}
+
+			if tt.wantCache == "HIT" {
+				if w.Header().Get("Content-Type") != "application/json" || w.Header().Get("Age") == "" {
+					t.Errorf("cached headers = %v", w.Header())
+				}
+			}
+		})
+	}
+}
+
+func TestCacheKeySortsQuery(t *testing.T) {
+	c := CacheConfig{}.withDefaults()
+
+	a := c.key(httptest.NewRequest(http.MethodGet, "/v1/users?a=1&b=2", nil))
+	b := c.key(httptest.NewRequest(http.MethodGet, "/v1/users?b=2&a=1", nil))
+
+	if a != b {
+		t.Errorf("keys differ: %q and %q", a, b)
+	}
+}
+
+func TestCacheDirectives(t *testing.T) {
+	tests := []struct {
+		header string
+		want   directives
+	}{
+		{header: "", want: directives{maxAge: -1}},
+		{header: "no-store", want: directives{noStore: true, maxAge: -1}},
+		{header: "No-Cache, Private", want: directives{noCache: true, private: true, maxAge: -1}},
+		{header: "max-age=60", want: directives{maxAge: time.Minute}},
+		{header: `s-maxage="30"`, want: directives{maxAge: 30 * time.Second}},
+		{header: "max-age=-1", want: directives{maxAge: -1}},
+		{header: "max-age=soon", want: directives{maxAge: -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			h := http.Header{}
+			if tt.header != "" {
+				h.Set("Cache-Control", tt.header)
+			}
+
+			if got := cacheDirectives(h); got != tt.want {
+				t.Errorf("cacheDirectives() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	resp := func(s string) *CachedResponse { return &CachedResponse{Status: http.StatusOK, Body: []byte(s)} }
+
+	tests := []struct {
+		name  string
+		size  int
+		setup func(c CacheStore)
+		want  map[string]string
+	}{
+		{
+			name:  "get",
+			size:  2,
+			setup: func(c CacheStore) { c.Set("a", resp("1"), time.Minute) },
+			want:  map[string]string{"a": "1", "b": ""},
+		},
+		{
+			name: "evicts the least recently used",
+			size: 2,
+			setup: func(c CacheStore) {
+				c.Set("a", resp("1"), time.Minute)
+				c.Set("b", resp("2"), time.Minute)
+				c.Get("a")
+				c.Set("c", resp("3"), time.Minute)
+			},
+			want: map[string]string{"a": "1", "b": "", "c": "3"},
+		},
+		{
+			name: "replaces",
+			size: 2,
+			setup: func(c CacheStore) {
+				c.Set("a", resp("1"), time.Minute)
+				c.Set("a", resp("2"), time.Minute)
+			},
+			want: map[string]string{"a": "2"},
+		},
+		{
+			name:  "expired",
+			size:  2,
+			setup: func(c CacheStore) { c.Set("a", resp("1"), -time.Second) },
+			want:  map[string]string{"a": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewLRUCache(tt.size)
+			tt.setup(c)
+
+			for key, want := range tt.want {
+				r, ok := c.Get(key)
+				if ok != (want != "") {
+					t.Fatalf("Get(%q) found = %t", key, ok)
+				}
+
+				if ok && string(r.Body) != want {
+					t.Errorf("Get(%q) = %s, want %s", key, r.Body, want)
+				}
+			}
+		})
+	}
+
+	if size := NewLRUCache(0).(*lruCache).size; size != DefaultCacheSize {
+		t.Errorf("default size = %d, want %d", size, DefaultCacheSize)
+	}
+}
+
+func TestServeCachedAge(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveCached(w, &CachedResponse{Status: http.StatusOK, Header: http.Header{}, Stored: time.Now().Add(-90 * time.Second)})
+
+	if age, _ := strconv.Atoi(w.Header().Get("Age")); age < 90 || age > 91 {
+		t.Errorf("Age = %q, want 90", w.Header().Get("Age"))
+	}
+}
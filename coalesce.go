@@ -0,0 +1,186 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	goproto "github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type coalesceKey struct{}
+
+// coalesceGET marks the calls of GET requests for coalescing, keyed by the
+// request headers that can change their response: the credentials and the
+// metadata forwarded to the server.
+func coalesceGET(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var b strings.Builder
+		keys := make([]string, 0, len(r.Header))
+		for k := range r.Header {
+			if k == "Authorization" || k == "Cookie" || strings.HasPrefix(k, "Grpc-Metadata-") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			b.WriteString(k)
+			b.WriteByte(':')
+			b.WriteString(strings.Join(r.Header[k], ","))
+			b.WriteByte('\n')
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), coalesceKey{}, b.String())))
+	})
+}
+
+// coalescer shares the result of identical unary calls in flight between
+// their callers.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a call whose result is shared once done is closed.
+type flight struct {
+	done    chan struct{}
+	reply   goproto.Message
+	header  metadata.MD
+	trailer metadata.MD
+	err     error
+
+	// canceled is set when the call failed on its own context, which the
+	// callers sharing it must not inherit.
+	canceled bool
+}
+
+// WithCoalescing makes concurrent identical unary calls of GET requests
+// share a single call to the server. Calls are identical when their method,
+// request message and credentials are.
+func WithCoalescing() DialOption {
+	return func(o *dialOptions) {
+		c := &coalescer{calls: map[string]*flight{}}
+		o.unary = append(o.unary, c.unaryInterceptor())
+	}
+}
+
+func (c *coalescer) unaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		prefix, ok := ctx.Value(coalesceKey{}).(string)
+		if !ok {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		in, ok := req.(goproto.Message)
+		out, outOK := reply.(goproto.Message)
+		if !ok || !outOK {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		buf := goproto.NewBuffer(nil)
+		buf.SetDeterministic(true)
+		if err := buf.Marshal(in); err != nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		key := method + "\n" + prefix + string(buf.Bytes())
+
+		for {
+			c.mu.Lock()
+			f, ok := c.calls[key]
+			if !ok {
+				break
+			}
+			c.mu.Unlock()
+
+			// A canceled call is made again, shared by those who waited.
+			if shared, err := f.wait(ctx, out, opts); shared {
+				return err
+			}
+		}
+
+		f := &flight{done: make(chan struct{})}
+		c.calls[key] = f
+		c.mu.Unlock()
+
+		header, trailer := metadata.MD{}, metadata.MD{}
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header), grpc.Trailer(&trailer))...)
+
+		f.reply = goproto.Clone(out)
+		f.header, f.trailer = header, trailer
+		f.err = err
+		f.canceled = err != nil && ctx.Err() != nil
+
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(f.done)
+
+		return err
+	}
+}
+
+// wait returns the shared result into reply, or false when the call was
+// canceled. It gives up when ctx is done.
+func (f *flight) wait(ctx context.Context, reply goproto.Message, opts []grpc.CallOption) (bool, error) {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return true, contextStatus(ctx.Err())
+	}
+
+	if f.canceled {
+		return false, nil
+	}
+
+	setCallMetadata(opts, f.header, f.trailer)
+
+	if f.err != nil {
+		return true, f.err
+	}
+
+	goproto.Merge(reply, f.reply)
+
+	return true, nil
+}
+
+// setCallMetadata fills the header and trailer requested by the caller's
+// options.
+func setCallMetadata(opts []grpc.CallOption, header, trailer metadata.MD) {
+	for _, o := range opts {
+		switch o := o.(type) {
+		case grpc.HeaderCallOption:
+			*o.HeaderAddr = header.Copy()
+		case grpc.TrailerCallOption:
+			*o.TrailerAddr = trailer.Copy()
+		}
+	}
+}
+
+// contextStatus converts the error of a done context to its gRPC status.
+func contextStatus(err error) error {
+	if err == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	return status.Error(codes.Canceled, err.Error())
+}
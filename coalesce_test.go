@@ -0,0 +1,239 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCoalesceGET(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    string
+		wantSet bool
+	}{
+		{name: "not GET", method: http.MethodPost},
+		{name: "plain", method: http.MethodGet, wantSet: true},
+		{
+			name:   "credentials and metadata",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"Authorization":      "Bearer t",
+				"Cookie":             "s=1",
+				"Grpc-Metadata-Lang": "fr",
+				"Accept":             "application/json",
+			},
+			want:    "Authorization:Bearer t\nCookie:s=1\nGrpc-Metadata-Lang:fr\n",
+			wantSet: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/users", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			var (
+				got string
+				set bool
+			)
+			coalesceGET(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, set = r.Context().Value(coalesceKey{}).(string)
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if set != tt.wantSet || got != tt.want {
+				t.Errorf("key = %q (%t), want %q (%t)", got, set, tt.want, tt.wantSet)
+			}
+		})
+	}
+}
+
+// sharedInvoker answers after release is closed, counting its calls.
+type sharedInvoker struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func (i *sharedInvoker) invoke(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+	if atomic.AddInt32(&i.calls, 1) == 1 {
+		close(i.started)
+	}
+
+	select {
+	case <-i.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	setCallMetadata(opts, metadata.Pairs("x-served-by", "a"), nil)
+	if i.err != nil {
+		return i.err
+	}
+
+	reply.(*wrappers.StringValue).Value = "hello " + req.(*wrappers.StringValue).Value
+
+	return nil
+}
+
+func TestCoalescer(t *testing.T) {
+	notFound := status.Error(codes.NotFound, "no such user")
+
+	tests := []struct {
+		name      string
+		keys      []string
+		reqs      []string
+		err       error
+		wantCalls int32
+	}{
+		{name: "shared", keys: []string{"", ""}, reqs: []string{"a", "a"}, wantCalls: 1},
+		{name: "shared error", keys: []string{"", ""}, reqs: []string{"a", "a"}, err: notFound, wantCalls: 1},
+		{name: "other request", keys: []string{"", ""}, reqs: []string{"a", "b"}, wantCalls: 2},
+		{name: "other credentials", keys: []string{"Authorization:a\n", "Authorization:b\n"}, reqs: []string{"a", "a"}, wantCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &coalescer{calls: map[string]*flight{}}
+			inv := &sharedInvoker{started: make(chan struct{}), release: make(chan struct{}), err: tt.err}
+
+			var wg sync.WaitGroup
+			replies := make([]*wrappers.StringValue, len(tt.reqs))
+			headers := make([]metadata.MD, len(tt.reqs))
+			errs := make([]error, len(tt.reqs))
+
+			call := func(i int) {
+				defer wg.Done()
+
+				ctx := context.WithValue(context.Background(), coalesceKey{}, tt.keys[i])
+				replies[i] = &wrappers.StringValue{}
+				errs[i] = c.unaryInterceptor()(ctx, "/pkg.Users/Get", &wrappers.StringValue{Value: tt.reqs[i]}, replies[i], nil,
+					inv.invoke, grpc.Header(&headers[i]))
+			}
+
+			wg.Add(1)
+			go call(0)
+			<-inv.started
+
+			for i := 1; i < len(tt.reqs); i++ {
+				wg.Add(1)
+				go call(i)
+			}
+
+			// Let the other calls join, or start their own.
+			time.Sleep(20 * time.Millisecond)
+			close(inv.release)
+			wg.Wait()
+
+			if got := atomic.LoadInt32(&inv.calls); got != tt.wantCalls {
+				t.Errorf("%d calls to the server, want %d", got, tt.wantCalls)
+			}
+
+			for i := range tt.reqs {
+				if errs[i] != tt.err {
+					t.Errorf("call %d: error = %v, want %v", i, errs[i], tt.err)
+				}
+
+				if tt.err == nil && replies[i].Value != "hello "+tt.reqs[i] {
+					t.Errorf("call %d: reply = %q", i, replies[i].Value)
+				}
+
+				if got := headers[i].Get("x-served-by"); len(got) != 1 {
+					t.Errorf("call %d: header = %v", i, headers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCoalescerCanceled(t *testing.T) {
+	c := &coalescer{calls: map[string]*flight{}}
+	inv := &sharedInvoker{started: make(chan struct{}), release: make(chan struct{})}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), coalesceKey{}, ""))
+
+	first := make(chan error, 1)
+	go func() {
+		first <- c.unaryInterceptor()(ctx, "/pkg.Users/Get", &wrappers.StringValue{Value: "a"}, &wrappers.StringValue{}, nil, inv.invoke)
+	}()
+	<-inv.started
+
+	second := make(chan error, 1)
+	reply := &wrappers.StringValue{}
+	go func() {
+		ctx := context.WithValue(context.Background(), coalesceKey{}, "")
+		second <- c.unaryInterceptor()(ctx, "/pkg.Users/Get", &wrappers.StringValue{Value: "a"}, reply, nil, inv.invoke)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-first; err != context.Canceled {
+		t.Errorf("canceled call = %v", err)
+	}
+
+	// The waiting call doesn't inherit the cancellation, it calls again.
+	close(inv.release)
+	if err := <-second; err != nil {
+		t.Fatalf("waiting call = %v", err)
+	}
+
+	if reply.Value != "hello a" {
+		t.Errorf("reply = %q", reply.Value)
+	}
+
+	if got := atomic.LoadInt32(&inv.calls); got != 2 {
+		t.Errorf("%d calls to the server, want 2", got)
+	}
+}
+
+func TestCoalescerWaiterDeadline(t *testing.T) {
+	c := &coalescer{calls: map[string]*flight{}}
+	inv := &sharedInvoker{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(inv.release)
+
+	go func() {
+		ctx := context.WithValue(context.Background(), coalesceKey{}, "")
+		_ = c.unaryInterceptor()(ctx, "/pkg.Users/Get", &wrappers.StringValue{}, &wrappers.StringValue{}, nil, inv.invoke)
+	}()
+	<-inv.started
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), coalesceKey{}, ""), 10*time.Millisecond)
+	defer cancel()
+
+	err := c.unaryInterceptor()(ctx, "/pkg.Users/Get", &wrappers.StringValue{}, &wrappers.StringValue{}, nil, inv.invoke)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("error = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestCoalescerNotMarked(t *testing.T) {
+	c := &coalescer{calls: map[string]*flight{}}
+	inv := &sharedInvoker{started: make(chan struct{}), release: make(chan struct{})}
+	close(inv.release)
+
+	for i := 0; i < 2; i++ {
+		if err := c.unaryInterceptor()(context.Background(), "/pkg.Users/Get", &wrappers.StringValue{}, &wrappers.StringValue{}, nil, inv.invoke); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&inv.calls); got != 2 {
+		t.Errorf("%d calls to the server, want 2", got)
+	}
+}
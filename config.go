@@ -0,0 +1,107 @@
+package drudge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// redactedOptions are the fields of Options whose values are never served
+// by the config endpoint, the TLS material and the exporter's configuration,
+// which may hold API keys.
+var redactedOptions = map[string]bool{
+	"Certificate":    true,
+	"CertificateKey": true,
+	"ClientCAs":      true,
+	"TraceConfig":    true,
+}
+
+// configHandler serves the options as JSON. Values JSON can't represent,
+// such as functions and interfaces, are described by their type.
+func configHandler(opts Options) http.HandlerFunc {
+	v := reflect.ValueOf(opts)
+	config := make(map[string]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if redactedOptions[name] {
+			config[name] = redactOption(v.Field(i))
+			continue
+		}
+
+		config[name] = describeOption(v.Field(i))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(config); err != nil {
+			http.Error(w, errors.Wrap(err, "failed to encode config").Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// redactOption hides the value, only telling whether it's set.
+func redactOption(v reflect.Value) interface{} {
+	if reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) {
+		return nil
+	}
+
+	return redactedValue
+}
+
+// describeOption renders v for JSON. Structs of this package are rendered
+// by their exported fields, other values JSON can't represent by their type.
+func describeOption(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Func, reflect.Chan, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+	}
+
+	if s, ok := v.Interface().(fmt.Stringer); ok && v.Kind() != reflect.Struct && v.Kind() != reflect.Ptr {
+		return s.String()
+	}
+
+	switch v.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return v.Interface()
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = describeOption(v.Index(i))
+		}
+
+		return list
+	case reflect.Ptr:
+		if v.Elem().Kind() == reflect.Struct && ownType(v.Elem().Type()) {
+			return describeOption(v.Elem())
+		}
+	case reflect.Struct:
+		if ownType(v.Type()) {
+			fields := map[string]interface{}{}
+			for i := 0; i < v.NumField(); i++ {
+				if f := v.Type().Field(i); f.PkgPath == "" && !f.Anonymous {
+					fields[f.Name] = describeOption(v.Field(i))
+				}
+			}
+
+			if len(fields) > 0 {
+				return fields
+			}
+		}
+	}
+
+	return v.Type().String()
+}
+
+// ownType reports whether t is declared by this package.
+func ownType(t reflect.Type) bool {
+	return t.PkgPath() == reflect.TypeOf(Options{}).PkgPath()
+}
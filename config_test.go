@@ -0,0 +1,101 @@
+package drudge
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDescribeOption(t *testing.T) {
+	var nilFunc func()
+
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{name: "string", value: "api", want: "api"},
+		{name: "int", value: 3, want: 3},
+		{name: "bool", value: true, want: true},
+		{name: "stringer", value: 2 * time.Second, want: "2s"},
+		{name: "own string type", value: TrailingSlashStrip, want: TrailingSlashStrip},
+		{name: "nil func", value: nilFunc, want: nil},
+		{name: "func", value: func() {}, want: "func()"},
+		{name: "nil slice", value: []string(nil), want: nil},
+		{name: "slice", value: []string{"a", "b"}, want: []interface{}{"a", "b"}},
+		{name: "own struct", value: Endpoint{Network: "unix", Addr: "@a"}, want: map[string]interface{}{"Network": "unix", "Addr": "@a"}},
+		{name: "own struct pointer", value: &Endpoint{Addr: "a"}, want: map[string]interface{}{"Network": "", "Addr": "a"}},
+		{name: "foreign struct", value: x509.CertPool{}, want: "x509.CertPool"},
+		{name: "map", value: map[string]int{"a": 1}, want: "map[string]int"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeOption(reflect.ValueOf(tt.value)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("describeOption() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want map[string]interface{}
+	}{
+		{
+			name: "unset",
+			want: map[string]interface{}{"Certificate": nil, "ClientCAs": nil, "TraceConfig": nil, "BasePath": ""},
+		},
+		{
+			name: "redacted",
+			opts: Options{
+				BasePath:       "/api",
+				Certificate:    "cert.pem",
+				CertificateKey: "key.pem",
+				ClientCAs:      x509.NewCertPool(),
+				TraceConfig:    map[string]string{"api_key": "secret"},
+			},
+			want: map[string]interface{}{
+				"Certificate":    redactedValue,
+				"CertificateKey": redactedValue,
+				"ClientCAs":      redactedValue,
+				"TraceConfig":    redactedValue,
+				"BasePath":       "/api",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			configHandler(tt.opts)(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var got map[string]interface{}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			for k, want := range tt.want {
+				v, ok := got[k]
+				if !ok {
+					t.Errorf("%s is missing", k)
+					continue
+				}
+
+				if !reflect.DeepEqual(v, want) {
+					t.Errorf("%s = %#v, want %#v", k, v, want)
+				}
+			}
+		})
+	}
+}
@@ -2,87 +2,469 @@ package drudge
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
-	"net/http"
+	"sync"
 
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
+// ProtobufContentType is the Accept, or Content-Type, value with which HTTP
+// clients exchange binary protobuf messages with the gateway instead of JSON.
+const ProtobufContentType = "application/x-protobuf"
+
 type Handler func(context.Context, *gwruntime.ServeMux, *grpc.ClientConn) error
 
-func dial(ctx context.Context, network, addr string) (*grpc.ClientConn, error) {
-	switch network {
-	case "tcp":
-		return dialTCP(ctx, addr)
-	case "unix":
-		return dialUnix(ctx, addr)
+// dialOptions holds the configurable settings of a client connection.
+type dialOptions struct {
+	serviceName    string
+	tracer         opentracing.Tracer
+	sampler        trace.Sampler
+	disableTracing bool
+	disableMetrics bool
+	dialer         func(context.Context, string) (net.Conn, error)
+	tls            *tls.Config
+	handshake      *handshakeRecorder
+	keepalive      *keepalive.ClientParameters
+	unary          []grpc.UnaryClientInterceptor
+	stream         []grpc.StreamClientInterceptor
+	extra          []grpc.DialOption
+}
+
+// DialOption configures the client connection created by Dial.
+type DialOption func(*dialOptions)
+
+// WithServiceName tags the client spans created on the connection with the
+// provided service name.
+func WithServiceName(name string) DialOption {
+	return func(o *dialOptions) {
+		o.serviceName = name
+	}
+}
+
+// WithTracer uses the provided tracer for client spans instead of the
+// global opentracing tracer.
+func WithTracer(t opentracing.Tracer) DialOption {
+	return func(o *dialOptions) {
+		o.tracer = t
+	}
+}
+
+// WithTraceSampler samples the OpenCensus client spans with s instead of the
+// global sampler.
+func WithTraceSampler(s trace.Sampler) DialOption {
+	return func(o *dialOptions) {
+		o.sampler = s
+	}
+}
+
+// WithoutTracing skips the tracing stats handler and interceptors.
+func WithoutTracing() DialOption {
+	return func(o *dialOptions) {
+		o.disableTracing = true
+	}
+}
+
+// WithoutMetrics skips the Prometheus client interceptors.
+func WithoutMetrics() DialOption {
+	return func(o *dialOptions) {
+		o.disableMetrics = true
+	}
+}
+
+// WithDialer replaces the transport used to reach the endpoint, such as an
+// in-memory bufconn listener. The endpoint's network is ignored.
+func WithDialer(d func(context.Context, string) (net.Conn, error)) DialOption {
+	return func(o *dialOptions) {
+		o.dialer = d
+	}
+}
+
+// WithTLS secures the client connection using the provided TLS configuration.
+func WithTLS(c *tls.Config) DialOption {
+	return func(o *dialOptions) {
+		o.tls = c
+	}
+}
+
+// WithKeepalive pings the server on idle connections, keeping intermediaries
+// from silently dropping them. The server's enforcement policy must allow
+// pings that often.
+func WithKeepalive(p keepalive.ClientParameters) DialOption {
+	return func(o *dialOptions) {
+		o.keepalive = &p
+	}
+}
+
+// WithUnaryInterceptors appends unary interceptors that run after the
+// built-in tracing and metrics interceptors.
+func WithUnaryInterceptors(i ...grpc.UnaryClientInterceptor) DialOption {
+	return func(o *dialOptions) {
+		o.unary = append(o.unary, i...)
+	}
+}
+
+// WithStreamInterceptors appends stream interceptors that run after the
+// built-in tracing and metrics interceptors.
+func WithStreamInterceptors(i ...grpc.StreamClientInterceptor) DialOption {
+	return func(o *dialOptions) {
+		o.stream = append(o.stream, i...)
+	}
+}
+
+// WithGRPCDialOptions passes additional options straight through to grpc.DialContext.
+func WithGRPCDialOptions(opts ...grpc.DialOption) DialOption {
+	return func(o *dialOptions) {
+		o.extra = append(o.extra, opts...)
+	}
+}
+
+// grpcOptions translates the dial options into the gRPC options shared by
+// every network type.
+func (o *dialOptions) grpcOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if o.tls != nil {
+		o.handshake = &handshakeRecorder{TransportCredentials: credentials.NewTLS(o.tls)}
+		opts[0] = grpc.WithTransportCredentials(o.handshake)
+	}
+
+	if o.dialer != nil {
+		opts = append(opts, grpc.WithContextDialer(o.dialer))
+	}
+
+	if o.keepalive != nil {
+		opts = append(opts, grpc.WithKeepaliveParams(*o.keepalive))
+	}
+
+	if len(o.unary) > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(o.unary...))
+	}
+
+	if len(o.stream) > 0 {
+		opts = append(opts, grpc.WithChainStreamInterceptor(o.stream...))
+	}
+
+	return append(opts, o.extra...)
+}
+
+// instrumentation returns the stats handler and interceptors wrapping every
+// call, whatever the transport.
+func (o *dialOptions) instrumentation() []grpc.DialOption {
+	var (
+		opts   []grpc.DialOption
+		unary  []grpc.UnaryClientInterceptor
+		stream []grpc.StreamClientInterceptor
+	)
+
+	if !o.disableTracing {
+		opts = append(opts, grpc.WithStatsHandler(&ocgrpc.ClientHandler{
+			StartOptions: trace.StartOptions{Sampler: o.sampler},
+		}))
+		unary = append(unary, o.unaryTracing())
+		stream = append(stream, o.streamTracing())
+	}
+
+	if !o.disableMetrics {
+		unary = append(unary, grpc_prometheus.UnaryClientInterceptor)
+		stream = append(stream, grpc_prometheus.StreamClientInterceptor)
+	}
+
+	return append(opts,
+		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(unary...)),
+		grpc.WithStreamInterceptor(grpc_middleware.ChainStreamClient(stream...)),
+	)
+}
+
+// unaryTracing returns the opentracing client interceptor, tagging each span
+// with the configured service name.
+func (o *dialOptions) unaryTracing() grpc.UnaryClientInterceptor {
+	i := grpc_opentracing.UnaryClientInterceptor(
+		grpc_opentracing.WithTracer(o.openTracer()),
+	)
+	if o.serviceName == "" {
+		return i
+	}
+
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		return i(o.spanTags(ctx), method, req, reply, cc, invoker, opts...)
+	}
+}
+
+// streamTracing returns the opentracing stream client interceptor, tagging
+// each span with the configured service name.
+func (o *dialOptions) streamTracing() grpc.StreamClientInterceptor {
+	i := grpc_opentracing.StreamClientInterceptor(
+		grpc_opentracing.WithTracer(o.openTracer()),
+	)
+	if o.serviceName == "" {
+		return i
+	}
+
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		return i(o.spanTags(ctx), desc, cc, method, streamer, opts...)
+	}
+}
+
+func (o *dialOptions) openTracer() opentracing.Tracer {
+	if o.tracer == nil {
+		return opentracing.GlobalTracer()
+	}
+
+	return o.tracer
+}
+
+func (o *dialOptions) spanTags(ctx context.Context) context.Context {
+	return grpc_opentracing.ClientAddContextTags(ctx, opentracing.Tags{
+		"service": o.serviceName,
+	})
+}
+
+// Dial creates a client connection to the provided endpoint, instrumented
+// with the same tracing and metrics interceptors used by the gateway.
+func Dial(ctx context.Context, e Endpoint, opts ...DialOption) (*grpc.ClientConn, error) {
+	return dial(ctx, e.Network, e.Addr, opts...)
+}
+
+func dial(ctx context.Context, network, addr string, opts ...DialOption) (*grpc.ClientConn, error) {
+	o := &dialOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var (
+		conn *grpc.ClientConn
+		err  error
+	)
+	switch {
+	case o.dialer != nil:
+		// The custom dialer owns the transport, e.g. bufconn.
+		conn, err = dialTCP(ctx, addr, o)
+	case network == "tcp":
+		conn, err = dialTCP(ctx, addr, o)
+	case network == "unix":
+		conn, err = dialUnix(ctx, addr, o)
 	default:
-		return nil, fmt.Errorf("unsupported network type %q", network)
+		return nil, &DialError{Network: network, Addr: addr, Kind: ErrUnsupportedNetwork}
+	}
+
+	if err != nil {
+		return nil, newDialError(network, addr, err, o.handshake.failure())
 	}
+
+	return conn, nil
+}
+
+var (
+	// ErrUnsupportedNetwork is the kind of dial errors for networks other
+	// than tcp and unix.
+	ErrUnsupportedNetwork = errors.New("unsupported network type")
+
+	// ErrDialTimeout is the kind of dial errors when the server couldn't be
+	// reached before the context was done, e.g. because it isn't up. Dials
+	// only wait for the server with grpc.WithBlock.
+	ErrDialTimeout = errors.New("timed out reaching the server")
+
+	// ErrDialTLS is the kind of dial errors when the TLS handshake failed,
+	// e.g. on an untrusted certificate, until the context was done.
+	ErrDialTLS = errors.New("TLS handshake failed")
+
+	// ErrDialFailed is the kind of the other dial errors.
+	ErrDialFailed = errors.New("failed to dial")
+)
+
+// DialError is returned by Dial. Kind, one of the ErrUnsupportedNetwork,
+// ErrDialTimeout, ErrDialTLS and ErrDialFailed sentinels, is matched by
+// errors.Is and returned by errors.Cause, Err holds the underlying error and
+// is returned by errors.Unwrap.
+type DialError struct {
+	Network string
+	Addr    string
+	Kind    error
+	Err     error
+}
+
+// newDialError classifies err, or the failure of the last TLS handshake when
+// the dial timed out retrying it.
+func newDialError(network, addr string, err, handshake error) *DialError {
+	e := &DialError{Network: network, Addr: addr, Kind: ErrDialFailed, Err: err}
+
+	for cause := err; cause != nil; cause = unwrapDialError(cause) {
+		switch cause.(type) {
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError,
+			tls.RecordHeaderError:
+			e.Kind = ErrDialTLS
+			return e
+		}
+
+		if isDialTimeout(cause) {
+			e.Kind = ErrDialTimeout
+			if handshake != nil {
+				e.Kind, e.Err = ErrDialTLS, handshake
+			}
+
+			return e
+		}
+	}
+
+	return e
+}
+
+// isDialTimeout reports whether err ends the dial with its context.
+func isDialTimeout(err error) bool {
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Canceled:
+		return true
+	}
+
+	return false
+}
+
+// unwrapDialError returns the error wrapped by err, by pkg/errors, the
+// standard library or gRPC's transport, nil when it wraps none.
+func unwrapDialError(err error) error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ Cause() error }:
+		return e.Cause()
+	case interface{ Origin() error }:
+		if o := e.Origin(); o != err {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// handshakeRecorder keeps the failure of the last TLS handshake, which gRPC
+// retries without reporting.
+type handshakeRecorder struct {
+	credentials.TransportCredentials
+
+	mu  sync.Mutex
+	err error
+}
+
+func (h *handshakeRecorder) ClientHandshake(
+	ctx context.Context,
+	authority string,
+	conn net.Conn,
+) (net.Conn, credentials.AuthInfo, error) {
+	c, info, err := h.TransportCredentials.ClientHandshake(ctx, authority, conn)
+
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+
+	return c, info, err
+}
+
+// failure returns the error of the last handshake, nil when it succeeded or
+// without TLS.
+func (h *handshakeRecorder) failure() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.err
+}
+
+func (e *DialError) Error() string {
+	msg := fmt.Sprintf("%s: %s on '%s'", e.Kind, e.Network, e.Addr)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+// Cause returns the kind of the error.
+func (e *DialError) Cause() error {
+	return e.Kind
+}
+
+// Unwrap returns the underlying error.
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error.
+func (e *DialError) Is(target error) bool {
+	return target == e.Kind
 }
 
 // dialTCP creates a client connection via TCP.
 // "addr" must be a valid TCP address with a port number.
-func dialTCP(ctx context.Context, addr string) (*grpc.ClientConn, error) {
-	return grpc.DialContext(
-		ctx,
-		addr,
-		grpc.WithInsecure(),
-		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}),
-		grpc.WithUnaryInterceptor(
-			grpc_opentracing.UnaryClientInterceptor(
-				grpc_opentracing.WithTracer(opentracing.GlobalTracer()),
-			),
-		),
-		grpc.WithStreamInterceptor(
-			grpc_opentracing.StreamClientInterceptor(
-				grpc_opentracing.WithTracer(opentracing.GlobalTracer()),
-			),
-		),
-	)
+func dialTCP(ctx context.Context, addr string, o *dialOptions) (*grpc.ClientConn, error) {
+	opts := o.instrumentation()
+
+	return grpc.DialContext(ctx, addr, append(opts, o.grpcOptions()...)...)
 }
 
 // dialUnix creates a client connection via a unix domain socket.
 // "addr" must be a valid path to the socket.
-func dialUnix(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+func dialUnix(ctx context.Context, addr string, o *dialOptions) (*grpc.ClientConn, error) {
 	d := func(ctx context.Context, addr string) (net.Conn, error) {
 		return net.Dial("unix", addr)
 	}
 
-	return grpc.DialContext(
-		ctx,
-		addr,
-		grpc.WithInsecure(),
-		grpc.WithContextDialer(d),
-		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}),
-		grpc.WithUnaryInterceptor(
-			grpc_opentracing.UnaryClientInterceptor(
-				grpc_opentracing.WithTracer(opentracing.GlobalTracer()),
-			),
-		),
-		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor),
-		grpc.WithStreamInterceptor(
-			grpc_opentracing.StreamClientInterceptor(
-				grpc_opentracing.WithTracer(opentracing.GlobalTracer()),
-			),
-		),
-	)
+	opts := append([]grpc.DialOption{grpc.WithContextDialer(d)}, o.instrumentation()...)
+
+	return grpc.DialContext(ctx, addr, append(opts, o.grpcOptions()...)...)
 }
 
 // newGateway returns a new gateway server which translates HTTP into gRPC.
+// The generated handlers invoke the backend with the request's context, so
+// the gRPC call is cancelled when the HTTP client goes away. Baggage from the
+// HTTP request is forwarded to the backend as gRPC metadata, and clients
+// sending ProtobufContentType get binary protobuf instead of JSON.
 func newGateway(
 	ctx context.Context,
 	conn *grpc.ClientConn,
 	opts []gwruntime.ServeMuxOption,
 	handlers []Handler,
-) (http.Handler, error) {
+) (*gwruntime.ServeMux, error) {
+	opts = append([]gwruntime.ServeMuxOption{
+		gwruntime.WithMetadata(baggageMetadata),
+		gwruntime.WithMetadata(routeMetadataAnnotator),
+		gwruntime.WithMetadata(clientIPAnnotator),
+		gwruntime.WithMarshalerOption(ProtobufContentType, &gwruntime.ProtoMarshaller{}),
+	}, opts...)
 	mux := gwruntime.NewServeMux(opts...)
 
 	for _, f := range handlers {
@@ -0,0 +1,358 @@
+package drudge
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// originError wraps err the way gRPC's transport errors do.
+type originError struct{ err error }
+
+func (e originError) Error() string { return "transport: " + e.err.Error() }
+func (e originError) Origin() error { return e.err }
+
+func TestNewDialError(t *testing.T) {
+	handshake := x509.UnknownAuthorityError{}
+
+	tests := []struct {
+		name      string
+		err       error
+		handshake error
+		wantKind  error
+		wantErr   error
+	}{
+		{name: "other", err: errors.New("connection refused"), wantKind: ErrDialFailed},
+		{name: "untrusted", err: x509.UnknownAuthorityError{}, wantKind: ErrDialTLS},
+		{name: "wrong host", err: errors.Wrap(x509.HostnameError{Host: "a"}, "dial"), wantKind: ErrDialTLS},
+		{name: "deadline", err: context.DeadlineExceeded, wantKind: ErrDialTimeout},
+		{name: "canceled", err: errors.WithStack(context.Canceled), wantKind: ErrDialTimeout},
+		{name: "status", err: status.Error(codes.DeadlineExceeded, "too slow"), wantKind: ErrDialTimeout},
+		{name: "transport", err: originError{x509.CertificateInvalidError{}}, wantKind: ErrDialTLS},
+		{name: "retried handshake", err: context.DeadlineExceeded, handshake: handshake, wantKind: ErrDialTLS, wantErr: handshake},
+		{name: "handshake of another failure", err: errors.New("refused"), handshake: handshake, wantKind: ErrDialFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newDialError("tcp", "localhost:1", tt.err, tt.handshake)
+
+			if e.Kind != tt.wantKind {
+				t.Errorf("Kind = %v, want %v", e.Kind, tt.wantKind)
+			}
+
+			wantErr := tt.wantErr
+			if wantErr == nil {
+				wantErr = tt.err
+			}
+
+			if e.Unwrap() != wantErr {
+				t.Errorf("Unwrap() = %v, want %v", e.Unwrap(), wantErr)
+			}
+
+			if errors.Cause(e) != tt.wantKind {
+				t.Errorf("errors.Cause() = %v, want %v", errors.Cause(e), tt.wantKind)
+			}
+
+			if !e.Is(tt.wantKind) || e.Is(tt.err) {
+				t.Error("Is() doesn't match the kind only")
+			}
+		})
+	}
+}
+
+func TestDialErrorMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *DialError
+		want string
+	}{
+		{
+			name: "kind",
+			err:  &DialError{Network: "udp", Addr: "x", Kind: ErrUnsupportedNetwork},
+			want: "unsupported network type: udp on 'x'",
+		},
+		{
+			name: "underlying error",
+			err:  &DialError{Network: "tcp", Addr: "localhost:1", Kind: ErrDialFailed, Err: errors.New("refused")},
+			want: "failed to dial: tcp on 'localhost:1': refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("Error() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	// Nothing answers once the listener is closed.
+	l.Close()
+
+	tests := []struct {
+		name     string
+		endpoint Endpoint
+		opts     []DialOption
+		wantKind error
+	}{
+		{name: "unsupported network", endpoint: Endpoint{Network: "udp", Addr: addr}, wantKind: ErrUnsupportedNetwork},
+		{
+			name:     "unreachable",
+			endpoint: Endpoint{Network: "tcp", Addr: addr},
+			opts:     []DialOption{WithGRPCDialOptions(grpc.WithBlock())},
+			wantKind: ErrDialTimeout,
+		},
+		{name: "lazy", endpoint: Endpoint{Network: "tcp", Addr: addr}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			conn, err := Dial(ctx, tt.endpoint, tt.opts...)
+			if tt.wantKind == nil {
+				if err != nil {
+					t.Fatalf("Dial() = %v", err)
+				}
+				conn.Close()
+				return
+			}
+
+			e, ok := err.(*DialError)
+			if !ok {
+				t.Fatalf("Dial() = %v, want a *DialError", err)
+			}
+
+			if e.Kind != tt.wantKind {
+				t.Errorf("Kind = %v, want %v", e.Kind, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestDialServiceName(t *testing.T) {
+	tracers := map[string]*mocktracer.MockTracer{
+		"users":  mocktracer.New(),
+		"orders": mocktracer.New(),
+	}
+
+	for name, tracer := range tracers {
+		s := startOperations(t, &operations{}, Options{ServiceName: name, Tracer: tracer})
+		defer s.Stop(context.Background())
+
+		getOperation(t, http.DefaultClient, s.Addr().String(), "a")
+	}
+
+	for name, tracer := range tracers {
+		var clients int
+		for _, span := range tracer.FinishedSpans() {
+			if span.Tag(string(ext.SpanKind)) != ext.SpanKindRPCClientEnum {
+				continue
+			}
+			clients++
+
+			if got := span.Tag("service"); got != name {
+				t.Errorf("%s client span tagged with service %v", name, got)
+			}
+		}
+
+		if clients != 1 {
+			t.Errorf("%s recorded %d client spans, want 1", name, clients)
+		}
+	}
+}
+
+// handledCalls returns the calls of the gRPC method counted by the metric,
+// e.g. grpc_client_handled_total, of the default Prometheus registry.
+func handledCalls(t *testing.T, metric, method string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n float64
+	for _, f := range families {
+		if f.GetName() != metric {
+			continue
+		}
+
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "grpc_method" && l.GetValue() == method {
+					n += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return n
+}
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drudge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := Endpoint{Network: "unix", Addr: filepath.Join(dir, "rpc.sock")}
+	l, err := listen(e, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpc := grpc.NewServer()
+	longrunning.RegisterOperationsServer(rpc, &operations{})
+	go rpc.Serve(l)
+	defer rpc.Stop()
+
+	tracer := mocktracer.New()
+	conn, err := Dial(context.Background(), e, WithTracer(tracer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	before := handledCalls(t, "grpc_client_handled_total", "GetOperation")
+
+	req := &longrunning.GetOperationRequest{Name: "operations/a"}
+	if _, err := longrunning.NewOperationsClient(conn).GetOperation(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 || spans[0].OperationName != "/google.longrunning.Operations/GetOperation" {
+		t.Errorf("client spans = %v, want the GetOperation call's", spans)
+	}
+
+	if got := handledCalls(t, "grpc_client_handled_total", "GetOperation") - before; got != 1 {
+		t.Errorf("grpc_client_handled_total grew by %v, want 1", got)
+	}
+}
+
+func TestGatewayCancel(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan error, 1)
+	ops := &operations{get: func(ctx context.Context, req *longrunning.GetOperationRequest) (*longrunning.Operation, error) {
+		close(started)
+		<-ctx.Done()
+		canceled <- ctx.Err()
+
+		return nil, ctx.Err()
+	}}
+
+	s := startOperations(t, ops, Options{})
+	defer s.Stop(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := http.NewRequest(http.MethodGet, "http://"+s.Addr().String()+"/v1/operations/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if resp, err := http.DefaultClient.Do(r.WithContext(ctx)); err == nil {
+		resp.Body.Close()
+		t.Fatal("request succeeded once canceled")
+	}
+
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Errorf("call ended with %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the gRPC call wasn't canceled with the HTTP request")
+	}
+}
+
+func TestGatewayNegotiation(t *testing.T) {
+	s := startOperations(t, &operations{}, Options{})
+	defer s.Stop(context.Background())
+
+	tests := []struct {
+		name      string
+		accept    string
+		wantType  string
+		unmarshal func([]byte, proto.Message) error
+	}{
+		{
+			name:     "JSON by default",
+			wantType: "application/json",
+			unmarshal: func(b []byte, m proto.Message) error {
+				return jsonpb.Unmarshal(bytes.NewReader(b), m)
+			},
+		},
+		{name: "protobuf", accept: ProtobufContentType, wantType: "application/octet-stream", unmarshal: proto.Unmarshal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "http://"+s.Addr().String()+"/v1/operations/a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if got := resp.Header.Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			op := &longrunning.Operation{}
+			if err := tt.unmarshal(body, op); err != nil {
+				t.Fatal(err)
+			}
+
+			if op.Name != "operations/a" || !op.Done {
+				t.Errorf("operation = %v", op)
+			}
+		})
+	}
+}
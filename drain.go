@@ -0,0 +1,192 @@
+package drudge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// readyPath serves the readiness of the server, answered even while draining.
+const readyPath = "/readyz"
+
+// drainPath serves Options.EnableDrainEndpoint, answered even while draining.
+const drainPath = "/drain"
+
+// drainer tracks the HTTP requests in flight, so Stop can let them finish
+// before shutting the server down.
+type drainer struct {
+	mu       sync.Mutex
+	serving  bool
+	stopping bool
+	draining bool
+	inflight sync.WaitGroup
+	count    int
+
+	// requested is closed by the drain endpoint.
+	requested chan struct{}
+}
+
+// serve marks the server ready.
+func (d *drainer) serve() {
+	d.mu.Lock()
+	d.serving = true
+	d.mu.Unlock()
+}
+
+// stop marks the server not ready, while it still serves requests.
+func (d *drainer) stop() {
+	d.mu.Lock()
+	d.stopping = true
+	d.mu.Unlock()
+}
+
+// drain rejects the requests arriving from now on.
+func (d *drainer) drain() {
+	d.mu.Lock()
+	d.stopping = true
+	d.draining = true
+	d.mu.Unlock()
+}
+
+// request marks the server not ready and asks for it to be stopped.
+func (d *drainer) request() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopping = true
+	if d.requested == nil {
+		d.requested = make(chan struct{})
+	}
+
+	select {
+	case <-d.requested:
+	default:
+		close(d.requested)
+	}
+}
+
+// requestedC is closed once the drain endpoint was called.
+func (d *drainer) requestedC() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.requested == nil {
+		d.requested = make(chan struct{})
+	}
+
+	return d.requested
+}
+
+func (d *drainer) ready() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.serving && !d.stopping
+}
+
+// wait blocks until the requests in flight are done, or ctx is.
+func (d *drainer) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track counts the requests served by h. Once draining, requests other than
+// the readiness probe are rejected with 503 Service Unavailable, closing
+// their connection.
+func (d *drainer) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == readyPath || r.URL.Path == drainPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		d.mu.Lock()
+		if d.draining {
+			d.mu.Unlock()
+			w.Header().Set("Connection", "close")
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		d.inflight.Add(1)
+		d.count++
+		d.mu.Unlock()
+
+		defer func() {
+			d.mu.Lock()
+			d.count--
+			d.mu.Unlock()
+			d.inflight.Done()
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readyHandler answers SERVING while the server serves, NOT_SERVING with
+// 503 Service Unavailable before and once Stop begins.
+func (d *drainer) readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !d.ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("NOT_SERVING\n"))
+		return
+	}
+
+	_, _ = w.Write([]byte("SERVING\n"))
+}
+
+// DrainStatus is served by the drain endpoint.
+type DrainStatus struct {
+	// Status is SERVING, NOT_SERVING once Stop begins or a drain was
+	// requested, or DRAINING once new requests are rejected.
+	Status string `json:"status"`
+
+	// InFlight is the number of HTTP requests being served.
+	InFlight int `json:"in_flight"`
+}
+
+func (d *drainer) status() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := DrainStatus{Status: "SERVING", InFlight: d.count}
+	switch {
+	case d.draining:
+		s.Status = "DRAINING"
+	case d.stopping || !d.serving:
+		s.Status = "NOT_SERVING"
+	}
+
+	return s
+}
+
+// drainHandler reports the drain status. POST requests first ask for the
+// server to be stopped, answered with 202 Accepted.
+func (d *drainer) drainHandler(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		d.request()
+		code = http.StatusAccepted
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(d.status())
+}
@@ -0,0 +1,203 @@
+package drudge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainerReadiness(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(d *drainer)
+		wantCode   int
+		wantBody   string
+		wantStatus string
+	}{
+		{name: "starting", setup: func(d *drainer) {}, wantCode: http.StatusServiceUnavailable, wantBody: "NOT_SERVING\n", wantStatus: "NOT_SERVING"},
+		{name: "serving", setup: (*drainer).serve, wantCode: http.StatusOK, wantBody: "SERVING\n", wantStatus: "SERVING"},
+		{
+			name:       "stopping",
+			setup:      func(d *drainer) { d.serve(); d.stop() },
+			wantCode:   http.StatusServiceUnavailable,
+			wantBody:   "NOT_SERVING\n",
+			wantStatus: "NOT_SERVING",
+		},
+		{
+			name:       "drain requested",
+			setup:      func(d *drainer) { d.serve(); d.request() },
+			wantCode:   http.StatusServiceUnavailable,
+			wantBody:   "NOT_SERVING\n",
+			wantStatus: "NOT_SERVING",
+		},
+		{
+			name:       "draining",
+			setup:      func(d *drainer) { d.serve(); d.drain() },
+			wantCode:   http.StatusServiceUnavailable,
+			wantBody:   "NOT_SERVING\n",
+			wantStatus: "DRAINING",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &drainer{}
+			tt.setup(d)
+
+			w := httptest.NewRecorder()
+			d.readyHandler(w, httptest.NewRequest(http.MethodGet, readyPath, nil))
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("readyHandler() = %d %q, want %d %q", w.Code, w.Body, tt.wantCode, tt.wantBody)
+			}
+
+			if got := d.status().Status; got != tt.wantStatus {
+				t.Errorf("status() = %s, want %s", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDrainerTrack(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		draining bool
+		want     int
+	}{
+		{name: "serving", path: "/v1/users", want: http.StatusOK},
+		{name: "draining", path: "/v1/users", draining: true, want: http.StatusServiceUnavailable},
+		{name: "readiness while draining", path: readyPath, draining: true, want: http.StatusOK},
+		{name: "drain endpoint while draining", path: drainPath, draining: true, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &drainer{}
+			if tt.draining {
+				d.drain()
+			}
+
+			w := httptest.NewRecorder()
+			d.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+				ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+
+			if tt.want == http.StatusServiceUnavailable && w.Header().Get("Connection") != "close" {
+				t.Error("rejected request doesn't close the connection")
+			}
+		})
+	}
+}
+
+func TestDrainerWait(t *testing.T) {
+	d := &drainer{}
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := d.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	<-entered
+
+	if got := d.status().InFlight; got != 1 {
+		t.Fatalf("InFlight = %d, want 1", got)
+	}
+
+	d.drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := d.wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wait() with a request in flight = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(release)
+
+	if err := d.wait(context.Background()); err != nil {
+		t.Fatalf("wait() = %v", err)
+	}
+
+	if got := d.status().InFlight; got != 0 {
+		t.Errorf("InFlight = %d, want 0", got)
+	}
+}
+
+func TestDrainHandler(t *testing.T) {
+	tests := []struct {
+		method        string
+		wantCode      int
+		wantStatus    string
+		wantRequested bool
+	}{
+		{method: http.MethodGet, wantCode: http.StatusOK, wantStatus: "SERVING"},
+		{method: http.MethodHead, wantCode: http.StatusOK, wantStatus: "SERVING"},
+		{method: http.MethodPost, wantCode: http.StatusAccepted, wantStatus: "NOT_SERVING", wantRequested: true},
+		{method: http.MethodDelete, wantCode: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			d := &drainer{}
+			d.serve()
+
+			w := httptest.NewRecorder()
+			d.drainHandler(w, httptest.NewRequest(tt.method, drainPath, nil))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if tt.wantCode == http.StatusMethodNotAllowed {
+				if allow := w.Header().Get("Allow"); !strings.Contains(allow, "POST") {
+					t.Errorf("Allow = %q", allow)
+				}
+				return
+			}
+
+			var s DrainStatus
+			if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+				t.Fatal(err)
+			}
+
+			if s.Status != tt.wantStatus {
+				t.Errorf("Status = %s, want %s", s.Status, tt.wantStatus)
+			}
+
+			select {
+			case <-d.requestedC():
+				if !tt.wantRequested {
+					t.Error("drain requested")
+				}
+			default:
+				if tt.wantRequested {
+					t.Error("drain not requested")
+				}
+			}
+		})
+	}
+}
+
+func TestDrainerRequestTwice(t *testing.T) {
+	d := &drainer{}
+	c := d.requestedC()
+
+	d.request()
+	d.request()
+
+	select {
+	case <-c:
+	default:
+		t.Fatal("requestedC() isn't closed")
+	}
+}
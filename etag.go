@@ -0,0 +1,140 @@
+package drudge
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// maxETagBody is the largest response body given an ETag, larger ones are
+// written as they come.
+const maxETagBody = 1 << 20
+
+// withETags gives the 2xx responses of GET requests a weak ETag computed from
+// their body, answering 304 Not Modified when it matches If-None-Match. An
+// ETag set by h is kept. Responses are buffered until complete, those which
+// are flushed, such as streams, or larger than maxETagBody get no ETag.
+func withETags(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ew := &etagWriter{ResponseWriter: w}
+		h.ServeHTTP(ew, r)
+		ew.finish(r)
+	})
+}
+
+// etagWriter buffers the response until it's complete, or released.
+type etagWriter struct {
+	http.ResponseWriter
+	code     int
+	body     bytes.Buffer
+	released bool
+}
+
+func (ew *etagWriter) WriteHeader(code int) {
+	if ew.released {
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if ew.code == 0 {
+		ew.code = code
+	}
+}
+
+func (ew *etagWriter) Write(b []byte) (int, error) {
+	if !ew.released && ew.body.Len()+len(b) > maxETagBody {
+		ew.release()
+	}
+
+	if ew.released {
+		return ew.ResponseWriter.Write(b)
+	}
+
+	return ew.body.Write(b)
+}
+
+// Flush writes the buffered response and the rest as it comes.
+func (ew *etagWriter) Flush() {
+	ew.release()
+
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// release writes what was buffered, without an ETag.
+func (ew *etagWriter) release() {
+	if ew.released {
+		return
+	}
+	ew.released = true
+
+	if ew.code != 0 {
+		ew.ResponseWriter.WriteHeader(ew.code)
+	}
+
+	_, _ = ew.ResponseWriter.Write(ew.body.Bytes())
+	ew.body.Reset()
+}
+
+// finish writes the complete response, or 304 when the client has it.
+func (ew *etagWriter) finish(r *http.Request) {
+	if ew.released {
+		return
+	}
+
+	code := ew.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+
+	if code < 200 || code > 299 {
+		ew.release()
+		return
+	}
+
+	header := ew.Header()
+
+	etag := header.Get("ETag")
+	if etag == "" {
+		h := fnv.New64a()
+		_, _ = h.Write(ew.body.Bytes())
+		etag = fmt.Sprintf(`W/"%x"`, h.Sum64())
+		header.Set("ETag", etag)
+	}
+
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		ew.released = true
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		ew.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	ew.release()
+}
+
+// etagMatch reports whether the If-None-Match list holds etag, using the weak
+// comparison.
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
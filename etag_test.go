@@ -0,0 +1,119 @@
+package drudge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithETags(t *testing.T) {
+	body := func(s string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(s))
+		}
+	}
+
+	// etag is the weak ETag of `{"id":1}`.
+	first := httptest.NewRecorder()
+	withETags(body(`{"id":1}`)).ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/v1/users/1", nil))
+	etag := first.Header().Get("ETag")
+
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("ETag = %q, want a weak one", etag)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		ifNoneMatch string
+		handler     http.HandlerFunc
+		wantCode    int
+		wantETag    string
+		wantNoETag  bool
+		wantBody    string
+	}{
+		{name: "tagged", method: http.MethodGet, handler: body(`{"id":1}`), wantCode: http.StatusOK, wantETag: etag, wantBody: `{"id":1}`},
+		{name: "not modified", method: http.MethodGet, ifNoneMatch: etag, handler: body(`{"id":1}`), wantCode: http.StatusNotModified, wantETag: etag},
+		{name: "strong match", method: http.MethodGet, ifNoneMatch: strings.TrimPrefix(etag, "W/"), handler: body(`{"id":1}`), wantCode: http.StatusNotModified, wantETag: etag},
+		{name: "in a list", method: http.MethodGet, ifNoneMatch: `"x", ` + etag, handler: body(`{"id":1}`), wantCode: http.StatusNotModified, wantETag: etag},
+		{name: "any", method: http.MethodGet, ifNoneMatch: "*", handler: body(`{"id":1}`), wantCode: http.StatusNotModified, wantETag: etag},
+		{name: "modified", method: http.MethodGet, ifNoneMatch: etag, handler: body(`{"id":2}`), wantCode: http.StatusOK, wantBody: `{"id":2}`},
+		{name: "not GET", method: http.MethodPost, handler: body(`{"id":1}`), wantCode: http.StatusOK, wantBody: `{"id":1}`},
+		{
+			name:   "own ETag",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v7"`)
+				_, _ = w.Write([]byte("v7"))
+			},
+			wantCode: http.StatusOK,
+			wantETag: `"v7"`,
+			wantBody: "v7",
+		},
+		{
+			name:   "error",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "not found", http.StatusNotFound)
+			},
+			wantCode: http.StatusNotFound,
+			wantBody: "not found\n",
+		},
+		{
+			name:   "flushed",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("a"))
+				w.(http.Flusher).Flush()
+				_, _ = w.Write([]byte("b"))
+			},
+			wantCode:   http.StatusOK,
+			wantNoETag: true,
+			wantBody:   "ab",
+		},
+		{
+			name:   "too large",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(make([]byte, maxETagBody))
+				_, _ = w.Write([]byte("!"))
+			},
+			wantCode:   http.StatusOK,
+			wantNoETag: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/users/1", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+
+			w := httptest.NewRecorder()
+			withETags(tt.handler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if got := w.Header().Get("ETag"); tt.wantETag != "" && got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+
+			if tt.wantNoETag && w.Header().Get("ETag") != "" {
+				t.Errorf("ETag = %q, want none", w.Header().Get("ETag"))
+			}
+
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+
+			if tt.wantCode == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("Content-Type") != "") {
+				t.Errorf("304 with body %q and Content-Type %q", w.Body, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
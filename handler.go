@@ -1,31 +1,594 @@
 package drudge
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
 	"net/http"
-	"path"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
-// swaggerServer returns swagger specification files located under "/swagger/"
-func swaggerServer(lg *zap.Logger, dir string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		lg.Info("Serving swagger", zap.String("path", r.URL.Path))
-		p := strings.TrimPrefix(r.URL.Path, "/openapi/")
-		p = path.Join(dir, p)
-		http.ServeFile(w, r, p)
+// grpcWrapper routes the gRPC requests arriving on the HTTP server to rpc, and
+// the gRPC-Web ones and their preflights to web when set. Everything else is
+// passed to h.
+func grpcWrapper(rpc, web, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case web != nil && isGRPCWebRequest(r):
+			web.ServeHTTP(w, r)
+		case isGRPCRequest(r):
+			rpc.ServeHTTP(w, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// grpcWebHandler translates gRPC-Web requests for rpc. CORS is left to
+// allowCORS, so gRPC-Web shares the gateway's policy.
+func grpcWebHandler(rpc *grpc.Server) http.Handler {
+	return http.HandlerFunc(grpcweb.WrapServer(rpc).HandleGrpcWebRequest)
+}
+
+// grpcWebPreflight allows gRPC-Web calls, which are always POSTed, with the
+// headers carrying their metadata.
+func grpcWebPreflight(r *http.Request) (methods, headers []string) {
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+
+	return []string{http.MethodPost}, headers
+}
+
+// stripBasePath serves h under base, removing it from the path before
+// routing. Requests outside of base are not found, except native gRPC ones
+// whose path is the method.
+func stripBasePath(base string, h http.Handler) http.Handler {
+	base = strings.TrimRight(base, "/")
+	if base == "" {
+		return h
+	}
+
+	strip := http.StripPrefix(base, h)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case isGRPCRequest(r):
+			h.ServeHTTP(w, r)
+		case r.URL.Path == base:
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, base+"/"):
+			strip.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// TrailingSlash sets how the gateway treats paths ending with a slash.
+type TrailingSlash string
+
+const (
+	// TrailingSlashStrip routes "/users/" like "/users".
+	TrailingSlashStrip TrailingSlash = "strip"
+
+	// TrailingSlashRedirect redirects "/users/" to "/users" permanently.
+	TrailingSlashRedirect TrailingSlash = "redirect"
+)
+
+// normalizeSlash removes the trailing slashes of the paths served by h, the
+// root path excepted, according to mode. An empty mode leaves paths alone.
+func normalizeSlash(mode TrailingSlash, h http.Handler) http.Handler {
+	if mode == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimRight(r.URL.Path, "/")
+		if p == r.URL.Path || p == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if mode == TrailingSlashRedirect {
+			redirectSlash(w, r)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath = strings.TrimRight(r.URL.RawPath, "/")
+
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// redirectSlash redirects to the requested URI without its trailing slashes,
+// which unlike the URL keeps the base path. Methods other than GET and HEAD
+// are redirected with 308 so clients repeat them with their body.
+func redirectSlash(w http.ResponseWriter, r *http.Request) {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		u = r.URL
+	}
+
+	location := strings.TrimRight(u.EscapedPath(), "/")
+	if location == "" {
+		location = "/"
+	}
+	if u.RawQuery != "" {
+		location += "?" + u.RawQuery
+	}
+
+	code := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		code = http.StatusMovedPermanently
+	}
+
+	w.Header().Set("Location", location)
+	w.WriteHeader(code)
+}
+
+// methodOverrideHeader names the method of POST requests sent by clients
+// restricted to GET and POST.
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// DefaultMethodOverrides are the methods a POST request can be overridden to.
+var DefaultMethodOverrides = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// overrideMethod serves POST requests with the method of their
+// X-HTTP-Method-Override header when it's one of allowed, others are rejected
+// with 400 Bad Request. No override takes place when allowed is empty.
+func overrideMethod(allowed []string, h http.Handler) http.Handler {
+	if len(allowed) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.ToUpper(strings.TrimSpace(r.Header.Get(methodOverrideHeader)))
+		if r.Method != http.MethodPost || method == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		for _, m := range allowed {
+			if strings.EqualFold(m, method) {
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.Method = method
+				r2.Header = cloneHeader(r.Header)
+				r2.Header.Del(methodOverrideHeader)
+
+				h.ServeHTTP(w, r2)
+				return
+			}
+		}
+
+		http.Error(w, "method override not allowed", http.StatusBadRequest)
+	})
+}
+
+// concurrencyLimiter bounds the requests served at once across the handlers
+// it wraps, the gateway and gRPC sharing the same budget.
+type concurrencyLimiter struct {
+	sem    chan struct{}
+	onShed func()
+}
+
+// newConcurrencyLimiter serves up to max requests at once, rejecting the
+// others with 503 Service Unavailable and a Retry-After header. onShed, when
+// set, is called for each rejected request. No limit applies when max isn't
+// positive.
+func newConcurrencyLimiter(max int, onShed func()) *concurrencyLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &concurrencyLimiter{sem: make(chan struct{}, max), onShed: onShed}
+}
+
+// limit applies the limiter to h.
+func (l *concurrencyLimiter) limit(h http.Handler) http.Handler {
+	if l == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			if l.onShed != nil {
+				l.onShed()
+			}
+
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-l.sem }()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// BasicCredentials returns an Options.AdminAuth checker accepting a single
+// username and password.
+func BasicCredentials(username, password string) func(username, password string) bool {
+	return func(u, p string) bool {
+		// Both are compared so the time taken doesn't tell which differs.
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+
+		return userOK && passOK
+	}
+}
+
+// requireBasicAuth serves the requests whose Basic credentials check accepts,
+// answering the others with 401 Unauthorized and a challenge. Every request
+// is served when check is nil.
+func requireBasicAuth(check func(username, password string) bool, h http.Handler) http.Handler {
+	if check == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); ok && check(u, p) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// limitBody rejects request bodies larger than max bytes with 413 Request
+// Entity Too Large, except for paths starting with one of the exempt
+// prefixes. Bodies of unknown length fail when read past max, answering 413
+// unless the handler already responded.
+func limitBody(max int64, exempt []string, h http.Handler) http.Handler {
+	if max <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range exempt {
+			if strings.HasPrefix(r.URL.Path, p) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if r.ContentLength > max {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if r.Body == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		lw := &bodyLimitWriter{ResponseWriter: w}
+		r.Body = &limitedBody{ReadCloser: r.Body, w: lw, left: max}
+
+		h.ServeHTTP(lw, r)
+	})
+}
+
+// errBodyTooLarge is returned by the reads past the body limit.
+var errBodyTooLarge = errors.New("http: request body too large")
+
+// limitedBody fails the reads past left bytes, answering 413 on w.
+type limitedBody struct {
+	io.ReadCloser
+	w    *bodyLimitWriter
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, errBodyTooLarge
+	}
+
+	// One byte more than left tells a body of exactly left bytes from a
+	// larger one.
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.left {
+		b.left -= int64(n)
+		return n, err
+	}
+
+	n, b.left = int(b.left), -1
+	b.w.tooLarge()
+
+	return n, errBodyTooLarge
+}
+
+// bodyLimitWriter answers 413 once the body is read past its limit, dropping
+// the handler's own response to the failed read.
+type bodyLimitWriter struct {
+	http.ResponseWriter
+	wrote    bool
+	exceeded bool
+}
+
+// tooLarge answers 413 unless a response was already written.
+func (lw *bodyLimitWriter) tooLarge() {
+	if lw.wrote || lw.exceeded {
+		return
+	}
+	lw.exceeded = true
+
+	// The rest of the body is left unread.
+	lw.Header().Set("Connection", "close")
+	http.Error(lw.ResponseWriter, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+}
+
+func (lw *bodyLimitWriter) WriteHeader(code int) {
+	if lw.exceeded {
+		return
+	}
+	lw.wrote = true
+
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *bodyLimitWriter) Write(b []byte) (int, error) {
+	if lw.exceeded {
+		return len(b), nil
+	}
+	lw.wrote = true
+
+	return lw.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses flowing when the underlying writer supports it.
+func (lw *bodyLimitWriter) Flush() {
+	if lw.exceeded {
+		return
+	}
+
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// grpcTimeoutHeader is read by the gateway, which applies it as the deadline
+// of the gRPC call.
+const grpcTimeoutHeader = "Grpc-Timeout"
+
+// withTimeout applies the timeout requested by the header, clamped to max, as
+// the deadline of the request. Grpc-Timeout uses the gRPC encoding, e.g.
+// "500m", other headers a duration such as "1.5s" or a number of seconds.
+// Requests without a timeout are left unbounded.
+func withTimeout(header string, max time.Duration, h http.Handler) http.Handler {
+	if header == "" && max <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, err := requestTimeout(r, header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case max <= 0:
+		case timeout > max:
+			timeout = max
+		case timeout == 0 && r.Header.Get(grpcTimeoutHeader) != "":
+			// The gateway applies Grpc-Timeout on its own, bound it too.
+			timeout = max
+		}
+
+		if timeout <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestTimeout parses the timeout requested by the header, zero when absent.
+func requestTimeout(r *http.Request, header string) (time.Duration, error) {
+	v := ""
+	if header != "" {
+		v = r.Header.Get(header)
+	}
+	if v == "" {
+		return 0, nil
 	}
+
+	if strings.EqualFold(header, grpcTimeoutHeader) {
+		d, err := decodeGRPCTimeout(v)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid %s", header)
+		}
+
+		return d, nil
+	}
+
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid %s: %q", header, v)
+	}
+
+	return d, nil
+}
+
+// decodeGRPCTimeout parses the gRPC timeout encoding, up to eight digits
+// followed by a unit.
+func decodeGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, errors.Errorf("malformed timeout %q", s)
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, errors.Errorf("unknown timeout unit in %q", s)
+	}
+
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.Errorf("malformed timeout %q", s)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// isGRPCRequest reports whether r is a native gRPC request.
+func isGRPCRequest(r *http.Request) bool {
+	if r.ProtoMajor != 2 {
+		return false
+	}
+
+	ct := r.Header.Get("Content-Type")
+
+	return ct == "application/grpc" ||
+		strings.HasPrefix(ct, "application/grpc+") ||
+		strings.HasPrefix(ct, "application/grpc;")
 }
 
-// allowCORS allows Cross Origin Resoruce Sharing from any origin.
-// Don't do this without consideration in production systems.
-func allowCORS(lg *zap.Logger, h http.Handler) http.Handler {
+// isGRPCWebRequest reports whether r is a gRPC-Web request or its preflight.
+func isGRPCWebRequest(r *http.Request) bool {
+	if r.Method == http.MethodOptions {
+		return strings.Contains(strings.ToLower(r.Header.Get("Access-Control-Request-Headers")), "x-grpc-web")
+	}
+
+	return r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web")
+}
+
+// corsPolicy is the CORS policy shared by the gateway and gRPC-Web.
+type corsPolicy struct {
+	origins     []string
+	credentials bool
+	maxAge      time.Duration
+}
+
+// allows reports whether origin may make cross-origin requests, which any
+// origin may without a list of origins.
+func (p corsPolicy) allows(origin string) bool {
+	if len(p.origins) == 0 {
+		return true
+	}
+
+	for _, o := range p.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withCredentials reports whether origin may send credentials, which only
+// the origins listed by name may, never those allowed by "*" or an empty
+// list.
+func (p corsPolicy) withCredentials(origin string) bool {
+	if !p.credentials || origin == "null" {
+		return false
+	}
+
+	for _, o := range p.origins {
+		if o != "*" && strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// preflightFunc returns the methods and headers a preflight request may ask
+// for.
+type preflightFunc func(r *http.Request) (methods, headers []string)
+
+// gatewayPreflight allows the methods the gateway routes for the path, or
+// "GET", "HEAD", "POST", "PUT", "DELETE" for the paths it doesn't serve.
+func gatewayPreflight(routes *routeTable) preflightFunc {
+	return func(r *http.Request) ([]string, []string) {
+		methods := routes.allowed(r)
+		if len(methods) == 0 {
+			methods = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+		}
+
+		return methods, []string{"Content-Type", "Accept"}
+	}
+}
+
+// allowCORS allows Cross Origin Resource Sharing from the origins of policy,
+// any of them without a list. Don't do this without consideration in
+// production systems. Preflight requests are answered with what preflight
+// allows, those of other origins are rejected with 403 Forbidden. With
+// credentials, the origin is allowed to send cookies and Authorization,
+// except the opaque "null" origin. Requests without an Origin aren't
+// cross-origin and get no CORS headers, nor do those of other origins.
+func allowCORS(lg *zap.Logger, policy corsPolicy, preflight preflightFunc, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses differ by origin, caches mustn't share them across.
+		w.Header().Add("Vary", "Origin")
+
 		if origin := r.Header.Get("Origin"); origin != "" {
+			isPreflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if !policy.allows(origin) {
+				if isPreflight {
+					http.Error(w, "origin not allowed", http.StatusForbidden)
+					return
+				}
+
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			// The origin is echoed rather than "*", which browsers
+			// reject with credentials.
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
-				preflightHandler(lg, w, r)
+
+			withCredentials := policy.withCredentials(origin)
+			if withCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if isPreflight {
+				preflightHandler(lg, preflight, withCredentials, policy.maxAge, w, r)
 				return
 			}
 		}
@@ -33,14 +596,200 @@ func allowCORS(lg *zap.Logger, h http.Handler) http.Handler {
 	})
 }
 
-// preflightHandler adds the necessary headers in order to serve
-// CORS from any origin using the methods "GET", "HEAD", "POST", "PUT", "DELETE"
+// preflightHandler adds the necessary headers in order to serve CORS using
+// the methods and headers allowed by preflight.
+// Browsers cache the response for maxAge when it's at least a second.
 // We insist, don't do this without consideration in production systems.
-func preflightHandler(lg *zap.Logger, w http.ResponseWriter, r *http.Request) {
-	headers := []string{"Content-Type", "Accept"}
+func preflightHandler(lg *zap.Logger, preflight preflightFunc, credentials bool, maxAge time.Duration, w http.ResponseWriter, r *http.Request) {
+	methods, headers := preflight(r)
+	if credentials {
+		headers = append(headers, "Authorization")
+	}
 	w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ","))
-
-	methods := []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
 	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ","))
-	lg.Info("preflight request", zap.String("path", r.URL.Path))
+
+	if secs := int64(maxAge / time.Second); secs > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.FormatInt(secs, 10))
+	}
+	requestLogger(r.Context(), lg).Info("preflight request", zap.String("path", r.URL.Path))
+}
+
+// DefaultMaxLoggedBody is the number of bytes of each body logged when no cap
+// is given.
+const DefaultMaxLoggedBody = 4096
+
+// redactedValue replaces the value of redacted fields in logged bodies.
+const redactedValue = "[REDACTED]"
+
+// streamedValue replaces the logged bodies of streams.
+const streamedValue = "[STREAMED]"
+
+// logBodies logs the request and response bodies at Debug level, masking the
+// redacted fields. The first max bytes of the request body are kept as h
+// reads it. The bodies of streams, told by their content type, aren't kept.
+func logBodies(lg *zap.Logger, redact []string, max int, h http.Handler) http.Handler {
+	if max <= 0 {
+		max = DefaultMaxLoggedBody
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lg.Core().Enabled(zap.DebugLevel) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var br *bodyLogReader
+		if r.Body != nil && !isStreamContentType(r.Header.Get("Content-Type")) {
+			br = &bodyLogReader{ReadCloser: r.Body, max: max}
+			r.Body = br
+		}
+
+		bw := &bodyLogWriter{ResponseWriter: w, max: max}
+		h.ServeHTTP(bw, r)
+
+		var req string
+		switch {
+		case br != nil:
+			req = redactBody(br.body.Bytes(), redact, max)
+		case r.Body != nil:
+			req = streamedValue
+		}
+
+		resp := streamedValue
+		if !bw.streamed {
+			resp = redactBody(bw.body.Bytes(), redact, max)
+		}
+
+		requestLogger(r.Context(), lg).Debug("gateway bodies",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Stringer("client_ip", ClientIP(r.Context())),
+			zap.String("request", req),
+			zap.String("response", resp),
+		)
+	})
+}
+
+// isStreamContentType reports whether bodies of the content type are
+// streams, which are neither buffered nor logged.
+func isStreamContentType(ct string) bool {
+	ct = strings.ToLower(ct)
+
+	return strings.HasPrefix(ct, "text/event-stream") ||
+		strings.HasPrefix(ct, "application/x-ndjson") ||
+		strings.HasPrefix(ct, "application/stream+json") ||
+		strings.HasPrefix(ct, "application/grpc")
+}
+
+// bodyLogReader keeps the first max+1 bytes read from the request body,
+// enough to tell whether it was truncated.
+type bodyLogReader struct {
+	io.ReadCloser
+	body bytes.Buffer
+	max  int
+}
+
+func (br *bodyLogReader) Read(b []byte) (int, error) {
+	n, err := br.ReadCloser.Read(b)
+	if room := br.max + 1 - br.body.Len(); room > 0 && n > 0 {
+		if n < room {
+			room = n
+		}
+		br.body.Write(b[:room])
+	}
+
+	return n, err
+}
+
+// bodyLogWriter keeps the first max+1 bytes of the response, enough to tell
+// whether it was truncated, unless it's a stream.
+type bodyLogWriter struct {
+	http.ResponseWriter
+	body     bytes.Buffer
+	max      int
+	wrote    bool
+	streamed bool
+}
+
+func (bw *bodyLogWriter) Write(b []byte) (int, error) {
+	if !bw.wrote {
+		bw.wrote = true
+		bw.streamed = isStreamContentType(bw.Header().Get("Content-Type"))
+	}
+
+	if room := bw.max + 1 - bw.body.Len(); room > 0 && !bw.streamed {
+		if len(b) < room {
+			room = len(b)
+		}
+		bw.body.Write(b[:room])
+	}
+
+	return bw.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses flowing when the underlying writer supports it.
+func (bw *bodyLogWriter) Flush() {
+	if f, ok := bw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// redactBody masks the dotted field paths of a JSON body. Bodies that are
+// truncated or not JSON can't be redacted, so only their size is reported
+// when fields are to be redacted.
+func redactBody(b []byte, fields []string, max int) string {
+	if len(b) == 0 {
+		return ""
+	}
+
+	if len(b) > max {
+		if len(fields) > 0 {
+			return "[TRUNCATED]"
+		}
+
+		return string(b[:max]) + "..."
+	}
+
+	if len(fields) == 0 {
+		return string(b)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "[UNPARSEABLE]"
+	}
+
+	for _, f := range fields {
+		redactPath(v, strings.Split(f, "."))
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "[UNPARSEABLE]"
+	}
+
+	return string(out)
+}
+
+// redactPath replaces the value at path, applying to every element of the
+// arrays along the way.
+func redactPath(v interface{}, path []string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		child, ok := t[path[0]]
+		if !ok {
+			return
+		}
+
+		if len(path) == 1 {
+			t[path[0]] = redactedValue
+			return
+		}
+
+		redactPath(child, path[1:])
+	case []interface{}:
+		for _, e := range t {
+			redactPath(e, path)
+		}
+	}
 }
@@ -0,0 +1,911 @@
+package drudge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/genproto/googleapis/longrunning"
+)
+
+// echoHandler writes the method, path and query it's served.
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(r.Method + " " + r.URL.Path))
+	if r.URL.RawQuery != "" {
+		_, _ = w.Write([]byte("?" + r.URL.RawQuery))
+	}
+})
+
+// named answers with its name.
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(name))
+	})
+}
+
+func TestGRPCWrapper(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		proto   int
+		headers map[string]string
+		noWeb   bool
+		want    string
+	}{
+		{name: "gateway", method: http.MethodGet, proto: 1, want: "gateway"},
+		{name: "gRPC", method: http.MethodPost, proto: 2, headers: map[string]string{"Content-Type": "application/grpc"}, want: "rpc"},
+		{name: "gRPC+proto", method: http.MethodPost, proto: 2, headers: map[string]string{"Content-Type": "application/grpc+proto"}, want: "rpc"},
+		{name: "gRPC over HTTP/1", method: http.MethodPost, proto: 1, headers: map[string]string{"Content-Type": "application/grpc"}, want: "gateway"},
+		{name: "lookalike", method: http.MethodPost, proto: 2, headers: map[string]string{"Content-Type": "application/grpcx"}, want: "gateway"},
+		{name: "gRPC-Web", method: http.MethodPost, proto: 1, headers: map[string]string{"Content-Type": "application/grpc-web+proto"}, want: "web"},
+		{
+			name:    "gRPC-Web preflight",
+			method:  http.MethodOptions,
+			proto:   1,
+			headers: map[string]string{"Access-Control-Request-Headers": "Content-Type, X-Grpc-Web"},
+			want:    "web",
+		},
+		{
+			name:    "gateway preflight",
+			method:  http.MethodOptions,
+			proto:   1,
+			headers: map[string]string{"Access-Control-Request-Headers": "Content-Type"},
+			want:    "gateway",
+		},
+		{
+			name:    "gRPC-Web disabled",
+			method:  http.MethodPost,
+			proto:   1,
+			headers: map[string]string{"Content-Type": "application/grpc-web"},
+			noWeb:   true,
+			want:    "gateway",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/pkg.Service/Method", nil)
+			r.ProtoMajor = tt.proto
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			web := named("web")
+			if tt.noWeb {
+				web = nil
+			}
+
+			w := httptest.NewRecorder()
+			grpcWrapper(named("rpc"), web, named("gateway")).ServeHTTP(w, r)
+
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("served by %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCWebPreflight(t *testing.T) {
+	r := httptest.NewRequest(http.MethodOptions, "/pkg.Service/Method", nil)
+	r.Header.Set("Access-Control-Request-Headers", "x-grpc-web, content-type,, x-user-agent")
+
+	methods, headers := grpcWebPreflight(r)
+
+	if strings.Join(methods, ",") != "POST" {
+		t.Errorf("methods = %v, want [POST]", methods)
+	}
+
+	if got := strings.Join(headers, ","); got != "x-grpc-web,content-type,x-user-agent" {
+		t.Errorf("headers = %s", got)
+	}
+}
+
+func TestGRPCWebCall(t *testing.T) {
+	s := startOperations(t, &operations{}, Options{EnableGRPCWeb: true})
+	defer s.Stop(context.Background())
+
+	msg, err := proto.Marshal(&longrunning.GetOperationRequest{Name: "operations/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	url := "http://" + s.Addr().String() + "/google.longrunning.Operations/GetOperation"
+	r, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/grpc-web+proto")
+	r.Header.Set("X-Grpc-Web", "1")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc-web+proto" {
+		t.Fatalf("answered %d with %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A message frame, then a trailer frame with the most significant bit of
+	// its flags set.
+	var frames [][]byte
+	var flags []byte
+	for len(got) >= 5 {
+		n := int(binary.BigEndian.Uint32(got[1:5]))
+		if len(got) < 5+n {
+			t.Fatalf("truncated frame of %d bytes", n)
+		}
+
+		flags = append(flags, got[0])
+		frames = append(frames, got[5:5+n])
+		got = got[5+n:]
+	}
+
+	if len(frames) != 2 || len(got) != 0 || flags[0] != 0 || flags[1] != 0x80 {
+		t.Fatalf("frames with flags %v, %d bytes left, want a message and trailers", flags, len(got))
+	}
+
+	op := &longrunning.Operation{}
+	if err := proto.Unmarshal(frames[0], op); err != nil {
+		t.Fatal(err)
+	}
+
+	if op.Name != "operations/a" || !op.Done {
+		t.Errorf("operation = %v", op)
+	}
+
+	trailers, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(frames[1], "\r\n"...)))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := trailers.Get("Grpc-Status"); got != "0" {
+		t.Errorf("grpc-status trailer = %q, want 0", got)
+	}
+}
+
+func TestStripBasePath(t *testing.T) {
+	tests := []struct {
+		name         string
+		base         string
+		path         string
+		grpc         bool
+		wantCode     int
+		wantBody     string
+		wantLocation string
+	}{
+		{name: "no base", path: "/v1/users", wantCode: http.StatusOK, wantBody: "GET /v1/users"},
+		{name: "stripped", base: "/api/", path: "/api/v1/users", wantCode: http.StatusOK, wantBody: "GET /v1/users"},
+		{name: "base", base: "/api", path: "/api", wantCode: http.StatusMovedPermanently, wantLocation: "/api/"},
+		{name: "outside", base: "/api", path: "/apiv1/users", wantCode: http.StatusNotFound},
+		{name: "gRPC", base: "/api", path: "/pkg.Service/Method", grpc: true, wantCode: http.StatusOK, wantBody: "POST /pkg.Service/Method"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.grpc {
+				r.Method = http.MethodPost
+				r.ProtoMajor = 2
+				r.Header.Set("Content-Type", "application/grpc")
+			}
+
+			w := httptest.NewRecorder()
+			stripBasePath(tt.base, echoHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestNormalizeSlash(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         TrailingSlash
+		method       string
+		target       string
+		wantCode     int
+		wantBody     string
+		wantLocation string
+	}{
+		{name: "unset", method: http.MethodGet, target: "/v1/users/", wantCode: http.StatusOK, wantBody: "GET /v1/users/"},
+		{name: "strip", mode: TrailingSlashStrip, method: http.MethodGet, target: "/v1/users//?page=2", wantCode: http.StatusOK, wantBody: "GET /v1/users?page=2"},
+		{name: "root", mode: TrailingSlashStrip, method: http.MethodGet, target: "/", wantCode: http.StatusOK, wantBody: "GET /"},
+		{name: "no slash", mode: TrailingSlashRedirect, method: http.MethodGet, target: "/v1/users", wantCode: http.StatusOK, wantBody: "GET /v1/users"},
+		{
+			name:         "redirect GET",
+			mode:         TrailingSlashRedirect,
+			method:       http.MethodGet,
+			target:       "/v1/users/?page=2",
+			wantCode:     http.StatusMovedPermanently,
+			wantLocation: "/v1/users?page=2",
+		},
+		{
+			name:         "redirect POST",
+			mode:         TrailingSlashRedirect,
+			method:       http.MethodPost,
+			target:       "/v1/users/",
+			wantCode:     http.StatusPermanentRedirect,
+			wantLocation: "/v1/users",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			normalizeSlash(tt.mode, echoHandler).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestRedirectSlashKeepsBasePath(t *testing.T) {
+	h := stripBasePath("/api", normalizeSlash(TrailingSlashRedirect, echoHandler))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/users/", nil))
+
+	if got := w.Header().Get("Location"); got != "/api/v1/users" {
+		t.Errorf("Location = %q, want %q", got, "/api/v1/users")
+	}
+}
+
+func TestOverrideMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  []string
+		method   string
+		override string
+		wantCode int
+		wantBody string
+	}{
+		{name: "disabled", method: http.MethodPost, override: "DELETE", wantCode: http.StatusOK, wantBody: "POST /v1/users/1"},
+		{name: "overridden", allowed: DefaultMethodOverrides, method: http.MethodPost, override: "delete", wantCode: http.StatusOK, wantBody: "DELETE /v1/users/1"},
+		{name: "no override", allowed: DefaultMethodOverrides, method: http.MethodPost, wantCode: http.StatusOK, wantBody: "POST /v1/users/1"},
+		{name: "not POST", allowed: DefaultMethodOverrides, method: http.MethodGet, override: "DELETE", wantCode: http.StatusOK, wantBody: "GET /v1/users/1"},
+		{name: "not allowed", allowed: DefaultMethodOverrides, method: http.MethodPost, override: "CONNECT", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/users/1", nil)
+			if tt.override != "" {
+				r.Header.Set(methodOverrideHeader, tt.override)
+			}
+
+			var header string
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header.Get(methodOverrideHeader)
+				echoHandler(w, r)
+			})
+
+			w := httptest.NewRecorder()
+			overrideMethod(tt.allowed, h).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+
+			overridden := tt.wantBody != "" && !strings.HasPrefix(tt.wantBody, tt.method)
+			if overridden && header != "" {
+				t.Errorf("%s is passed on as %q", methodOverrideHeader, header)
+			}
+
+			if got := r.Header.Get(methodOverrideHeader); got != tt.override {
+				t.Errorf("the request's header was changed to %q", got)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		wantCode int
+		wantShed int
+	}{
+		{name: "unlimited", max: 0, wantCode: http.StatusOK},
+		{name: "room left", max: 2, wantCode: http.StatusOK},
+		{name: "full", max: 1, wantCode: http.StatusServiceUnavailable, wantShed: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shed := 0
+			l := newConcurrencyLimiter(tt.max, func() { shed++ })
+
+			entered, release := make(chan struct{}), make(chan struct{})
+			busy := l.limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(entered)
+				<-release
+			}))
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				busy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+			}()
+			<-entered
+
+			w := httptest.NewRecorder()
+			l.limit(echoHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+
+			close(release)
+			<-done
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if shed != tt.wantShed {
+				t.Errorf("onShed called %d times, want %d", shed, tt.wantShed)
+			}
+
+			if tt.wantCode == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Error("no Retry-After")
+			}
+		})
+	}
+}
+
+func TestRequireBasicAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		check    func(username, password string) bool
+		user     string
+		password string
+		noAuth   bool
+		wantCode int
+	}{
+		{name: "no check", noAuth: true, wantCode: http.StatusOK},
+		{name: "valid", check: BasicCredentials("admin", "secret"), user: "admin", password: "secret", wantCode: http.StatusOK},
+		{name: "wrong password", check: BasicCredentials("admin", "secret"), user: "admin", password: "nope", wantCode: http.StatusUnauthorized},
+		{name: "wrong user", check: BasicCredentials("admin", "secret"), user: "root", password: "secret", wantCode: http.StatusUnauthorized},
+		{name: "no credentials", check: BasicCredentials("admin", "secret"), noAuth: true, wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, drainPath, nil)
+			if !tt.noAuth {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+
+			w := httptest.NewRecorder()
+			requireBasicAuth(tt.check, echoHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			challenge := w.Header().Get("WWW-Authenticate")
+			if (tt.wantCode == http.StatusUnauthorized) != strings.HasPrefix(challenge, "Basic ") {
+				t.Errorf("WWW-Authenticate = %q", challenge)
+			}
+		})
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int64
+		exempt   []string
+		path     string
+		body     string
+		chunked  bool
+		wantCode int
+	}{
+		{name: "unlimited", path: "/v1/upload", body: "0123456789", wantCode: http.StatusOK},
+		{name: "within", max: 10, path: "/v1/upload", body: "0123456789", wantCode: http.StatusOK},
+		{name: "too large", max: 4, path: "/v1/upload", body: "0123456789", wantCode: http.StatusRequestEntityTooLarge},
+		{name: "unknown length", max: 4, path: "/v1/upload", body: "0123456789", chunked: true, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "unknown length within", max: 10, path: "/v1/upload", body: "0123456789", chunked: true, wantCode: http.StatusOK},
+		{name: "exempt", max: 4, exempt: []string{"/v1/upload"}, path: "/v1/upload/big", body: "0123456789", wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+
+			// Like the gateway, a failed read is answered as a bad request.
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := ioutil.ReadAll(r.Body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+			})
+
+			w := httptest.NewRecorder()
+			limitBody(tt.max, tt.exempt, h).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestLimitBodyChunked(t *testing.T) {
+	var chunked bool
+	srv := httptest.NewServer(limitBody(4, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunked = len(r.TransferEncoding) == 1 && r.TransferEncoding[0] == "chunked"
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})))
+	defer srv.Close()
+
+	// The client can't tell the length of a plain io.Reader, sending it
+	// chunked.
+	body := ioutil.NopCloser(strings.NewReader("0123456789"))
+
+	resp, err := http.Post(srv.URL+"/v1/upload", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !chunked {
+		t.Fatal("the body wasn't chunked")
+	}
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		max      time.Duration
+		headers  map[string]string
+		wantCode int
+		want     time.Duration
+	}{
+		{name: "unbounded", header: grpcTimeoutHeader, wantCode: http.StatusOK},
+		{name: "gRPC timeout", header: grpcTimeoutHeader, headers: map[string]string{grpcTimeoutHeader: "500m"}, wantCode: http.StatusOK, want: 500 * time.Millisecond},
+		{name: "clamped", header: grpcTimeoutHeader, max: time.Second, headers: map[string]string{grpcTimeoutHeader: "1H"}, wantCode: http.StatusOK, want: time.Second},
+		{name: "max without a timeout", max: time.Second, wantCode: http.StatusOK},
+		{
+			name:     "gateway's Grpc-Timeout bounded",
+			header:   "X-Timeout",
+			max:      time.Second,
+			headers:  map[string]string{grpcTimeoutHeader: "1H"},
+			wantCode: http.StatusOK,
+			want:     time.Second,
+		},
+		{name: "seconds", header: "X-Timeout", headers: map[string]string{"X-Timeout": "1.5"}, wantCode: http.StatusOK, want: 1500 * time.Millisecond},
+		{name: "duration", header: "X-Timeout", headers: map[string]string{"X-Timeout": "250ms"}, wantCode: http.StatusOK, want: 250 * time.Millisecond},
+		{name: "invalid", header: "X-Timeout", headers: map[string]string{"X-Timeout": "soon"}, wantCode: http.StatusBadRequest},
+		{name: "negative", header: "X-Timeout", headers: map[string]string{"X-Timeout": "-1s"}, wantCode: http.StatusBadRequest},
+		{name: "invalid gRPC timeout", header: grpcTimeoutHeader, headers: map[string]string{grpcTimeoutHeader: "5"}, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			var got time.Duration
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if deadline, ok := r.Context().Deadline(); ok {
+					got = time.Until(deadline)
+				}
+			})
+
+			w := httptest.NewRecorder()
+			withTimeout(tt.header, tt.max, h).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if got > tt.want || got < tt.want-time.Second/10 {
+				t.Errorf("deadline in %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "1H", want: time.Hour},
+		{in: "2M", want: 2 * time.Minute},
+		{in: "3S", want: 3 * time.Second},
+		{in: "500m", want: 500 * time.Millisecond},
+		{in: "10u", want: 10 * time.Microsecond},
+		{in: "99999999n", want: 99999999 * time.Nanosecond},
+		{in: "S", wantErr: true},
+		{in: "100000000n", wantErr: true},
+		{in: "10x", wantErr: true},
+		{in: "0S", wantErr: true},
+		{in: "-1S", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := decodeGRPCTimeout(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeGRPCTimeout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("decodeGRPCTimeout() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowCORS(t *testing.T) {
+	preflight := func(r *http.Request) ([]string, []string) {
+		return []string{"GET", "POST"}, []string{"Content-Type"}
+	}
+
+	tests := []struct {
+		name        string
+		policy      corsPolicy
+		method      string
+		origin      string
+		preflight   bool
+		wantCode    int
+		wantServed  bool
+		wantOrigin  string
+		wantCreds   string
+		wantHeaders string
+		wantMethods string
+		wantMaxAge  string
+	}{
+		{name: "same origin", method: http.MethodGet, wantCode: http.StatusOK, wantServed: true},
+		{name: "any origin", method: http.MethodGet, origin: "https://a.example", wantCode: http.StatusOK, wantServed: true, wantOrigin: "https://a.example"},
+		{
+			name:       "listed origin",
+			policy:     corsPolicy{origins: []string{"https://A.example"}},
+			method:     http.MethodGet,
+			origin:     "https://a.example",
+			wantCode:   http.StatusOK,
+			wantServed: true,
+			wantOrigin: "https://a.example",
+		},
+		{
+			name:       "unlisted origin",
+			policy:     corsPolicy{origins: []string{"https://a.example"}},
+			method:     http.MethodGet,
+			origin:     "https://b.example",
+			wantCode:   http.StatusOK,
+			wantServed: true,
+		},
+		{
+			name:      "unlisted origin preflight",
+			policy:    corsPolicy{origins: []string{"https://a.example"}},
+			method:    http.MethodOptions,
+			origin:    "https://b.example",
+			preflight: true,
+			wantCode:  http.StatusForbidden,
+		},
+		{
+			name:        "preflight",
+			policy:      corsPolicy{maxAge: 10 * time.Minute},
+			method:      http.MethodOptions,
+			origin:      "https://a.example",
+			preflight:   true,
+			wantCode:    http.StatusOK,
+			wantOrigin:  "https://a.example",
+			wantHeaders: "Content-Type",
+			wantMethods: "GET,POST",
+			wantMaxAge:  "600",
+		},
+		{
+			name:        "preflight with credentials",
+			policy:      corsPolicy{origins: []string{"https://a.example"}, credentials: true},
+			method:      http.MethodOptions,
+			origin:      "https://a.example",
+			preflight:   true,
+			wantCode:    http.StatusOK,
+			wantOrigin:  "https://a.example",
+			wantCreds:   "true",
+			wantHeaders: "Content-Type,Authorization",
+			wantMethods: "GET,POST",
+		},
+		{
+			name:        "credentials of any origin",
+			policy:      corsPolicy{credentials: true},
+			method:      http.MethodOptions,
+			origin:      "https://a.example",
+			preflight:   true,
+			wantCode:    http.StatusOK,
+			wantOrigin:  "https://a.example",
+			wantHeaders: "Content-Type",
+			wantMethods: "GET,POST",
+		},
+		{
+			name:       "credentials of a wildcard origin",
+			policy:     corsPolicy{origins: []string{"https://b.example", "*"}, credentials: true},
+			method:     http.MethodGet,
+			origin:     "https://a.example",
+			wantCode:   http.StatusOK,
+			wantServed: true,
+			wantOrigin: "https://a.example",
+		},
+		{
+			name:       "credentials of the null origin",
+			policy:     corsPolicy{credentials: true},
+			method:     http.MethodGet,
+			origin:     "null",
+			wantCode:   http.StatusOK,
+			wantServed: true,
+			wantOrigin: "null",
+		},
+		{
+			name:       "OPTIONS without preflight",
+			method:     http.MethodOptions,
+			origin:     "https://a.example",
+			wantCode:   http.StatusOK,
+			wantServed: true,
+			wantOrigin: "https://a.example",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/users", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", "POST")
+			}
+
+			served := false
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true })
+
+			w := httptest.NewRecorder()
+			allowCORS(zap.NewNop(), tt.policy, preflight, h).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if served != tt.wantServed {
+				t.Errorf("served = %t, want %t", served, tt.wantServed)
+			}
+
+			if got := w.Header().Get("Vary"); got != "Origin" {
+				t.Errorf("Vary = %q", got)
+			}
+
+			for header, want := range map[string]string{
+				"Access-Control-Allow-Origin":      tt.wantOrigin,
+				"Access-Control-Allow-Credentials": tt.wantCreds,
+				"Access-Control-Allow-Headers":     tt.wantHeaders,
+				"Access-Control-Allow-Methods":     tt.wantMethods,
+				"Access-Control-Max-Age":           tt.wantMaxAge,
+			} {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGatewayPreflight(t *testing.T) {
+	routes := newRouteTable(operationsServer(), nil, "", nil)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/v1/operations/a", want: "GET,DELETE"},
+		{path: "/nope", want: "GET,HEAD,POST,PUT,DELETE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			methods, headers := gatewayPreflight(routes)(httptest.NewRequest(http.MethodOptions, tt.path, nil))
+
+			if got := strings.Join(methods, ","); got != tt.want {
+				t.Errorf("methods = %s, want %s", got, tt.want)
+			}
+
+			if got := strings.Join(headers, ","); got != "Content-Type,Accept" {
+				t.Errorf("headers = %s", got)
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		fields []string
+		max    int
+		want   string
+	}{
+		{name: "empty", max: 10, want: ""},
+		{name: "as is", body: `{"a":1}`, max: 10, want: `{"a":1}`},
+		{name: "truncated", body: "0123456789", max: 4, want: "0123..."},
+		{name: "truncated with fields", body: `{"password":"0123456789"}`, fields: []string{"password"}, max: 4, want: "[TRUNCATED]"},
+		{name: "not JSON", body: "password=x", fields: []string{"password"}, max: 100, want: "[UNPARSEABLE]"},
+		{name: "field", body: `{"password":"x","user":"u"}`, fields: []string{"password"}, max: 100, want: `{"password":"[REDACTED]","user":"u"}`},
+		{
+			name:   "nested in arrays",
+			body:   `{"users":[{"card":{"number":"4111"}},{"name":"u"}]}`,
+			fields: []string{"users.card.number"},
+			max:    100,
+			want:   `{"users":[{"card":{"number":"[REDACTED]"}},{"name":"u"}]}`,
+		},
+		{name: "missing field", body: `{"a":1}`, fields: []string{"b.c"}, max: 100, want: `{"a":1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactBody([]byte(tt.body), tt.fields, tt.max); got != tt.want {
+				t.Errorf("redactBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogBodiesReplaysRequest(t *testing.T) {
+	var got string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = string(b)
+		_, _ = w.Write([]byte("response"))
+	})
+
+	core, logs := observer.New(zap.DebugLevel)
+	w := httptest.NewRecorder()
+
+	logBodies(zap.New(core), nil, 4, h).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader("0123456789")))
+
+	if got != "0123456789" {
+		t.Errorf("handler read %q", got)
+	}
+
+	if w.Body.String() != "response" {
+		t.Errorf("body = %q", w.Body)
+	}
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("%d entries logged, want 1", len(entries))
+	}
+
+	fields := entries[0].ContextMap()
+	if fields["request"] != "0123..." || fields["response"] != "resp..." {
+		t.Errorf("logged %v", fields)
+	}
+}
+
+func TestLogBodiesStreams(t *testing.T) {
+	tests := []struct {
+		name         string
+		contentType  string
+		read         int64
+		responseType string
+		wantRead     string
+		wantRequest  string
+		wantResponse string
+	}{
+		{name: "read as it's read", read: 2, wantRead: "01", wantRequest: "01", wantResponse: "resp..."},
+		{name: "unread", read: 0, wantRequest: "", wantResponse: "resp..."},
+		{
+			name:         "streamed request",
+			contentType:  "application/x-ndjson",
+			read:         -1,
+			wantRead:     "0123456789",
+			wantRequest:  streamedValue,
+			wantResponse: "resp...",
+		},
+		{
+			name:         "streamed response",
+			read:         -1,
+			responseType: "text/event-stream",
+			wantRead:     "0123456789",
+			wantRequest:  "0123...",
+			wantResponse: streamedValue,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := io.Reader(r.Body)
+				if tt.read >= 0 {
+					body = io.LimitReader(r.Body, tt.read)
+				}
+
+				b, _ := ioutil.ReadAll(body)
+				got = string(b)
+
+				if tt.responseType != "" {
+					w.Header().Set("Content-Type", tt.responseType)
+				}
+				_, _ = w.Write([]byte("response"))
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader("0123456789"))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			core, logs := observer.New(zap.DebugLevel)
+			logBodies(zap.New(core), nil, 4, h).ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.wantRead {
+				t.Errorf("handler read %q, want %q", got, tt.wantRead)
+			}
+
+			entries := logs.All()
+			if len(entries) != 1 {
+				t.Fatalf("%d entries logged, want 1", len(entries))
+			}
+
+			fields := entries[0].ContextMap()
+			if fields["request"] != tt.wantRequest || fields["response"] != tt.wantResponse {
+				t.Errorf("logged request %q and response %q, want %q and %q", fields["request"], fields["response"], tt.wantRequest, tt.wantResponse)
+			}
+		})
+	}
+}
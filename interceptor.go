@@ -0,0 +1,119 @@
+package drudge
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// Stage names a built-in interceptor of the gRPC server chain, which runs
+// them in the order below. Observability and recovery come first, so the
+// calls rejected by the rate limit or authentication are traced, logged and
+// counted too.
+type Stage string
+
+const (
+	StageTracing    Stage = "tracing"
+	StageTags       Stage = "tags"
+	StageLogging    Stage = "logging"
+	StageMetrics    Stage = "metrics"
+	StageRecovery   Stage = "recovery"
+	StageRateLimit  Stage = "ratelimit"
+	StageAuth       Stage = "auth"
+	StageValidation Stage = "validation"
+)
+
+var stages = []Stage{StageTracing, StageTags, StageLogging, StageMetrics, StageRecovery, StageRateLimit, StageAuth, StageValidation}
+
+// Interceptor places user interceptors in the gRPC server chain, right before
+// or after a built-in stage. Without a stage they run last. A disabled stage,
+// such as tracing, keeps its position in the chain.
+type Interceptor struct {
+	Before Stage
+	After  Stage
+
+	Unary  grpc.UnaryServerInterceptor
+	Stream grpc.StreamServerInterceptor
+}
+
+func (i Interceptor) validate() error {
+	if i.Before != "" && i.After != "" {
+		return errors.New("only one of Before and After can be set")
+	}
+
+	for _, s := range []Stage{i.Before, i.After} {
+		if s != "" && !knownStage(s) {
+			return errors.Errorf("unknown stage '%s'", s)
+		}
+	}
+
+	return nil
+}
+
+func knownStage(s Stage) bool {
+	for _, known := range stages {
+		if s == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// chain assembles the server interceptors from the built-in ones of each
+// stage and the user's.
+type chain struct {
+	unary  map[Stage][]grpc.UnaryServerInterceptor
+	stream map[Stage][]grpc.StreamServerInterceptor
+}
+
+func newChain() *chain {
+	return &chain{
+		unary:  map[Stage][]grpc.UnaryServerInterceptor{},
+		stream: map[Stage][]grpc.StreamServerInterceptor{},
+	}
+}
+
+// add appends the interceptors to the stage, either can be nil.
+func (c *chain) add(s Stage, unary grpc.UnaryServerInterceptor, stream grpc.StreamServerInterceptor) {
+	if unary != nil {
+		c.unary[s] = append(c.unary[s], unary)
+	}
+	if stream != nil {
+		c.stream[s] = append(c.stream[s], stream)
+	}
+}
+
+// build returns the chain in order, with the user interceptors around their
+// stage.
+func (c *chain) build(user []Interceptor) ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor) {
+	var (
+		unary  []grpc.UnaryServerInterceptor
+		stream []grpc.StreamServerInterceptor
+	)
+
+	place := func(match func(Interceptor) bool) {
+		for _, i := range user {
+			if !match(i) {
+				continue
+			}
+
+			if i.Unary != nil {
+				unary = append(unary, i.Unary)
+			}
+			if i.Stream != nil {
+				stream = append(stream, i.Stream)
+			}
+		}
+	}
+
+	for _, s := range stages {
+		place(func(i Interceptor) bool { return i.Before == s })
+		unary = append(unary, c.unary[s]...)
+		stream = append(stream, c.stream[s]...)
+		place(func(i Interceptor) bool { return i.After == s })
+	}
+
+	place(func(i Interceptor) bool { return i.Before == "" && i.After == "" })
+
+	return unary, stream
+}
@@ -0,0 +1,145 @@
+package drudge
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+)
+
+func TestInterceptorValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		i       Interceptor
+		wantErr bool
+	}{
+		{name: "last"},
+		{name: "before", i: Interceptor{Before: StageAuth}},
+		{name: "after", i: Interceptor{After: StageTracing}},
+		{name: "both", i: Interceptor{Before: StageAuth, After: StageTracing}, wantErr: true},
+		{name: "unknown before", i: Interceptor{Before: "auditing"}, wantErr: true},
+		{name: "unknown after", i: Interceptor{After: "auditing"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.i.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// recordUnary appends name to the calls when the interceptor runs.
+func recordUnary(calls *[]string, name string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		*calls = append(*calls, name)
+		return handler(ctx, req)
+	}
+}
+
+// recordStream appends name to the calls when the interceptor runs.
+func recordStream(calls *[]string, name string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		*calls = append(*calls, name)
+		return handler(srv, ss)
+	}
+}
+
+func TestChainBuild(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled []Stage
+		user     []Interceptor
+		want     string
+	}{
+		{
+			name: "built-in",
+			want: "tracing,tags,logging,metrics,recovery,ratelimit,auth,validation",
+		},
+		{
+			name: "before and after",
+			user: []Interceptor{
+				{Before: StageAuth},
+				{After: StageAuth},
+				{Before: StageTracing},
+			},
+			want: "user2,tracing,tags,logging,metrics,recovery,ratelimit,user0,auth,user1,validation",
+		},
+		{
+			name: "last in order",
+			user: []Interceptor{{}, {}},
+			want: "tracing,tags,logging,metrics,recovery,ratelimit,auth,validation,user0,user1",
+		},
+		{
+			name:     "disabled stage",
+			disabled: []Stage{StageTracing, StageRateLimit},
+			user:     []Interceptor{{After: StageTracing}, {Before: StageRateLimit}},
+			want:     "user0,tags,logging,metrics,recovery,user1,auth,validation",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var unaryCalls, streamCalls []string
+
+			c := newChain()
+		stages:
+			for _, s := range stages {
+				for _, d := range tt.disabled {
+					if s == d {
+						continue stages
+					}
+				}
+
+				c.add(s, recordUnary(&unaryCalls, string(s)), recordStream(&streamCalls, string(s)))
+			}
+
+			user := make([]Interceptor, len(tt.user))
+			for i, u := range tt.user {
+				name := "user" + strconv.Itoa(i)
+				u.Unary = recordUnary(&unaryCalls, name)
+				u.Stream = recordStream(&streamCalls, name)
+				user[i] = u
+			}
+
+			unary, stream := c.build(user)
+
+			_, err := grpc_middleware.ChainUnaryServer(unary...)(context.Background(), nil, &grpc.UnaryServerInfo{},
+				func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = grpc_middleware.ChainStreamServer(stream...)(nil, &contextStream{ctx: context.Background()}, &grpc.StreamServerInfo{},
+				func(srv interface{}, ss grpc.ServerStream) error { return nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Join(unaryCalls, ","); got != tt.want {
+				t.Errorf("unary chain = %s, want %s", got, tt.want)
+			}
+
+			if got := strings.Join(streamCalls, ","); got != tt.want {
+				t.Errorf("stream chain = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainAddNil(t *testing.T) {
+	var calls []string
+
+	c := newChain()
+	c.add(StageAuth, recordUnary(&calls, "auth"), nil)
+	c.add(StageMetrics, nil, recordStream(&calls, "metrics"))
+
+	unary, stream := c.build(nil)
+	if len(unary) != 1 || len(stream) != 1 {
+		t.Errorf("built %d unary and %d stream interceptors, want 1 and 1", len(unary), len(stream))
+	}
+}
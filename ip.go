@@ -0,0 +1,246 @@
+package drudge
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+type clientIPKey struct{}
+
+const (
+	// clientIPMetadata carries the client IP resolved by the gateway to the
+	// gRPC server.
+	clientIPMetadata = "drudge-client-ip"
+
+	// gatewayTokenMetadata proves that clientIPMetadata and routeMetadata
+	// were set by a gateway of the process rather than by the caller.
+	gatewayTokenMetadata = "drudge-gateway-token"
+)
+
+// gatewayToken is a secret shared by the gateways and gRPC servers of the
+// process. The forwarded client IPs are ignored when it couldn't be drawn.
+var gatewayToken = newGatewayToken()
+
+func newGatewayToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// parseCIDRs parses the CIDR blocks, a bare IP is treated as a single address
+// block.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP address '%s'", c)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid CIDR '%s'", c)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RealIP resolves the IP of the client behind the trusted proxies, given as
+// CIDR blocks, and stores it in the request's context, see ClientIP.
+func RealIP(trustedProxies []string, h http.Handler) (http.Handler, error) {
+	trusted, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid trusted proxies")
+	}
+
+	return realIP(trusted, h), nil
+}
+
+func realIP(trusted []*net.IPNet, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r, trusted); ip != nil {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ClientIP returns the IP of the client resolved by RealIP, falling back to
+// the peer address of gRPC calls. Calls proxied by the gateway return the IP
+// the gateway resolved.
+func ClientIP(ctx context.Context) net.IP {
+	if ip, ok := ctx.Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+
+	if ip := forwardedClientIP(ctx); ip != nil {
+		return ip
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// clientIPAnnotator forwards the client IP of the gateway's requests to the
+// gRPC server, with the token that has it trusted.
+func clientIPAnnotator(_ context.Context, r *http.Request) metadata.MD {
+	ip := ClientIP(r.Context())
+	if ip == nil || gatewayToken == "" {
+		return nil
+	}
+
+	return metadata.Pairs(clientIPMetadata, ip.String(), gatewayTokenMetadata, gatewayToken)
+}
+
+// forwardedClientIP returns the client IP forwarded by a gateway of the
+// process. The gateway's values come after the ones its clients may send as
+// Grpc-Metadata headers, and callers don't know the token.
+func forwardedClientIP(ctx context.Context) net.IP {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	ips := md.Get(clientIPMetadata)
+	if len(ips) == 0 || !fromGateway(md) {
+		return nil
+	}
+
+	return net.ParseIP(ips[len(ips)-1])
+}
+
+// fromGateway reports whether the call's metadata was forwarded by a gateway
+// of the process, holding its token last.
+func fromGateway(md metadata.MD) bool {
+	tokens := md.Get(gatewayTokenMetadata)
+	if gatewayToken == "" || len(tokens) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(tokens[len(tokens)-1]), []byte(gatewayToken)) == 1
+}
+
+// clientIP resolves the IP of the client. The Forwarded, or X-Forwarded-For,
+// header is only honored when the connection comes from a trusted proxy, and
+// is walked from the right until the first hop that isn't trusted, so
+// clients can't spoof it.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// forwardedHops lists the addresses of the Forwarded header's "for"
+// parameters, falling back to X-Forwarded-For.
+func forwardedHops(h http.Header) []string {
+	var hops []string
+	for _, v := range h["Forwarded"] {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+
+				// Quoted values may carry a port, IPv6 addresses are bracketed.
+				addr := strings.Trim(kv[1], `"`)
+				if host, _, err := net.SplitHostPort(addr); err == nil {
+					addr = host
+				}
+				hops = append(hops, strings.Trim(addr, "[]"))
+			}
+		}
+	}
+
+	if len(hops) > 0 {
+		return hops
+	}
+
+	for _, v := range h["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	return hops
+}
+
+// filterIPs responds with 403 Forbidden to clients in the denied blocks, or
+// outside the allowed blocks when any are given. It expects the client's IP
+// to be resolved by realIP.
+func filterIPs(allowed, denied []*net.IPNet, h http.Handler) http.Handler {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r.Context())
+		if ip == nil || containsIP(denied, ip) || (len(allowed) > 0 && !containsIP(allowed, ip)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,254 @@
+package drudge
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "none", want: []string{}},
+		{name: "blocks", cidrs: []string{"10.0.0.0/8", "fd00::/8"}, want: []string{"10.0.0.0/8", "fd00::/8"}},
+		{name: "bare IPv4", cidrs: []string{"192.0.2.1"}, want: []string{"192.0.2.1/32"}},
+		{name: "bare IPv6", cidrs: []string{"2001:db8::1"}, want: []string{"2001:db8::1/128"}},
+		{name: "invalid IP", cidrs: []string{"example.com"}, wantErr: true},
+		{name: "invalid block", cidrs: []string{"10.0.0.0/33"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseCIDRs(tt.cidrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCIDRs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			got := make([]string, 0, len(nets))
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCIDRs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "without port", remoteAddr: "192.0.2.1", want: "192.0.2.1"},
+		{name: "unparsable", remoteAddr: "pipe", want: "<nil>"},
+		{
+			name:       "untrusted peer ignores the header",
+			remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "spoofed hops before the first untrusted one",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.1, 10.0.0.2"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "several headers",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.9", "198.51.100.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "garbage hop",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1, unknown"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {`for=203.0.113.9;proto=https, for="198.51.100.1:4711"`}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "Forwarded IPv6",
+			remoteAddr: "[fd00::1]:1234",
+			header:     http.Header{"Forwarded": {`For="[2001:db8::7]:4711"`}},
+			want:       "2001:db8::7",
+		},
+		{
+			name:       "Forwarded over X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Forwarded":       {"for=198.51.100.1"},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+
+			if got := clientIP(r, trusted).String(); got != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	if _, err := RealIP([]string{"not an IP"}, http.NotFoundHandler()); err == nil {
+		t.Fatal("RealIP() with an invalid proxy succeeded")
+	}
+
+	var got net.IP
+	h, err := RealIP([]string{"10.0.0.0/8"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ClientIP(r.Context())
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got.String() != "198.51.100.1" {
+		t.Errorf("ClientIP() = %s, want 198.51.100.1", got)
+	}
+}
+
+func TestFilterIPs(t *testing.T) {
+	blocks := func(cidrs ...string) []*net.IPNet {
+		nets, err := parseCIDRs(cidrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nets
+	}
+
+	tests := []struct {
+		name    string
+		allowed []*net.IPNet
+		denied  []*net.IPNet
+		ip      string
+		want    int
+	}{
+		{name: "no filter", ip: "192.0.2.1", want: http.StatusOK},
+		{name: "no filter, unknown client", want: http.StatusOK},
+		{name: "allowed", allowed: blocks("192.0.2.0/24"), ip: "192.0.2.1", want: http.StatusOK},
+		{name: "not allowed", allowed: blocks("192.0.2.0/24"), ip: "198.51.100.1", want: http.StatusForbidden},
+		{name: "denied", denied: blocks("192.0.2.1"), ip: "192.0.2.1", want: http.StatusForbidden},
+		{name: "not denied", denied: blocks("192.0.2.1"), ip: "192.0.2.2", want: http.StatusOK},
+		{
+			name:    "denied within allowed",
+			allowed: blocks("192.0.2.0/24"),
+			denied:  blocks("192.0.2.1"),
+			ip:      "192.0.2.1",
+			want:    http.StatusForbidden,
+		},
+		{name: "unknown client", denied: blocks("192.0.2.1"), want: http.StatusForbidden},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ip != "" {
+				r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, net.ParseIP(tt.ip)))
+			}
+
+			w := httptest.NewRecorder()
+			filterIPs(tt.allowed, tt.denied, ok).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, net.ParseIP("198.51.100.1")))
+	annotated := clientIPAnnotator(context.Background(), r)
+
+	tests := []struct {
+		name string
+		md   metadata.MD
+		want string
+	}{
+		{name: "annotated by the gateway", md: annotated, want: "198.51.100.1"},
+		{name: "none", md: metadata.MD{}, want: "<nil>"},
+		{
+			name: "wrong token",
+			md:   metadata.Pairs(clientIPMetadata, "203.0.113.9", gatewayTokenMetadata, "guess"),
+			want: "<nil>",
+		},
+		{
+			name: "caller's values come first",
+			md: metadata.Join(
+				metadata.Pairs(clientIPMetadata, "203.0.113.9", gatewayTokenMetadata, "guess"),
+				annotated,
+			),
+			want: "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			if got := forwardedClientIP(ctx).String(); got != tt.want {
+				t.Errorf("forwardedClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if md := clientIPAnnotator(context.Background(), httptest.NewRequest(http.MethodGet, "/", nil)); md != nil {
+		t.Errorf("clientIPAnnotator() without a client IP = %v, want nil", md)
+	}
+}
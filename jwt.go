@@ -0,0 +1,368 @@
+package drudge
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// DefaultJWKSRefresh is how long the keys fetched from a JWKS URL are used
+// before being fetched again.
+const DefaultJWKSRefresh = 5 * time.Minute
+
+const (
+	// jwksMinRefresh limits how often an unknown key ID fetches the keys
+	// again.
+	jwksMinRefresh = 10 * time.Second
+
+	// jwksFetchTimeout bounds the fetches of the keys, which don't use the
+	// context of the calls waiting for them.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// JWTConfig configures the bearer tokens accepted by JWTAuth.
+type JWTConfig struct {
+	// Key verifies the token signatures: an *rsa.PublicKey, an
+	// *ecdsa.PublicKey or the []byte secret of HMAC. Only one of Key and
+	// JWKSURL can be set.
+	Key interface{}
+
+	// JWKSURL serves the JSON Web Key Set verifying the token signatures,
+	// picked by the key ID of the tokens.
+	JWKSURL string
+
+	// JWKSRefresh is how long the fetched keys are used, defaulting to
+	// DefaultJWKSRefresh.
+	JWKSRefresh time.Duration
+
+	// HTTPClient fetches JWKSURL, defaulting to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Issuer, when set, must be the iss claim of the tokens.
+	Issuer string
+
+	// Audience, when set, must be one of the aud claim of the tokens.
+	Audience string
+
+	// Leeway tolerates the clock skew with the issuer when checking the
+	// exp and nbf claims.
+	Leeway time.Duration
+}
+
+// Claims are the claims of a verified token, see ClaimsFromContext.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ID        string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+
+	// Raw holds every claim of the token, the custom ones included.
+	Raw map[string]interface{}
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims of the token authenticating the call,
+// stored by the AuthFunc of JWTAuth.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(*Claims)
+	return c, ok
+}
+
+// JWTAuth returns the AuthFunc verifying the bearer token of the calls, sent
+// in their authorization metadata or header through the gateway. Calls
+// without a valid token fail with Unauthenticated; the claims of the others
+// are available to handlers with ClaimsFromContext.
+func JWTAuth(c JWTConfig) (grpc_auth.AuthFunc, error) {
+	v, err := newJWTVerifier(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context) (context.Context, error) {
+		token, err := grpc_auth.AuthFromMD(ctx, "bearer")
+		if err != nil {
+			return nil, err
+		}
+
+		claims, err := v.verify(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+
+		return context.WithValue(ctx, claimsKey{}, claims), nil
+	}, nil
+}
+
+type jwtVerifier struct {
+	config JWTConfig
+	keys   *keySet
+}
+
+func newJWTVerifier(c JWTConfig) (*jwtVerifier, error) {
+	switch {
+	case c.Key == nil && c.JWKSURL == "":
+		return nil, errors.New("one of Key and JWKSURL must be set")
+	case c.Key != nil && c.JWKSURL != "":
+		return nil, errors.New("only one of Key and JWKSURL can be set")
+	}
+
+	v := &jwtVerifier{config: c}
+	if c.Key != nil {
+		switch k := c.Key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		case []byte:
+			if len(k) == 0 {
+				return nil, errors.New("empty HMAC key")
+			}
+		default:
+			return nil, errors.Errorf("unsupported key type %T", c.Key)
+		}
+
+		return v, nil
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	refresh := c.JWKSRefresh
+	if refresh <= 0 {
+		refresh = DefaultJWKSRefresh
+	}
+
+	v.keys = &keySet{url: c.JWKSURL, client: client, refresh: refresh}
+
+	return v, nil
+}
+
+func unauthenticated(format string, args ...interface{}) error {
+	return status.Errorf(codes.Unauthenticated, "invalid token: "+format, args...)
+}
+
+// verify checks the signature of the compact serialized token, then its
+// claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (*Claims, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil || len(tok.Headers) != 1 {
+		return nil, unauthenticated("malformed")
+	}
+
+	header := tok.Headers[0]
+
+	key := v.config.Key
+	if v.keys != nil {
+		if key, err = v.keys.lookup(ctx, header.KeyID, header.Algorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		reg jwt.Claims
+		raw map[string]interface{}
+	)
+	switch err := tok.Claims(key, &reg, &raw); err {
+	case nil:
+	case jose.ErrCryptoFailure:
+		return nil, unauthenticated("invalid signature")
+	default:
+		return nil, unauthenticated("%s", err)
+	}
+
+	expected := jwt.Expected{Issuer: v.config.Issuer, Time: time.Now()}
+	if v.config.Audience != "" {
+		expected.Audience = jwt.Audience{v.config.Audience}
+	}
+
+	switch err := reg.ValidateWithLeeway(expected, v.config.Leeway); err {
+	case nil:
+	case jwt.ErrExpired:
+		return nil, unauthenticated("expired")
+	case jwt.ErrNotValidYet, jwt.ErrIssuedInTheFuture:
+		return nil, unauthenticated("not valid yet")
+	case jwt.ErrInvalidIssuer:
+		return nil, unauthenticated("wrong issuer")
+	case jwt.ErrInvalidAudience:
+		return nil, unauthenticated("wrong audience")
+	default:
+		return nil, unauthenticated("%s", err)
+	}
+
+	return &Claims{
+		Issuer:    reg.Issuer,
+		Subject:   reg.Subject,
+		Audience:  []string(reg.Audience),
+		ID:        reg.ID,
+		ExpiresAt: numericDate(reg.Expiry),
+		NotBefore: numericDate(reg.NotBefore),
+		IssuedAt:  numericDate(reg.IssuedAt),
+		Raw:       raw,
+	}, nil
+}
+
+func numericDate(d *jwt.NumericDate) time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+
+	return d.Time()
+}
+
+// keySet caches the keys served by a JWKS URL by key ID. The keys are
+// fetched by a single goroutine at a time, outside of the lock: stale keys
+// are refreshed in the background while still being used, and calls only
+// wait for the first fetch or for a fetch looking for an unknown key ID.
+type keySet struct {
+	url     string
+	client  *http.Client
+	refresh time.Duration
+
+	group singleflight.Group
+
+	mu      sync.RWMutex
+	keys    map[string]jose.JSONWebKey
+	fetched time.Time
+	tried   time.Time
+}
+
+// lookup returns the key of ID kid for alg. Tokens without a key ID need the
+// set to hold a single key.
+func (s *keySet) lookup(ctx context.Context, kid, alg string) (interface{}, error) {
+	keys, fetched, tried := s.snapshot()
+
+	switch {
+	case keys == nil:
+		if err := s.wait(ctx); err != nil {
+			return nil, err
+		}
+	case time.Since(fetched) >= s.refresh && time.Since(tried) >= jwksMinRefresh:
+		// The stale keys are still used meanwhile.
+		s.group.DoChan(s.url, s.fetch)
+	}
+
+	k, ok := s.find(kid)
+	if !ok && time.Since(tried) >= jwksMinRefresh {
+		if err := s.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		k, ok = s.find(kid)
+	}
+
+	if !ok {
+		return nil, unauthenticated("unknown key '%s'", kid)
+	}
+
+	if k.Algorithm != "" && k.Algorithm != alg {
+		return nil, unauthenticated("algorithm '%s' doesn't match the key", alg)
+	}
+
+	return k.Key, nil
+}
+
+func (s *keySet) snapshot() (map[string]jose.JSONWebKey, time.Time, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.keys, s.fetched, s.tried
+}
+
+// find returns the key of ID kid, or the only key for an empty kid.
+func (s *keySet) find(kid string) (jose.JSONWebKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.keys[kid]
+	if !ok && kid == "" && len(s.keys) == 1 {
+		for _, k = range s.keys {
+			ok = true
+		}
+	}
+
+	return k, ok
+}
+
+// wait fetches the keys, or joins the fetch in flight, until ctx is done. It
+// only fails when no keys were ever fetched, the ones fetched last are still
+// good for a while.
+func (s *keySet) wait(ctx context.Context) error {
+	var err error
+	select {
+	case r := <-s.group.DoChan(s.url, s.fetch):
+		err = r.Err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if keys, _, _ := s.snapshot(); err != nil && keys == nil {
+		return status.Errorf(codes.Unavailable, "fetching the signing keys: %s", err)
+	}
+
+	return nil
+}
+
+func (s *keySet) fetch() (interface{}, error) {
+	s.mu.Lock()
+	s.tried = time.Now()
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status '%s'", resp.Status)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "decoding the key set")
+	}
+
+	keys := make(map[string]jose.JSONWebKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		// Keys of unsupported types are skipped, not failing the set.
+		var k jose.JSONWebKey
+		if err := k.UnmarshalJSON(raw); err != nil || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		if pub := k.Public(); pub.Valid() {
+			keys[k.KeyID] = pub
+		}
+	}
+
+	s.mu.Lock()
+	s.keys, s.fetched = keys, time.Now()
+	s.mu.Unlock()
+
+	return nil, nil
+}
@@ -0,0 +1,630 @@
+package drudge
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	testRSAKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	testECDSAKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testHMACKey     = []byte("0123456789abcdef0123456789abcdef")
+)
+
+// signToken signs the claims with the key and algorithm, setting kid when
+// it isn't empty.
+func signToken(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, kid string, claims ...interface{}) string {
+	t.Helper()
+
+	opts := &jose.SignerOptions{}
+	if kid != "" {
+		opts = opts.WithHeader("kid", kid)
+	}
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := jwt.Signed(sig)
+	for _, c := range claims {
+		b = b.Claims(c)
+	}
+
+	token, err := b.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func at(d time.Duration) *jwt.NumericDate {
+	return jwt.NewNumericDate(time.Now().Add(d))
+}
+
+func TestNewJWTVerifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  JWTConfig
+		wantErr bool
+	}{
+		{name: "none", config: JWTConfig{}, wantErr: true},
+		{name: "both", config: JWTConfig{Key: testHMACKey, JWKSURL: "http://keys"}, wantErr: true},
+		{name: "hmac", config: JWTConfig{Key: testHMACKey}},
+		{name: "empty hmac", config: JWTConfig{Key: []byte{}}, wantErr: true},
+		{name: "rsa", config: JWTConfig{Key: &testRSAKey.PublicKey}},
+		{name: "ecdsa", config: JWTConfig{Key: &testECDSAKey.PublicKey}},
+		{name: "rsa private", config: JWTConfig{Key: testRSAKey}, wantErr: true},
+		{name: "string", config: JWTConfig{Key: "secret"}, wantErr: true},
+		{name: "jwks", config: JWTConfig{JWKSURL: "http://keys"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newJWTVerifier(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newJWTVerifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	valid := jwt.Claims{
+		Issuer:   "issuer",
+		Subject:  "subject",
+		Audience: jwt.Audience{"other", "audience"},
+		Expiry:   at(time.Hour),
+	}
+
+	with := func(f func(c *jwt.Claims)) jwt.Claims {
+		c := valid
+		f(&c)
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		config   JWTConfig
+		token    func(t *testing.T) string
+		wantCode codes.Code
+	}{
+		{
+			name:   "hmac",
+			config: JWTConfig{Key: testHMACKey},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", valid)
+			},
+		},
+		{
+			name:   "rsa",
+			config: JWTConfig{Key: &testRSAKey.PublicKey},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.RS256, testRSAKey, "", valid)
+			},
+		},
+		{
+			name:   "rsa pss",
+			config: JWTConfig{Key: &testRSAKey.PublicKey},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.PS384, testRSAKey, "", valid)
+			},
+		},
+		{
+			name:   "ecdsa",
+			config: JWTConfig{Key: &testECDSAKey.PublicKey},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.ES256, testECDSAKey, "", valid)
+			},
+		},
+		{
+			name:   "wrong secret",
+			config: JWTConfig{Key: []byte("another secret of 32 bytes long!")},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", valid)
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:   "algorithm of another key type",
+			config: JWTConfig{Key: &testRSAKey.PublicKey},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", valid)
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "malformed",
+			config:   JWTConfig{Key: testHMACKey},
+			token:    func(t *testing.T) string { return "not.a.token" },
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:   "tampered",
+			config: JWTConfig{Key: testHMACKey},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", valid) + "x"
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:   "expired",
+			config: JWTConfig{Key: testHMACKey},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", with(func(c *jwt.Claims) {
+					c.Expiry = at(-time.Minute)
+				}))
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:   "expired within leeway",
+			config: JWTConfig{Key: testHMACKey, Leeway: 2 * time.Minute},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", with(func(c *jwt.Claims) {
+					c.Expiry = at(-time.Minute)
+				}))
+			},
+		},
+		{
+			name:   "not valid yet",
+			config: JWTConfig{Key: testHMACKey},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", with(func(c *jwt.Claims) {
+					c.NotBefore = at(time.Minute)
+				}))
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:   "issuer",
+			config: JWTConfig{Key: testHMACKey, Issuer: "issuer"},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", valid)
+			},
+		},
+		{
+			name:   "wrong issuer",
+			config: JWTConfig{Key: testHMACKey, Issuer: "someone else"},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", valid)
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:   "one of the audiences",
+			config: JWTConfig{Key: testHMACKey, Audience: "audience"},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", valid)
+			},
+		},
+		{
+			name:   "single audience",
+			config: JWTConfig{Key: testHMACKey, Audience: "audience"},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", map[string]interface{}{"aud": "audience"})
+			},
+		},
+		{
+			name:   "wrong audience",
+			config: JWTConfig{Key: testHMACKey, Audience: "someone else"},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.HS256, testHMACKey, "", valid)
+			},
+			wantCode: codes.Unauthenticated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newJWTVerifier(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = v.verify(context.Background(), tt.token(t))
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("verify() code = %s, want %s: %v", got, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	auth, err := JWTAuth(JWTConfig{Key: testHMACKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := signToken(t, jose.HS256, testHMACKey, "", jwt.Claims{
+		Subject:  "subject",
+		Expiry:   at(time.Hour),
+		IssuedAt: at(-time.Minute),
+	}, map[string]interface{}{"tenant": "acme"})
+
+	tests := []struct {
+		name        string
+		md          metadata.MD
+		wantCode    codes.Code
+		wantSubject string
+	}{
+		{name: "bearer", md: metadata.Pairs("authorization", "Bearer "+token), wantSubject: "subject"},
+		{name: "missing", md: metadata.MD{}, wantCode: codes.Unauthenticated},
+		{name: "basic", md: metadata.Pairs("authorization", "Basic dXNlcjpwYXNz"), wantCode: codes.Unauthenticated},
+		{name: "invalid", md: metadata.Pairs("authorization", "Bearer invalid"), wantCode: codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := auth(metadata.NewIncomingContext(context.Background(), tt.md))
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("auth() code = %s, want %s: %v", got, tt.wantCode, err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			claims, ok := ClaimsFromContext(ctx)
+			if !ok {
+				t.Fatal("ClaimsFromContext() found no claims")
+			}
+
+			if claims.Subject != tt.wantSubject {
+				t.Errorf("Subject = %q, want %q", claims.Subject, tt.wantSubject)
+			}
+
+			if claims.Raw["tenant"] != "acme" {
+				t.Errorf("Raw[tenant] = %v, want acme", claims.Raw["tenant"])
+			}
+
+			if claims.ExpiresAt.IsZero() || claims.IssuedAt.IsZero() || !claims.NotBefore.IsZero() {
+				t.Errorf("dates = %v, %v, %v", claims.ExpiresAt, claims.IssuedAt, claims.NotBefore)
+			}
+		})
+	}
+}
+
+// jwksServer serves the keys, counting the fetches.
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []jose.JSONWebKey
+	status  int
+	fetches int32
+	block   chan struct{}
+}
+
+func newJWKSServer(keys ...jose.JSONWebKey) *jwksServer {
+	s := &jwksServer{keys: keys, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.fetches, 1)
+
+		s.mu.Lock()
+		keys, code, block := s.keys, s.status, s.block
+		s.mu.Unlock()
+
+		if block != nil {
+			<-block
+		}
+
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: keys})
+	}))
+
+	return s
+}
+
+func (s *jwksServer) set(code int, keys ...jose.JSONWebKey) {
+	s.mu.Lock()
+	s.status, s.keys = code, keys
+	s.mu.Unlock()
+}
+
+func TestJWKSVerify(t *testing.T) {
+	rsaJWK := jose.JSONWebKey{Key: &testRSAKey.PublicKey, KeyID: "rsa", Algorithm: "RS256", Use: "sig"}
+	ecJWK := jose.JSONWebKey{Key: &testECDSAKey.PublicKey, KeyID: "ec"}
+	encJWK := jose.JSONWebKey{Key: &testECDSAKey.PublicKey, KeyID: "enc", Use: "enc"}
+	claims := jwt.Claims{Expiry: at(time.Hour)}
+
+	tests := []struct {
+		name     string
+		keys     []jose.JSONWebKey
+		token    func(t *testing.T) string
+		wantCode codes.Code
+	}{
+		{
+			name: "by key ID",
+			keys: []jose.JSONWebKey{rsaJWK, ecJWK},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.ES256, testECDSAKey, "ec", claims)
+			},
+		},
+		{
+			name: "without key ID, single key",
+			keys: []jose.JSONWebKey{rsaJWK},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.RS256, testRSAKey, "", claims)
+			},
+		},
+		{
+			name: "without key ID, several keys",
+			keys: []jose.JSONWebKey{rsaJWK, ecJWK},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.RS256, testRSAKey, "", claims)
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name: "unknown key ID",
+			keys: []jose.JSONWebKey{rsaJWK},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.RS256, testRSAKey, "other", claims)
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name: "algorithm of the key",
+			keys: []jose.JSONWebKey{rsaJWK},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.RS512, testRSAKey, "rsa", claims)
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name: "encryption key",
+			keys: []jose.JSONWebKey{encJWK},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.ES256, testECDSAKey, "enc", claims)
+			},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name: "private key served",
+			keys: []jose.JSONWebKey{{Key: testRSAKey, KeyID: "private"}},
+			token: func(t *testing.T) string {
+				return signToken(t, jose.RS256, testRSAKey, "private", claims)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newJWKSServer(tt.keys...)
+			defer srv.Close()
+
+			v, err := newJWTVerifier(JWTConfig{JWKSURL: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = v.verify(context.Background(), tt.token(t))
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("verify() code = %s, want %s: %v", got, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestJWKSUnsupportedKeys(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rsa, _ := json.Marshal(jose.JSONWebKey{Key: &testRSAKey.PublicKey, KeyID: "rsa"})
+		_, _ = w.Write([]byte(`{"keys": [{"kty": "unknown", "kid": "x"}, ` + string(rsa) + `]}`))
+	}))
+	defer srv.Close()
+
+	v, err := newJWTVerifier(JWTConfig{JWKSURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := signToken(t, jose.RS256, testRSAKey, "rsa", jwt.Claims{Expiry: at(time.Hour)})
+	if _, err := v.verify(context.Background(), token); err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+}
+
+func TestJWKSFetchFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		fetched  bool
+		wantCode codes.Code
+	}{
+		{name: "never fetched", status: http.StatusInternalServerError, wantCode: codes.Unavailable},
+		{name: "stale keys kept", status: http.StatusInternalServerError, fetched: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newJWKSServer(jose.JSONWebKey{Key: &testRSAKey.PublicKey, KeyID: "rsa"})
+			defer srv.Close()
+
+			v, err := newJWTVerifier(JWTConfig{JWKSURL: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token := signToken(t, jose.RS256, testRSAKey, "rsa", jwt.Claims{Expiry: at(time.Hour)})
+			if tt.fetched {
+				if _, err := v.verify(context.Background(), token); err != nil {
+					t.Fatal(err)
+				}
+
+				// Stale and allowed to fetch again.
+				v.keys.mu.Lock()
+				v.keys.fetched = time.Now().Add(-2 * DefaultJWKSRefresh)
+				v.keys.tried = time.Now().Add(-2 * jwksMinRefresh)
+				v.keys.mu.Unlock()
+			}
+
+			srv.set(tt.status)
+
+			_, err = v.verify(context.Background(), token)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("verify() code = %s, want %s: %v", got, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	srv := newJWKSServer(jose.JSONWebKey{Key: &testRSAKey.PublicKey, KeyID: "old"})
+	defer srv.Close()
+
+	v, err := newJWTVerifier(JWTConfig{JWKSURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := jwt.Claims{Expiry: at(time.Hour)}
+	old := signToken(t, jose.RS256, testRSAKey, "old", claims)
+	rotated := signToken(t, jose.ES256, testECDSAKey, "new", claims)
+
+	if _, err := v.verify(context.Background(), old); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.set(http.StatusOK, jose.JSONWebKey{Key: &testECDSAKey.PublicKey, KeyID: "new"})
+
+	// An unknown key ID right after a fetch doesn't fetch again.
+	if _, err := v.verify(context.Background(), rotated); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("verify() error = %v, want Unauthenticated", err)
+	}
+
+	if n := atomic.LoadInt32(&srv.fetches); n != 1 {
+		t.Fatalf("fetches = %d, want 1", n)
+	}
+
+	v.keys.mu.Lock()
+	v.keys.tried = time.Now().Add(-2 * jwksMinRefresh)
+	v.keys.mu.Unlock()
+
+	if _, err := v.verify(context.Background(), rotated); err != nil {
+		t.Fatalf("verify() after rotation error = %v", err)
+	}
+
+	if n := atomic.LoadInt32(&srv.fetches); n != 2 {
+		t.Fatalf("fetches = %d, want 2", n)
+	}
+}
+
+func TestJWKSBackgroundRefresh(t *testing.T) {
+	srv := newJWKSServer(jose.JSONWebKey{Key: &testRSAKey.PublicKey, KeyID: "rsa"})
+	defer srv.Close()
+
+	v, err := newJWTVerifier(JWTConfig{JWKSURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := signToken(t, jose.RS256, testRSAKey, "rsa", jwt.Claims{Expiry: at(time.Hour)})
+	if _, err := v.verify(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	block := make(chan struct{})
+	srv.mu.Lock()
+	srv.block = block
+	srv.mu.Unlock()
+
+	v.keys.mu.Lock()
+	v.keys.fetched = time.Now().Add(-2 * DefaultJWKSRefresh)
+	v.keys.tried = time.Now().Add(-2 * jwksMinRefresh)
+	v.keys.mu.Unlock()
+
+	// The stale keys verify the tokens while the refresh hangs.
+	for i := 0; i < 3; i++ {
+		if _, err := v.verify(context.Background(), token); err != nil {
+			t.Fatalf("verify() during refresh error = %v", err)
+		}
+	}
+
+	close(block)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, fetched, _ := v.keys.snapshot()
+		if time.Since(fetched) < DefaultJWKSRefresh {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the keys weren't refreshed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&srv.fetches); n != 2 {
+		t.Fatalf("fetches = %d, want 2", n)
+	}
+}
+
+func TestJWKSSharedFetch(t *testing.T) {
+	srv := newJWKSServer(jose.JSONWebKey{Key: &testRSAKey.PublicKey, KeyID: "rsa"})
+	defer srv.Close()
+
+	block := make(chan struct{})
+	srv.block = block
+
+	v, err := newJWTVerifier(JWTConfig{JWKSURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := signToken(t, jose.RS256, testRSAKey, "rsa", jwt.Claims{Expiry: at(time.Hour)})
+
+	// A caller giving up doesn't cancel the fetch the others wait for.
+	canceled, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 4)
+	go func() {
+		_, err := v.verify(canceled, token)
+		errc <- err
+	}()
+
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := v.verify(context.Background(), token)
+			errc <- err
+		}()
+	}
+
+	cancel()
+	if err := <-errc; status.Code(err) != codes.Unavailable {
+		t.Fatalf("verify() of the canceled call error = %v, want Unavailable", err)
+	}
+
+	close(block)
+	for i := 0; i < 3; i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("verify() error = %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&srv.fetches); n != 1 {
+		t.Fatalf("fetches = %d, want 1", n)
+	}
+}
@@ -1,15 +1,22 @@
 package drudge
 
 import (
+	"context"
+	"net/http"
 	"os"
 	"time"
 
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
 
+type loggerKey struct{}
+
 // codeToLevel redirects OK to DEBUG level logging instead of INFO
 // This is example how you can log several gRPC code results
 func codeToLevel(code codes.Code) zapcore.Level {
@@ -67,3 +74,97 @@ func initLogger(lvl int, timeFormat string) *zap.Logger {
 
 	return lg
 }
+
+// loggedSpan returns the span context of ctx to add to log lines. Unsampled
+// spans never reach a backend, so they're left out unless unsampled is set.
+func loggedSpan(ctx context.Context, unsampled bool) (trace.SpanContext, bool) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return trace.SpanContext{}, false
+	}
+
+	sc := span.SpanContext()
+
+	return sc, sc.IsSampled() || unsampled
+}
+
+// traceFields returns the IDs of the span in ctx as log fields, joining the
+// log line to its trace.
+func traceFields(ctx context.Context, unsampled bool) []zap.Field {
+	sc, ok := loggedSpan(ctx, unsampled)
+	if !ok {
+		return nil
+	}
+
+	return []zap.Field{
+		zap.String("trace_id", sc.TraceID.String()),
+		zap.String("span_id", sc.SpanID.String()),
+		zap.Bool("trace_sampled", sc.IsSampled()),
+	}
+}
+
+// withTraceLogger makes a logger carrying the request's trace IDs available
+// to the handlers through requestLogger.
+func withTraceLogger(lg *zap.Logger, unsampled bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := traceFields(r.Context(), unsampled)
+		if route := RouteFromContext(r.Context()); route != "" {
+			fields = append(fields, zap.String("route", route))
+		}
+
+		if len(fields) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, lg.With(fields...)))
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestLogger returns the logger of the request set by withTraceLogger,
+// falling back to lg.
+func requestLogger(ctx context.Context, lg *zap.Logger) *zap.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return l
+	}
+
+	return lg
+}
+
+// traceTagsUnary adds the trace IDs to the call's tags, which grpc_zap adds
+// to every log line of the call.
+func traceTagsUnary(unsampled bool) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		setTraceTags(ctx, unsampled)
+		return handler(ctx, req)
+	}
+}
+
+// traceTagsStream is the stream counterpart of traceTagsUnary.
+func traceTagsStream(unsampled bool) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		setTraceTags(ss.Context(), unsampled)
+		return handler(srv, ss)
+	}
+}
+
+func setTraceTags(ctx context.Context, unsampled bool) {
+	sc, ok := loggedSpan(ctx, unsampled)
+	if !ok {
+		return
+	}
+
+	grpc_ctxtags.Extract(ctx).
+		Set("trace_id", sc.TraceID.String()).
+		Set("span_id", sc.SpanID.String()).
+		Set("trace_sampled", sc.IsSampled())
+}
@@ -0,0 +1,196 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestCodeToLevel(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want zapcore.Level
+	}{
+		{code: codes.OK, want: zap.DebugLevel},
+		{code: codes.NotFound, want: zap.InfoLevel},
+		{code: codes.DeadlineExceeded, want: zap.WarnLevel},
+		{code: codes.Internal, want: zap.ErrorLevel},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code.String(), func(t *testing.T) {
+			if got := codeToLevel(tt.code); got != tt.want {
+				t.Errorf("codeToLevel() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// spanContext returns a context holding a span, sampled or not.
+func spanContext(sampled bool) (context.Context, *trace.Span) {
+	sampler := trace.NeverSample()
+	if sampled {
+		sampler = trace.AlwaysSample()
+	}
+
+	return trace.StartSpan(context.Background(), "test", trace.WithSampler(sampler))
+}
+
+func TestTraceFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		span      bool
+		sampled   bool
+		unsampled bool
+		wantCount int
+	}{
+		{name: "no span"},
+		{name: "sampled", span: true, sampled: true, wantCount: 3},
+		{name: "unsampled", span: true},
+		{name: "unsampled logged", span: true, unsampled: true, wantCount: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.span {
+				var span *trace.Span
+				ctx, span = spanContext(tt.sampled)
+				defer span.End()
+			}
+
+			fields := traceFields(ctx, tt.unsampled)
+			if len(fields) != tt.wantCount {
+				t.Fatalf("traceFields() = %v", fields)
+			}
+
+			if len(fields) == 0 {
+				return
+			}
+
+			sc := trace.FromContext(ctx).SpanContext()
+			enc := zapcore.NewMapObjectEncoder()
+			for _, f := range fields {
+				f.AddTo(enc)
+			}
+
+			if enc.Fields["trace_id"] != sc.TraceID.String() || enc.Fields["span_id"] != sc.SpanID.String() || enc.Fields["trace_sampled"] != tt.sampled {
+				t.Errorf("fields = %v", enc.Fields)
+			}
+		})
+	}
+}
+
+func TestWithTraceLogger(t *testing.T) {
+	tests := []struct {
+		name       string
+		span       bool
+		route      string
+		wantFields []string
+	}{
+		{name: "plain"},
+		{name: "trace", span: true, wantFields: []string{"trace_id", "span_id", "trace_sampled"}},
+		{name: "route", route: "/v1/users/{id}", wantFields: []string{"route"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			lg := zap.New(core)
+
+			ctx := context.Background()
+			if tt.span {
+				var span *trace.Span
+				ctx, span = spanContext(true)
+				defer span.End()
+			}
+			if tt.route != "" {
+				ctx = context.WithValue(ctx, routeKey{}, tt.route)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/1", nil).WithContext(ctx)
+			withTraceLogger(lg, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestLogger(r.Context(), lg).Info("handled")
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			entries := logs.All()
+			if len(entries) != 1 {
+				t.Fatalf("%d log lines", len(entries))
+			}
+
+			fields := entries[0].ContextMap()
+			if len(fields) != len(tt.wantFields) {
+				t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+			}
+
+			for _, k := range tt.wantFields {
+				if _, ok := fields[k]; !ok {
+					t.Errorf("missing field %q in %v", k, fields)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		span     bool
+		sampled  bool
+		wantTags bool
+	}{
+		{name: "no span"},
+		{name: "sampled", span: true, sampled: true, wantTags: true},
+		{name: "unsampled", span: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.span {
+				var span *trace.Span
+				ctx, span = spanContext(tt.sampled)
+				defer span.End()
+			}
+
+			var unaryTagged bool
+			_, err := grpc_ctxtags.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return traceTagsUnary(false)(ctx, req, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+					unaryTagged = grpc_ctxtags.Extract(ctx).Has("trace_id")
+					return nil, nil
+				})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if unaryTagged != tt.wantTags {
+				t.Errorf("unary tagged = %t, want %t", unaryTagged, tt.wantTags)
+			}
+
+			var streamTagged bool
+			err = grpc_ctxtags.StreamServerInterceptor()(nil, &contextStream{ctx: ctx}, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+				return traceTagsStream(false)(srv, ss, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+					streamTagged = grpc_ctxtags.Extract(ss.Context()).Has("trace_id")
+					return nil
+				})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if streamTagged != tt.wantTags {
+				t.Errorf("stream tagged = %t, want %t", streamTagged, tt.wantTags)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package drudge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	goproto "github.com/golang/protobuf/proto"
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+)
+
+// int64Marshaler is the gateway's JSON marshaler writing 64-bit integers as
+// JSON numbers instead of the strings of the proto3 JSON mapping. Numbers past
+// 2^53 lose precision in JavaScript. Fields of messages packed in an Any are
+// left as strings.
+type int64Marshaler struct {
+	gwruntime.JSONPb
+}
+
+// newInt64Marshaler returns the marshaler configured like the gateway's
+// default one.
+func newInt64Marshaler() *int64Marshaler {
+	return &int64Marshaler{JSONPb: gwruntime.JSONPb{OrigName: true}}
+}
+
+func (m *int64Marshaler) Marshal(v interface{}) ([]byte, error) {
+	b, err := m.JSONPb.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := int64Numbers(&buf, b, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (m *int64Marshaler) NewEncoder(w io.Writer) gwruntime.Encoder {
+	return gwruntime.EncoderFunc(func(v interface{}) error {
+		b, err := m.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(append(b, m.Delimiter()...))
+		return err
+	})
+}
+
+// wellKnownType is implemented by the messages of the well-known types, whose
+// JSON mapping isn't an object of their fields.
+type wellKnownType interface {
+	XXX_WellKnownType() string
+}
+
+// int64Numbers writes the JSON raw encoding v, unquoting the 64-bit integers.
+// v guides the rewrite, values it doesn't describe are written unchanged.
+func int64Numbers(buf *bytes.Buffer, raw []byte, v reflect.Value) error {
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) {
+		if v.IsNil() {
+			buf.Write(raw)
+			return nil
+		}
+
+		if wkt, ok := v.Interface().(wellKnownType); ok {
+			switch wkt.XXX_WellKnownType() {
+			case "Int64Value", "UInt64Value":
+				writeNumber(buf, raw)
+			default:
+				buf.Write(raw)
+			}
+
+			return nil
+		}
+
+		if _, ok := v.Interface().(goproto.Message); ok && v.Elem().Kind() == reflect.Struct {
+			return rewriteObject(buf, raw, messageFields(v.Elem()))
+		}
+
+		v = v.Elem()
+	}
+
+	if !v.IsValid() {
+		buf.Write(raw)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int64, reflect.Uint64:
+		writeNumber(buf, raw)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.Write(raw)
+			return nil
+		}
+
+		return rewriteArray(buf, raw, v)
+	case reflect.Map:
+		fields := make(map[string]reflect.Value, v.Len())
+		for _, k := range v.MapKeys() {
+			fields[fmt.Sprint(k.Interface())] = v.MapIndex(k)
+		}
+
+		return rewriteObject(buf, raw, fields)
+	default:
+		buf.Write(raw)
+	}
+
+	return nil
+}
+
+// messageFields indexes the fields of a generated message by their JSON
+// names, both original and camel cased. Set oneof fields are included.
+func messageFields(v reflect.Value) map[string]reflect.Value {
+	fields := map[string]reflect.Value{}
+
+	add := func(f reflect.StructField, fv reflect.Value) {
+		tag := f.Tag.Get("protobuf")
+		if tag == "" {
+			return
+		}
+
+		var p goproto.Properties
+		p.Parse(tag)
+
+		fields[p.OrigName] = fv
+		if p.JSONName != "" {
+			fields[p.JSONName] = fv
+		}
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if strings.HasPrefix(f.Name, "XXX_") {
+			continue
+		}
+
+		if f.Tag.Get("protobuf_oneof") == "" {
+			add(f, v.Field(i))
+			continue
+		}
+
+		// A set oneof holds a pointer to a wrapper struct of a single field.
+		o := v.Field(i)
+		if o.IsNil() || o.Elem().Kind() != reflect.Ptr || o.Elem().Elem().Kind() != reflect.Struct {
+			continue
+		}
+
+		w := o.Elem().Elem()
+		if w.NumField() == 1 {
+			add(w.Type().Field(0), w.Field(0))
+		}
+	}
+
+	return fields
+}
+
+// rewriteObject rewrites the members of the JSON object raw with the value of
+// the same name, preserving their order.
+func rewriteObject(buf *bytes.Buffer, raw []byte, fields map[string]reflect.Value) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if tok != json.Delim('{') {
+		buf.Write(raw)
+		return nil
+	}
+
+	buf.WriteByte('{')
+	for i := 0; dec.More(); i++ {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		key, _ := tok.(string)
+
+		var val json.RawMessage
+		if err := dec.Decode(&val); err != nil {
+			return err
+		}
+
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		kb, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(kb)
+		buf.WriteByte(':')
+
+		if err := int64Numbers(buf, val, fields[key]); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+
+	return nil
+}
+
+// rewriteArray rewrites the elements of the JSON array raw with the elements
+// of v.
+func rewriteArray(buf *bytes.Buffer, raw []byte, v reflect.Value) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if tok != json.Delim('[') {
+		buf.Write(raw)
+		return nil
+	}
+
+	buf.WriteByte('[')
+	for i := 0; dec.More(); i++ {
+		var val json.RawMessage
+		if err := dec.Decode(&val); err != nil {
+			return err
+		}
+
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		var elem reflect.Value
+		if i < v.Len() {
+			elem = v.Index(i)
+		}
+
+		if err := int64Numbers(buf, val, elem); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+
+	return nil
+}
+
+// writeNumber unquotes the JSON string raw when it holds an integer.
+func writeNumber(buf *bytes.Buffer, raw []byte) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		buf.Write(raw)
+		return
+	}
+
+	if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+		if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+			buf.Write(raw)
+			return
+		}
+	}
+
+	buf.WriteString(s)
+}
@@ -0,0 +1,104 @@
+package drudge
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/genproto/googleapis/api/distribution"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1beta1"
+)
+
+func TestInt64Marshaler(t *testing.T) {
+	packed, err := ptypes.MarshalAny(&wrappers.Int64Value{Value: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{
+			name: "fields",
+			v:    &distribution.Distribution{Count: 3, Mean: 1.5, BucketCounts: []int64{1, 2}},
+			want: `{"count":3,"mean":1.5,"bucket_counts":[1,2]}`,
+		},
+		{name: "oneof", v: &expr.Value{Kind: &expr.Value_Int64Value{Int64Value: -7}}, want: `{"int64_value":-7}`},
+		{name: "uint64", v: &expr.Value{Kind: &expr.Value_Uint64Value{Uint64Value: 1<<64 - 1}}, want: `{"uint64_value":18446744073709551615}`},
+		{name: "other oneof", v: &expr.Value{Kind: &expr.Value_StringValue{StringValue: "12"}}, want: `{"string_value":"12"}`},
+		{
+			name: "nested",
+			v: &expr.Value{Kind: &expr.Value_ListValue{ListValue: &expr.ListValue{Values: []*expr.Value{
+				{Kind: &expr.Value_Int64Value{Int64Value: 1}},
+				{Kind: &expr.Value_StringValue{StringValue: "2"}},
+			}}}},
+			want: `{"list_value":{"values":[{"int64_value":1},{"string_value":"2"}]}}`,
+		},
+		{name: "wrapper", v: &wrappers.Int64Value{Value: 5}, want: `5`},
+		{name: "timestamp", v: &timestamp.Timestamp{Seconds: 60}, want: `"1970-01-01T00:01:00Z"`},
+		{
+			name: "any",
+			v:    &expr.Value{Kind: &expr.Value_ObjectValue{ObjectValue: packed}},
+			want: `{"object_value":{"@type":"type.googleapis.com/google.protobuf.Int64Value","value":"9"}}`,
+		},
+	}
+
+	m := newInt64Marshaler()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("Marshal() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInt64MarshalerEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := newInt64Marshaler().NewEncoder(&buf)
+
+	for _, v := range []int64{1, 2} {
+		if err := enc.Encode(&wrappers.Int64Value{Value: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := buf.String(); got != "1\n2\n" {
+		t.Errorf("encoded %q", got)
+	}
+}
+
+func TestWriteNumber(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: `"42"`, want: `42`},
+		{raw: `"-42"`, want: `-42`},
+		{raw: `"18446744073709551615"`, want: `18446744073709551615`},
+		{raw: `"1.5"`, want: `"1.5"`},
+		{raw: `"NaN"`, want: `"NaN"`},
+		{raw: `42`, want: `42`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeNumber(&buf, []byte(tt.raw))
+
+			if buf.String() != tt.want {
+				t.Errorf("writeNumber() = %s, want %s", buf.String(), tt.want)
+			}
+		})
+	}
+}
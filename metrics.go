@@ -4,15 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	ocprometheus "contrib.go.opencensus.io/exporter/prometheus"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
 )
 
+// DefaultMetricsPath serves the Prometheus metrics when Options.MetricsPath
+// isn't set.
+const DefaultMetricsPath = "/metrics"
+
 func MeasureInt(ctx context.Context, m *stats.Int64Measure, v int64, tags ...tag.Mutator) {
 	if m == nil {
 		return
@@ -39,14 +50,75 @@ func MeasureFloat(ctx context.Context, m *stats.Float64Measure, v float64, tags
 	}
 }
 
+// exportViews exposes the registered OpenCensus views, including those of the
+// RegistryHandler, on the Prometheus registry served at /metrics.
+func exportViews(lg *zap.Logger, reg *prometheus.Registry) error {
+	_, err := ocprometheus.NewExporter(ocprometheus.Options{
+		Registry: reg,
+		OnError: func(err error) {
+			lg.Warn("failed to export OpenCensus views to Prometheus", zap.Error(err))
+		},
+	})
+
+	return err
+}
+
 type RegistryHandler struct {
-	metrics map[string]interface{}
+	// Namespace, when set, prefixes the names of the registry's metrics as
+	// "namespace/name", so services registering the same name don't
+	// collide.
+	Namespace string
+
+	metrics map[string]*registeredMetric
 	log     *zap.Logger
 	sync.Mutex
 }
 
+// registeredMetric pairs a measure with the view recording it.
+type registeredMetric struct {
+	measure stats.Measure
+	view    *view.View
+	kind    string
+}
+
+// MetricInfo describes a registered metric as served by the metric list.
+type MetricInfo struct {
+	Name        string    `json:"name" yaml:"name"`
+	Description string    `json:"description" yaml:"description"`
+	Unit        string    `json:"unit" yaml:"unit"`
+	Type        string    `json:"type" yaml:"type"`
+	TagKeys     []string  `json:"tag_keys" yaml:"tag_keys"`
+	Aggregation string    `json:"aggregation" yaml:"aggregation"`
+	Buckets     []float64 `json:"buckets,omitempty" yaml:"buckets,omitempty"`
+}
+
+// DefaultRegistry is the registry used by the package level Int64Measure and
+// Float64Measure helpers, and by Run when Options.Metrics isn't set, so every
+// metric shows up in one listing.
+var DefaultRegistry = &RegistryHandler{}
+
+// Int64Measure registers an integer metric on the DefaultRegistry.
+func Int64Measure(name, description, unit string, tags []tag.Key, aggregate *view.Aggregation) *stats.Int64Measure {
+	return DefaultRegistry.Int64Measure(name, description, unit, tags, aggregate)
+}
+
+// Float64Measure registers a floating point metric on the DefaultRegistry.
+func Float64Measure(name, description, unit string, tags []tag.Key, aggregate *view.Aggregation) *stats.Float64Measure {
+	return DefaultRegistry.Float64Measure(name, description, unit, tags, aggregate)
+}
+
+// Int64MeasureE is Int64Measure, returning the registration error.
+func Int64MeasureE(name, description, unit string, tags []tag.Key, aggregate *view.Aggregation) (*stats.Int64Measure, error) {
+	return DefaultRegistry.Int64MeasureE(name, description, unit, tags, aggregate)
+}
+
+// Float64MeasureE is Float64Measure, returning the registration error.
+func Float64MeasureE(name, description, unit string, tags []tag.Key, aggregate *view.Aggregation) (*stats.Float64Measure, error) {
+	return DefaultRegistry.Float64MeasureE(name, description, unit, tags, aggregate)
+}
+
 // Int64Measure establishes a new OpenCensus Integer Metric based on the provided information and registers
-// a configured stats.View.
+// a configured stats.View. Registering a name twice in the namespace is fatal, see Int64MeasureE.
 func (r *RegistryHandler) Int64Measure(
 	name,
 	description,
@@ -54,29 +126,32 @@ func (r *RegistryHandler) Int64Measure(
 	tags []tag.Key,
 	aggregate *view.Aggregation,
 ) *stats.Int64Measure {
-	if r.exists(name) {
-		r.log.Fatal("the provided metric name is already registered", zap.String("name", name))
+	s, err := r.Int64MeasureE(name, description, unit, tags, aggregate)
+	if err != nil {
+		r.fatal(name, err)
 	}
 
-	s := stats.Int64(name, description, unit)
+	return s
+}
 
-	if err := view.Register(&view.View{
-		Name:        name,
-		Measure:     s,
-		Description: description,
-		Aggregation: aggregate,
-		TagKeys:     tags,
-	}); err != nil {
-		_ = err
+// Int64MeasureE is Int64Measure, failing when the name is already registered in the namespace.
+func (r *RegistryHandler) Int64MeasureE(
+	name,
+	description,
+	unit string,
+	tags []tag.Key,
+	aggregate *view.Aggregation,
+) (*stats.Int64Measure, error) {
+	s := stats.Int64(r.name(name), description, unit)
+	if err := r.register(s, "int64", tags, aggregate); err != nil {
+		return nil, err
 	}
 
-	r.put(name, s)
-
-	return s
+	return s, nil
 }
 
 // Float64Measure establishes a new OpenCensus Floating Point Metric based on the provided information and registers
-// a configured stats.View.
+// a configured stats.View. Registering a name twice in the namespace is fatal, see Float64MeasureE.
 func (r *RegistryHandler) Float64Measure(
 	name,
 	description,
@@ -84,49 +159,320 @@ func (r *RegistryHandler) Float64Measure(
 	tags []tag.Key,
 	aggregate *view.Aggregation,
 ) *stats.Float64Measure {
-	if r.exists(name) {
-		r.log.Fatal("the provided metric name is already registered", zap.String("name", name))
+	s, err := r.Float64MeasureE(name, description, unit, tags, aggregate)
+	if err != nil {
+		r.fatal(name, err)
+	}
+
+	return s
+}
+
+// Float64MeasureE is Float64Measure, failing when the name is already registered in the namespace.
+func (r *RegistryHandler) Float64MeasureE(
+	name,
+	description,
+	unit string,
+	tags []tag.Key,
+	aggregate *view.Aggregation,
+) (*stats.Float64Measure, error) {
+	s := stats.Float64(r.name(name), description, unit)
+	if err := r.register(s, "float64", tags, aggregate); err != nil {
+		return nil, err
 	}
 
-	s := stats.Float64(name, description, unit)
+	return s, nil
+}
+
+// fatal logs the failed registration of a metric and exits.
+func (r *RegistryHandler) fatal(name string, err error) {
+	r.logger().Fatal(
+		"failed to register the metric",
+		zap.String("name", r.name(name)),
+		zap.String("namespace", r.Namespace),
+		zap.Error(err),
+	)
+}
+
+// register records the measure's view and adds it to the registry, under the
+// lock so concurrent registrations of a name can't both succeed.
+func (r *RegistryHandler) register(m stats.Measure, kind string, tags []tag.Key, aggregate *view.Aggregation) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.metrics[m.Name()]; ok {
+		return errors.Errorf("metric '%s' is already registered", m.Name())
+	}
 
-	if err := view.Register(&view.View{
-		Name:        name,
-		Measure:     s,
-		Description: description,
+	v := &view.View{
+		Name:        m.Name(),
+		Measure:     m,
+		Description: m.Description(),
 		Aggregation: aggregate,
 		TagKeys:     tags,
-	}); err != nil {
-		_ = err
 	}
+	if err := view.Register(v); err != nil {
+		return errors.Wrapf(err, "failed to register the view of metric '%s'", m.Name())
+	}
+
+	if r.metrics == nil {
+		r.metrics = map[string]*registeredMetric{}
+	}
+	r.metrics[m.Name()] = &registeredMetric{measure: m, view: v, kind: kind}
 
-	r.put(name, s)
+	return nil
+}
 
-	return s
+func (r *RegistryHandler) logger() *zap.Logger {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.log == nil {
+		return zap.L()
+	}
+
+	return r.log
 }
 
+// setLogger assigns the logger unless one is already set.
+func (r *RegistryHandler) setLogger(lg *zap.Logger) {
+	r.Lock()
+	if r.log == nil {
+		r.log = lg
+	}
+	r.Unlock()
+}
+
+// name returns the full name of the metric, within the namespace.
+func (r *RegistryHandler) name(name string) string {
+	if r.Namespace == "" {
+		return name
+	}
+
+	return r.Namespace + "/" + name
+}
+
+// Unregister removes a metric and its OpenCensus view, allowing the name to
+// be registered again. The name is given without the namespace.
+func (r *RegistryHandler) Unregister(name string) error {
+	name = r.name(name)
+
+	r.Lock()
+	defer r.Unlock()
+
+	m, ok := r.metrics[name]
+	if !ok {
+		return errors.Errorf("metric '%s' is not registered", name)
+	}
+
+	view.Unregister(m.view)
+	delete(r.metrics, name)
+
+	return nil
+}
+
+// ServeHTTP writes the metric list as compact JSON, as YAML when asked by
+// the Accept header or ?format=yaml, or as indented JSON with ?pretty.
 func (r *RegistryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if err := json.NewEncoder(w).Encode(r.metrics); err != nil {
+	list := r.List()
+
+	var (
+		body []byte
+		err  error
+	)
+	switch {
+	case wantsYAML(req):
+		w.Header().Set("Content-Type", "application/x-yaml")
+		body, err = yaml.Marshal(list)
+	case req.URL.Query()["pretty"] != nil:
+		w.Header().Set("Content-Type", "application/json")
+		body, err = json.MarshalIndent(list, "", "  ")
+		body = append(body, '\n')
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		body, err = json.Marshal(list)
+		body = append(body, '\n')
+	}
+
+	if err != nil {
+		w.Header().Del("Content-Type")
 		http.Error(w, errors.Wrap(err, "failed to encode metric list").Error(), http.StatusInternalServerError)
 		return
 	}
+
+	_, _ = w.Write(body)
 }
 
-func (r *RegistryHandler) Metrics() map[string]interface{} {
-	return r.metrics
+// wantsYAML reports whether the request asks for YAML rather than JSON.
+func wantsYAML(req *http.Request) bool {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format == "yaml"
+	}
+
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		switch mediaType {
+		case "application/x-yaml", "application/yaml", "text/yaml", "text/x-yaml":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+
+	return false
 }
 
-func (r *RegistryHandler) exists(key string) bool {
-	_, ok := r.metrics[key]
-	return ok
+// List describes every registered metric, sorted by name.
+func (r *RegistryHandler) List() []MetricInfo {
+	r.Lock()
+	defer r.Unlock()
+
+	list := make([]MetricInfo, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		list = append(list, m.info())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
 }
 
-func (r *RegistryHandler) put(key string, m interface{}) {
+// Metrics returns the registered measures keyed by their full name.
+func (r *RegistryHandler) Metrics() map[string]interface{} {
 	r.Lock()
-	if r.metrics == nil {
-		r.metrics = map[string]interface{}{}
+	defer r.Unlock()
+
+	metrics := make(map[string]interface{}, len(r.metrics))
+	for name, m := range r.metrics {
+		metrics[name] = m.measure
 	}
 
-	r.metrics[key] = m
-	r.Unlock()
+	return metrics
+}
+
+func (m *registeredMetric) info() MetricInfo {
+	info := MetricInfo{
+		Name:        m.measure.Name(),
+		Description: m.measure.Description(),
+		Unit:        m.measure.Unit(),
+		Type:        m.kind,
+		TagKeys:     make([]string, 0, len(m.view.TagKeys)),
+	}
+
+	for _, k := range m.view.TagKeys {
+		info.TagKeys = append(info.TagKeys, k.Name())
+	}
+
+	if agg := m.view.Aggregation; agg != nil {
+		info.Aggregation = agg.Type.String()
+		info.Buckets = agg.Buckets
+	}
+
+	return info
+}
+
+// httpMetrics are the Prometheus metrics of the requests served by the
+// gateway, labeled by route template rather than path to bound their
+// cardinality.
+type httpMetrics struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	shed     prometheus.Counter
+	slow     *prometheus.CounterVec
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "drudge_http_requests_total",
+			Help: "Total number of HTTP requests served by the gateway.",
+		}, []string{"method", "route", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "drudge_http_request_duration_seconds",
+			Help:    "Latency of the HTTP requests served by the gateway.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		shed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "drudge_http_requests_shed_total",
+			Help: "Total number of HTTP requests rejected over Options.MaxConcurrentRequests.",
+		}),
+		slow: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "drudge_slow_requests_total",
+			Help: "Total number of HTTP requests and unary gRPC calls slower than Options.SlowRequestThreshold.",
+		}, []string{"protocol"}),
+	}
+}
+
+// register adds the metrics to r, reusing the ones registered by a previous
+// server of the process.
+func (m *httpMetrics) register(r prometheus.Registerer) error {
+	if err := r.Register(m.requests); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return errors.Wrap(err, "failed to register the HTTP request counter")
+		}
+
+		m.requests = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+
+	if err := r.Register(m.latency); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return errors.Wrap(err, "failed to register the HTTP latency histogram")
+		}
+
+		m.latency = are.ExistingCollector.(*prometheus.HistogramVec)
+	}
+
+	if err := r.Register(m.shed); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return errors.Wrap(err, "failed to register the HTTP shed counter")
+		}
+
+		m.shed = are.ExistingCollector.(prometheus.Counter)
+	}
+
+	if err := r.Register(m.slow); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return errors.Wrap(err, "failed to register the slow request counter")
+		}
+
+		m.slow = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+
+	return nil
+}
+
+// slowRequest counts a request slower than Options.SlowRequestThreshold.
+func (m *httpMetrics) slowRequest(protocol string) {
+	m.slow.WithLabelValues(protocol).Inc()
+}
+
+// instrument records the requests served by h, labeled by the route
+// withRouteInfo resolved.
+func (m *httpMetrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := routeLabel(r.Context())
+
+		trw := &traceableResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(trw, r)
+
+		status := trw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		m.requests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		m.latency.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+
+		method := tag.Upsert(MethodTag, r.Method)
+		if r.ContentLength >= 0 {
+			MeasureInt(r.Context(), HTTPRequestBytes, r.ContentLength, method)
+		}
+		MeasureInt(r.Context(), HTTPResponseBytes, trw.written, method)
+	})
 }
@@ -0,0 +1,362 @@
+package drudge
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRegistryHandlerRegister(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		metrics   []string
+		wantErr   bool
+		wantNames []string
+	}{
+		{name: "one", metrics: []string{"test_register_one"}, wantNames: []string{"test_register_one"}},
+		{name: "duplicate", metrics: []string{"test_register_dup", "test_register_dup"}, wantErr: true, wantNames: []string{"test_register_dup"}},
+		{name: "namespaced", namespace: "svc", metrics: []string{"test_register_ns"}, wantNames: []string{"svc/test_register_ns"}},
+		{
+			name:      "namespaced duplicate",
+			namespace: "svc",
+			metrics:   []string{"test_register_ns_dup", "test_register_ns_dup"},
+			wantErr:   true,
+			wantNames: []string{"svc/test_register_ns_dup"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RegistryHandler{Namespace: tt.namespace}
+
+			var err error
+			for i, name := range tt.metrics {
+				if i%2 == 0 {
+					_, err = r.Int64MeasureE(name, "a test metric", "1", nil, view.Count())
+				} else {
+					_, err = r.Float64MeasureE(name, "a test metric", "1", nil, view.Count())
+				}
+				if err != nil {
+					break
+				}
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("register error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var names []string
+			for _, m := range r.List() {
+				names = append(names, m.Name)
+			}
+
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("List() = %v, want %v", names, tt.wantNames)
+			}
+
+			for _, name := range tt.metrics[:1] {
+				if err := r.Unregister(name); err != nil {
+					t.Errorf("Unregister() = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	i := Int64Measure("test_measure_int", "a test metric", "1", nil, view.Count())
+	defer DefaultRegistry.Unregister("test_measure_int")
+
+	f := Float64Measure("test_measure_float", "a test metric", "ms", nil, view.Count())
+	defer DefaultRegistry.Unregister("test_measure_float")
+
+	if i == nil || i.Name() != "test_measure_int" {
+		t.Errorf("Int64Measure() = %v", i)
+	}
+
+	if f == nil || f.Name() != "test_measure_float" {
+		t.Errorf("Float64Measure() = %v", f)
+	}
+
+	if _, err := Int64MeasureE("test_measure_int", "a test metric", "1", nil, view.Count()); err == nil {
+		t.Error("Int64MeasureE() registered a name twice")
+	}
+}
+
+func TestRegistryHandlerNamespaces(t *testing.T) {
+	a, b := &RegistryHandler{Namespace: "a"}, &RegistryHandler{Namespace: "b"}
+
+	if _, err := a.Int64MeasureE("test_namespaces", "requests", "1", nil, view.Count()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Unregister("test_namespaces")
+
+	if _, err := b.Int64MeasureE("test_namespaces", "requests", "1", nil, view.Count()); err != nil {
+		t.Fatalf("the same name in another namespace = %v", err)
+	}
+	defer b.Unregister("test_namespaces")
+}
+
+func TestRegistryHandlerUnregister(t *testing.T) {
+	tests := []struct {
+		name       string
+		register   bool
+		unregister string
+		wantErr    bool
+	}{
+		{name: "registered", register: true, unregister: "test_unregister"},
+		{name: "unknown", unregister: "test_unregister", wantErr: true},
+		{name: "another name", register: true, unregister: "test_unregister_other", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RegistryHandler{}
+			if tt.register {
+				if _, err := r.Int64MeasureE("test_unregister", "a test metric", "1", nil, view.Count()); err != nil {
+					t.Fatal(err)
+				}
+				defer r.Unregister("test_unregister")
+			}
+
+			if err := r.Unregister(tt.unregister); (err != nil) != tt.wantErr {
+				t.Fatalf("Unregister() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if view.Find("test_unregister") != nil {
+				t.Error("the view is still registered")
+			}
+
+			// The name can be registered again.
+			if _, err := r.Int64MeasureE("test_unregister", "a test metric", "1", nil, view.Count()); err != nil {
+				t.Errorf("registering again = %v", err)
+			}
+		})
+	}
+}
+
+func TestRegistryHandlerServeHTTP(t *testing.T) {
+	key, err := tag.NewKey("test_method")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &RegistryHandler{Namespace: "test_serve"}
+	if _, err := r.Float64MeasureE("latency", "request latency", "ms", []tag.Key{key}, view.Distribution(10, 100)); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Unregister("latency")
+
+	want := MetricInfo{
+		Name:        "test_serve/latency",
+		Description: "request latency",
+		Unit:        "ms",
+		Type:        "float64",
+		TagKeys:     []string{"test_method"},
+		Aggregation: "Distribution",
+		Buckets:     []float64{10, 100},
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		accept     string
+		wantType   string
+		wantIndent bool
+	}{
+		{name: "JSON", target: "/metrics/list", wantType: "application/json"},
+		{name: "pretty", target: "/metrics/list?pretty", wantType: "application/json", wantIndent: true},
+		{name: "YAML format", target: "/metrics/list?format=yaml", wantType: "application/x-yaml"},
+		{name: "YAML accepted", target: "/metrics/list", accept: "text/yaml;q=0.9, application/json;q=0.5", wantType: "application/x-yaml"},
+		{name: "JSON accepted first", target: "/metrics/list", accept: "application/json, text/yaml", wantType: "application/json"},
+		{name: "format over Accept", target: "/metrics/list?format=json", accept: "text/yaml", wantType: "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Fatalf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+
+			var list []MetricInfo
+			if tt.wantType == "application/x-yaml" {
+				err = yaml.Unmarshal(w.Body.Bytes(), &list)
+			} else {
+				err = json.Unmarshal(w.Body.Bytes(), &list)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", w.Body, err)
+			}
+
+			if len(list) != 1 {
+				t.Fatalf("list = %+v", list)
+			}
+
+			got := list[0]
+			if got.Name != want.Name || got.Description != want.Description || got.Unit != want.Unit ||
+				got.Type != want.Type || got.Aggregation != want.Aggregation ||
+				strings.Join(got.TagKeys, ",") != strings.Join(want.TagKeys, ",") || len(got.Buckets) != len(want.Buckets) {
+				t.Errorf("list = %+v, want %+v", got, want)
+			}
+
+			if indented := strings.Contains(w.Body.String(), "\n  "); indented != tt.wantIndent && tt.wantType == "application/json" {
+				t.Errorf("indented = %t, want %t", indented, tt.wantIndent)
+			}
+		})
+	}
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	first := newHTTPMetrics()
+	if err := first.register(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later server of the process reuses the registered metrics.
+	m := newHTTPMetrics()
+	if err := m.register(reg); err != nil {
+		t.Fatalf("registering again = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		route  string
+		want   string
+	}{
+		{name: "implicit OK", route: "/v1/users", want: "200"},
+		{name: "not found", status: http.StatusNotFound, want: "404"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := m.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/1", nil)
+			if tt.route != "" {
+				r = r.WithContext(context.WithValue(r.Context(), routeKey{}, tt.route))
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			route := tt.route
+			if route == "" {
+				route = unmatchedRoute
+			}
+
+			if got := testutil.ToFloat64(first.requests.WithLabelValues(http.MethodGet, route, tt.want)); got != 1 {
+				t.Errorf("requests{route=%q,code=%q} = %v, want 1", route, tt.want, got)
+			}
+		})
+	}
+
+	m.slowRequest("http")
+	if got := testutil.ToFloat64(first.slow.WithLabelValues("http")); got != 1 {
+		t.Errorf("slow requests = %v, want 1", got)
+	}
+}
+
+// scrapeMetrics returns the body of the Prometheus endpoint of the server
+// listening on addr.
+func scrapeMetrics(t *testing.T, addr string) string {
+	t.Helper()
+
+	resp, err := http.Get("http://" + addr + DefaultMetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s status = %d", DefaultMetricsPath, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestScrapeCustomMetric(t *testing.T) {
+	r := &RegistryHandler{Namespace: "test_scrape"}
+	m, err := r.Int64MeasureE("widgets", "widgets made", "1", nil, view.Sum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Unregister("widgets")
+
+	s := startServer(t, Options{Metrics: r})
+	defer s.Stop(context.Background())
+
+	MeasureInt(context.Background(), m, 3)
+
+	want := "test_scrape_widgets 3"
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(scrapeMetrics(t, s.Addr().String()), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never served %q", DefaultMetricsPath, want)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrometheusRegistry(t *testing.T) {
+	global := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_global_only_total"})
+	if err := prometheus.Register(global); err != nil {
+		t.Fatal(err)
+	}
+	defer prometheus.Unregister(global)
+
+	s := startOperations(t, &operations{}, Options{})
+	defer s.Stop(context.Background())
+
+	before := handledCalls(t, "grpc_server_handled_total", "GetOperation")
+	getOperation(t, http.DefaultClient, s.Addr().String(), "a")
+
+	body := scrapeMetrics(t, s.Addr().String())
+
+	want := `grpc_server_handled_total{grpc_code="OK",grpc_method="GetOperation",grpc_service="google.longrunning.Operations",grpc_type="unary"} 1`
+	if !strings.Contains(body, want) {
+		t.Errorf("%s doesn't count the call on the private registry", DefaultMetricsPath)
+	}
+
+	if strings.Contains(body, "test_global_only_total") {
+		t.Errorf("%s serves the global registry", DefaultMetricsPath)
+	}
+
+	if got := handledCalls(t, "grpc_server_handled_total", "GetOperation") - before; got != 0 {
+		t.Errorf("the global registry counted %v calls", got)
+	}
+}
@@ -0,0 +1,522 @@
+package drudge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultOTLPEndpoint is the collector's OTLP/HTTP address used when
+	// OTLPConfig.Endpoint isn't set.
+	DefaultOTLPEndpoint = "localhost:4318"
+
+	// DefaultOTLPBatchSize is the number of spans exported at once when
+	// OTLPConfig.BatchSize isn't set.
+	DefaultOTLPBatchSize = 512
+
+	// DefaultOTLPFlushInterval is the longest spans are buffered when
+	// OTLPConfig.FlushInterval isn't set.
+	DefaultOTLPFlushInterval = 5 * time.Second
+
+	// DefaultOTLPMaxQueueSize is the most spans buffered when
+	// OTLPConfig.MaxQueueSize isn't set.
+	DefaultOTLPMaxQueueSize = 2048
+)
+
+// otlpTracesPath is where OTLP/HTTP collectors receive spans.
+const otlpTracesPath = "/v1/traces"
+
+// OTLPConfig configures the exporter shipping spans over OTLP/HTTP, with the
+// JSON encoding, to an OpenTelemetry Collector or a backend accepting OTLP
+// such as Tempo or Honeycomb.
+type OTLPConfig struct {
+	ServiceName string
+
+	// Endpoint is the host:port of the collector, defaults to
+	// DefaultOTLPEndpoint. Spans are POSTed to its /v1/traces.
+	Endpoint string
+
+	// Headers are sent with every export, e.g. API keys.
+	Headers map[string]string
+
+	// Insecure exports over plain HTTP rather than HTTPS.
+	Insecure bool
+
+	// Compression encodes the exports, "gzip" or "" for none.
+	Compression string
+
+	// HTTPClient sends the exports, defaulting to one timing out after 10s.
+	HTTPClient *http.Client
+
+	// BatchSize and FlushInterval bound how many spans are buffered, and
+	// for how long, before being exported. They default to
+	// DefaultOTLPBatchSize and DefaultOTLPFlushInterval.
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// MaxQueueSize bounds the spans buffered while the exports can't keep
+	// up, e.g. when the collector is down. The spans past it are dropped
+	// and counted. It defaults to DefaultOTLPMaxQueueSize, and is at least
+	// BatchSize.
+	MaxQueueSize int
+
+	// Logger, when set, logs the failed exports and the dropped spans.
+	Logger *zap.Logger
+}
+
+// OTLP registers an exporter shipping the spans over OTLP/HTTP. The returned
+// func exports the buffered spans before returning.
+func OTLP(c interface{}) (func(), error) {
+	var cfg OTLPConfig
+	switch v := c.(type) {
+	case OTLPConfig:
+		cfg = v
+	case *OTLPConfig:
+		if v == nil {
+			return nil, errors.New("configuration was nil")
+		}
+
+		cfg = *v
+	default:
+		return nil, errors.Errorf("expected OTLP config, received '%T'", c)
+	}
+
+	e, err := newOTLPExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	trace.RegisterExporter(e)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+
+	return func() {
+		trace.UnregisterExporter(e)
+		e.shutdown()
+	}, nil
+}
+
+// otlpExporter buffers the spans it receives, exporting them in batches from
+// a background goroutine.
+type otlpExporter struct {
+	client   *http.Client
+	url      string
+	headers  map[string]string
+	gzip     bool
+	resource otlpResource
+	batch    int
+	max      int
+	lg       *zap.Logger
+
+	mu      sync.Mutex
+	spans   []*trace.SpanData
+	dropped int
+
+	// sendMu serializes the exports, so spans are sent in order.
+	sendMu sync.Mutex
+
+	full chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newOTLPExporter(cfg OTLPConfig) (*otlpExporter, error) {
+	switch cfg.Compression {
+	case "", "gzip":
+	default:
+		return nil, errors.Errorf("unsupported OTLP compression '%s'", cfg.Compression)
+	}
+
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = DefaultOTLPEndpoint
+	}
+
+	scheme := "https"
+	if cfg.Insecure {
+		scheme = "http"
+	}
+
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultOTLPBatchSize
+	}
+
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultOTLPFlushInterval
+	}
+
+	if cfg.MaxQueueSize <= 0 {
+		cfg.MaxQueueSize = DefaultOTLPMaxQueueSize
+	}
+
+	if cfg.MaxQueueSize < cfg.BatchSize {
+		cfg.MaxQueueSize = cfg.BatchSize
+	}
+
+	e := &otlpExporter{
+		client:  cfg.HTTPClient,
+		url:     scheme + "://" + cfg.Endpoint + otlpTracesPath,
+		headers: cfg.Headers,
+		gzip:    cfg.Compression == "gzip",
+		resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpAttribute("service.name", cfg.ServiceName),
+		}},
+		batch: cfg.BatchSize,
+		max:   cfg.MaxQueueSize,
+		lg:    cfg.Logger,
+		full:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go e.loop(cfg.FlushInterval)
+
+	return e, nil
+}
+
+// ExportSpan buffers the span, dropping it when the queue is full.
+func (e *otlpExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	if len(e.spans) < e.max {
+		e.spans = append(e.spans, s)
+	} else {
+		e.dropped++
+	}
+	full := len(e.spans) >= e.batch
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// loop exports the buffered spans every interval, or once a batch is full,
+// until shutdown.
+func (e *otlpExporter) loop(interval time.Duration) {
+	defer e.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-e.full:
+		case <-e.done:
+			return
+		}
+
+		e.flush()
+	}
+}
+
+// shutdown stops the background exports and exports the remaining spans.
+func (e *otlpExporter) shutdown() {
+	close(e.done)
+	e.wg.Wait()
+	e.flush()
+}
+
+// flush exports the buffered spans, batch by batch, reporting the spans
+// dropped since the last flush.
+func (e *otlpExporter) flush() {
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+
+	e.mu.Lock()
+	dropped := e.dropped
+	e.dropped = 0
+	e.mu.Unlock()
+
+	if dropped > 0 && e.lg != nil {
+		e.lg.Warn("dropped spans, the OTLP export queue was full",
+			zap.Int("spans", dropped),
+			zap.Int("max_queue_size", e.max),
+		)
+	}
+
+	for {
+		e.mu.Lock()
+		n := len(e.spans)
+		if n > e.batch {
+			n = e.batch
+		}
+		spans := e.spans[:n:n]
+		e.spans = e.spans[n:]
+		e.mu.Unlock()
+
+		if n == 0 {
+			return
+		}
+
+		if err := e.send(spans); err != nil && e.lg != nil {
+			e.lg.Warn("failed to export spans over OTLP",
+				zap.Int("spans", len(spans)),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (e *otlpExporter) send(spans []*trace.SpanData) error {
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: e.resource,
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "drudge"},
+			Spans: make([]otlpSpan, 0, len(spans)),
+		}},
+	}}}
+	for _, s := range spans {
+		req.ResourceSpans[0].ScopeSpans[0].Spans = append(req.ResourceSpans[0].ScopeSpans[0].Spans, newOTLPSpan(s))
+	}
+
+	var body bytes.Buffer
+	w := io.Writer(&body)
+
+	var gz *gzip.Writer
+	if e.gzip {
+		gz = gzip.NewWriter(&body)
+		w = gz
+	}
+
+	if err := json.NewEncoder(w).Encode(req); err != nil {
+		return errors.Wrap(err, "failed to encode the spans")
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return errors.Wrap(err, "failed to compress the spans")
+		}
+	}
+
+	r, err := http.NewRequest(http.MethodPost, e.url, &body)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the export request")
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+	if gz != nil {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range e.headers {
+		r.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to export the spans")
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("collector answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of an ExportTraceServiceRequest. IDs are hex
+// encoded and 64-bit integers are strings, as in the protobuf JSON mapping.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Links             []otlpLink     `json:"links,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+
+	otlpLink struct {
+		TraceID    string         `json:"traceId"`
+		SpanID     string         `json:"spanId"`
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+
+	otlpAnyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    string   `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// The OTLP span kinds and status codes.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+
+	otlpStatusError = 2
+)
+
+func newOTLPSpan(s *trace.SpanData) otlpSpan {
+	span := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: otlpTime(s.StartTime),
+		EndTimeUnixNano:   otlpTime(s.EndTime),
+		Attributes:        otlpAttributes(s.Attributes),
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+
+	switch s.SpanKind {
+	case trace.SpanKindServer:
+		span.Kind = otlpKindServer
+	case trace.SpanKindClient:
+		span.Kind = otlpKindClient
+	}
+
+	// OpenCensus spans carry a gRPC code, OK leaves the status unset.
+	if s.Code != 0 {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: s.Message}
+	}
+
+	for _, a := range s.Annotations {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: otlpTime(a.Time),
+			Name:         a.Message,
+			Attributes:   otlpAttributes(a.Attributes),
+		})
+	}
+
+	for _, m := range s.MessageEvents {
+		name := "message.sent"
+		if m.EventType == trace.MessageEventTypeRecv {
+			name = "message.received"
+		}
+
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: otlpTime(m.Time),
+			Name:         name,
+			Attributes: otlpAttributes(map[string]interface{}{
+				"message.id":                m.MessageID,
+				"message.uncompressed_size": m.UncompressedByteSize,
+				"message.compressed_size":   m.CompressedByteSize,
+			}),
+		})
+	}
+
+	for _, l := range s.Links {
+		span.Links = append(span.Links, otlpLink{
+			TraceID:    l.TraceID.String(),
+			SpanID:     l.SpanID.String(),
+			Attributes: otlpAttributes(l.Attributes),
+		})
+	}
+
+	return span
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpAttributes converts the attributes, sorted by key so exports are
+// stable.
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, otlpAttribute(k, attrs[k]))
+	}
+
+	return kvs
+}
+
+func otlpAttribute(k string, v interface{}) otlpKeyValue {
+	var value otlpAnyValue
+	switch v := v.(type) {
+	case string:
+		value.StringValue = &v
+	case bool:
+		value.BoolValue = &v
+	case int:
+		value.IntValue = strconv.FormatInt(int64(v), 10)
+	case int64:
+		value.IntValue = strconv.FormatInt(v, 10)
+	case float64:
+		value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		value.StringValue = &s
+	}
+
+	return otlpKeyValue{Key: k, Value: value}
+}
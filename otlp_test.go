@@ -0,0 +1,485 @@
+package drudge
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeCollector records the spans exported to it.
+type fakeCollector struct {
+	t      *testing.T
+	status int
+
+	mu      sync.Mutex
+	batches [][]otlpSpan
+	headers []http.Header
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != otlpTracesPath {
+		c.t.Errorf("export to %s %s", r.Method, r.URL.Path)
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			c.t.Error(err)
+			return
+		}
+		body = gz
+	}
+
+	var req otlpRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		c.t.Error(err)
+		return
+	}
+
+	c.mu.Lock()
+	c.batches = append(c.batches, req.ResourceSpans[0].ScopeSpans[0].Spans)
+	c.headers = append(c.headers, r.Header)
+	c.mu.Unlock()
+
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+	}
+}
+
+// spans returns the names of the exported spans, in order.
+func (c *fakeCollector) spans() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var names []string
+	for _, b := range c.batches {
+		for _, s := range b {
+			names = append(names, s.Name)
+		}
+	}
+
+	return names
+}
+
+func TestOTLPConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     interface{}
+		wantErr bool
+	}{
+		{name: "value", cfg: OTLPConfig{Insecure: true}},
+		{name: "pointer", cfg: &OTLPConfig{Compression: "gzip"}},
+		{name: "nil", cfg: (*OTLPConfig)(nil), wantErr: true},
+		{name: "other", cfg: "localhost:4318", wantErr: true},
+		{name: "compression", cfg: OTLPConfig{Compression: "zstd"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop, err := OTLP(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OTLP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if stop != nil {
+				stop()
+			}
+		})
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         OTLPConfig
+		spans       int
+		status      int
+		wantBatches int
+	}{
+		{name: "one batch", cfg: OTLPConfig{BatchSize: 10}, spans: 3, wantBatches: 1},
+		{name: "full batches", cfg: OTLPConfig{BatchSize: 2}, spans: 5, wantBatches: 3},
+		{name: "gzip", cfg: OTLPConfig{BatchSize: 10, Compression: "gzip"}, spans: 2, wantBatches: 1},
+		{name: "headers", cfg: OTLPConfig{BatchSize: 10, Headers: map[string]string{"X-Api-Key": "secret"}}, spans: 1, wantBatches: 1},
+		{name: "rejected", cfg: OTLPConfig{BatchSize: 10}, spans: 1, status: http.StatusServiceUnavailable, wantBatches: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeCollector{t: t, status: tt.status}
+			srv := httptest.NewServer(c)
+			defer srv.Close()
+
+			cfg := tt.cfg
+			cfg.Endpoint = strings.TrimPrefix(srv.URL, "http://")
+			cfg.Insecure = true
+			// Only full batches and the shutdown export.
+			cfg.FlushInterval = time.Hour
+
+			e, err := newOTLPExporter(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want []string
+			for i := 0; i < tt.spans; i++ {
+				name := "span" + strconv.Itoa(i)
+				want = append(want, name)
+
+				e.mu.Lock()
+				e.spans = append(e.spans, &trace.SpanData{Name: name})
+				e.mu.Unlock()
+			}
+			e.shutdown()
+
+			if got := strings.Join(c.spans(), ","); got != strings.Join(want, ",") {
+				t.Errorf("exported %s, want %s", got, strings.Join(want, ","))
+			}
+
+			if len(c.batches) != tt.wantBatches {
+				t.Errorf("%d batches, want %d", len(c.batches), tt.wantBatches)
+			}
+
+			for k, v := range cfg.Headers {
+				if got := c.headers[0].Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestOTLPExporterFullBatch(t *testing.T) {
+	c := &fakeCollector{t: t}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	e, err := newOTLPExporter(OTLPConfig{
+		Endpoint:      strings.TrimPrefix(srv.URL, "http://"),
+		Insecure:      true,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.shutdown()
+
+	e.ExportSpan(&trace.SpanData{Name: "a"})
+	e.ExportSpan(&trace.SpanData{Name: "b"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.spans()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the full batch wasn't exported before the flush interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewOTLPSpan(t *testing.T) {
+	start := time.Unix(1, 500)
+	parent := trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8}
+
+	tests := []struct {
+		name string
+		data *trace.SpanData
+		want func(otlpSpan) bool
+	}{
+		{
+			name: "root",
+			data: &trace.SpanData{Name: "root", StartTime: start, EndTime: start.Add(time.Second)},
+			want: func(s otlpSpan) bool {
+				return s.ParentSpanID == "" && s.Kind == otlpKindInternal &&
+					s.StartTimeUnixNano == "1000000500" && s.EndTimeUnixNano == "2000000500"
+			},
+		},
+		{
+			name: "child",
+			data: &trace.SpanData{ParentSpanID: parent},
+			want: func(s otlpSpan) bool { return s.ParentSpanID == "0102030405060708" },
+		},
+		{
+			name: "server",
+			data: &trace.SpanData{SpanKind: trace.SpanKindServer},
+			want: func(s otlpSpan) bool { return s.Kind == otlpKindServer },
+		},
+		{
+			name: "client",
+			data: &trace.SpanData{SpanKind: trace.SpanKindClient},
+			want: func(s otlpSpan) bool { return s.Kind == otlpKindClient },
+		},
+		{
+			name: "ok",
+			data: &trace.SpanData{},
+			want: func(s otlpSpan) bool { return s.Status == otlpStatus{} },
+		},
+		{
+			name: "error",
+			data: &trace.SpanData{Status: trace.Status{Code: 5, Message: "not found"}},
+			want: func(s otlpSpan) bool { return s.Status == otlpStatus{Code: otlpStatusError, Message: "not found"} },
+		},
+		{
+			name: "events",
+			data: &trace.SpanData{
+				Annotations:   []trace.Annotation{{Time: start, Message: "cache miss"}},
+				MessageEvents: []trace.MessageEvent{{Time: start, EventType: trace.MessageEventTypeRecv, MessageID: 1}},
+			},
+			want: func(s otlpSpan) bool {
+				return len(s.Events) == 2 && s.Events[0].Name == "cache miss" &&
+					s.Events[1].Name == "message.received" && len(s.Events[1].Attributes) == 3
+			},
+		},
+		{
+			name: "links",
+			data: &trace.SpanData{Links: []trace.Link{{SpanID: parent}}},
+			want: func(s otlpSpan) bool { return len(s.Links) == 1 && s.Links[0].SpanID == "0102030405060708" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newOTLPSpan(tt.data); !tt.want(got) {
+				t.Errorf("newOTLPSpan() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestOTLPAttribute(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "string", value: "a", want: `{"key":"k","value":{"stringValue":"a"}}`},
+		{name: "bool", value: true, want: `{"key":"k","value":{"boolValue":true}}`},
+		{name: "int", value: 7, want: `{"key":"k","value":{"intValue":"7"}}`},
+		{name: "int64", value: int64(1) << 40, want: `{"key":"k","value":{"intValue":"1099511627776"}}`},
+		{name: "float64", value: 1.5, want: `{"key":"k","value":{"doubleValue":1.5}}`},
+		{name: "other", value: time.Second, want: `{"key":"k","value":{"stringValue":"1s"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(otlpAttribute("k", tt.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != tt.want {
+				t.Errorf("otlpAttribute() = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestOTLPExporterQueueFull(t *testing.T) {
+	c := &fakeCollector{t: t}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	core, logs := observer.New(zap.WarnLevel)
+	e, err := newOTLPExporter(OTLPConfig{
+		Endpoint:      strings.TrimPrefix(srv.URL, "http://"),
+		Insecure:      true,
+		BatchSize:     2,
+		MaxQueueSize:  4,
+		FlushInterval: time.Hour,
+		Logger:        zap.New(core),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Holding the exports back as a slow collector would.
+	e.sendMu.Lock()
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		e.ExportSpan(&trace.SpanData{Name: name})
+	}
+	e.sendMu.Unlock()
+	e.shutdown()
+
+	if got := strings.Join(c.spans(), ","); got != "a,b,c,d" {
+		t.Errorf("exported %s, want a,b,c,d", got)
+	}
+
+	entries := logs.FilterMessage("dropped spans, the OTLP export queue was full").All()
+	if len(entries) != 1 || entries[0].ContextMap()["spans"] != int64(2) {
+		t.Errorf("dropped spans logged as %v", entries)
+	}
+}
+
+// otlpSchema mirrors the messages of opentelemetry-proto's
+// ExportTraceServiceRequest in the OTLP/HTTP JSON encoding: the fields by
+// their lowerCamelCase names, the 64-bit integers as strings, the enums as
+// integers and the trace and span IDs as hex.
+var otlpSchema = map[string]map[string]string{
+	"ExportTraceServiceRequest": {"resourceSpans": "[]ResourceSpans"},
+	"ResourceSpans":             {"resource": "Resource", "scopeSpans": "[]ScopeSpans", "schemaUrl": "string"},
+	"Resource":                  {"attributes": "[]KeyValue", "droppedAttributesCount": "uint32"},
+	"ScopeSpans":                {"scope": "InstrumentationScope", "spans": "[]Span", "schemaUrl": "string"},
+	"InstrumentationScope": {
+		"name": "string", "version": "string", "attributes": "[]KeyValue", "droppedAttributesCount": "uint32",
+	},
+	"Span": {
+		"traceId": "traceId", "spanId": "spanId", "traceState": "string", "parentSpanId": "spanId",
+		"flags": "uint32", "name": "string", "kind": "SpanKind",
+		"startTimeUnixNano": "fixed64", "endTimeUnixNano": "fixed64",
+		"attributes": "[]KeyValue", "droppedAttributesCount": "uint32",
+		"events": "[]Event", "droppedEventsCount": "uint32",
+		"links": "[]Link", "droppedLinksCount": "uint32",
+		"status": "Status",
+	},
+	"Event": {"timeUnixNano": "fixed64", "name": "string", "attributes": "[]KeyValue", "droppedAttributesCount": "uint32"},
+	"Link": {
+		"traceId": "traceId", "spanId": "spanId", "traceState": "string",
+		"attributes": "[]KeyValue", "droppedAttributesCount": "uint32", "flags": "uint32",
+	},
+	"Status":   {"message": "string", "code": "StatusCode"},
+	"KeyValue": {"key": "string", "value": "AnyValue"},
+	// A oneof, exactly one is set.
+	"AnyValue": {"stringValue": "string", "boolValue": "bool", "intValue": "int64", "doubleValue": "double"},
+}
+
+// checkOTLP reports where v doesn't match the type typ of otlpSchema.
+func checkOTLP(t *testing.T, path, typ string, v interface{}) {
+	t.Helper()
+
+	if strings.HasPrefix(typ, "[]") {
+		items, ok := v.([]interface{})
+		if !ok {
+			t.Errorf("%s: %v isn't a list", path, v)
+			return
+		}
+
+		for i, item := range items {
+			checkOTLP(t, path+"["+strconv.Itoa(i)+"]", typ[2:], item)
+		}
+		return
+	}
+
+	hexOf := func(n int) bool {
+		s, ok := v.(string)
+		if !ok || len(s) != n {
+			return false
+		}
+		_, err := hex.DecodeString(s)
+		return err == nil
+	}
+
+	var ok bool
+	switch typ {
+	case "string":
+		_, ok = v.(string)
+	case "bool":
+		_, ok = v.(bool)
+	case "double":
+		_, ok = v.(float64)
+	case "int64", "fixed64":
+		s, isString := v.(string)
+		_, err := strconv.ParseInt(s, 10, 64)
+		ok = isString && err == nil
+	case "uint32":
+		n, isNumber := v.(float64)
+		ok = isNumber && n >= 0 && n == float64(uint32(n))
+	case "SpanKind":
+		n, isNumber := v.(float64)
+		ok = isNumber && n >= 0 && n <= 5 && n == float64(int(n))
+	case "StatusCode":
+		n, isNumber := v.(float64)
+		ok = isNumber && n >= 0 && n <= 2 && n == float64(int(n))
+	case "traceId":
+		ok = hexOf(32)
+	case "spanId":
+		ok = hexOf(16)
+	default:
+		fields, known := otlpSchema[typ]
+		if !known {
+			t.Fatalf("%s: unknown type %s", path, typ)
+		}
+
+		obj, isObject := v.(map[string]interface{})
+		if !isObject {
+			break
+		}
+		ok = true
+
+		if typ == "AnyValue" && len(obj) != 1 {
+			t.Errorf("%s: %d values set", path, len(obj))
+		}
+
+		for k, fv := range obj {
+			ft, known := fields[k]
+			if !known {
+				t.Errorf("%s: unknown field %s.%s", path, typ, k)
+				continue
+			}
+			checkOTLP(t, path+"."+k, ft, fv)
+		}
+	}
+
+	if !ok {
+		t.Errorf("%s: %v isn't a %s", path, v, typ)
+	}
+}
+
+func TestOTLPSchema(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	e, err := newOTLPExporter(OTLPConfig{
+		ServiceName:   "users",
+		Endpoint:      strings.TrimPrefix(srv.URL, "http://"),
+		Insecure:      true,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1, 500)
+	attrs := map[string]interface{}{"s": "a", "b": true, "i": 7, "i64": int64(1) << 40, "f": 1.5, "d": time.Second}
+
+	e.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			SpanID:  trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		},
+		ParentSpanID:  trace.SpanID{8, 7, 6, 5, 4, 3, 2, 1},
+		SpanKind:      trace.SpanKindServer,
+		Name:          "/v1/users/{id}",
+		StartTime:     start,
+		EndTime:       start.Add(time.Second),
+		Attributes:    attrs,
+		Annotations:   []trace.Annotation{{Time: start, Message: "cache miss", Attributes: attrs}},
+		MessageEvents: []trace.MessageEvent{{Time: start, EventType: trace.MessageEventTypeSent, MessageID: 1}},
+		Links:         []trace.Link{{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}, Attributes: attrs}},
+		Status:        trace.Status{Code: 5, Message: "not found"},
+	})
+	e.ExportSpan(&trace.SpanData{Name: "root"})
+	e.shutdown()
+
+	var req interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+
+	checkOTLP(t, "request", "ExportTraceServiceRequest", req)
+}
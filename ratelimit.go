@@ -0,0 +1,148 @@
+package drudge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limiter decides whether the call identified by key may proceed.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (bool, error)
+}
+
+// RateLimitKey identifies the caller of a gRPC method for rate limiting.
+type RateLimitKey func(ctx context.Context, method string) string
+
+// DefaultRateLimitKey keys calls by method and ClientIP. Calls proxied by the
+// gateway use the client IP it resolved against Options.TrustedProxies.
+func DefaultRateLimitKey(ctx context.Context, method string) string {
+	var ip string
+	if v := ClientIP(ctx); v != nil {
+		ip = v.String()
+	}
+
+	return method + "|" + ip
+}
+
+// rateLimitUnary rejects calls over the limit with ResourceExhausted. The
+// call proceeds when the limiter fails, so an unreachable store doesn't take
+// the service down.
+func rateLimitUnary(lg *zap.Logger, l Limiter, key RateLimitKey) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if err := rateLimit(ctx, lg, l, key, info.FullMethod); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// rateLimitStream rejects streams over the limit, see rateLimitUnary.
+func rateLimitStream(lg *zap.Logger, l Limiter, key RateLimitKey) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if err := rateLimit(ss.Context(), lg, l, key, info.FullMethod); err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+func rateLimit(ctx context.Context, lg *zap.Logger, l Limiter, key RateLimitKey, method string) error {
+	ok, err := l.Allow(ctx, key(ctx, method))
+	if err != nil {
+		lg.Warn("rate limiter failed, allowing the call", zap.String("method", method), zap.Error(err))
+		return nil
+	}
+
+	if !ok {
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded for %s", method)
+	}
+
+	return nil
+}
+
+// RedisLimiter allows Limit calls per sliding Window for each key, sharing
+// the counts across replicas through Redis. The calls of the previous fixed
+// window count in proportion to its overlap with the sliding one, so bursts
+// can't double the limit across a window boundary.
+type RedisLimiter struct {
+	Client redis.Cmdable
+	Limit  int64
+	Window time.Duration
+
+	// Prefix namespaces the Redis keys, defaulting to "drudge:ratelimit:".
+	Prefix string
+
+	now func() time.Time
+}
+
+// slidingWindow counts the call in KEYS[1], the current window, when the
+// calls of the sliding window, weighing those of KEYS[2], the previous
+// window, by ARGV[1], stay under the limit ARGV[2]. The current window
+// expires once it's no longer the previous one, after ARGV[3] milliseconds.
+var slidingWindow = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local previous = tonumber(redis.call("GET", KEYS[2]) or "0")
+
+if previous * tonumber(ARGV[1]) + current >= tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+
+return 1
+`)
+
+// Allow counts the call when the sliding window ending now has room for it.
+func (l *RedisLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	if l.Window <= 0 {
+		return false, errors.New("RedisLimiter.Window must be positive")
+	}
+
+	prefix := l.Prefix
+	if prefix == "" {
+		prefix = "drudge:ratelimit:"
+	}
+
+	now := time.Now
+	if l.now != nil {
+		now = l.now
+	}
+
+	t := now().UnixNano()
+	window := t / int64(l.Window)
+	// The part of the previous window still within the sliding one.
+	weight := 1 - float64(t%int64(l.Window))/float64(l.Window)
+
+	keys := []string{
+		fmt.Sprintf("%s%s:%d", prefix, key, window),
+		fmt.Sprintf("%s%s:%d", prefix, key, window-1),
+	}
+
+	allowed, err := slidingWindow.Run(l.Client, keys, weight, l.Limit, int64(2*l.Window/time.Millisecond)).Int64()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to count the call in Redis")
+	}
+
+	return allowed == 1, nil
+}
@@ -0,0 +1,297 @@
+package drudge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestDefaultRateLimitKey(t *testing.T) {
+	peerCtx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+	})
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "unknown client", ctx: context.Background(), want: "/svc/Method|"},
+		{name: "peer", ctx: peerCtx, want: "/svc/Method|10.0.0.1"},
+		{
+			name: "resolved by RealIP",
+			ctx:  context.WithValue(peerCtx, clientIPKey{}, net.ParseIP("192.0.2.7")),
+			want: "/svc/Method|192.0.2.7",
+		},
+		{
+			name: "forwarded by the gateway",
+			ctx: metadata.NewIncomingContext(peerCtx, metadata.Pairs(
+				clientIPMetadata, "192.0.2.8",
+				gatewayTokenMetadata, gatewayToken,
+			)),
+			want: "/svc/Method|192.0.2.8",
+		},
+		{
+			name: "forwarded without the token",
+			ctx: metadata.NewIncomingContext(peerCtx, metadata.Pairs(
+				clientIPMetadata, "192.0.2.8",
+			)),
+			want: "/svc/Method|10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DefaultRateLimitKey(tt.ctx, "/svc/Method"); got != tt.want {
+				t.Errorf("DefaultRateLimitKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// limiterFunc adapts a function to Limiter.
+type limiterFunc func(ctx context.Context, key string) (bool, error)
+
+func (f limiterFunc) Allow(ctx context.Context, key string) (bool, error) {
+	return f(ctx, key)
+}
+
+func TestRateLimitInterceptors(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    bool
+		err      error
+		wantCode codes.Code
+		wantCall bool
+	}{
+		{name: "allowed", allow: true, wantCall: true},
+		{name: "over the limit", allow: false, wantCode: codes.ResourceExhausted},
+		{name: "limiter failure", err: errors.New("unreachable"), wantCall: true},
+	}
+
+	key := func(ctx context.Context, method string) string { return "key:" + method }
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotKey string
+			l := limiterFunc(func(ctx context.Context, key string) (bool, error) {
+				gotKey = key
+				return tt.allow, tt.err
+			})
+
+			called := false
+			_, err := rateLimitUnary(zap.NewNop(), l, key)(
+				context.Background(),
+				nil,
+				&grpc.UnaryServerInfo{FullMethod: "/svc/Unary"},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					called = true
+					return nil, nil
+				},
+			)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("unary code = %s, want %s", got, tt.wantCode)
+			}
+
+			if called != tt.wantCall {
+				t.Errorf("unary handler called = %v, want %v", called, tt.wantCall)
+			}
+
+			if gotKey != "key:/svc/Unary" {
+				t.Errorf("unary key = %q", gotKey)
+			}
+
+			called = false
+			err = rateLimitStream(zap.NewNop(), l, key)(
+				nil,
+				&contextStream{ctx: context.Background()},
+				&grpc.StreamServerInfo{FullMethod: "/svc/Stream"},
+				func(srv interface{}, ss grpc.ServerStream) error {
+					called = true
+					return nil
+				},
+			)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("stream code = %s, want %s", got, tt.wantCode)
+			}
+
+			if called != tt.wantCall {
+				t.Errorf("stream handler called = %v, want %v", called, tt.wantCall)
+			}
+
+			if gotKey != "key:/svc/Stream" {
+				t.Errorf("stream key = %q", gotKey)
+			}
+		})
+	}
+}
+
+// contextStream is a grpc.ServerStream with only a context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestRedisLimiter(t *testing.T) {
+	// The start of a window, whatever the window of the cases.
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		limit      int64
+		window     time.Duration
+		prefix     string
+		calls      []time.Duration
+		down       bool
+		wantAllow  []bool
+		wantErr    bool
+		wantPrefix string
+	}{
+		{
+			name:       "under the limit",
+			limit:      2,
+			window:     time.Hour,
+			calls:      []time.Duration{0, time.Minute},
+			wantAllow:  []bool{true, true},
+			wantPrefix: "drudge:ratelimit:key:",
+		},
+		{
+			name:       "over the limit",
+			limit:      1,
+			window:     time.Hour,
+			calls:      []time.Duration{0, time.Minute, 2 * time.Minute},
+			wantAllow:  []bool{true, false, false},
+			wantPrefix: "drudge:ratelimit:key:",
+		},
+		{
+			name:   "previous window weighed",
+			limit:  2,
+			window: time.Minute,
+			// Most of the previous window's calls still count right
+			// after the boundary, where a fixed window would allow 2
+			// more calls.
+			calls:      []time.Duration{58 * time.Second, 59 * time.Second, 61 * time.Second, 62 * time.Second},
+			wantAllow:  []bool{true, true, true, false},
+			wantPrefix: "drudge:ratelimit:key:",
+		},
+		{
+			name:       "previous window expired",
+			limit:      1,
+			window:     time.Minute,
+			calls:      []time.Duration{0, 2 * time.Minute},
+			wantAllow:  []bool{true, true},
+			wantPrefix: "drudge:ratelimit:key:",
+		},
+		{
+			name:       "prefix",
+			limit:      1,
+			window:     time.Hour,
+			prefix:     "svc:",
+			calls:      []time.Duration{0},
+			wantAllow:  []bool{true},
+			wantPrefix: "svc:key:",
+		},
+		{name: "no window", limit: 1, calls: []time.Duration{0}, wantErr: true},
+		{name: "redis failure", limit: 1, window: time.Hour, calls: []time.Duration{0}, down: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr, err := miniredis.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mr.Close()
+
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer client.Close()
+
+			if tt.down {
+				mr.Close()
+			}
+
+			var now time.Time
+			l := &RedisLimiter{Client: client, Limit: tt.limit, Window: tt.window, Prefix: tt.prefix, now: func() time.Time { return now }}
+
+			for i, at := range tt.calls {
+				if i > 0 {
+					mr.FastForward(at - tt.calls[i-1])
+				}
+				now = start.Add(at)
+
+				ok, err := l.Allow(context.Background(), "key")
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Allow() error = %v, wantErr %v", err, tt.wantErr)
+				}
+
+				if tt.wantErr {
+					return
+				}
+
+				if ok != tt.wantAllow[i] {
+					t.Errorf("Allow() call %d = %v, want %v", i, ok, tt.wantAllow[i])
+				}
+			}
+
+			for _, k := range mr.Keys() {
+				if !strings.HasPrefix(k, tt.wantPrefix) {
+					t.Errorf("key %q doesn't start with %q", k, tt.wantPrefix)
+				}
+
+				if ttl := mr.TTL(k); ttl <= 0 || ttl > 2*tt.window {
+					t.Errorf("key %q expires in %s, want at most %s", k, ttl, 2*tt.window)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisLimiterShared(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	// Two replicas, each with its own client.
+	var limiters []*RedisLimiter
+	for i := 0; i < 2; i++ {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		defer client.Close()
+
+		limiters = append(limiters, &RedisLimiter{Client: client, Limit: 3, Window: time.Hour})
+	}
+
+	want := []bool{true, true, true, false, false}
+	for i, w := range want {
+		ok, err := limiters[i%2].Allow(context.Background(), "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != w {
+			t.Errorf("call %d on replica %d = %t, want %t", i, i%2, ok, w)
+		}
+	}
+
+	// A key of its own isn't limited by the others.
+	if ok, err := limiters[1].Allow(context.Background(), "other"); err != nil || !ok {
+		t.Errorf("Allow() other key = %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,88 @@
+package drudge
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PanicError is the error of a handler that panicked, as passed to
+// Options.OnRequestError. Its status is Internal.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// GRPCStatus lets status.FromError and status.Code report the panic as
+// Internal.
+func (e *PanicError) GRPCStatus() *status.Status {
+	return status.New(codes.Internal, e.Error())
+}
+
+// errInternal is returned to clients in place of a panic, whose details stay
+// on the server.
+var errInternal = status.Error(codes.Internal, "internal error")
+
+// recoverUnary turns panics into Internal errors and passes the handler's
+// errors, panics included, to onError.
+func recoverUnary(onError func(context.Context, string, error)) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				resp, err = nil, errInternal
+				notifyError(ctx, onError, info.FullMethod, &PanicError{Value: r, Stack: debug.Stack()})
+			}
+		}()
+
+		resp, err = handler(ctx, req)
+		notifyError(ctx, onError, info.FullMethod, err)
+
+		return resp, err
+	}
+}
+
+// recoverStream is the stream counterpart of recoverUnary.
+func recoverStream(onError func(context.Context, string, error)) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errInternal
+				notifyError(ss.Context(), onError, info.FullMethod, &PanicError{Value: r, Stack: debug.Stack()})
+			}
+		}()
+
+		err = handler(srv, ss)
+		notifyError(ss.Context(), onError, info.FullMethod, err)
+
+		return err
+	}
+}
+
+func notifyError(ctx context.Context, onError func(context.Context, string, error), method string, err error) {
+	if err == nil || onError == nil {
+		return
+	}
+
+	onError(ctx, method, err)
+}
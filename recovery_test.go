@@ -0,0 +1,88 @@
+package drudge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecover(t *testing.T) {
+	failed := status.Error(codes.NotFound, "no such user")
+
+	tests := []struct {
+		name        string
+		handler     func() error
+		wantCode    codes.Code
+		wantNotify  bool
+		wantPanic   bool
+		wantMessage string
+	}{
+		{name: "ok", handler: func() error { return nil }, wantCode: codes.OK},
+		{name: "error", handler: func() error { return failed }, wantCode: codes.NotFound, wantNotify: true, wantMessage: "no such user"},
+		{
+			name:        "panic",
+			handler:     func() error { panic("boom") },
+			wantCode:    codes.Internal,
+			wantNotify:  true,
+			wantPanic:   true,
+			wantMessage: "internal error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, kind := range []string{"unary", "stream"} {
+				var notified error
+				onError := func(ctx context.Context, method string, err error) {
+					if method != "/pkg.Service/Method" {
+						t.Errorf("%s: method = %s", kind, method)
+					}
+					notified = err
+				}
+
+				var err error
+				if kind == "unary" {
+					_, err = recoverUnary(onError)(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"},
+						func(ctx context.Context, req interface{}) (interface{}, error) { return nil, tt.handler() })
+				} else {
+					err = recoverStream(onError)(nil, &contextStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: "/pkg.Service/Method"},
+						func(srv interface{}, ss grpc.ServerStream) error { return tt.handler() })
+				}
+
+				if code := status.Code(err); code != tt.wantCode {
+					t.Errorf("%s: code = %s, want %s", kind, code, tt.wantCode)
+				}
+
+				if tt.wantMessage != "" && status.Convert(err).Message() != tt.wantMessage {
+					t.Errorf("%s: message = %q, want %q", kind, status.Convert(err).Message(), tt.wantMessage)
+				}
+
+				if (notified != nil) != tt.wantNotify {
+					t.Errorf("%s: notified %v", kind, notified)
+				}
+
+				p, isPanic := notified.(*PanicError)
+				if isPanic != tt.wantPanic {
+					t.Errorf("%s: notified %T", kind, notified)
+				}
+
+				if isPanic && (p.Value != "boom" || len(p.Stack) == 0 || status.Code(p) != codes.Internal) {
+					t.Errorf("%s: PanicError = %v", kind, p)
+				}
+			}
+		})
+	}
+}
+
+func TestRecoverWithoutOnError(t *testing.T) {
+	_, err := recoverUnary(nil)(context.Background(), nil, &grpc.UnaryServerInfo{},
+		func(ctx context.Context, req interface{}) (interface{}, error) { return nil, errors.New("failed") })
+
+	if err == nil || err.Error() != "failed" {
+		t.Errorf("error = %v", err)
+	}
+}
@@ -0,0 +1,518 @@
+package drudge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// unmatchedRoute labels the requests the gateway has no route for.
+const unmatchedRoute = "unmatched"
+
+// routeSegment is a path segment of a route template: a literal, or a "*" or
+// "**" wildcard.
+type routeSegment string
+
+// route is a gateway route, as declared by the google.api.http annotation of
+// a gRPC method.
+type route struct {
+	method   string
+	template string
+	segments []routeSegment
+	verb     string
+}
+
+// parseRoute parses the path template of a google.api.http rule, e.g.
+// "/v1/{name=shelves/*}/books:list". Variables are matched by their segments,
+// "*" when they have none.
+func parseRoute(method, template string) (route, error) {
+	rt := route{method: method, template: strings.Replace(template, "=*}", "}", -1)}
+	if !strings.HasPrefix(template, "/") {
+		return rt, errors.Errorf("route template '%s' doesn't start with '/'", template)
+	}
+
+	path := template[1:]
+	if i := strings.LastIndex(path, ":"); i >= 0 && !strings.ContainsAny(path[i:], "/}") {
+		path, rt.verb = path[:i], path[i+1:]
+	}
+
+	for path != "" {
+		if path[0] == '{' {
+			end := strings.IndexByte(path, '}')
+			if end < 0 {
+				return rt, errors.Errorf("unterminated variable in route template '%s'", template)
+			}
+
+			sub := "*"
+			if eq := strings.IndexByte(path[:end], '='); eq >= 0 {
+				sub = path[eq+1 : end]
+			}
+			for _, seg := range strings.Split(sub, "/") {
+				rt.segments = append(rt.segments, routeSegment(seg))
+			}
+
+			path = path[end+1:]
+		} else {
+			end := strings.IndexByte(path, '/')
+			if end < 0 {
+				end = len(path)
+			}
+
+			rt.segments = append(rt.segments, routeSegment(path[:end]))
+			path = path[end:]
+		}
+
+		if path == "" {
+			break
+		}
+		if path[0] != '/' || len(path) == 1 {
+			return rt, errors.Errorf("malformed route template '%s'", template)
+		}
+		path = path[1:]
+	}
+
+	return rt, nil
+}
+
+// match reports whether the path components and verb, split like the
+// gateway's mux does, match the route.
+func (rt route) match(components []string, verb string) bool {
+	if verb != rt.verb {
+		if rt.verb != "" {
+			return false
+		}
+
+		// The gateway tries the colon as part of the last segment too.
+		components = append([]string(nil), components...)
+		components[len(components)-1] += ":" + verb
+	}
+
+	if len(rt.segments) == 0 {
+		return len(components) == 1 && components[0] == ""
+	}
+
+	for i, seg := range rt.segments {
+		switch seg {
+		case "**":
+			// The rest of the template matches the last components.
+			tail := rt.segments[i+1:]
+			if len(components)-i < len(tail) {
+				return false
+			}
+
+			return route{segments: tail}.matchAll(components[len(components)-len(tail):])
+		case "*":
+			if i >= len(components) {
+				return false
+			}
+		default:
+			if i >= len(components) || components[i] != string(seg) {
+				return false
+			}
+		}
+	}
+
+	return len(components) == len(rt.segments)
+}
+
+// matchAll matches every component with the segments, which are free of "**".
+func (rt route) matchAll(components []string) bool {
+	for i, seg := range rt.segments {
+		if seg != "*" && components[i] != string(seg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitPath splits the path like the gateway's mux does, the verb following
+// the last colon of the last component.
+func splitPath(path string) ([]string, string) {
+	components := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	last := len(components) - 1
+
+	var verb string
+	if idx := strings.LastIndex(components[last], ":"); idx > 0 {
+		components[last], verb = components[last][:idx], components[last][idx+1:]
+	}
+
+	return components, verb
+}
+
+// serviceRoutes returns the routes declared by the google.api.http
+// annotations of the services registered on rpc, whose generated code
+// registers their file descriptor, whether or not their gateway handlers are
+// registered. Routes registered on the gateway otherwise, e.g. from a YAML
+// gRPC API configuration, aren't known.
+func serviceRoutes(rpc *grpc.Server) []route {
+	info := rpc.GetServiceInfo()
+
+	names := make([]string, 0, len(info))
+	for name := range info {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var routes []route
+	for _, name := range names {
+		file, ok := info[name].Metadata.(string)
+		if !ok {
+			continue
+		}
+
+		fd, err := fileDescriptor(file)
+		if err != nil {
+			continue
+		}
+
+		for _, svc := range fd.GetService() {
+			if fullName(fd.GetPackage(), svc.GetName()) != name {
+				continue
+			}
+
+			for _, m := range svc.GetMethod() {
+				ext, err := proto.GetExtension(m.GetOptions(), annotations.E_Http)
+				if err != nil {
+					continue
+				}
+
+				if rule, ok := ext.(*annotations.HttpRule); ok {
+					routes = append(routes, ruleRoutes(rule)...)
+				}
+			}
+		}
+	}
+
+	return routes
+}
+
+// ruleRoutes returns the routes of the rule and its additional bindings.
+func ruleRoutes(rule *annotations.HttpRule) []route {
+	var method, template string
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		method, template = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		method, template = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		method, template = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		method, template = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		method, template = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		method, template = p.Custom.GetKind(), p.Custom.GetPath()
+	}
+
+	var routes []route
+	if rt, err := parseRoute(method, template); err == nil && method != "" {
+		routes = append(routes, rt)
+	}
+
+	for _, b := range rule.GetAdditionalBindings() {
+		routes = append(routes, ruleRoutes(b)...)
+	}
+
+	return routes
+}
+
+// fileDescriptor decodes the descriptor registered for the proto file, by
+// golang/protobuf or gogo/protobuf generated code.
+func fileDescriptor(file string) (*descriptor.FileDescriptorProto, error) {
+	gz := proto.FileDescriptor(file)
+	if gz == nil {
+		gz = gogoproto.FileDescriptor(file)
+	}
+	if gz == nil {
+		return nil, errors.Errorf("no descriptor registered for '%s'", file)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress the descriptor of '%s'", file)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress the descriptor of '%s'", file)
+	}
+
+	fd := &descriptor.FileDescriptorProto{}
+	if err := proto.Unmarshal(b, fd); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the descriptor of '%s'", file)
+	}
+
+	return fd, nil
+}
+
+func fullName(pkg, name string) string {
+	if pkg == "" {
+		return name
+	}
+
+	return pkg + "." + name
+}
+
+// routeTable resolves the route template, e.g. "/v1/users/{id}", matched by
+// a gateway request, bounding the cardinality of metric labels and span
+// names compared to raw paths.
+type routeTable struct {
+	mu     sync.RWMutex
+	routes []route
+
+	// mux, when set, names the requests served beside the gateway after
+	// their pattern, such as "/version".
+	mux *http.ServeMux
+
+	// slash and overrides normalize the requests like normalizeSlash and
+	// overrideMethod do before they reach the gateway.
+	slash     TrailingSlash
+	overrides []string
+}
+
+// newRouteTable records the routes of the services registered on rpc.
+func newRouteTable(rpc *grpc.Server, beside *http.ServeMux, slash TrailingSlash, overrides []string) *routeTable {
+	return &routeTable{
+		routes:    serviceRoutes(rpc),
+		mux:       beside,
+		slash:     slash,
+		overrides: overrides,
+	}
+}
+
+// reload records the routes of the services registered on rpc since, e.g.
+// with Server.Register.
+func (t *routeTable) reload(rpc *grpc.Server) {
+	routes := serviceRoutes(rpc)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.routes = routes
+}
+
+// methodOrder sorts the allowed methods, the custom ones last.
+var methodOrder = map[string]int{
+	http.MethodGet:    1,
+	http.MethodPost:   2,
+	http.MethodPut:    3,
+	http.MethodPatch:  4,
+	http.MethodDelete: 5,
+}
+
+// allowed returns the methods routed by the gateway for the path of r.
+func (t *routeTable) allowed(r *http.Request) []string {
+	if t == nil || !strings.HasPrefix(r.URL.Path, "/") {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	components, verb := splitPath(t.normalizePath(r.URL.Path))
+
+	seen := map[string]bool{}
+	var methods []string
+	for _, rt := range t.routes {
+		if !seen[rt.method] && rt.match(components, verb) {
+			seen[rt.method] = true
+			methods = append(methods, rt.method)
+		}
+	}
+
+	sort.Slice(methods, func(i, j int) bool {
+		oi, oj := methodOrder[methods[i]], methodOrder[methods[j]]
+		switch {
+		case oi == 0 && oj == 0:
+			return methods[i] < methods[j]
+		case oi == 0 || oj == 0:
+			return oj == 0
+		default:
+			return oi < oj
+		}
+	})
+
+	return methods
+}
+
+// normalizePath trims the trailing slashes like normalizeSlash does.
+func (t *routeTable) normalizePath(path string) string {
+	if p := strings.TrimRight(path, "/"); t.slash != "" && p != "" {
+		return p
+	}
+
+	return path
+}
+
+// template returns the template of the route matching r, or unmatchedRoute.
+func (t *routeTable) template(r *http.Request) string {
+	if t == nil || !strings.HasPrefix(r.URL.Path, "/") {
+		return unmatchedRoute
+	}
+
+	if t.mux != nil {
+		// The gateway is mounted at "/".
+		if _, pattern := t.mux.Handler(r); pattern != "/" && pattern != "" {
+			return pattern
+		}
+	}
+
+	path := t.normalizePath(r.URL.Path)
+
+	method := r.Method
+	if override := r.Header.Get(methodOverrideHeader); method == http.MethodPost && override != "" {
+		for _, m := range t.overrides {
+			if strings.EqualFold(m, strings.TrimSpace(override)) {
+				method = strings.ToUpper(m)
+			}
+		}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	components, verb := splitPath(path)
+	for _, rt := range t.routes {
+		if rt.method == method && rt.match(components, verb) {
+			return rt.template
+		}
+	}
+
+	return unmatchedRoute
+}
+
+type routeKey struct{}
+
+type serviceNameKey struct{}
+
+// routeLabel returns the route of the request, or unmatchedRoute, labeling
+// its metrics and spans.
+func routeLabel(ctx context.Context) string {
+	if route := RouteFromContext(ctx); route != "" {
+		return route
+	}
+
+	return unmatchedRoute
+}
+
+// routeMetadata forwards the route template of a gateway request to the gRPC
+// server, which only trusts it with the gateway's token.
+const routeMetadata = "drudge-route"
+
+// RouteFromContext returns the template of the gateway route matched by the
+// request, e.g. "/v1/users/{id}", in both HTTP handlers and the gRPC
+// handlers called by the gateway. It's empty when no route matched.
+func RouteFromContext(ctx context.Context) string {
+	route, _ := ctx.Value(routeKey{}).(string)
+	return route
+}
+
+// ServiceNameFromContext returns Options.ServiceName in HTTP and gRPC
+// handlers.
+func ServiceNameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(serviceNameKey{}).(string)
+	return name
+}
+
+// withRouteInfo adds the matched route and the service name to the context
+// of the requests served by h. The route is resolved once, for the metrics,
+// spans and handlers to read it from the context.
+func withRouteInfo(service string, routes *routeTable, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), serviceNameKey{}, service)
+		if route := routes.template(r); route != unmatchedRoute {
+			ctx = context.WithValue(ctx, routeKey{}, route)
+		}
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// routeMetadataAnnotator forwards the route of the request to the gRPC
+// server, with the token that has it trusted.
+func routeMetadataAnnotator(ctx context.Context, r *http.Request) metadata.MD {
+	route := RouteFromContext(r.Context())
+	if route == "" || gatewayToken == "" {
+		return nil
+	}
+
+	return metadata.Pairs(routeMetadata, route, gatewayTokenMetadata, gatewayToken)
+}
+
+// routeInfoUnary adds the route forwarded by the gateway and the service name
+// to the call's context, tags and span.
+func routeInfoUnary(service string) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		return handler(withCallRouteInfo(ctx, service), req)
+	}
+}
+
+// routeInfoStream is the stream counterpart of routeInfoUnary.
+func routeInfoStream(service string) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = withCallRouteInfo(ss.Context(), service)
+
+		return handler(srv, wrapped)
+	}
+}
+
+func withCallRouteInfo(ctx context.Context, service string) context.Context {
+	ctx = context.WithValue(ctx, serviceNameKey{}, service)
+	tags := grpc_ctxtags.Extract(ctx)
+	if service != "" {
+		tags.Set("service", service)
+	}
+
+	// Direct gRPC clients can't name the route, which labels the metrics.
+	md, _ := metadata.FromIncomingContext(ctx)
+	routes := md.Get(routeMetadata)
+	if len(routes) == 0 || !fromGateway(md) {
+		return ctx
+	}
+
+	route := routes[len(routes)-1]
+	tags.Set("route", route)
+	setSpanRoute(ctx, route)
+
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+// setSpanRoute adds the route to the spans of the request.
+func setSpanRoute(ctx context.Context, route string) {
+	if span := trace.FromContext(ctx); span != nil {
+		span.AddAttributes(trace.StringAttribute("http.route", route))
+	}
+
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		sp.SetTag("http.route", route)
+	}
+}
@@ -0,0 +1,474 @@
+package drudge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		template     string
+		wantTemplate string
+		wantSegments []routeSegment
+		wantVerb     string
+		wantErr      bool
+	}{
+		{template: "/", wantTemplate: "/"},
+		{template: "/v1/users", wantTemplate: "/v1/users", wantSegments: []routeSegment{"v1", "users"}},
+		{template: "/v1/users/{id}", wantTemplate: "/v1/users/{id}", wantSegments: []routeSegment{"v1", "users", "*"}},
+		{template: "/v1/users/{id=*}", wantTemplate: "/v1/users/{id}", wantSegments: []routeSegment{"v1", "users", "*"}},
+		{
+			template:     "/v1/{name=shelves/*/books/*}",
+			wantTemplate: "/v1/{name=shelves/*/books/*}",
+			wantSegments: []routeSegment{"v1", "shelves", "*", "books", "*"},
+		},
+		{
+			template:     "/v1/{name=files/**}",
+			wantTemplate: "/v1/{name=files/**}",
+			wantSegments: []routeSegment{"v1", "files", "**"},
+		},
+		{
+			template:     "/v1/users/{id}:undelete",
+			wantTemplate: "/v1/users/{id}:undelete",
+			wantSegments: []routeSegment{"v1", "users", "*"},
+			wantVerb:     "undelete",
+		},
+		{template: "v1/users", wantErr: true},
+		{template: "/v1/{id", wantErr: true},
+		{template: "/v1/users/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			rt, err := parseRoute(http.MethodGet, tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRoute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if rt.template != tt.wantTemplate {
+				t.Errorf("template = %q, want %q", rt.template, tt.wantTemplate)
+			}
+
+			if !reflect.DeepEqual(rt.segments, tt.wantSegments) {
+				t.Errorf("segments = %q, want %q", rt.segments, tt.wantSegments)
+			}
+
+			if rt.verb != tt.wantVerb {
+				t.Errorf("verb = %q, want %q", rt.verb, tt.wantVerb)
+			}
+		})
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		want     bool
+	}{
+		{template: "/", path: "/", want: true},
+		{template: "/", path: "/v1", want: false},
+		{template: "/v1/users", path: "/v1/users", want: true},
+		{template: "/v1/users", path: "/v1/users/1", want: false},
+		{template: "/v1/users/{id}", path: "/v1/users/1", want: true},
+		{template: "/v1/users/{id}", path: "/v1/users", want: false},
+		{template: "/v1/users/{id}", path: "/v1/users/1/books", want: false},
+		{template: "/v1/{name=files/**}", path: "/v1/files/a/b/c", want: true},
+		{template: "/v1/{name=files/**}", path: "/v1/files", want: true},
+		{template: "/v1/{name=files/**}", path: "/v1/other/a", want: false},
+		{template: "/v1/{name=files/**}/meta", path: "/v1/files/a/b/meta", want: true},
+		{template: "/v1/{name=files/**}/meta", path: "/v1/files/a/b", want: false},
+		{template: "/v1/users/{id}:undelete", path: "/v1/users/1:undelete", want: true},
+		{template: "/v1/users/{id}:undelete", path: "/v1/users/1", want: false},
+		{template: "/v1/users/{id}:undelete", path: "/v1/users/1:delete", want: false},
+		{template: "/v1/users/{id}", path: "/v1/users/a:b", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template+" "+tt.path, func(t *testing.T) {
+			rt, err := parseRoute(http.MethodGet, tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := rt.match(splitPath(tt.path)); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// operationsServer registers the longrunning Operations service, whose
+// methods are annotated with routes, without implementing it.
+func operationsServer() *grpc.Server {
+	rpc := grpc.NewServer()
+	longrunning.RegisterOperationsServer(rpc, struct{ longrunning.OperationsServer }{})
+
+	return rpc
+}
+
+func TestServiceRoutes(t *testing.T) {
+	var got []string
+	for _, rt := range serviceRoutes(operationsServer()) {
+		got = append(got, rt.method+" "+rt.template)
+	}
+
+	want := []string{
+		"GET /v1/{name=operations}",
+		"GET /v1/{name=operations/**}",
+		"DELETE /v1/{name=operations/**}",
+		"POST /v1/{name=operations/**}:cancel",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceRoutes() = %q, want %q", got, want)
+	}
+
+	if routes := serviceRoutes(grpc.NewServer()); len(routes) != 0 {
+		t.Errorf("serviceRoutes() without services = %v", routes)
+	}
+}
+
+// gogoWidgets registers, in gogo/protobuf's registry only, the descriptor of
+// a Widgets service annotated with HTTP rules, as gogo generated code does.
+func gogoWidgets(t *testing.T) *grpc.ServiceDesc {
+	t.Helper()
+
+	const file = "drudge/test/widgets.proto"
+
+	opts := &descriptor.MethodOptions{}
+	rule := &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/widgets/{id}"}}
+	if err := proto.SetExtension(opts, annotations.E_Http, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := proto.Marshal(&descriptor.FileDescriptorProto{
+		Name:    proto.String(file),
+		Package: proto.String("drudge.test"),
+		Service: []*descriptor.ServiceDescriptorProto{{
+			Name: proto.String("Widgets"),
+			Method: []*descriptor.MethodDescriptorProto{{
+				Name:       proto.String("GetWidget"),
+				InputType:  proto.String(".server.StreamError"),
+				OutputType: proto.String(".server.StreamError"),
+				Options:    opts,
+			}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if gogoproto.FileDescriptor(file) == nil {
+		gogoproto.RegisterFile(file, gz.Bytes())
+	}
+
+	return &grpc.ServiceDesc{
+		ServiceName: "drudge.test.Widgets",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "GetWidget",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				return &StreamError{}, nil
+			},
+		}},
+		Metadata: file,
+	}
+}
+
+func TestServiceRoutesGogo(t *testing.T) {
+	// This package's own generated code registers with gogo/protobuf.
+	fd, err := fileDescriptor("server.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fd.GetMessageType()) == 0 || fd.GetMessageType()[0].GetName() != "StreamError" {
+		t.Errorf("server.proto messages = %v", fd.GetMessageType())
+	}
+
+	rpc := grpc.NewServer()
+	rpc.RegisterService(gogoWidgets(t), struct{}{})
+
+	var got []string
+	for _, rt := range serviceRoutes(rpc) {
+		got = append(got, rt.method+" "+rt.template)
+	}
+
+	if want := []string{"GET /v1/widgets/{id}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceRoutes() = %q, want %q", got, want)
+	}
+}
+
+func TestRouteTableReload(t *testing.T) {
+	rpc := grpc.NewServer()
+	routes := newRouteTable(rpc, nil, "", nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/operations/a", nil)
+	if got := routes.template(r); got != unmatchedRoute {
+		t.Fatalf("template() before registration = %q", got)
+	}
+
+	longrunning.RegisterOperationsServer(rpc, struct{ longrunning.OperationsServer }{})
+	routes.reload(rpc)
+
+	if got := routes.template(r); got != "/v1/{name=operations/**}" {
+		t.Fatalf("template() after reload = %q", got)
+	}
+}
+
+func TestRouteTableAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		slash TrailingSlash
+		want  []string
+	}{
+		{name: "collection", path: "/v1/users", want: []string{"GET", "POST"}},
+		{name: "resource", path: "/v1/users/1", want: []string{"GET", "DELETE"}},
+		{name: "verb", path: "/v1/users/1:undelete", want: []string{"GET", "POST", "DELETE"}},
+		{name: "unknown", path: "/v2/users"},
+		{name: "trailing slash kept", path: "/v1/users/", want: []string{"GET", "DELETE"}},
+		{name: "trailing slash stripped", path: "/v1/users/", slash: TrailingSlashStrip, want: []string{"GET", "POST"}},
+		{name: "root", path: "/"},
+		{name: "deep wildcard", path: "/v1/files/a/b", want: []string{"GET"}},
+		{name: "empty deep wildcard", path: "/v1/files", want: []string{"GET"}},
+	}
+
+	var routes []route
+	for _, r := range [][2]string{
+		{http.MethodGet, "/v1/users"},
+		{http.MethodPost, "/v1/users"},
+		{http.MethodGet, "/v1/users/{id}"},
+		{http.MethodDelete, "/v1/users/{id}"},
+		{http.MethodPost, "/v1/users/{id}:undelete"},
+		{http.MethodGet, "/v1/{name=files/**}"},
+	} {
+		rt, err := parseRoute(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, rt)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &routeTable{routes: routes, slash: tt.slash}
+
+			got := table.allowed(httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("allowed() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var nilTable *routeTable
+	if got := nilTable.allowed(httptest.NewRequest(http.MethodGet, "/", nil)); got != nil {
+		t.Errorf("allowed() of a nil table = %q", got)
+	}
+}
+
+func TestMethodOrder(t *testing.T) {
+	routes := &routeTable{}
+	for _, m := range []string{"PURGE", http.MethodDelete, "COPY", http.MethodPatch, http.MethodGet, http.MethodPut, http.MethodPost} {
+		rt, err := parseRoute(m, "/v1/things")
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes.routes = append(routes.routes, rt)
+	}
+
+	got := routes.allowed(httptest.NewRequest(http.MethodGet, "/v1/things", nil))
+	want := []string{"GET", "POST", "PUT", "PATCH", "DELETE", "COPY", "PURGE"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("allowed() = %q, want %q", got, want)
+	}
+}
+
+func TestRouteTableTemplate(t *testing.T) {
+	beside := http.NewServeMux()
+	beside.Handle("/", http.NotFoundHandler())
+	beside.Handle("/version", http.NotFoundHandler())
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		header    http.Header
+		slash     TrailingSlash
+		overrides []string
+		want      string
+	}{
+		{name: "route", method: http.MethodGet, path: "/v1/operations/a", want: "/v1/{name=operations/**}"},
+		{name: "method", method: http.MethodDelete, path: "/v1/operations/a", want: "/v1/{name=operations/**}"},
+		{name: "verb", method: http.MethodPost, path: "/v1/operations/a:cancel", want: "/v1/{name=operations/**}:cancel"},
+		{name: "wrong method", method: http.MethodPut, path: "/v1/operations/a", want: unmatchedRoute},
+		{name: "unknown", method: http.MethodGet, path: "/v2/things", want: unmatchedRoute},
+		{name: "beside the gateway", method: http.MethodGet, path: "/version", want: "/version"},
+		{name: "trailing slash", method: http.MethodGet, path: "/v1/operations/", slash: TrailingSlashRedirect, want: "/v1/{name=operations}"},
+		{
+			name:      "method override",
+			method:    http.MethodPost,
+			path:      "/v1/operations/a",
+			header:    http.Header{methodOverrideHeader: {"delete"}},
+			overrides: DefaultMethodOverrides,
+			want:      "/v1/{name=operations/**}",
+		},
+		{
+			name:   "method override disabled",
+			method: http.MethodPost,
+			path:   "/v1/operations/a",
+			header: http.Header{methodOverrideHeader: {"DELETE"}},
+			want:   unmatchedRoute,
+		},
+	}
+
+	rpc := operationsServer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := newRouteTable(rpc, beside, tt.slash, tt.overrides)
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v[0])
+			}
+
+			if got := routes.template(r); got != tt.want {
+				t.Errorf("template() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRouteInfo(t *testing.T) {
+	routes := newRouteTable(operationsServer(), nil, "", nil)
+
+	tests := []struct {
+		path      string
+		wantRoute string
+		wantLabel string
+		wantMD    metadata.MD
+	}{
+		{
+			path:      "/v1/operations/a",
+			wantRoute: "/v1/{name=operations/**}",
+			wantLabel: "/v1/{name=operations/**}",
+			wantMD:    metadata.Pairs(routeMetadata, "/v1/{name=operations/**}", gatewayTokenMetadata, gatewayToken),
+		},
+		{path: "/nope", wantLabel: unmatchedRoute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			var (
+				route, label, service string
+				md                    metadata.MD
+			)
+			withRouteInfo("svc", routes, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				route, label = RouteFromContext(r.Context()), routeLabel(r.Context())
+				service = ServiceNameFromContext(r.Context())
+				md = routeMetadataAnnotator(r.Context(), r)
+			})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if route != tt.wantRoute || label != tt.wantLabel || service != "svc" {
+				t.Errorf("route, label, service = %q, %q, %q", route, label, service)
+			}
+
+			if !reflect.DeepEqual(md, tt.wantMD) {
+				t.Errorf("metadata = %v, want %v", md, tt.wantMD)
+			}
+		})
+	}
+}
+
+func TestRouteInfoInterceptors(t *testing.T) {
+	tests := []struct {
+		name      string
+		md        metadata.MD
+		wantRoute string
+	}{
+		{
+			name:      "from the gateway",
+			md:        metadata.Pairs(routeMetadata, "/v1/users/{id}", gatewayTokenMetadata, gatewayToken),
+			wantRoute: "/v1/users/{id}",
+		},
+		{
+			name:      "last value",
+			md:        metadata.Pairs(routeMetadata, "/a", routeMetadata, "/b", gatewayTokenMetadata, gatewayToken),
+			wantRoute: "/b",
+		},
+		{name: "gRPC client", md: metadata.MD{}},
+		{name: "spoofed", md: metadata.Pairs(routeMetadata, "/v1/users/{id}")},
+		{name: "wrong token", md: metadata.Pairs(routeMetadata, "/v1/users/{id}", gatewayTokenMetadata, "guess")},
+		{
+			name: "token not last",
+			md:   metadata.Pairs(routeMetadata, "/v1/users/{id}", gatewayTokenMetadata, gatewayToken, gatewayTokenMetadata, "guess"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+
+			check := func(ctx context.Context) {
+				if got := RouteFromContext(ctx); got != tt.wantRoute {
+					t.Errorf("RouteFromContext() = %q, want %q", got, tt.wantRoute)
+				}
+
+				if got := ServiceNameFromContext(ctx); got != "svc" {
+					t.Errorf("ServiceNameFromContext() = %q", got)
+				}
+
+				tags := grpc_ctxtags.Extract(ctx).Values()
+				if tags["service"] != "svc" {
+					t.Errorf("service tag = %v", tags["service"])
+				}
+
+				if route, _ := tags["route"].(string); route != tt.wantRoute {
+					t.Errorf("route tag = %v, want %q", tags["route"], tt.wantRoute)
+				}
+			}
+
+			unary := grpc_middleware.ChainUnaryServer(grpc_ctxtags.UnaryServerInterceptor(), routeInfoUnary("svc"))
+			_, _ = unary(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				check(ctx)
+				return nil, nil
+			})
+
+			stream := grpc_middleware.ChainStreamServer(grpc_ctxtags.StreamServerInterceptor(), routeInfoStream("svc"))
+			_ = stream(nil, &contextStream{ctx: ctx}, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+				check(ss.Context())
+				return nil
+			})
+		})
+	}
+}
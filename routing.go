@@ -0,0 +1,48 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+)
+
+// routingErrors handles the routing errors of the gateway, passing the others
+// on to next: notFound, when set, serves unknown paths and 405 Method Not
+// Allowed responses list the methods of routes matching the path in the
+// Allow header. It's installed on the server's own mux, so a proto error
+// handler given in Options.Mux replaces it.
+func routingErrors(notFound http.Handler, routes *routeTable, next gwruntime.ProtoErrorHandlerFunc) gwruntime.ProtoErrorHandlerFunc {
+	return func(
+		ctx context.Context,
+		mux *gwruntime.ServeMux,
+		marshaler gwruntime.Marshaler,
+		w http.ResponseWriter,
+		r *http.Request,
+		err error,
+	) {
+		// The gateway reports unknown paths and methods alike.
+		if err != gwruntime.ErrUnknownURI {
+			next(ctx, mux, marshaler, w, r, err)
+			return
+		}
+
+		var allow []string
+		for _, m := range routes.allowed(r) {
+			if m != r.Method {
+				allow = append(allow, m)
+			}
+		}
+
+		switch {
+		case len(allow) > 0:
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			gwruntime.DefaultOtherErrorHandler(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		case notFound != nil:
+			notFound.ServeHTTP(w, r)
+		default:
+			gwruntime.DefaultOtherErrorHandler(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+	}
+}
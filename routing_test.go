@@ -0,0 +1,134 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operationsGateway serves GET /v1/operations/{name=**} and the routing
+// errors of the longrunning Operations service, as the server's mux does.
+func operationsGateway(t *testing.T, notFound http.Handler, mapper func(codes.Code) int) http.Handler {
+	t.Helper()
+
+	routes := newRouteTable(operationsServer(), nil, "", nil)
+	errs := routingErrors(notFound, routes, mappedHTTPError(mapper, gwruntime.DefaultHTTPError))
+	mux := gwruntime.NewServeMux(gwruntime.WithProtoErrorHandler(errs))
+
+	pattern := gwruntime.MustPattern(gwruntime.NewPattern(
+		1,
+		[]int{2, 0, 2, 1, 3, 2, 4, 1, 5, 2},
+		[]string{"v1", "operations", "name"},
+		"",
+	))
+	mux.Handle(http.MethodGet, pattern, func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if params["name"] == "missing" {
+			_, m := gwruntime.MarshalerForRequest(mux, r)
+			gwruntime.HTTPError(r.Context(), mux, m, w, r, status.Error(codes.NotFound, "no such operation"))
+			return
+		}
+
+		_, _ = w.Write([]byte(params["name"]))
+	})
+
+	return withStatusMapper(mapper, mux)
+}
+
+func TestRoutingErrors(t *testing.T) {
+	branded := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"branded":true}`))
+	})
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		notFound  http.Handler
+		wantCode  int
+		wantAllow string
+		wantBody  string
+	}{
+		{name: "routed", method: http.MethodGet, path: "/v1/operations/a/b", wantCode: http.StatusOK, wantBody: "a/b"},
+		{name: "unknown path", method: http.MethodGet, path: "/nope", wantCode: http.StatusNotFound, wantBody: "Not Found\n"},
+		{
+			name:     "unknown path, NotFoundHandler",
+			method:   http.MethodGet,
+			path:     "/nope",
+			notFound: branded,
+			wantCode: http.StatusNotFound,
+			wantBody: `{"branded":true}`,
+		},
+		{
+			name:      "method not allowed",
+			method:    http.MethodPut,
+			path:      "/v1/operations/a",
+			notFound:  branded,
+			wantCode:  http.StatusMethodNotAllowed,
+			wantAllow: "GET, DELETE",
+			wantBody:  "Method Not Allowed\n",
+		},
+		{
+			// The route is annotated but its gateway handler isn't
+			// registered.
+			name:     "unregistered handler",
+			method:   http.MethodDelete,
+			path:     "/v1/operations/a",
+			wantCode: http.StatusMethodNotAllowed,
+			// GET is the only other method routed for the path.
+			wantAllow: "GET",
+			wantBody:  "Method Not Allowed\n",
+		},
+		{
+			name:     "error of the call",
+			method:   http.MethodGet,
+			path:     "/v1/operations/missing",
+			notFound: branded,
+			wantCode: http.StatusNotFound,
+			wantBody: `{"error":"no such operation","code":5,"message":"no such operation"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			operationsGateway(t, tt.notFound, nil).ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRoutingErrorsOverridden(t *testing.T) {
+	routes := newRouteTable(operationsServer(), nil, "", nil)
+	errs := routingErrors(nil, routes, gwruntime.DefaultHTTPError)
+
+	own := func(ctx context.Context, mux *gwruntime.ServeMux, m gwruntime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(http.StatusTeapot)
+	}
+
+	// The options of Options.Mux follow the server's.
+	mux := gwruntime.NewServeMux(gwruntime.WithProtoErrorHandler(errs), gwruntime.WithProtoErrorHandler(own))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nope", nil))
+
+	if w.Code != http.StatusTeapot {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusTeapot)
+	}
+}
@@ -2,41 +2,120 @@ package drudge
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
-	grpc_validator "github.com/grpc-ecosystem/go-grpc-middleware/validator"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 const (
 	GoogleProjectID      = "GCE_PROJECT_ID"
 	GoogleServiceAccount = "GCE_SERVICE_ACCOUNT"
+
+	// DefaultShutdownTimeout bounds the graceful shutdown when
+	// Options.ShutdownTimeout isn't set.
+	DefaultShutdownTimeout = 10 * time.Second
+
+	// DefaultMaxConcurrentStreams bounds the streams a single client
+	// connection may open when Options.MaxConcurrentStreams isn't set.
+	DefaultMaxConcurrentStreams uint32 = 250
 )
 
+// HTTPTimeouts maps onto the timeouts of the http.Server.
+type HTTPTimeouts struct {
+	Read       time.Duration
+	ReadHeader time.Duration
+	Idle       time.Duration
+
+	// Write is left unbounded by default, as it would cut long-lived
+	// streaming responses.
+	Write time.Duration
+}
+
+// DefaultHTTPTimeouts protects the HTTP server from slow clients.
+var DefaultHTTPTimeouts = HTTPTimeouts{
+	Read:       time.Minute,
+	ReadHeader: 10 * time.Second,
+	Idle:       2 * time.Minute,
+}
+
+// withDefaults fills any unset timeout from DefaultHTTPTimeouts.
+func (t HTTPTimeouts) withDefaults() HTTPTimeouts {
+	if t.Read == 0 {
+		t.Read = DefaultHTTPTimeouts.Read
+	}
+
+	if t.ReadHeader == 0 {
+		t.ReadHeader = DefaultHTTPTimeouts.ReadHeader
+	}
+
+	if t.Idle == 0 {
+		t.Idle = DefaultHTTPTimeouts.Idle
+	}
+
+	if t.Write == 0 {
+		t.Write = DefaultHTTPTimeouts.Write
+	}
+
+	return t
+}
+
+// listenerDialer is implemented by in-memory listeners, such as bufconn,
+// which hand out client connections themselves.
+type listenerDialer interface {
+	Dial() (net.Conn, error)
+}
+
 // Endpoint describes a gRPC endpoint
 type Endpoint struct {
+	// Network is "tcp" or "unix", defaulting to "tcp". A unix Addr starting
+	// with "@" is in the abstract namespace on Linux, without a file.
 	Network string
 	Addr    string
 }
 
 // Options is a set of options to be passed to Run
 type Options struct {
-	// BasePath is the root path that the HTTP service listens on
+	// ServiceName identifies the service in traces created by drudge
+	ServiceName string
+
+	// BasePath is the root path that the HTTP service listens on, e.g.
+	// "/api/v1". It's stripped before routing, so the gateway, /openapi/ and
+	// /metrics are all served under it.
 	BasePath string
 
 	// Addr is the address to listen
@@ -45,158 +124,1457 @@ type Options struct {
 	// GRPCServer defines an endpoint of a gRPC service
 	RPC Endpoint
 
-	// Defines the RPC Clients to pass requests through
+	// Defines the RPC Clients to pass requests through, each package
+	// exposing a gateway can contribute its own Handler.
 	Handlers []Handler
 
+	// RegisterServices registers each service on the gRPC server after
+	// Services, and its handler on the gateway after GatewayHandlers.
+	RegisterServices []Service
+
 	// SwaggerDir is a path to a directory from which the server
 	// serves swagger specs.
 	SwaggerDir string
 
+	// SwaggerFS serves the swagger files from a file system instead of
+	// SwaggerDir, e.g. one generated into the binary.
+	SwaggerFS http.FileSystem
+
 	// Mux is a list of options to be passed to the grpc-gateway multiplexer
 	Mux []gwruntime.ServeMuxOption
 
+	// Int64AsNumber encodes 64-bit integers in gateway JSON responses as
+	// numbers instead of strings. Marshalers registered through Mux take
+	// precedence.
+	Int64AsNumber bool
+
 	OnRegister func(server *grpc.Server) error
 
+	// Services registers additional gRPC services, in order, after
+	// OnRegister. It lets modular service packages each contribute a registrar.
+	Services []func(*grpc.Server) error
+
+	// GatewayHandlers registers additional gateway handlers, in order, after
+	// Handlers. It's the gateway side of Services.
+	GatewayHandlers []Handler
+
+	// TraceExporter registers the exporter receiving spans, configured by
+	// TraceConfig. Use Multi with a []ExporterConfig to export to several
+	// backends. No exporter is registered when it's nil, spans are only
+	// written to stdout by the Stdout exporter.
 	TraceExporter TraceExporter
 	TraceConfig   interface{}
 
+	// TracePropagation reads the OpenCensus span context of HTTP requests,
+	// defaulting to the W3C traceparent header. Use &b3.HTTPFormat{} for
+	// Zipkin's headers. gRPC calls always use grpc-trace-bin.
+	TracePropagation propagation.HTTPFormat
+
+	// TraceSampler samples the OpenCensus spans of HTTP requests and gRPC
+	// calls, including the gateway's client spans. Without it, the sampler
+	// applied by the exporter decides.
+	TraceSampler trace.Sampler
+
+	// Tracer is used for drudge's own opentracing spans instead of the
+	// global tracer, which is left untouched.
+	Tracer opentracing.Tracer
+
 	Metrics *RegistryHandler
+
+	// PrometheusRegistry, when set, replaces the global Prometheus registry
+	// for the gRPC server metrics and the /metrics endpoint.
+	PrometheusRegistry *prometheus.Registry
+
+	// SpanMetadata allowlists the incoming gRPC metadata keys added to server
+	// spans, defaulting to DefaultSpanMetadata.
+	SpanMetadata []string
+
+	// TagExtractor extracts the request fields tagged on the request's logs,
+	// defaulting to the fields annotated with log_field in the generated
+	// code.
+	TagExtractor grpc_ctxtags.RequestFieldExtractorFunc
+
+	// Interceptors are added to the gRPC server chain, placed relative to
+	// the built-in stages.
+	Interceptors []Interceptor
+
+	// RateLimiter, when set, rejects the gRPC calls over its limit with
+	// ResourceExhausted, 429 Too Many Requests on the gateway. Calls are
+	// keyed by RateLimitKey, defaulting to DefaultRateLimitKey.
+	RateLimiter  Limiter
+	RateLimitKey RateLimitKey
+
+	// AuthFunc, when set, authenticates the gRPC calls, the gateway's
+	// included, failing the others. Services implementing
+	// grpc_auth.ServiceAuthFuncOverride authenticate their own calls.
+	// JWTAuth verifies bearer tokens.
+	AuthFunc grpc_auth.AuthFunc
+
+	// TenantExtractor, when set, extracts the tenant of the gRPC calls, the
+	// gateway's included, e.g. TenantFromHeader. It's available to handlers
+	// with TenantFromContext, tagged on logs and spans, and labels the
+	// drudge_tenant_* metrics. The first MaxTenants tenants seen label
+	// their calls, defaulting to DefaultMaxTenants, the others are labeled
+	// "other".
+	TenantExtractor TenantExtractor
+	MaxTenants      int
+
+	// CircuitBreaker, when set, fails gateway calls fast with 503 Service
+	// Unavailable while the gRPC server keeps failing. Its state is recorded
+	// in CircuitBreakerView.
+	CircuitBreaker *BreakerConfig
+
+	// ValidateAll reports every validation error of a request instead of the
+	// first, for messages generating a ValidateAll method.
+	ValidateAll bool
+
+	// LogUnsampledTraceIDs adds the trace IDs of unsampled requests to their
+	// log lines too, by default only the sampled ones that can be joined to
+	// their trace are.
+	LogUnsampledTraceIDs bool
+
+	// TraceSkipPaths lists the paths served without creating spans, along
+	// with the paths below them, defaulting to DefaultTraceSkipPaths and
+	// MetricsPath. Paths ending with a '/' only skip the paths below.
+	TraceSkipPaths []string
+
+	// HTTPSpanAttributes, when set, adds attributes to the spans of the
+	// HTTP requests, e.g. from their headers.
+	HTTPSpanAttributes SpanAttributes
+
+	// DisableTracing skips the trace exporter and every tracing interceptor
+	// and handler, for services that don't want the overhead.
+	DisableTracing bool
+
+	// DisableMetrics skips the Prometheus interceptors and the /metrics and
+	// /metrics/list endpoints.
+	DisableMetrics bool
+
+	// MetricsPath relocates the /metrics endpoint, the metric list being
+	// served under it at MetricsPath+"/list". It's left untraced unless
+	// TraceSkipPaths is set.
+	MetricsPath string
+
+	// AllowedCIDRs, when set, restricts the HTTP server to clients within the
+	// blocks. DeniedCIDRs rejects the clients within its blocks, taking
+	// precedence. Rejected clients receive 403 Forbidden.
+	AllowedCIDRs []string
+	DeniedCIDRs  []string
+
+	// TrustedProxies lists the CIDR blocks of the proxies whose Forwarded
+	// and X-Forwarded-For headers are trusted to resolve the client's IP,
+	// see ClientIP.
+	TrustedProxies []string
+
+	// MaxHTTPBodyBytes rejects HTTP request bodies larger than the limit with
+	// 413 Request Entity Too Large, zero disables the limit.
+	MaxHTTPBodyBytes int64
+
+	// MaxHTTPBodyExempt lists the path prefixes, such as streaming uploads,
+	// that aren't subject to MaxHTTPBodyBytes.
+	MaxHTTPBodyExempt []string
+
+	// MaxConcurrentRequests bounds the gateway requests served at once,
+	// rejecting those beyond with 503 Service Unavailable. Zero leaves them
+	// unbounded.
+	MaxConcurrentRequests int
+
+	// SlowRequestThreshold, when set, logs the HTTP requests and unary gRPC
+	// calls taking longer at Warn level, counting them in
+	// drudge_slow_requests_total.
+	SlowRequestThreshold time.Duration
+
+	// TimeoutHeader names the header, e.g. "X-Request-Timeout", whose
+	// timeout bounds the gRPC call of a gateway request. Its value is a
+	// duration such as "1.5s" or a number of seconds. The gateway always
+	// honors Grpc-Timeout.
+	TimeoutHeader string
+
+	// MaxRequestTimeout clamps the timeouts requested by clients, zero
+	// leaves them unbounded.
+	MaxRequestTimeout time.Duration
+
+	// ResponseCache, when set, caches the 2xx responses of gateway GET
+	// requests.
+	ResponseCache *CacheConfig
+
+	// CoalesceRequests makes concurrent gateway GET requests for the same
+	// unary call share a single call to the gRPC server. Requests are the
+	// same when their message, Authorization, Cookie and Grpc-Metadata-
+	// headers are.
+	CoalesceRequests bool
+
+	// ETags gives the 2xx responses of gateway GET requests a weak ETag,
+	// answering 304 Not Modified to clients which already have them.
+	ETags bool
+
+	// StatusCodeMapper, when set, maps the gRPC codes of gateway errors,
+	// including those of streams, to HTTP statuses. Returning zero keeps
+	// the gateway's mapping. A proto error handler given in Mux replaces it
+	// for unary calls.
+	StatusCodeMapper func(codes.Code) int
+
+	// TrailingSlash, when set, strips or redirects away the trailing slash
+	// of gateway paths, so "/users/" reaches the route of "/users".
+	TrailingSlash TrailingSlash
+
+	// MethodOverride lists the methods, e.g. DefaultMethodOverrides, that
+	// POST requests reach the gateway as when they name one in their
+	// X-HTTP-Method-Override header. Empty ignores the header.
+	MethodOverride []string
+
+	// NotFoundHandler, when set, serves the requests the gateway has no
+	// route for, e.g. with a branded JSON body. A proto error handler given
+	// in Mux replaces it.
+	NotFoundHandler http.Handler
+
+	// LogBodies logs the request and response bodies of gateway calls at
+	// Debug level, meant for development.
+	LogBodies bool
+
+	// RedactFields lists the dotted JSON field paths, e.g. "user.password",
+	// masked in logged bodies.
+	RedactFields []string
+
+	// MaxLoggedBody caps the bytes logged for each body, defaulting to
+	// DefaultMaxLoggedBody.
+	MaxLoggedBody int
+
+	// BuildInfo is reported by the /version endpoint.
+	BuildInfo BuildInfo
+
+	// EnableConfigEndpoint serves the effective options as JSON at /config,
+	// redacting the TLS material and TraceConfig. It requires AdminAuth.
+	EnableConfigEndpoint bool
+
+	// CORSAllowedOrigins are the origins allowed to make cross-origin
+	// requests to the gateway and gRPC-Web, e.g. "https://app.example.com".
+	// Any origin is allowed when it's empty or holds "*".
+	CORSAllowedOrigins []string
+
+	// CORSAllowCredentials lets cross-origin browsers send cookies and
+	// Authorization headers to the gateway from the origins listed by name
+	// in CORSAllowedOrigins, which it requires. The origins allowed by "*"
+	// never send credentials.
+	CORSAllowCredentials bool
+
+	// CORSMaxAge, when positive, lets browsers cache the preflight
+	// responses, in whole seconds, rather than preflighting every request.
+	CORSMaxAge time.Duration
+
+	// AdminAuth, when set, protects the admin endpoints with HTTP Basic
+	// Auth, checking the credentials, e.g. with BasicCredentials: /metrics
+	// and /metrics/list wherever MetricsPath moves them, /config, /services
+	// and /drain. The gateway, /version and /readyz stay open.
+	AdminAuth func(username, password string) bool
+
+	// EnableDrainEndpoint serves the drain status as JSON at /drain. A POST
+	// marks the server NOT_SERVING and asks for it to be stopped, which Run
+	// does gracefully, see Server.DrainRequested. It requires AdminAuth.
+	EnableDrainEndpoint bool
+
+	// EnableServicesEndpoint serves the registered gRPC services and their
+	// methods as JSON at /services. It requires AdminAuth.
+	EnableServicesEndpoint bool
+
+	// OnRequestError is invoked with the method and error of every failed
+	// gRPC call, e.g. to report them to an error tracker. Panics are
+	// recovered into Internal errors and passed as a *PanicError.
+	OnRequestError func(ctx context.Context, method string, err error)
+
+	// OnShutdown is invoked once the context is done, before the HTTP and
+	// gRPC servers finish stopping. Errors are logged and do not abort the
+	// shutdown.
+	OnShutdown func(context.Context) error
+
+	// ShutdownTimeout bounds the OnShutdown hook and the graceful stop of the
+	// servers, defaulting to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+
+	// DisableSignals stops Run from triggering a graceful shutdown on
+	// SIGINT/SIGTERM, leaving the context as the only way to stop the server.
+	// Signals are handled unless it's set, so the zero Options keep the
+	// default behaviour.
+	DisableSignals bool
+
+	// Signals, when set, replaces SIGINT and SIGTERM as the signals
+	// triggering Run's graceful shutdown, e.g. to stop it from tests. It's
+	// ignored with DisableSignals.
+	Signals <-chan os.Signal
+
+	// SocketMode sets the permissions of the file of RPC's unix socket once
+	// bound, zero keeps the ones of the process's umask.
+	SocketMode os.FileMode
+
+	// SocketGroup changes the group owning the file of RPC's unix socket, by
+	// name or id.
+	SocketGroup string
+
+	// Listener, when set, is used to serve gRPC instead of listening on
+	// RPC.Addr. Listeners that can dial themselves, such as bufconn, are
+	// also used for the gateway's client connection.
+	Listener net.Listener
+
+	// HTTPTimeouts bounds the HTTP server's connections, zero values fall
+	// back to DefaultHTTPTimeouts.
+	HTTPTimeouts HTTPTimeouts
+
+	// EnableH2C serves HTTP/2 over cleartext connections on Addr, which lets
+	// native gRPC clients reach the gRPC server through the HTTP port.
+	EnableH2C bool
+
+	// EnableGRPCWeb serves gRPC-Web requests on Addr, subject to the CORS
+	// options of the gateway.
+	EnableGRPCWeb bool
+
+	// Certificate and CertificateKey are the PEM encoded files used to serve
+	// Addr and RPC.Addr over TLS. They're reloaded when modified or on
+	// SIGHUP, so rotated certificates are served without a restart.
+	Certificate    string
+	CertificateKey string
+
+	// ClientCAs verifies the certificates presented by clients, which are
+	// exposed to handlers through PeerCertificate.
+	ClientCAs *x509.CertPool
+
+	// RequireClientCert rejects clients that don't present a certificate
+	// verified by ClientCAs. The gateway presents Certificate when dialing
+	// RPC.Addr, which must then be verified by ClientCAs too.
+	RequireClientCert bool
+
+	// InsecureRPC serves RPC.Addr without TLS even when Certificate is set,
+	// e.g. for a sidecar on the same host.
+	InsecureRPC bool
+
+	// ClientKeepalive, when set, pings the gRPC server on the gateway's idle
+	// connection. The server's enforcement policy is relaxed to allow it.
+	ClientKeepalive *keepalive.ClientParameters
+
+	// MaxConcurrentStreams limits the concurrent streams of each client
+	// connection, defaulting to DefaultMaxConcurrentStreams. Streams beyond
+	// the limit wait until an earlier one finishes.
+	MaxConcurrentStreams uint32
+
+	// Ready, when set, is closed once both the gRPC and HTTP listeners are
+	// accepting connections.
+	Ready chan<- struct{}
+
+	// InProcess connects the gateway to the gRPC server through memory
+	// instead of dialing RPC.Addr, which becomes optional. Without it,
+	// native clients reach the gRPC server through Addr.
+	InProcess bool
+
+	// DeferServe makes Server.Start open the listeners and dial the gRPC
+	// server without serving them until Server.Serve. Services discovered
+	// in between are registered with Server.Register and
+	// Server.RegisterHandlers. Run doesn't support it.
+	DeferServe bool
+}
+
+// Validate checks that the options required to start the servers are set.
+func (o Options) Validate() error {
+	if o.Addr == "" {
+		return errors.New("Options.Addr is required for the HTTP server")
+	}
+
+	if o.RPC.Addr == "" && o.Listener == nil && !o.InProcess {
+		return errors.New("Options.RPC.Addr, Options.Listener or Options.InProcess is required for the gRPC server")
+	}
+
+	if (o.SocketMode != 0 || o.SocketGroup != "") && o.RPC.Network != "unix" {
+		return errors.New("Options.SocketMode and Options.SocketGroup require the unix network for Options.RPC")
+	}
+
+	if o.BasePath != "" && !strings.HasPrefix(o.BasePath, "/") {
+		return errors.New("Options.BasePath must start with a '/'")
+	}
+
+	if o.MetricsPath != "" && (!strings.HasPrefix(o.MetricsPath, "/") || strings.HasSuffix(o.MetricsPath, "/")) {
+		return errors.New("Options.MetricsPath must start with a '/' and not end with one")
+	}
+
+	if o.MaxConcurrentRequests < 0 {
+		return errors.New("Options.MaxConcurrentRequests can't be negative")
+	}
+
+	if o.MaxTenants < 0 {
+		return errors.New("Options.MaxTenants can't be negative")
+	}
+
+	if o.CORSMaxAge < 0 {
+		return errors.New("Options.CORSMaxAge can't be negative")
+	}
+
+	named := false
+	for _, origin := range o.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || strings.TrimRight(u.Path, "/") != "" {
+			return errors.Errorf("invalid Options.CORSAllowedOrigins origin '%s'", origin)
+		}
+		named = true
+	}
+
+	if o.CORSAllowCredentials && !named {
+		return errors.New("Options.CORSAllowCredentials requires the origins in Options.CORSAllowedOrigins")
+	}
+
+	switch o.TrailingSlash {
+	case "", TrailingSlashStrip, TrailingSlashRedirect:
+	default:
+		return errors.Errorf("unknown Options.TrailingSlash '%s'", o.TrailingSlash)
+	}
+
+	if (o.Certificate == "") != (o.CertificateKey == "") {
+		return errors.New("Options.Certificate and Options.CertificateKey must be set together")
+	}
+
+	if o.Certificate == "" && (o.ClientCAs != nil || o.RequireClientCert) {
+		return errors.New("Options.Certificate is required for client certificate authentication")
+	}
+
+	if o.RequireClientCert && o.ClientCAs == nil {
+		return errors.New("Options.ClientCAs is required when Options.RequireClientCert is set")
+	}
+
+	if o.AdminAuth == nil && (o.EnableDrainEndpoint || o.EnableConfigEndpoint || o.EnableServicesEndpoint) {
+		return errors.New("Options.AdminAuth is required for the drain, config and services endpoints")
+	}
+
+	if _, err := parseCIDRs(o.AllowedCIDRs); err != nil {
+		return errors.Wrap(err, "Options.AllowedCIDRs is invalid")
+	}
+
+	if _, err := parseCIDRs(o.DeniedCIDRs); err != nil {
+		return errors.Wrap(err, "Options.DeniedCIDRs is invalid")
+	}
+
+	if _, err := parseCIDRs(o.TrustedProxies); err != nil {
+		return errors.Wrap(err, "Options.TrustedProxies is invalid")
+	}
+
+	for i, ic := range o.Interceptors {
+		if err := ic.validate(); err != nil {
+			return errors.Wrapf(err, "Options.Interceptors[%d] is invalid", i)
+		}
+	}
+
+	if o.OnRegister == nil && len(o.Services) == 0 && len(o.RegisterServices) == 0 && !o.DeferServe {
+		return errors.New("Options.OnRegister, Options.Services or Options.RegisterServices is required for registering the RPC server")
+	}
+
+	if o.SwaggerDir != "" && o.SwaggerFS != nil {
+		return errors.New("only one of Options.SwaggerDir and Options.SwaggerFS can be set")
+	}
+
+	if o.SwaggerDir != "" {
+		fi, err := os.Stat(o.SwaggerDir)
+		if err != nil {
+			return errors.Wrap(err, "Options.SwaggerDir is invalid")
+		}
+
+		if !fi.IsDir() {
+			return errors.Errorf("Options.SwaggerDir '%s' is not a directory", o.SwaggerDir)
+		}
+	}
+
+	return nil
+}
+
+// gatewayHandlers returns Handlers followed by GatewayHandlers.
+func (o Options) gatewayHandlers() []Handler {
+	return append(append([]Handler(nil), o.Handlers...), o.GatewayHandlers...)
+}
+
+// swaggerFS returns the file system the swagger specs are served from,
+// SwaggerDir by default.
+func (o Options) swaggerFS() http.FileSystem {
+	if o.SwaggerFS == nil {
+		return http.Dir(o.SwaggerDir)
+	}
+
+	return o.SwaggerFS
+}
+
+// metricsPath returns the path of the Prometheus endpoint.
+func (o Options) metricsPath() string {
+	if o.MetricsPath == "" {
+		return DefaultMetricsPath
+	}
+
+	return o.MetricsPath
 }
 
-func Run(ctx context.Context, opts Options) error {
+// traceSkipPaths returns the paths served without spans, the relocated
+// metrics endpoint included by default.
+func (o Options) traceSkipPaths() []string {
+	if len(o.TraceSkipPaths) > 0 {
+		return o.TraceSkipPaths
+	}
+
+	if o.metricsPath() == DefaultMetricsPath {
+		return DefaultTraceSkipPaths
+	}
+
+	return append([]string{o.metricsPath()}, DefaultTraceSkipPaths...)
+}
+
+// tracePropagation returns the HTTP propagation format, honoring the W3C
+// traceparent header sent by most clients by default.
+func (o Options) tracePropagation() propagation.HTTPFormat {
+	if o.TracePropagation == nil {
+		return &tracecontext.HTTPFormat{}
+	}
+
+	return o.TracePropagation
+}
+
+// tracer returns the opentracing tracer used for drudge's spans.
+func (o Options) tracer() opentracing.Tracer {
+	if o.Tracer == nil {
+		return opentracing.GlobalTracer()
+	}
+
+	return o.Tracer
+}
+
+func (o Options) maxConcurrentStreams() uint32 {
+	if o.MaxConcurrentStreams == 0 {
+		return DefaultMaxConcurrentStreams
+	}
+
+	return o.MaxConcurrentStreams
+}
+
+func (o Options) shutdownTimeout() time.Duration {
+	if o.ShutdownTimeout <= 0 {
+		return DefaultShutdownTimeout
+	}
+
+	return o.ShutdownTimeout
+}
+
+// Server is the gRPC server and the HTTP gateway in front of it. Run wraps
+// its lifecycle for services that only need to serve until a signal.
+type Server struct {
+	opts Options
+	lg   *zap.Logger
+
+	tlsConfig      *tls.Config
+	certs          *certReloader
+	serverMetrics  *grpc_prometheus.ServerMetrics
+	gatewayMetrics *httpMetrics
+	tenantMetrics  *tenantMetrics
+	rpc            *grpc.Server
+
+	mu      sync.Mutex
+	started bool
+	serving bool
+	stopped bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mux     *gwruntime.ServeMux
+	routes  *routeTable
+	cleanup []func()
+	conn    *grpc.ClientConn
+	http    *http.Server
+	rpcList net.Listener
+	memList net.Listener
+	httpLst net.Listener
+	errc    chan error
+
+	drain drainer
+}
+
+// replaceGrpcLogger replaces gRPC's logger once per process.
+var replaceGrpcLogger sync.Once
+
+// New validates the options and registers the services on the gRPC server.
+// Nothing listens until Start.
+func New(opts Options) (*Server, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.WithMessage(err, "invalid options")
+	}
+
 	lg := initLogger(-1, time.RFC3339)
 	// Make sure that log statements internal to gRPC library are logged using the zapLogger as well.
-	grpc_zap.ReplaceGrpcLogger(lg)
+	// gRPC's logger can't be replaced while it logs, only the first server's
+	// replaces it.
+	replaceGrpcLogger.Do(func() { grpc_zap.ReplaceGrpcLogger(lg) })
 
 	if opts.Metrics == nil {
-		opts.Metrics = &RegistryHandler{
-			log: lg,
-		}
+		opts.Metrics = DefaultRegistry
 	}
 
-	var flush func()
+	opts.Metrics.setLogger(lg)
 
-	if opts.TraceExporter != nil {
-		var err error
+	s := &Server{
+		opts: opts,
+		lg:   lg,
+		errc: make(chan error, serveGoroutines),
+	}
 
-		flush, err = opts.TraceExporter(opts.TraceConfig)
+	if opts.Certificate != "" {
+		certs, err := newCertReloader(lg, opts.Certificate, opts.CertificateKey)
 		if err != nil {
-			return errors.WithMessage(err, "failed to register trace exporter")
+			return nil, err
 		}
+
+		s.certs = certs
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
+	s.tlsConfig = opts.serverTLSConfig(s.certs)
 
-	defer func() {
-		if cancel != nil {
-			cancel()
+	if !opts.DisableMetrics {
+		var registerer prometheus.Registerer = prometheus.DefaultRegisterer
+
+		s.serverMetrics = grpc_prometheus.DefaultServerMetrics
+		if opts.PrometheusRegistry != nil {
+			registerer = opts.PrometheusRegistry
+			s.serverMetrics = grpc_prometheus.NewServerMetrics()
+			if err := opts.PrometheusRegistry.Register(s.serverMetrics); err != nil {
+				return nil, errors.Wrap(err, "failed to register gRPC server metrics")
+			}
 		}
 
-		if flush != nil {
-			flush()
+		s.gatewayMetrics = newHTTPMetrics()
+		if err := s.gatewayMetrics.register(registerer); err != nil {
+			return nil, err
 		}
 
-		if r := recover(); r != nil {
-			lg.Fatal("Recovered from fatal error", zap.Any("recovery", r))
+		if err := view.Register(HTTPSizeViews...); err != nil {
+			return nil, errors.Wrap(err, "failed to register HTTP size views")
 		}
-	}()
 
-	rpc := grpc.NewServer(
-		grpc_middleware.WithUnaryServerChain(
-			grpc_validator.UnaryServerInterceptor(),
-			grpc_opentracing.UnaryServerInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer())),
-			grpc_ctxtags.UnaryServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
-			grpc_zap.UnaryServerInterceptor(lg, grpc_zap.WithLevels(codeToLevel)),
-			grpc_prometheus.UnaryServerInterceptor,
-		),
-		grpc_middleware.WithStreamServerChain(
-			grpc_validator.StreamServerInterceptor(),
-			grpc_opentracing.StreamServerInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer())),
-			grpc_ctxtags.StreamServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
-			grpc_zap.StreamServerInterceptor(lg, grpc_zap.WithLevels(codeToLevel)),
-			grpc_prometheus.StreamServerInterceptor,
-		),
-		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
-	)
+		if opts.TenantExtractor != nil {
+			s.tenantMetrics = newTenantMetrics(opts.MaxTenants)
+			if err := s.tenantMetrics.register(registerer); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var onSlow func(string)
+	if s.gatewayMetrics != nil {
+		onSlow = s.gatewayMetrics.slowRequest
+	}
 
-	if opts.OnRegister == nil {
-		return errors.New("no register callback was defined, this is required for registering the RPC server")
+	s.rpc = newRPCServer(lg, opts, s.serverMetrics, s.tenantMetrics, s.tlsConfig, onSlow)
+
+	if err := s.register(); err != nil {
+		// Nothing is left behind by a failed registration.
+		s.rpc.Stop()
+		return nil, err
 	}
 
-	if err := opts.OnRegister(rpc); err != nil {
-		return errors.Wrap(err, "failed to register RPC service")
+	if !opts.DisableTracing {
+		grpc.EnableTracing = true
 	}
 
-	grpc.EnableTracing = true
+	if s.serverMetrics != nil {
+		s.serverMetrics.InitializeMetrics(s.rpc)
+	}
 
-	grpc_prometheus.Register(rpc)
+	return s, nil
+}
 
-	list, err := net.Listen("tcp", opts.RPC.Addr)
-	if err != nil {
-		return errors.Wrap(err, "failed to open TCP connection")
+func (s *Server) register() error {
+	if s.opts.OnRegister != nil {
+		if err := s.opts.OnRegister(s.rpc); err != nil {
+			return errors.Wrap(err, "failed to register RPC service")
+		}
 	}
 
-	lg.Info("Serve gRPC", zap.String("address", fmt.Sprintf("http://%s", opts.RPC.Addr)))
+	for i, register := range s.opts.Services {
+		if err := register(s.rpc); err != nil {
+			return errors.Wrapf(err, "failed to register RPC service %d", i)
+		}
+	}
 
-	go func() {
-		lg.Fatal("failed to serve gRPC", zap.Error(rpc.Serve(list)))
+	for _, svc := range s.opts.RegisterServices {
+		svc.RegisterGRPC(s.rpc)
+	}
+
+	return nil
+}
+
+// Start opens the listeners and serves in the background until Stop is
+// called, serving errors are reported by Err. The gateway's handlers are
+// registered with ctx, which must outlive the server.
+func (s *Server) Start(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.stopped:
+		return errors.New("server stopped")
+	case s.started:
+		return errors.New("server already started")
+	}
+	s.started = true
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.ctx = ctx
+
+	// Failures leave nothing behind. The gRPC server can't serve once
+	// stopped, so the server is left stopped rather than started and Stop
+	// has nothing to do.
+	defer func() {
+		if err != nil {
+			s.rpc.Stop()
+			if s.conn != nil {
+				_ = s.conn.Close()
+			}
+			s.closeListeners()
+			s.release()
+
+			s.started, s.stopped = false, true
+			s.conn, s.http = nil, nil
+			s.rpcList, s.memList, s.httpLst = nil, nil, nil
+		}
 	}()
 
-	lg.Info(
+	if s.opts.TraceExporter != nil && !s.opts.DisableTracing {
+		flush, err := s.opts.TraceExporter(s.opts.TraceConfig)
+		if err != nil {
+			return errors.WithMessage(err, "failed to register trace exporter")
+		}
+
+		if flush != nil {
+			s.cleanup = append(s.cleanup, flush)
+		}
+	}
+
+	if s.certs != nil && !s.opts.DisableSignals {
+		s.cleanup = append(s.cleanup, s.certs.reloadOnHangup())
+	}
+
+	list := s.opts.Listener
+	if list == nil && s.opts.RPC.Addr != "" {
+		list, err = listen(s.opts.RPC, s.opts.SocketMode, s.opts.SocketGroup)
+		if err != nil {
+			return err
+		}
+	}
+	s.rpcList = list
+
+	// The gateway dials the in-memory listener in process, list only serves
+	// the other clients.
+	if s.opts.InProcess {
+		s.memList = bufconn.Listen(inProcessBufferSize)
+		list = s.memList
+	}
+
+	rpcAddr := list.Addr().String()
+
+	network := s.opts.RPC.Network
+	if network == "" || s.opts.InProcess {
+		network = list.Addr().Network()
+	}
+
+	s.lg.Info(
 		"Dialing RPC service connection",
-		zap.String("address", opts.RPC.Addr),
-		zap.String("network", opts.RPC.Network),
+		zap.String("address", rpcAddr),
+		zap.String("network", network),
 	)
 
-	conn, err := dial(ctx, opts.RPC.Network, opts.RPC.Addr)
+	dopts, err := s.dialOptions(list)
 	if err != nil {
-		return errors.Wrapf(err, "failed to create network connection for '%s' on '%s'", opts.RPC.Network, opts.RPC.Addr)
+		return err
+	}
+
+	s.conn, err = dial(ctx, network, rpcAddr, dopts...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create network connection for '%s' on '%s'", network, rpcAddr)
+	}
+
+	handler, err := s.handler(ctx)
+	if err != nil {
+		return err
+	}
+
+	timeouts := s.opts.HTTPTimeouts.withDefaults()
+
+	s.http = &http.Server{
+		Addr:              s.opts.Addr,
+		ReadTimeout:       timeouts.Read,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+		Handler:           handler,
+		TLSConfig:         s.tlsConfig,
+	}
+
+	hl, err := net.Listen("tcp", s.opts.Addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to open HTTP listener")
+	}
+	s.httpLst = hl
+
+	if !s.opts.DeferServe {
+		s.serve()
+	}
+
+	return nil
+}
+
+// serveGoroutines is the most goroutines serve starts, each reporting at
+// most one error to Server.errc without a reader.
+const serveGoroutines = 3
+
+// serve serves the listeners opened by Start in the background.
+func (s *Server) serve() {
+	s.serving = true
+	defer s.drain.serve()
+
+	for _, list := range []net.Listener{s.rpcList, s.memList} {
+		if list == nil {
+			continue
+		}
+
+		s.lg.Info("Serve gRPC", zap.String("address", fmt.Sprintf("http://%s", list.Addr())))
+
+		go func(list net.Listener) {
+			if err := s.rpc.Serve(list); err != nil {
+				s.errc <- errors.Wrap(err, "failed to serve gRPC")
+			}
+		}(list)
+	}
+
+	s.lg.Info("starting HTTP server", zap.String("address", s.httpLst.Addr().String()))
+
+	hl := s.httpLst
+	if s.tlsConfig != nil {
+		hl = tls.NewListener(hl, s.tlsConfig)
 	}
 
 	go func() {
-		<-ctx.Done()
-		if err := conn.Close(); err != nil {
-			lg.Fatal("Failed to close a client connection to the gRPC server", zap.Error(err))
+		if err := s.http.Serve(hl); err != http.ErrServerClosed {
+			s.errc <- errors.Wrap(err, "failed to serve HTTP")
 		}
 	}()
 
-	gw, err := newGateway(ctx, conn, opts.Mux, opts.Handlers)
-	if err != nil {
-		return err
+	if s.opts.Ready != nil {
+		close(s.opts.Ready)
+	}
+}
+
+// inProcessBufferSize is the buffer of each in-memory connection of
+// Options.InProcess.
+const inProcessBufferSize = 1 << 20
+
+// ErrServing is returned when registering services once the server serves,
+// which gRPC doesn't allow.
+var ErrServing = errors.New("services can't be registered once the server is serving")
+
+// Register registers more gRPC services, like Options.Services. Services
+// discovered after startup can be registered between Start and Serve with
+// Options.DeferServe.
+func (s *Server) Register(services ...func(*grpc.Server) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.serving {
+		return ErrServing
+	}
+
+	for i, register := range services {
+		if err := register(s.rpc); err != nil {
+			return errors.Wrapf(err, "failed to register RPC service %d", i)
+		}
+	}
+
+	if s.serverMetrics != nil {
+		s.serverMetrics.InitializeMetrics(s.rpc)
 	}
 
+	// Started servers record the gateway routes of the new services.
+	if s.routes != nil {
+		s.routes.reload(s.rpc)
+	}
+
+	return nil
+}
+
+// RegisterHandlers registers more gateway handlers, like Options.Handlers,
+// between Start and Serve.
+func (s *Server) RegisterHandlers(handlers ...Handler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.serving {
+		return ErrServing
+	}
+
+	if !s.started {
+		return errors.New("gateway handlers can only be registered once started")
+	}
+
+	for _, f := range handlers {
+		if err := f(s.ctx, s.mux, s.conn); err != nil {
+			return err
+		}
+	}
+
+	s.routes.reload(s.rpc)
+
+	return nil
+}
+
+// Serve starts serving when Options.DeferServe held it back in Start.
+func (s *Server) Serve() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case !s.started:
+		return errors.New("server not started")
+	case s.stopped:
+		return errors.New("server stopped")
+	case !s.serving:
+		s.serve()
+	}
+
+	return nil
+}
+
+// closeListeners closes the listeners opened by Start once the servers are
+// stopped. The servers close those they serve too, but only once their
+// goroutines run, which may be after Stop returned.
+func (s *Server) closeListeners() {
+	for _, l := range []net.Listener{s.rpcList, s.memList, s.httpLst} {
+		if l != nil {
+			_ = l.Close()
+		}
+	}
+}
+
+// dialOptions configures the gateway's connection to the gRPC server
+// listening on list.
+func (s *Server) dialOptions(list net.Listener) ([]DialOption, error) {
+	dopts := []DialOption{
+		WithServiceName(s.opts.ServiceName),
+		WithTracer(s.opts.tracer()),
+	}
+	if s.opts.DisableTracing {
+		dopts = append(dopts, WithoutTracing())
+	}
+
+	if s.opts.DisableMetrics {
+		dopts = append(dopts, WithoutMetrics())
+	}
+
+	if s.opts.CircuitBreaker != nil {
+		if err := view.Register(CircuitBreakerView); err != nil {
+			return nil, errors.Wrap(err, "failed to register the circuit breaker view")
+		}
+
+		dopts = append(dopts, WithCircuitBreaker(*s.opts.CircuitBreaker))
+	}
+
+	if s.opts.CoalesceRequests {
+		dopts = append(dopts, WithCoalescing())
+	}
+
+	if s.opts.TraceSampler != nil {
+		dopts = append(dopts, WithTraceSampler(s.opts.TraceSampler))
+	}
+
+	if s.opts.ClientKeepalive != nil {
+		dopts = append(dopts, WithKeepalive(*s.opts.ClientKeepalive))
+	}
+
+	if s.tlsConfig != nil && !s.opts.InsecureRPC {
+		dopts = append(dopts, WithTLS(s.opts.gatewayTLSConfig(s.certs)))
+	}
+
+	if d, ok := list.(listenerDialer); ok {
+		dopts = append(dopts, WithDialer(func(context.Context, string) (net.Conn, error) {
+			return d.Dial()
+		}))
+	}
+
+	return dopts, nil
+}
+
+// handler builds the HTTP handler chain in front of the gateway.
+func (s *Server) handler(ctx context.Context) (http.Handler, error) {
+	opts, lg := s.opts, s.lg
+
 	r := http.NewServeMux()
 
-	r.HandleFunc("/openapi/", swaggerServer(lg, opts.SwaggerDir))
+	// Spans and metrics are named after the matched route rather than the
+	// path, whose IDs would explode their cardinality.
+	routes := newRouteTable(s.rpc, r, opts.TrailingSlash, opts.MethodOverride)
+	s.routes = routes
+
+	errs := routingErrors(opts.NotFoundHandler, routes, mappedHTTPError(opts.StatusCodeMapper, gwruntime.DefaultHTTPError))
+	muxOpts := append([]gwruntime.ServeMuxOption{gwruntime.WithProtoErrorHandler(errs)}, opts.Mux...)
+	if opts.Int64AsNumber {
+		muxOpts = append([]gwruntime.ServeMuxOption{
+			gwruntime.WithMarshalerOption(gwruntime.MIMEWildcard, newInt64Marshaler()),
+		}, muxOpts...)
+	}
+
+	mux, err := newGateway(ctx, s.conn, muxOpts, serviceHandlers(opts.gatewayHandlers(), opts.RegisterServices))
+	if err != nil {
+		return nil, err
+	}
+	s.mux = mux
+
+	r.HandleFunc("/openapi/", swaggerServer(lg, opts.swaggerFS()))
+
+	if !opts.DisableMetrics {
+		if err := registerMetrics(lg, r, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	r.Handle("/version", versionHandler(opts.BuildInfo))
+	r.HandleFunc(readyPath, s.drain.readyHandler)
+
+	if opts.EnableConfigEndpoint {
+		r.Handle("/config", requireBasicAuth(opts.AdminAuth, configHandler(opts)))
+	}
+
+	if opts.EnableDrainEndpoint {
+		r.Handle(drainPath, requireBasicAuth(opts.AdminAuth, http.HandlerFunc(s.drain.drainHandler)))
+	}
+
+	if opts.EnableServicesEndpoint {
+		r.Handle("/services", requireBasicAuth(opts.AdminAuth, servicesHandler(s.rpc)))
+	}
+
+	gw := withTimeout(opts.TimeoutHeader, opts.MaxRequestTimeout, withStatusMapper(opts.StatusCodeMapper, mux))
+
+	if opts.CoalesceRequests {
+		gw = coalesceGET(gw)
+	}
+
+	if opts.ResponseCache != nil {
+		gw = cacheResponses(*opts.ResponseCache, gw)
+	}
 
-	// Register Prometheus metrics handler.
-	r.Handle("/metrics", promhttp.Handler())
-	r.Handle("/metrics/list", opts.Metrics)
+	// Outside of the cache, so cached responses are revalidated too.
+	if opts.ETags {
+		gw = withETags(gw)
+	}
+
+	var onShed func()
+	if s.gatewayMetrics != nil {
+		onShed = s.gatewayMetrics.shed.Inc
+	}
+
+	// Shared by the gateway and gRPC requests made through the HTTP server.
+	limiter := newConcurrencyLimiter(opts.MaxConcurrentRequests, onShed)
+
+	// Inside the instrumentation, so rejected requests are counted too.
+	gw = limiter.limit(gw)
+
+	if s.gatewayMetrics != nil {
+		gw = s.gatewayMetrics.instrument(gw)
+	}
+
+	if opts.LogBodies {
+		gw = logBodies(lg, opts.RedactFields, opts.MaxLoggedBody, gw)
+	}
+
+	// Outermost, so the cache, metrics and logs see the normalized path.
+	gw = normalizeSlash(opts.TrailingSlash, overrideMethod(opts.MethodOverride, gw))
 
 	// must be registered last
 	r.Handle("/", gw)
 
-	s := &http.Server{
-		Addr: opts.Addr,
-		Handler: &ochttp.Handler{
-			Handler: tracingWrapper(allowCORS(lg, r)),
-		},
+	var onSlow func(string)
+	if s.gatewayMetrics != nil {
+		onSlow = s.gatewayMetrics.slowRequest
 	}
 
-	go func() {
-		<-ctx.Done()
-		lg.Info("shutting down the http server")
-		if err := s.Shutdown(context.Background()); err != nil {
-			lg.Fatal("failed to shutdown http server", zap.Error(err))
+	// Every request is bounded and tracked for the drain, gRPC's included.
+	guard := func(h http.Handler) http.Handler {
+		return limitBody(opts.MaxHTTPBodyBytes, opts.MaxHTTPBodyExempt, s.drain.track(h))
+	}
+
+	cors := corsPolicy{
+		origins:     opts.CORSAllowedOrigins,
+		credentials: opts.CORSAllowCredentials,
+		maxAge:      opts.CORSMaxAge,
+	}
+
+	var handler http.Handler = allowCORS(lg, cors, gatewayPreflight(routes), guard(r))
+	handler = logSlowHTTP(lg, opts.SlowRequestThreshold, onSlow, handler)
+	if !opts.DisableTracing {
+		handler = withTraceLogger(lg, opts.LogUnsampledTraceIDs, handler)
+		traced := &ochttp.Handler{
+			Handler: tracingWrapper(opts.tracer(), opts.HTTPSpanAttributes, handler),
+			FormatSpanName: func(r *http.Request) string {
+				return routeLabel(r.Context())
+			},
+			Propagation:  opts.tracePropagation(),
+			StartOptions: trace.StartOptions{Sampler: opts.TraceSampler},
 		}
-	}()
+		handler = skipTracing(opts.traceSkipPaths(), traced, handler)
+	}
+
+	handler = withRouteInfo(opts.ServiceName, routes, handler)
+
+	var web http.Handler
+	if opts.EnableGRPCWeb {
+		web = allowCORS(lg, cors, grpcWebPreflight, guard(limiter.limit(grpcWebHandler(s.rpc))))
+	}
 
-	lg.Info("starting HTTP server", zap.String("address", opts.Addr))
+	// grpcWrapper is the only place gRPC requests are split off from the
+	// HTTP chain. They're instrumented by the gRPC server itself, so they're
+	// routed before the HTTP tracing.
+	handler = grpcWrapper(guard(limiter.limit(s.rpc)), web, handler)
+
+	handler = stripBasePath(opts.BasePath, handler)
+
+	if s.tlsConfig != nil {
+		handler = withPeerCertificate(handler)
+	}
 
-	if err := s.ListenAndServe(); err != http.ErrServerClosed {
-		lg.Fatal("failed to listen and serve", zap.Error(err))
+	// Validate made sure the blocks parse.
+	allowed, _ := parseCIDRs(opts.AllowedCIDRs)
+	denied, _ := parseCIDRs(opts.DeniedCIDRs)
+	trusted, _ := parseCIDRs(opts.TrustedProxies)
+
+	// The filter covers gRPC requests made through the HTTP server too.
+	handler = filterIPs(allowed, denied, handler)
+	handler = realIP(trusted, handler)
+
+	if opts.EnableH2C {
+		// h2c must be the outermost handler to see the connection upgrade.
+		handler = h2c.NewHandler(handler, &http2.Server{
+			MaxConcurrentStreams: opts.maxConcurrentStreams(),
+		})
+	}
+
+	return handler, nil
+}
+
+// DrainRequested is closed once the drain endpoint was asked to stop the
+// server, which is then NOT_SERVING. Run stops the server, others should call
+// Stop.
+func (s *Server) DrainRequested() <-chan struct{} {
+	return s.drain.requestedC()
+}
+
+// Err receives the first error of either server once started.
+func (s *Server) Err() <-chan error {
+	return s.errc
+}
+
+// Addr returns the address the HTTP server listens on, nil until started.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.httpLst == nil {
+		return nil
+	}
+
+	return s.httpLst.Addr()
+}
+
+// RPCAddr returns the address the gRPC server listens on, nil until started
+// or when only serving in process.
+func (s *Server) RPCAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rpcList == nil {
+		return nil
+	}
+
+	return s.rpcList.Addr()
+}
+
+// Stop gracefully shuts the servers down, forcing them once ctx is done.
+// /readyz reports NOT_SERVING at once. The OnShutdown hook runs first, while
+// the servers still accept requests. The HTTP requests arriving afterwards
+// are rejected while those in flight finish.
+func (s *Server) Stop(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started || s.stopped {
+		return nil
+	}
+	s.stopped = true
+
+	defer s.release()
+	defer s.closeListeners()
+
+	// Load balancers stop routing to the server while the requests in
+	// flight finish.
+	s.drain.stop()
+
+	if s.opts.OnShutdown != nil {
+		s.lg.Info("running shutdown hook")
+		if herr := s.opts.OnShutdown(ctx); herr != nil {
+			s.lg.Error("shutdown hook failed", zap.Error(herr))
+		}
+	}
+
+	s.lg.Info("draining the http requests in flight")
+	s.drain.drain()
+	if derr := s.drain.wait(ctx); derr != nil {
+		s.lg.Warn("http requests still in flight", zap.Error(derr))
+	}
+
+	if s.http != nil {
+		s.lg.Info("shutting down the http server")
+		if serr := s.http.Shutdown(ctx); serr != nil {
+			s.lg.Error("failed to shutdown http server", zap.Error(serr))
+			err = errors.Wrap(serr, "failed to shutdown http server")
+		}
+	}
+
+	s.lg.Info("shutting down the gRPC server")
+	gracefulStop(ctx, s.rpc)
+
+	if s.conn != nil {
+		if cerr := s.conn.Close(); cerr != nil {
+			s.lg.Error("failed to close a client connection to the gRPC server", zap.Error(cerr))
+		}
+	}
+
+	return err
+}
+
+// release cancels the gateway's context and runs the cleanups registered
+// by Start, flushing the trace exporter.
+func (s *Server) release() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	for i := len(s.cleanup) - 1; i >= 0; i-- {
+		s.cleanup[i]()
+	}
+	s.cleanup = nil
+}
+
+// Run starts the gRPC server and the HTTP gateway in front of it, blocking
+// until the context is done or either server fails. The first server error
+// is returned rather than exiting the process.
+func Run(ctx context.Context, opts Options) (err error) {
+	if opts.DeferServe {
+		return errors.New("Options.DeferServe requires Server.Serve, use New instead of Run")
+	}
+
+	s, err := New(opts)
+	if err != nil {
 		return err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if !opts.DisableSignals {
+		stop := cancelOnSignal(s.lg, opts.Signals, cancel)
+		defer stop()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.lg.Error("Recovered from fatal error", zap.Any("recovery", r))
+			err = errors.Errorf("recovered from fatal error: %v", r)
+		}
+	}()
+
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+	case err = <-s.Err():
+		s.lg.Error("server failed, shutting down", zap.Error(err))
+	case <-s.DrainRequested():
+		s.lg.Info("drain requested, shutting down")
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), opts.shutdownTimeout())
+	defer scancel()
+
+	if serr := s.Stop(sctx); serr != nil && err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// registerMetrics mounts the Prometheus and metric list endpoints. Custom
+// OpenCensus measures are exported onto the same Prometheus registry.
+func registerMetrics(lg *zap.Logger, r *http.ServeMux, opts Options) error {
+	metricsHandler := promhttp.Handler()
+	reg, _ := prometheus.DefaultRegisterer.(*prometheus.Registry)
+	if opts.PrometheusRegistry != nil {
+		reg = opts.PrometheusRegistry
+		metricsHandler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	}
+
+	if reg != nil {
+		if err := exportViews(lg, reg); err != nil {
+			return errors.Wrap(err, "failed to export metrics to Prometheus")
+		}
+	}
+
+	r.Handle(opts.metricsPath(), requireBasicAuth(opts.AdminAuth, metricsHandler))
+	r.Handle(opts.metricsPath()+"/list", requireBasicAuth(opts.AdminAuth, opts.Metrics))
+
 	return nil
 }
+
+// newRPCServer creates the gRPC server with the interceptor chain enabled by
+// the options. serverMetrics, tenantMetrics and onSlow are nil when metrics
+// are disabled.
+func newRPCServer(
+	lg *zap.Logger,
+	opts Options,
+	serverMetrics *grpc_prometheus.ServerMetrics,
+	tenantMetrics *tenantMetrics,
+	tlsConfig *tls.Config,
+	onSlow func(protocol string),
+) *grpc.Server {
+	c := newChain()
+
+	if !opts.DisableTracing {
+		c.add(StageTracing,
+			grpc_opentracing.UnaryServerInterceptor(grpc_opentracing.WithTracer(opts.tracer())),
+			grpc_opentracing.StreamServerInterceptor(grpc_opentracing.WithTracer(opts.tracer())),
+		)
+		c.add(StageTracing,
+			UnaryServerInterceptor(opts.SpanMetadata...),
+			StreamServerInterceptor(opts.SpanMetadata...),
+		)
+	}
+
+	extractor := opts.TagExtractor
+	if extractor == nil {
+		extractor = grpc_ctxtags.CodeGenRequestFieldExtractor
+	}
+
+	c.add(StageTags,
+		grpc_ctxtags.UnaryServerInterceptor(grpc_ctxtags.WithFieldExtractor(extractor)),
+		grpc_ctxtags.StreamServerInterceptor(grpc_ctxtags.WithFieldExtractor(extractor)),
+	)
+	c.add(StageTags, routeInfoUnary(opts.ServiceName), routeInfoStream(opts.ServiceName))
+
+	c.add(StageLogging, traceTagsUnary(opts.LogUnsampledTraceIDs), traceTagsStream(opts.LogUnsampledTraceIDs))
+	c.add(StageLogging,
+		grpc_zap.UnaryServerInterceptor(lg, grpc_zap.WithLevels(codeToLevel)),
+		grpc_zap.StreamServerInterceptor(lg, grpc_zap.WithLevels(codeToLevel)),
+	)
+
+	if opts.SlowRequestThreshold > 0 {
+		c.add(StageLogging, slowUnary(opts.SlowRequestThreshold, onSlow), nil)
+	}
+
+	if serverMetrics != nil {
+		c.add(StageMetrics, serverMetrics.UnaryServerInterceptor(), serverMetrics.StreamServerInterceptor())
+	}
+
+	c.add(StageRecovery, recoverUnary(opts.OnRequestError), recoverStream(opts.OnRequestError))
+
+	if opts.RateLimiter != nil {
+		key := opts.RateLimitKey
+		if key == nil {
+			key = DefaultRateLimitKey
+		}
+
+		c.add(StageRateLimit, rateLimitUnary(lg, opts.RateLimiter, key), rateLimitStream(lg, opts.RateLimiter, key))
+	}
+
+	if opts.AuthFunc != nil {
+		c.add(StageAuth, grpc_auth.UnaryServerInterceptor(opts.AuthFunc), grpc_auth.StreamServerInterceptor(opts.AuthFunc))
+	}
+
+	// The tenant follows authentication, which TenantFromClaim relies on.
+	// The logs, which the tags stage set up, still get it.
+	if opts.TenantExtractor != nil {
+		c.add(StageAuth, tenantUnary(opts.TenantExtractor, tenantMetrics), tenantStream(opts.TenantExtractor, tenantMetrics))
+	}
+
+	c.add(StageValidation, validateUnary(opts.ValidateAll), validateStream(opts.ValidateAll))
+
+	unary, stream := c.build(opts.Interceptors)
+
+	serverOpts := []grpc.ServerOption{
+		grpc_middleware.WithUnaryServerChain(unary...),
+		grpc_middleware.WithStreamServerChain(stream...),
+		grpc.MaxConcurrentStreams(opts.maxConcurrentStreams()),
+	}
+
+	if tlsConfig != nil && !opts.InsecureRPC {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	if opts.ClientKeepalive != nil {
+		// The gateway's pings would otherwise be answered with GOAWAY once
+		// more frequent than the default policy allows.
+		serverOpts = append(serverOpts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             opts.ClientKeepalive.Time,
+			PermitWithoutStream: opts.ClientKeepalive.PermitWithoutStream,
+		}))
+	}
+
+	if !opts.DisableTracing {
+		serverOpts = append(serverOpts, grpc.StatsHandler(&ocgrpc.ServerHandler{
+			StartOptions: trace.StartOptions{Sampler: opts.TraceSampler},
+		}))
+	}
+
+	return grpc.NewServer(serverOpts...)
+}
+
+// cancelOnSignal cancels the server context when a signal is received from
+// sigs, or SIGINT or SIGTERM when it's nil. The returned function removes
+// the signal handler.
+func cancelOnSignal(lg *zap.Logger, sigs <-chan os.Signal, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+
+	var notified chan os.Signal
+	if sigs == nil {
+		notified = make(chan os.Signal, 1)
+		signal.Notify(notified, os.Interrupt, syscall.SIGTERM)
+		sigs = notified
+	}
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			lg.Info("received signal, shutting down", zap.String("signal", sig.String()))
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		if notified != nil {
+			signal.Stop(notified)
+		}
+		close(done)
+	}
+}
+
+// gracefulStop stops the gRPC server, waiting for pending RPCs to finish
+// unless the context expires first.
+func gracefulStop(ctx context.Context, rpc *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		rpc.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		rpc.Stop()
+	}
+}
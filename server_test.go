@@ -0,0 +1,1120 @@
+package drudge
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	hpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+)
+
+func TestMain(m *testing.M) {
+	// gRPC's logger can only be replaced before gRPC is used, tests serving
+	// plain gRPC servers before the first New would race with it.
+	replaceGrpcLogger.Do(func() { grpc_zap.ReplaceGrpcLogger(zap.NewNop()) })
+
+	os.Exit(m.Run())
+}
+
+func TestOptionsValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swagger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "users.json")
+	if err := ioutil.WriteFile(file, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := func(username, password string) bool { return true }
+
+	tests := []struct {
+		name    string
+		opts    func(o *Options)
+		wantErr bool
+	}{
+		{name: "valid", opts: func(o *Options) {}},
+		{name: "no address", opts: func(o *Options) { o.Addr = "" }, wantErr: true},
+		{name: "no RPC endpoint", opts: func(o *Options) { o.RPC = Endpoint{} }, wantErr: true},
+		{name: "in process", opts: func(o *Options) { o.RPC, o.InProcess = Endpoint{}, true }},
+		{name: "socket mode over tcp", opts: func(o *Options) { o.SocketMode = 0600 }, wantErr: true},
+		{name: "socket group over unix", opts: func(o *Options) { o.RPC.Network, o.SocketGroup = "unix", "drudge" }},
+		{name: "relative base path", opts: func(o *Options) { o.BasePath = "api" }, wantErr: true},
+		{name: "base path", opts: func(o *Options) { o.BasePath = "/api" }},
+		{name: "metrics path", opts: func(o *Options) { o.MetricsPath = "/internal/metrics" }},
+		{name: "metrics path trailing slash", opts: func(o *Options) { o.MetricsPath = "/metrics/" }, wantErr: true},
+		{name: "relative metrics path", opts: func(o *Options) { o.MetricsPath = "metrics" }, wantErr: true},
+		{name: "negative concurrency", opts: func(o *Options) { o.MaxConcurrentRequests = -1 }, wantErr: true},
+		{name: "negative tenants", opts: func(o *Options) { o.MaxTenants = -1 }, wantErr: true},
+		{name: "negative CORS max age", opts: func(o *Options) { o.CORSMaxAge = -time.Second }, wantErr: true},
+		{name: "CORS origins", opts: func(o *Options) { o.CORSAllowedOrigins = []string{"*", "https://example.com/"} }},
+		{name: "CORS origin with a path", opts: func(o *Options) { o.CORSAllowedOrigins = []string{"https://example.com/app"} }, wantErr: true},
+		{name: "CORS origin without scheme", opts: func(o *Options) { o.CORSAllowedOrigins = []string{"example.com"} }, wantErr: true},
+		{name: "CORS credentials without origins", opts: func(o *Options) { o.CORSAllowCredentials = true }, wantErr: true},
+		{
+			name:    "CORS credentials with a wildcard origin",
+			opts:    func(o *Options) { o.CORSAllowedOrigins, o.CORSAllowCredentials = []string{"*"}, true },
+			wantErr: true,
+		},
+		{
+			name: "CORS credentials",
+			opts: func(o *Options) { o.CORSAllowedOrigins, o.CORSAllowCredentials = []string{"https://example.com"}, true },
+		},
+		{name: "trailing slash", opts: func(o *Options) { o.TrailingSlash = TrailingSlashRedirect }},
+		{name: "unknown trailing slash", opts: func(o *Options) { o.TrailingSlash = "keep" }, wantErr: true},
+		{name: "certificate without key", opts: func(o *Options) { o.Certificate = "cert.pem" }, wantErr: true},
+		{name: "client CAs without certificate", opts: func(o *Options) { o.ClientCAs = x509.NewCertPool() }, wantErr: true},
+		{
+			name: "client certificate without CAs",
+			opts: func(o *Options) {
+				o.Certificate, o.CertificateKey, o.RequireClientCert = "cert.pem", "key.pem", true
+			},
+			wantErr: true,
+		},
+		{name: "drain endpoint without auth", opts: func(o *Options) { o.EnableDrainEndpoint = true }, wantErr: true},
+		{name: "config endpoint without auth", opts: func(o *Options) { o.EnableConfigEndpoint = true }, wantErr: true},
+		{name: "services endpoint without auth", opts: func(o *Options) { o.EnableServicesEndpoint = true }, wantErr: true},
+		{name: "admin endpoints", opts: func(o *Options) { o.EnableDrainEndpoint, o.AdminAuth = true, admin }},
+		{name: "allowed CIDRs", opts: func(o *Options) { o.AllowedCIDRs = []string{"10.0.0.0/8"} }},
+		{name: "invalid allowed CIDRs", opts: func(o *Options) { o.AllowedCIDRs = []string{"10.0.0.0/33"} }, wantErr: true},
+		{name: "invalid denied CIDRs", opts: func(o *Options) { o.DeniedCIDRs = []string{"nope"} }, wantErr: true},
+		{name: "invalid trusted proxies", opts: func(o *Options) { o.TrustedProxies = []string{"nope"} }, wantErr: true},
+		{
+			name:    "invalid interceptor",
+			opts:    func(o *Options) { o.Interceptors = []Interceptor{{Before: StageAuth, After: StageTracing}} },
+			wantErr: true,
+		},
+		{name: "no services", opts: func(o *Options) { o.OnRegister = nil }, wantErr: true},
+		{name: "deferred services", opts: func(o *Options) { o.OnRegister, o.DeferServe = nil, true }},
+		{
+			name: "services",
+			opts: func(o *Options) {
+				o.Services = []func(*grpc.Server) error{o.OnRegister}
+				o.OnRegister = nil
+			},
+		},
+		{name: "swagger dir", opts: func(o *Options) { o.SwaggerDir = dir }},
+		{name: "missing swagger dir", opts: func(o *Options) { o.SwaggerDir = filepath.Join(dir, "nope") }, wantErr: true},
+		{name: "swagger file", opts: func(o *Options) { o.SwaggerDir = file }, wantErr: true},
+		{name: "swagger dir and FS", opts: func(o *Options) { o.SwaggerDir, o.SwaggerFS = dir, http.Dir(dir) }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := Options{
+				Addr:       "127.0.0.1:8080",
+				RPC:        Endpoint{Addr: "127.0.0.1:9090"},
+				OnRegister: func(*grpc.Server) error { return nil },
+			}
+			tt.opts(&o)
+
+			if err := o.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPTimeoutsDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts HTTPTimeouts
+		want     HTTPTimeouts
+	}{
+		{name: "zero", want: DefaultHTTPTimeouts},
+		{
+			name:     "partial",
+			timeouts: HTTPTimeouts{Read: time.Second, Write: time.Minute},
+			want:     HTTPTimeouts{Read: time.Second, ReadHeader: DefaultHTTPTimeouts.ReadHeader, Idle: DefaultHTTPTimeouts.Idle, Write: time.Minute},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.timeouts.withDefaults(); got != tt.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         Options
+		wantMetrics  string
+		wantSkip     []string
+		wantStreams  uint32
+		wantShutdown time.Duration
+	}{
+		{
+			name:         "zero",
+			wantMetrics:  DefaultMetricsPath,
+			wantSkip:     DefaultTraceSkipPaths,
+			wantStreams:  DefaultMaxConcurrentStreams,
+			wantShutdown: DefaultShutdownTimeout,
+		},
+		{
+			name:         "relocated metrics",
+			opts:         Options{MetricsPath: "/internal/metrics", MaxConcurrentStreams: 10, ShutdownTimeout: time.Second},
+			wantMetrics:  "/internal/metrics",
+			wantSkip:     append([]string{"/internal/metrics"}, DefaultTraceSkipPaths...),
+			wantStreams:  10,
+			wantShutdown: time.Second,
+		},
+		{
+			name:         "skip paths",
+			opts:         Options{MetricsPath: "/internal/metrics", TraceSkipPaths: []string{"/ping"}, ShutdownTimeout: -time.Second},
+			wantMetrics:  "/internal/metrics",
+			wantSkip:     []string{"/ping"},
+			wantStreams:  DefaultMaxConcurrentStreams,
+			wantShutdown: DefaultShutdownTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.metricsPath(); got != tt.wantMetrics {
+				t.Errorf("metricsPath() = %s, want %s", got, tt.wantMetrics)
+			}
+
+			got := tt.opts.traceSkipPaths()
+			if len(got) != len(tt.wantSkip) {
+				t.Fatalf("traceSkipPaths() = %v, want %v", got, tt.wantSkip)
+			}
+			for i := range got {
+				if got[i] != tt.wantSkip[i] {
+					t.Errorf("traceSkipPaths() = %v, want %v", got, tt.wantSkip)
+				}
+			}
+
+			if got := tt.opts.maxConcurrentStreams(); got != tt.wantStreams {
+				t.Errorf("maxConcurrentStreams() = %d, want %d", got, tt.wantStreams)
+			}
+
+			if got := tt.opts.shutdownTimeout(); got != tt.wantShutdown {
+				t.Errorf("shutdownTimeout() = %s, want %s", got, tt.wantShutdown)
+			}
+		})
+	}
+}
+
+// startServer starts an in-process server on a random port, the caller
+// stops it.
+func startServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+
+	opts.Addr = "127.0.0.1:0"
+	opts.InProcess = true
+	opts.DisableSignals = true
+	opts.PrometheusRegistry = prometheus.NewRegistry()
+	if opts.OnRegister == nil && !opts.DeferServe {
+		opts.OnRegister = func(s *grpc.Server) error {
+			hpb.RegisterHealthServer(s, health.NewServer())
+			return nil
+		}
+	}
+
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// operations answers GetOperation with the operation asked for, done, unless
+// get is set.
+type operations struct {
+	longrunning.OperationsServer
+	get func(context.Context, *longrunning.GetOperationRequest) (*longrunning.Operation, error)
+}
+
+func (o *operations) GetOperation(ctx context.Context, req *longrunning.GetOperationRequest) (*longrunning.Operation, error) {
+	if o.get != nil {
+		return o.get(ctx, req)
+	}
+
+	return &longrunning.Operation{Name: req.Name, Done: true}, nil
+}
+
+// operationsHandler serves GetOperation at GET /v1/operations/{name=**}, as
+// a generated gateway handler does.
+func operationsHandler(ctx context.Context, mux *gwruntime.ServeMux, conn *grpc.ClientConn) error {
+	client := longrunning.NewOperationsClient(conn)
+	pattern := gwruntime.MustPattern(gwruntime.NewPattern(
+		1,
+		[]int{2, 0, 2, 1, 3, 2, 4, 1, 5, 2},
+		[]string{"v1", "operations", "name"},
+		"",
+	))
+
+	mux.Handle(http.MethodGet, pattern, func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		_, outbound := gwruntime.MarshalerForRequest(mux, r)
+		ctx, err := gwruntime.AnnotateContext(r.Context(), mux, r)
+		if err != nil {
+			gwruntime.HTTPError(r.Context(), mux, outbound, w, r, err)
+			return
+		}
+
+		var md gwruntime.ServerMetadata
+		op, err := client.GetOperation(
+			ctx,
+			&longrunning.GetOperationRequest{Name: "operations/" + params["name"]},
+			grpc.Header(&md.HeaderMD),
+			grpc.Trailer(&md.TrailerMD),
+		)
+		ctx = gwruntime.NewServerMetadataContext(ctx, md)
+		if err != nil {
+			gwruntime.HTTPError(ctx, mux, outbound, w, r, err)
+			return
+		}
+
+		gwruntime.ForwardResponseMessage(ctx, mux, outbound, w, r, op, mux.GetForwardResponseOptions()...)
+	})
+
+	return nil
+}
+
+// startOperations starts a server exposing ops through the gateway with
+// operationsHandler, the caller stops it.
+func startOperations(t *testing.T, ops *operations, opts Options) *Server {
+	t.Helper()
+
+	opts.OnRegister = func(s *grpc.Server) error {
+		longrunning.RegisterOperationsServer(s, ops)
+		return nil
+	}
+	opts.Handlers = append(opts.Handlers, operationsHandler)
+
+	return startServer(t, opts)
+}
+
+// getOperation gets the operation name through the gateway listening on
+// addr, failing unless it's answered with 200 OK.
+func getOperation(t *testing.T, client *http.Client, addr, name string) *longrunning.Operation {
+	t.Helper()
+
+	resp, err := client.Get("http://" + addr + "/v1/operations/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /v1/operations/%s status = %d", name, resp.StatusCode)
+	}
+
+	op := &longrunning.Operation{}
+	if err := jsonpb.Unmarshal(resp.Body, op); err != nil {
+		t.Fatal(err)
+	}
+
+	return op
+}
+
+func TestServerEndpoints(t *testing.T) {
+	s := startServer(t, Options{
+		EnableDrainEndpoint: true,
+		AdminAuth:           BasicCredentials("admin", "secret"),
+	})
+	defer s.Stop(context.Background())
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		admin      bool
+		wantStatus int
+	}{
+		{name: "version", method: http.MethodGet, path: "/version", wantStatus: http.StatusOK},
+		{name: "ready", method: http.MethodGet, path: readyPath, wantStatus: http.StatusOK},
+		{name: "metrics", method: http.MethodGet, path: DefaultMetricsPath, admin: true, wantStatus: http.StatusOK},
+		{name: "metrics without credentials", method: http.MethodGet, path: DefaultMetricsPath, wantStatus: http.StatusUnauthorized},
+		{name: "drain without credentials", method: http.MethodPost, path: drainPath, wantStatus: http.StatusUnauthorized},
+		{name: "unknown route", method: http.MethodGet, path: "/v1/nope", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(tt.method, "http://"+s.Addr().String()+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.admin {
+				r.SetBasicAuth("admin", "secret")
+			}
+
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	register := func(s *grpc.Server) error { return nil }
+
+	tests := []struct {
+		name         string
+		opts         Options
+		wantRegister error
+	}{
+		{name: "serving", wantRegister: ErrServing},
+		{name: "deferred", opts: Options{DeferServe: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, tt.opts)
+
+			if err := s.Register(register); err != tt.wantRegister {
+				t.Errorf("Register() = %v, want %v", err, tt.wantRegister)
+			}
+
+			if err := s.Start(context.Background()); err == nil {
+				t.Error("second Start() succeeded")
+			}
+
+			if err := s.Serve(); err != nil {
+				t.Errorf("Serve() = %v", err)
+			}
+
+			if err := s.Register(register); err != ErrServing {
+				t.Errorf("Register() once serving = %v", err)
+			}
+
+			if s.RPCAddr() != nil {
+				t.Errorf("RPCAddr() = %v, in process only", s.RPCAddr())
+			}
+
+			if err := s.Stop(context.Background()); err != nil {
+				t.Fatalf("Stop() = %v", err)
+			}
+
+			if err := s.Stop(context.Background()); err != nil {
+				t.Errorf("second Stop() = %v", err)
+			}
+
+			if err := s.Serve(); err == nil {
+				t.Error("Serve() once stopped succeeded")
+			}
+		})
+	}
+}
+
+func TestServerReady(t *testing.T) {
+	ready := make(chan struct{})
+
+	var (
+		addr     string
+		stopping int
+	)
+	s := startOperations(t, &operations{}, Options{
+		Ready:      ready,
+		DeferServe: true,
+		OnShutdown: func(context.Context) error {
+			stopping = readyStatus(t, addr)
+			return nil
+		},
+	})
+	defer s.Stop(context.Background())
+	addr = s.Addr().String()
+
+	select {
+	case <-ready:
+		t.Fatal("ready before serving")
+	default:
+	}
+
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	<-ready
+
+	// Nothing is retried once ready.
+	if got := readyStatus(t, addr); got != http.StatusOK {
+		t.Errorf("%s status once ready = %d", readyPath, got)
+	}
+	getOperation(t, http.DefaultClient, addr, "a")
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if stopping != http.StatusServiceUnavailable {
+		t.Errorf("%s status while stopping = %d", readyPath, stopping)
+	}
+}
+
+// readyStatus returns the status of the readiness probe of the server
+// listening on addr.
+func readyStatus(t *testing.T, addr string) int {
+	t.Helper()
+
+	resp, err := http.Get("http://" + addr + readyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestH2C(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{name: "enabled", enabled: true},
+		{name: "disabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startOperations(t, &operations{}, Options{EnableH2C: tt.enabled})
+			defer s.Stop(context.Background())
+
+			conn, err := grpc.Dial(s.Addr().String(), grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			req := &longrunning.GetOperationRequest{Name: "operations/a"}
+			op, err := longrunning.NewOperationsClient(conn).GetOperation(ctx, req)
+			if !tt.enabled {
+				if err == nil {
+					t.Error("gRPC call over h2c succeeded while disabled")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("gRPC call over h2c = %v", err)
+			}
+
+			if op.Name != req.Name {
+				t.Errorf("operation = %q, want %q", op.Name, req.Name)
+			}
+
+			// The gateway is served over h2c too.
+			client := &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			}}
+
+			resp, err := client.Get("http://" + s.Addr().String() + "/v1/operations/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+				t.Errorf("gateway answered %d over HTTP/%d, want 200 over HTTP/2", resp.StatusCode, resp.ProtoMajor)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	ops := &operations{get: func(ctx context.Context, req *longrunning.GetOperationRequest) (*longrunning.Operation, error) {
+		started <- req.Name
+		<-release
+
+		return &longrunning.Operation{Name: req.Name}, nil
+	}}
+
+	s := startOperations(t, ops, Options{Listener: list, MaxConcurrentStreams: 1})
+	defer s.Stop(context.Background())
+
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+
+	conn, err := grpc.Dial(list.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := longrunning.NewOperationsClient(conn)
+	done := make(chan error, 2)
+	get := func(name string) {
+		_, err := client.GetOperation(context.Background(), &longrunning.GetOperationRequest{Name: name})
+		done <- err
+	}
+
+	go get("operations/first")
+	if got := <-started; got != "operations/first" {
+		t.Fatalf("started %s first", got)
+	}
+
+	// The second stream waits for the first, on the same connection.
+	go get("operations/second")
+	select {
+	case got := <-started:
+		t.Fatalf("%s started beyond the stream limit", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unblock()
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("call = %v", err)
+		}
+	}
+
+	if got := <-started; got != "operations/second" {
+		t.Errorf("started %s second", got)
+	}
+}
+
+func TestLateRegistration(t *testing.T) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := make(chan string, 2)
+	ops := &operations{get: func(ctx context.Context, req *longrunning.GetOperationRequest) (*longrunning.Operation, error) {
+		routes <- RouteFromContext(ctx)
+		return &longrunning.Operation{Name: req.Name}, nil
+	}}
+
+	s := startServer(t, Options{Listener: list, DeferServe: true})
+	defer s.Stop(context.Background())
+
+	// The services are discovered once the listeners are up.
+	err = s.Register(func(s *grpc.Server) error {
+		longrunning.RegisterOperationsServer(s, ops)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RegisterHandlers(operationsHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	if op := getOperation(t, http.DefaultClient, s.Addr().String(), "a"); op.Name != "operations/a" {
+		t.Errorf("gateway operation = %q", op.Name)
+	}
+
+	// The routes of the late services are known too.
+	if got := <-routes; got != "/v1/{name=operations/**}" {
+		t.Errorf("gateway call route = %q", got)
+	}
+
+	conn, err := grpc.Dial(list.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := &longrunning.GetOperationRequest{Name: "operations/b"}
+	if _, err := longrunning.NewOperationsClient(conn).GetOperation(context.Background(), req); err != nil {
+		t.Errorf("gRPC call = %v", err)
+	}
+
+	if err := s.RegisterHandlers(operationsHandler); err != ErrServing {
+		t.Errorf("RegisterHandlers() once serving = %v, want %v", err, ErrServing)
+	}
+}
+
+// pingListener reports the keepalive pings received on the connections it
+// accepts, which it counts.
+type pingListener struct {
+	net.Listener
+	pings    chan struct{}
+	accepted int32
+}
+
+func (l *pingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&l.accepted, 1)
+
+	r, w := io.Pipe()
+	go l.readFrames(r)
+
+	return &teeConn{Conn: c, w: w}, nil
+}
+
+// readFrames reads the HTTP/2 frames the client sends after its preface.
+// The pings of gRPC's keepalive carry zeros, unlike those estimating the
+// bandwidth.
+func (l *pingListener) readFrames(r *io.PipeReader) {
+	defer r.Close()
+
+	if _, err := io.ReadFull(r, make([]byte, len(http2.ClientPreface))); err != nil {
+		return
+	}
+
+	f := http2.NewFramer(nil, r)
+	for {
+		frame, err := f.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		if p, ok := frame.(*http2.PingFrame); ok && !p.IsAck() && p.Data == [8]byte{} {
+			select {
+			case l.pings <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// teeConn copies what it reads to w.
+type teeConn struct {
+	net.Conn
+	w *io.PipeWriter
+}
+
+func (c *teeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		_, _ = c.w.Write(b[:n])
+	}
+
+	if err != nil {
+		c.w.CloseWithError(err)
+	}
+
+	return n, err
+}
+
+func TestClientKeepalive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("gRPC waits at least 10s to ping an idle connection")
+	}
+
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &pingListener{Listener: list, pings: make(chan struct{}, 1)}
+
+	s, err := New(Options{
+		Addr:               "127.0.0.1:0",
+		Listener:           pl,
+		DisableSignals:     true,
+		PrometheusRegistry: prometheus.NewRegistry(),
+		OnRegister: func(s *grpc.Server) error {
+			longrunning.RegisterOperationsServer(s, &operations{})
+			return nil
+		},
+		Handlers: []Handler{operationsHandler},
+		ClientKeepalive: &keepalive.ClientParameters{
+			Time:                time.Second,
+			Timeout:             time.Second,
+			PermitWithoutStream: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.Background())
+
+	getOperation(t, http.DefaultClient, s.Addr().String(), "a")
+
+	// gRPC raises the interval to its 10s minimum, and only pings once a
+	// whole interval went by without reading.
+	select {
+	case <-pl.pings:
+	case <-time.After(25 * time.Second):
+		t.Fatal("no keepalive ping on the idle connection")
+	}
+
+	// The server's policy allows the pings rather than closing the
+	// connection.
+	getOperation(t, http.DefaultClient, s.Addr().String(), "b")
+
+	if n := atomic.LoadInt32(&pl.accepted); n != 1 {
+		t.Errorf("the gateway connected %d times, want once", n)
+	}
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+
+	return c, err
+}
+
+func TestInProcess(t *testing.T) {
+	tests := []struct {
+		name      string
+		inProcess bool
+		wantDials int32
+	}{
+		{name: "in process", inProcess: true},
+		{name: "dialed", wantDials: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cl := &countingListener{Listener: list}
+
+			s, err := New(Options{
+				Addr:               "127.0.0.1:0",
+				Listener:           cl,
+				InProcess:          tt.inProcess,
+				DisableSignals:     true,
+				PrometheusRegistry: prometheus.NewRegistry(),
+				OnRegister: func(s *grpc.Server) error {
+					longrunning.RegisterOperationsServer(s, &operations{})
+					return nil
+				},
+				Handlers: []Handler{operationsHandler},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop(context.Background())
+
+			for _, name := range []string{"a", "b"} {
+				getOperation(t, http.DefaultClient, s.Addr().String(), name)
+			}
+
+			if n := atomic.LoadInt32(&cl.accepted); n != tt.wantDials {
+				t.Errorf("the gateway dialed the gRPC port %d times, want %d", n, tt.wantDials)
+			}
+		})
+	}
+}
+
+func TestServerStartFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	s, err := New(Options{
+		Addr:               taken.Addr().String(),
+		InProcess:          true,
+		DisableSignals:     true,
+		PrometheusRegistry: prometheus.NewRegistry(),
+		OnRegister:         func(s *grpc.Server) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("Start() succeeded on a port in use")
+	}
+
+	if s.Addr() != nil {
+		t.Errorf("Addr() = %v after a failed Start", s.Addr())
+	}
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Errorf("Stop() after a failed Start = %v", err)
+	}
+
+	if err := s.Start(context.Background()); err == nil {
+		t.Error("Start() after a failed Start succeeded")
+	}
+
+	if err := s.Serve(); err == nil {
+		t.Error("Serve() after a failed Start succeeded")
+	}
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestServerReleasesPorts(t *testing.T) {
+	failed := errors.New("registration failed")
+
+	tests := []struct {
+		name     string
+		register func(*grpc.Server) error
+		wantErr  bool
+	}{
+		{
+			name: "stopped",
+			register: func(s *grpc.Server) error {
+				longrunning.RegisterOperationsServer(s, &operations{})
+				return nil
+			},
+		},
+		{
+			name: "partial registration",
+			register: func(s *grpc.Server) error {
+				longrunning.RegisterOperationsServer(s, &operations{})
+				return failed
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, rpcAddr := freeAddr(t), freeAddr(t)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			ready := make(chan struct{})
+			done := make(chan error, 1)
+			go func() {
+				done <- Run(ctx, Options{
+					Addr:               addr,
+					RPC:                Endpoint{Addr: rpcAddr},
+					DisableSignals:     true,
+					PrometheusRegistry: prometheus.NewRegistry(),
+					Ready:              ready,
+					OnRegister:         tt.register,
+				})
+			}()
+
+			var err error
+			select {
+			case <-ready:
+				cancel()
+				err = <-done
+			case err = <-done:
+				cancel()
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() = %v, want error %t", err, tt.wantErr)
+			}
+
+			for _, a := range []string{addr, rpcAddr} {
+				l, err := net.Listen("tcp", a)
+				if err != nil {
+					t.Fatalf("%s not released: %v", a, err)
+				}
+				l.Close()
+			}
+		})
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	rpc, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := startServer(t, Options{Listener: rpc, DeferServe: true})
+	defer s.Stop(context.Background())
+
+	// Every serving goroutine fails at once, none may block on Err.
+	for _, l := range []net.Listener{s.rpcList, s.memList, s.httpLst} {
+		l.Close()
+	}
+
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Err()) < serveGoroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := len(s.Err()); n != serveGoroutines {
+		t.Errorf("%d errors buffered, want %d", n, serveGoroutines)
+	}
+}
+
+// slowHealth answers health checks once released, reporting the calls it
+// started.
+type slowHealth struct {
+	hpb.HealthServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *slowHealth) Check(ctx context.Context, req *hpb.HealthCheckRequest) (*hpb.HealthCheckResponse, error) {
+	h.started <- struct{}{}
+	<-h.release
+
+	return &hpb.HealthCheckResponse{Status: hpb.HealthCheckResponse_SERVING}, nil
+}
+
+func TestRunSignal(t *testing.T) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health := &slowHealth{started: make(chan struct{}), release: make(chan struct{})}
+	sigs := make(chan os.Signal, 1)
+	ready := make(chan struct{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(context.Background(), Options{
+			Addr:               "127.0.0.1:0",
+			Listener:           list,
+			InProcess:          true,
+			PrometheusRegistry: prometheus.NewRegistry(),
+			Signals:            sigs,
+			Ready:              ready,
+			OnRegister: func(s *grpc.Server) error {
+				hpb.RegisterHealthServer(s, health)
+				return nil
+			},
+		})
+	}()
+
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() = %v before serving", err)
+	}
+
+	conn, err := grpc.Dial(list.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := hpb.NewHealthClient(conn).Check(context.Background(), &hpb.HealthCheckRequest{})
+		inFlight <- err
+	}()
+	<-health.started
+
+	sigs <- syscall.SIGTERM
+
+	// The server waits for the call in flight.
+	select {
+	case err := <-done:
+		t.Fatalf("Run() = %v with a call in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(health.release)
+
+	if err := <-inFlight; err != nil {
+		t.Errorf("call in flight = %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() didn't return after SIGTERM")
+	}
+}
+
+func TestRunListenFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	err = Run(context.Background(), Options{
+		Addr:               "127.0.0.1:0",
+		RPC:                Endpoint{Addr: taken.Addr().String()},
+		DisableSignals:     true,
+		PrometheusRegistry: prometheus.NewRegistry(),
+		OnRegister:         func(s *grpc.Server) error { return nil },
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to listen") {
+		t.Errorf("Run() = %v, want the listen failure", err)
+	}
+}
+
+func TestRunDeferServe(t *testing.T) {
+	err := Run(context.Background(), Options{Addr: "127.0.0.1:0", InProcess: true, DeferServe: true})
+	if err == nil {
+		t.Error("Run() succeeded")
+	}
+}
@@ -0,0 +1,84 @@
+package drudge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// Service registers a gRPC service together with its gateway handler, such as
+// the generated RegisterXServer and RegisterXHandler pair.
+type Service interface {
+	RegisterGRPC(*grpc.Server)
+	RegisterGateway(context.Context, *gwruntime.ServeMux, *grpc.ClientConn) error
+}
+
+// serviceHandlers returns the gateway handlers of the services, after
+// handlers.
+func serviceHandlers(handlers []Handler, services []Service) []Handler {
+	all := append([]Handler(nil), handlers...)
+	for _, svc := range services {
+		all = append(all, svc.RegisterGateway)
+	}
+
+	return all
+}
+
+// ServiceDescription describes a gRPC service as served by the services
+// endpoint.
+type ServiceDescription struct {
+	Name    string              `json:"name"`
+	Methods []MethodDescription `json:"methods"`
+}
+
+// MethodDescription describes a method of a gRPC service.
+type MethodDescription struct {
+	Name            string `json:"name"`
+	ClientStreaming bool   `json:"client_streaming"`
+	ServerStreaming bool   `json:"server_streaming"`
+}
+
+// servicesHandler lists the services registered on rpc, sorted by name. The
+// list is built on every request, so services registered late are included.
+func servicesHandler(rpc *grpc.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := rpc.GetServiceInfo()
+
+		services := make([]ServiceDescription, 0, len(info))
+		for name, si := range info {
+			s := ServiceDescription{
+				Name:    name,
+				Methods: make([]MethodDescription, 0, len(si.Methods)),
+			}
+
+			for _, m := range si.Methods {
+				s.Methods = append(s.Methods, MethodDescription{
+					Name:            m.Name,
+					ClientStreaming: m.IsClientStream,
+					ServerStreaming: m.IsServerStream,
+				})
+			}
+
+			sort.Slice(s.Methods, func(i, j int) bool {
+				return s.Methods[i].Name < s.Methods[j].Name
+			})
+
+			services = append(services, s)
+		}
+
+		sort.Slice(services, func(i, j int) bool {
+			return services[i].Name < services[j].Name
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(services); err != nil {
+			http.Error(w, errors.Wrap(err, "failed to encode service list").Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package drudge
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// namedService records the order its gateway is registered in.
+type namedService struct {
+	name  string
+	order *[]string
+}
+
+func (s namedService) RegisterGRPC(*grpc.Server) {}
+
+func (s namedService) RegisterGateway(context.Context, *gwruntime.ServeMux, *grpc.ClientConn) error {
+	*s.order = append(*s.order, s.name)
+	return nil
+}
+
+func TestServiceHandlers(t *testing.T) {
+	var order []string
+	handler := func(name string) Handler {
+		return func(context.Context, *gwruntime.ServeMux, *grpc.ClientConn) error {
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name     string
+		handlers []Handler
+		services []Service
+		want     []string
+	}{
+		{name: "none"},
+		{name: "handlers", handlers: []Handler{handler("a"), handler("b")}, want: []string{"a", "b"}},
+		{
+			name:     "services after handlers",
+			handlers: []Handler{handler("a")},
+			services: []Service{namedService{"svc", &order}},
+			want:     []string{"a", "svc"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order = nil
+
+			all := serviceHandlers(tt.handlers, tt.services)
+			for _, h := range all {
+				if err := h(context.Background(), nil, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if len(order) != len(tt.want) {
+				t.Fatalf("registered %v, want %v", order, tt.want)
+			}
+
+			for i := range order {
+				if order[i] != tt.want[i] {
+					t.Errorf("registered %v, want %v", order, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestServicesHandler(t *testing.T) {
+	rpc := operationsServer()
+	healthpb.RegisterHealthServer(rpc, health.NewServer())
+
+	w := httptest.NewRecorder()
+	servicesHandler(rpc)(w, httptest.NewRequest(http.MethodGet, "/services", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var services []ServiceDescription
+	if err := json.NewDecoder(w.Body).Decode(&services); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ServiceDescription{
+		{Name: "google.longrunning.Operations", Methods: []MethodDescription{
+			{Name: "CancelOperation"},
+			{Name: "DeleteOperation"},
+			{Name: "GetOperation"},
+			{Name: "ListOperations"},
+			{Name: "WaitOperation"},
+		}},
+		{Name: "grpc.health.v1.Health", Methods: []MethodDescription{
+			{Name: "Check"},
+			{Name: "Watch", ServerStreaming: true},
+		}},
+	}
+
+	if len(services) != len(want) {
+		t.Fatalf("services = %+v, want %+v", services, want)
+	}
+
+	for i, s := range services {
+		if s.Name != want[i].Name || len(s.Methods) != len(want[i].Methods) {
+			t.Fatalf("services[%d] = %+v, want %+v", i, s, want[i])
+		}
+
+		for j, m := range s.Methods {
+			if m != want[i].Methods[j] {
+				t.Errorf("%s methods[%d] = %+v, want %+v", s.Name, j, m, want[i].Methods[j])
+			}
+		}
+	}
+}
+
+// operationsService registers the Operations service on both transports.
+type operationsService struct {
+	ops *operations
+}
+
+func (s operationsService) RegisterGRPC(rpc *grpc.Server) {
+	longrunning.RegisterOperationsServer(rpc, s.ops)
+}
+
+func (s operationsService) RegisterGateway(ctx context.Context, mux *gwruntime.ServeMux, conn *grpc.ClientConn) error {
+	return operationsHandler(ctx, mux, conn)
+}
+
+func TestRegisterServices(t *testing.T) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := startServer(t, Options{
+		Listener:         list,
+		RegisterServices: []Service{operationsService{&operations{}}},
+	})
+	defer s.Stop(context.Background())
+
+	if op := getOperation(t, http.DefaultClient, s.Addr().String(), "a"); op.Name != "operations/a" {
+		t.Errorf("gateway operation = %q", op.Name)
+	}
+
+	conn, err := grpc.Dial(list.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := &longrunning.GetOperationRequest{Name: "operations/b"}
+	op, err := longrunning.NewOperationsClient(conn).GetOperation(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if op.Name != req.Name {
+		t.Errorf("gRPC operation = %q, want %q", op.Name, req.Name)
+	}
+}
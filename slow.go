@@ -0,0 +1,66 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// logSlowHTTP warns about the requests served by h taking longer than
+// threshold, calling onSlow, when set, for each. Nothing is measured when
+// threshold isn't positive.
+func logSlowHTTP(lg *zap.Logger, threshold time.Duration, onSlow func(protocol string), h http.Handler) http.Handler {
+	if threshold <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+
+		elapsed := time.Since(start)
+		if elapsed <= threshold {
+			return
+		}
+
+		if onSlow != nil {
+			onSlow("http")
+		}
+
+		requestLogger(r.Context(), lg).Warn("slow request",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.String("route", RouteFromContext(r.Context())),
+			zap.Duration("duration", elapsed),
+		)
+	})
+}
+
+// slowUnary warns about the unary calls taking longer than threshold, see
+// logSlowHTTP. Streams are left out, lasting as long as their client wants.
+func slowUnary(threshold time.Duration, onSlow func(protocol string)) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		if elapsed := time.Since(start); elapsed > threshold {
+			if onSlow != nil {
+				onSlow("grpc")
+			}
+
+			// The call's logger carries its method and tags.
+			ctxzap.Extract(ctx).Warn("slow request", zap.Duration("duration", elapsed))
+		}
+
+		return resp, err
+	}
+}
@@ -0,0 +1,70 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+)
+
+func TestSlowRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		wantSlow  bool
+	}{
+		{name: "disabled", delay: 10 * time.Millisecond},
+		{name: "fast", threshold: time.Hour},
+		{name: "slow", threshold: time.Millisecond, delay: 10 * time.Millisecond, wantSlow: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var slow []string
+			onSlow := func(protocol string) { slow = append(slow, protocol) }
+
+			core, logs := observer.New(zap.WarnLevel)
+			lg := zap.New(core)
+
+			h := logSlowHTTP(lg, tt.threshold, onSlow, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/users", nil))
+
+			if tt.threshold > 0 {
+				_, err := slowUnary(tt.threshold, onSlow)(ctxzap.ToContext(context.Background(), lg), nil, &grpc.UnaryServerInfo{},
+					func(ctx context.Context, req interface{}) (interface{}, error) {
+						time.Sleep(tt.delay)
+						return nil, nil
+					})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			wantSlow := 0
+			if tt.wantSlow {
+				wantSlow = 2
+			}
+
+			if len(slow) != wantSlow {
+				t.Errorf("onSlow called for %v, want %d calls", slow, wantSlow)
+			}
+
+			if tt.wantSlow && (slow[0] != "http" || slow[1] != "grpc") {
+				t.Errorf("protocols = %v", slow)
+			}
+
+			if got := logs.FilterMessage("slow request").Len(); got != wantSlow {
+				t.Errorf("%d warnings, want %d", got, wantSlow)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package drudge
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// listen opens the listener of the endpoint, TCP by default. The file of a
+// unix socket gets the mode and group once bound.
+func listen(e Endpoint, mode os.FileMode, group string) (net.Listener, error) {
+	network := e.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	list, err := net.Listen(network, e.Addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on '%s' at '%s'", network, e.Addr)
+	}
+
+	if network != "unix" || isAbstractSocket(e.Addr) {
+		return list, nil
+	}
+
+	if err := chmodSocket(e.Addr, mode, group); err != nil {
+		_ = list.Close()
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func chmodSocket(path string, mode os.FileMode, group string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return errors.Wrap(err, "failed to set the socket's mode")
+		}
+	}
+
+	if group == "" {
+		return nil
+	}
+
+	gid, err := lookupGroup(group)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chown(path, -1, gid); err != nil {
+		return errors.Wrap(err, "failed to set the socket's group")
+	}
+
+	return nil
+}
+
+// lookupGroup resolves a group name or id to its id.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to look up group '%s'", group)
+	}
+
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, errors.Wrapf(err, "group '%s' has no numeric id", group)
+	}
+
+	return gid, nil
+}
+
+// isAbstractSocket reports whether addr is in the Linux abstract namespace,
+// which has no file.
+func isAbstractSocket(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
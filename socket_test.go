@@ -0,0 +1,112 @@
+package drudge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drudge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gid := strconv.Itoa(os.Getgid())
+
+	tests := []struct {
+		name     string
+		endpoint Endpoint
+		mode     os.FileMode
+		group    string
+		linux    bool
+		wantErr  bool
+		wantMode os.FileMode
+	}{
+		{name: "tcp by default", endpoint: Endpoint{Addr: "127.0.0.1:0"}},
+		{name: "unix", endpoint: Endpoint{Network: "unix", Addr: filepath.Join(dir, "plain.sock")}},
+		{name: "unix mode", endpoint: Endpoint{Network: "unix", Addr: filepath.Join(dir, "mode.sock")}, mode: 0600, wantMode: 0600},
+		{name: "unix group", endpoint: Endpoint{Network: "unix", Addr: filepath.Join(dir, "group.sock")}, group: gid},
+		{name: "unknown group", endpoint: Endpoint{Network: "unix", Addr: filepath.Join(dir, "nogroup.sock")}, group: "no-such-group-drudge", wantErr: true},
+		{name: "abstract", endpoint: Endpoint{Network: "unix", Addr: "@drudge-test"}, mode: 0600, linux: true},
+		{name: "bad address", endpoint: Endpoint{Addr: "127.0.0.1:-1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linux && runtime.GOOS != "linux" {
+				t.Skip("abstract sockets are Linux only")
+			}
+
+			l, err := listen(tt.endpoint, tt.mode, tt.group)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer l.Close()
+
+			if tt.wantMode == 0 {
+				return
+			}
+
+			fi, err := os.Stat(tt.endpoint.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fi.Mode().Perm(); got != tt.wantMode {
+				t.Errorf("mode = %v, want %v", got, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestLookupGroup(t *testing.T) {
+	tests := []struct {
+		group   string
+		want    int
+		wantErr bool
+	}{
+		{group: "0", want: 0},
+		{group: "1234", want: 1234},
+		{group: "no-such-group-drudge", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.group, func(t *testing.T) {
+			got, err := lookupGroup(tt.group)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupGroup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("lookupGroup() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAbstractSocket(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "@drudge", want: true},
+		{addr: "/run/drudge.sock"},
+		{addr: "drudge@host"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isAbstractSocket(tt.addr); got != tt.want {
+				t.Errorf("isAbstractSocket() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
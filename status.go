@@ -0,0 +1,89 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type statusMapperKey struct{}
+
+// withStatusMapper stores mapper in the requests' context, where the stream
+// forwarders, which the error handler of the mux doesn't reach, find it.
+func withStatusMapper(mapper func(codes.Code) int, h http.Handler) http.Handler {
+	if mapper == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), statusMapperKey{}, mapper)))
+	})
+}
+
+// httpStatusMapper returns the mapping of the request, the gateway's by
+// default.
+func httpStatusMapper(ctx context.Context) func(codes.Code) int {
+	mapper, _ := ctx.Value(statusMapperKey{}).(func(codes.Code) int)
+	return statusMapping(mapper)
+}
+
+// statusMapping maps the codes with mapper, falling back to the gateway's
+// mapping when it's nil or returns zero.
+func statusMapping(mapper func(codes.Code) int) func(codes.Code) int {
+	if mapper == nil {
+		return gwruntime.HTTPStatusFromCode
+	}
+
+	return func(c codes.Code) int {
+		if code := mapper(c); code != 0 {
+			return code
+		}
+
+		return gwruntime.HTTPStatusFromCode(c)
+	}
+}
+
+// mappedHTTPError maps the gRPC codes of the errors handled by next to HTTP
+// statuses with mapper, see statusMapping. It's installed on the server's own
+// mux, so a proto error handler given in Options.Mux replaces it.
+func mappedHTTPError(mapper func(codes.Code) int, next gwruntime.ProtoErrorHandlerFunc) gwruntime.ProtoErrorHandlerFunc {
+	if mapper == nil {
+		return next
+	}
+
+	mapping := statusMapping(mapper)
+
+	return func(
+		ctx context.Context,
+		mux *gwruntime.ServeMux,
+		marshaler gwruntime.Marshaler,
+		w http.ResponseWriter,
+		r *http.Request,
+		err error,
+	) {
+		code := status.Code(err)
+		next(ctx, mux, marshaler, &statusMapWriter{
+			ResponseWriter: w,
+			from:           gwruntime.HTTPStatusFromCode(code),
+			to:             mapping(code),
+		}, r, err)
+	}
+}
+
+// statusMapWriter replaces the status from, leaving others such as the
+// failure to marshal the error untouched.
+type statusMapWriter struct {
+	http.ResponseWriter
+	from, to int
+}
+
+func (sw *statusMapWriter) WriteHeader(code int) {
+	if code == sw.from {
+		code = sw.to
+	}
+
+	sw.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,110 @@
+package drudge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestStatusMapping(t *testing.T) {
+	gone := func(c codes.Code) int {
+		if c == codes.NotFound {
+			return http.StatusGone
+		}
+		return 0
+	}
+
+	tests := []struct {
+		name   string
+		mapper func(codes.Code) int
+		code   codes.Code
+		want   int
+	}{
+		{name: "gateway's", code: codes.NotFound, want: http.StatusNotFound},
+		{name: "mapped", mapper: gone, code: codes.NotFound, want: http.StatusGone},
+		{name: "zero keeps the gateway's", mapper: gone, code: codes.PermissionDenied, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusMapping(tt.mapper)(tt.code); got != tt.want {
+				t.Errorf("statusMapping() = %d, want %d", got, tt.want)
+			}
+
+			ctx := context.Background()
+			if tt.mapper != nil {
+				ctx = context.WithValue(ctx, statusMapperKey{}, tt.mapper)
+			}
+
+			if got := httpStatusMapper(ctx)(tt.code); got != tt.want {
+				t.Errorf("httpStatusMapper() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMappedHTTPError(t *testing.T) {
+	tests := []struct {
+		name     string
+		mapper   func(codes.Code) int
+		path     string
+		wantCode int
+	}{
+		{name: "no mapper", path: "/v1/operations/missing", wantCode: http.StatusNotFound},
+		{
+			name:     "mapped",
+			mapper:   func(c codes.Code) int { return http.StatusGone },
+			path:     "/v1/operations/missing",
+			wantCode: http.StatusGone,
+		},
+		{
+			name:     "zero",
+			mapper:   func(c codes.Code) int { return 0 },
+			path:     "/v1/operations/missing",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			// Routing errors aren't gRPC codes of the calls.
+			name:     "routing error",
+			mapper:   func(c codes.Code) int { return http.StatusGone },
+			path:     "/nope",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			operationsGateway(t, nil, tt.mapper).ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestStatusMapWriter(t *testing.T) {
+	tests := []struct {
+		code int
+		want int
+	}{
+		{code: http.StatusNotFound, want: http.StatusGone},
+		{code: http.StatusInternalServerError, want: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sw := &statusMapWriter{ResponseWriter: w, from: http.StatusNotFound, to: http.StatusGone}
+			sw.WriteHeader(tt.code)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -1,15 +1,23 @@
 package drudge
 
 import (
+	"bytes"
 	context "context"
+	"encoding/json"
 	fmt "fmt"
 	io "io"
 	"net/http"
+	"strings"
+	"time"
 
 	proto "github.com/gogo/protobuf/proto"
 	types "github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/jsonpb"
 	goproto "github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails" // register the well-known error detail types
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/status"
@@ -24,14 +32,128 @@ func ForwardResponseStream(
 	req *http.Request,
 	recv func() (goproto.Message, error), opts ...func(context.Context, http.ResponseWriter, goproto.Message) error,
 ) {
-	f, ok := w.(http.Flusher)
-	if !ok {
-		grpclog.Infof("Flush not supported in %T", w)
-		http.Error(w, "unexpected type of web server", http.StatusInternalServerError)
+	forwardResponseStream(streamConfig{envelope: DefaultStreamEnvelope}, ctx, mux, marshaler, w, req, recv, opts...)
+}
 
-		return
+// StreamEnvelope configures the JSON objects wrapping streamed results and
+// errors. Empty keys write them bare.
+type StreamEnvelope struct {
+	// ResultKey wraps each result as {ResultKey: result}.
+	ResultKey string
+
+	// ErrorKey wraps the error as {ErrorKey: StreamError}.
+	ErrorKey string
+}
+
+// DefaultStreamEnvelope writes the results bare and wraps the error as
+// {"error": ...}.
+var DefaultStreamEnvelope = StreamEnvelope{ErrorKey: "error"}
+
+// StreamOptions configures the function returned by ForwardResponseStreamWith.
+type StreamOptions struct {
+	// Heartbeat is the interval heartbeat frames are written at while waiting
+	// for the next message, disabled when zero. See
+	// ForwardResponseStreamWithHeartbeat.
+	Heartbeat time.Duration
+
+	// Envelope wraps the results and the error, defaults to
+	// DefaultStreamEnvelope. Results are only wrapped by JSON marshalers.
+	Envelope *StreamEnvelope
+
+	// Delimited writes each result as it arrives, followed by the
+	// marshaler's delimiter (a newline for JSON), instead of an array once
+	// the stream ends. The error is the last record.
+	//
+	// Together with the gateway's handlers, which read client and bidi
+	// streams from a body of delimited messages, it allows bidi streaming
+	// over HTTP/2, e.g. with Options.EnableH2C. HTTP/1.1 is half duplex: the
+	// request body must be sent in full before the responses are read.
+	Delimited bool
+}
+
+// ForwardResponseStreamWith returns a ForwardResponseStream configured by opts.
+func ForwardResponseStreamWith(opts StreamOptions) func(
+	context.Context,
+	*runtime.ServeMux,
+	runtime.Marshaler,
+	http.ResponseWriter,
+	*http.Request,
+	func() (goproto.Message, error),
+	...func(context.Context, http.ResponseWriter, goproto.Message) error,
+) {
+	envelope := DefaultStreamEnvelope
+	if opts.Envelope != nil {
+		envelope = *opts.Envelope
 	}
 
+	return func(
+		ctx context.Context,
+		mux *runtime.ServeMux,
+		marshaler runtime.Marshaler,
+		w http.ResponseWriter,
+		req *http.Request,
+		recv func() (goproto.Message, error), fopts ...func(context.Context, http.ResponseWriter, goproto.Message) error,
+	) {
+		cfg := streamConfig{
+			heartbeat: heartbeatFrame(marshaler.ContentType()),
+			interval:  opts.Heartbeat,
+			envelope:  envelope,
+			delimited: opts.Delimited,
+		}
+		if cfg.delimited || cfg.interval > 0 && cfg.heartbeat != nil {
+			w = &committedWriter{ResponseWriter: w}
+		}
+
+		forwardResponseStream(cfg, ctx, mux, marshaler, w, req, recv, fopts...)
+	}
+}
+
+// ForwardResponseStreamWithHeartbeat is ForwardResponseStream writing a
+// heartbeat frame every interval while waiting for the next message, keeping
+// idle connections open through proxies. Heartbeats are SSE comment lines for
+// text/event-stream and newlines for JSON, which parsers skip as whitespace;
+// other content types get none. Once a heartbeat is sent the status is 200,
+// errors are still reported in the body.
+func ForwardResponseStreamWithHeartbeat(interval time.Duration) func(
+	context.Context,
+	*runtime.ServeMux,
+	runtime.Marshaler,
+	http.ResponseWriter,
+	*http.Request,
+	func() (goproto.Message, error),
+	...func(context.Context, http.ResponseWriter, goproto.Message) error,
+) {
+	return ForwardResponseStreamWith(StreamOptions{Heartbeat: interval})
+}
+
+// streamConfig holds the options of the ForwardResponseStream variants.
+type streamConfig struct {
+	// heartbeat is written every interval while waiting for a message.
+	heartbeat []byte
+	interval  time.Duration
+
+	envelope StreamEnvelope
+
+	// delimited writes the results as they arrive.
+	delimited bool
+
+	// httpStatus maps the codes of errors, set from the request.
+	httpStatus func(codes.Code) int
+}
+
+// forwardResponseStream stops reading once the client disconnects. The
+// backend stream is bound to the request's context, so it's canceled along.
+func forwardResponseStream(
+	cfg streamConfig,
+	ctx context.Context,
+	mux *runtime.ServeMux,
+	marshaler runtime.Marshaler,
+	w http.ResponseWriter,
+	req *http.Request,
+	recv func() (goproto.Message, error), opts ...func(context.Context, http.ResponseWriter, goproto.Message) error,
+) {
+	cfg.httpStatus = httpStatusMapper(req.Context())
+
 	md, ok := runtime.ServerMetadataFromContext(ctx)
 	if !ok {
 		grpclog.Infof("Failed to extract ServerMetadata from context")
@@ -50,30 +172,49 @@ func ForwardResponseStream(
 	}
 
 	chunks := []goproto.Message{}
+	results := receive(req.Context(), recv)
 
 	for {
-		resp, err := recv()
+		resp, err := cfg.next(req.Context(), w, results)
 		if err == io.EOF {
 			break
 		}
 
 		if err != nil {
-			handleForwardResponseStreamError(marshaler, w, err)
+			if req.Context().Err() != nil {
+				grpclog.Infof("Client disconnected, stopping the stream: %v", err)
+				return
+			}
+
+			handleForwardResponseStreamError(cfg, marshaler, w, err)
 			return
 		}
 
 		if err := handleForwardResponseOptions(ctx, w, resp, opts); err != nil {
-			handleForwardResponseStreamError(marshaler, w, err)
+			handleForwardResponseStreamError(cfg, marshaler, w, err)
 			return
 		}
 
+		if cfg.delimited {
+			if err := cfg.writeRecord(marshaler, w, cfg.envelope.wrap(resp, nil, cfg.httpStatus)); err != nil {
+				grpclog.Infof("Failed to send response: %v", err)
+				return
+			}
+
+			continue
+		}
+
 		chunks = append(chunks, resp)
 	}
 
-	buf, err := marshaler.Marshal(chunks)
+	if cfg.delimited {
+		return
+	}
+
+	buf, err := cfg.marshalChunks(marshaler, chunks)
 	if err != nil {
 		grpclog.Infof("Failed to marshal response: %v", err)
-		handleForwardResponseStreamError(marshaler, w, err)
+		handleForwardResponseStreamError(cfg, marshaler, w, err)
 
 		return
 	}
@@ -83,7 +224,116 @@ func ForwardResponseStream(
 		return
 	}
 
-	f.Flush()
+	// Writers which can't flush, such as some test recorders, send the
+	// response once the handler returns instead.
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// heartbeatFrame returns the frame written to keep a response of the content
+// type alive, nil when it can't be padded.
+func heartbeatFrame(contentType string) []byte {
+	switch {
+	case strings.HasPrefix(contentType, "text/event-stream"):
+		return []byte(": heartbeat\n\n")
+	case strings.Contains(contentType, "json"):
+		return []byte("\n")
+	default:
+		return nil
+	}
+}
+
+// committedWriter drops the status codes written after the body started,
+// e.g. by a heartbeat, which committed the response with a 200.
+type committedWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (hw *committedWriter) WriteHeader(code int) {
+	if hw.wrote {
+		return
+	}
+
+	hw.wrote = true
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *committedWriter) Write(b []byte) (int, error) {
+	hw.wrote = true
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *committedWriter) Flush() {
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// streamResult is a message, or the error, read from the backend stream.
+type streamResult struct {
+	msg goproto.Message
+	err error
+}
+
+// receive reads the stream in the background until its first error, which
+// includes io.EOF. The reader stops once ctx is done, its pending recv ends
+// with the canceled backend stream.
+func receive(ctx context.Context, recv func() (goproto.Message, error)) <-chan streamResult {
+	results := make(chan streamResult)
+	go func() {
+		for {
+			msg, err := recv()
+
+			select {
+			case results <- streamResult{msg, err}:
+			case <-ctx.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return results
+}
+
+// next waits for the next result, writing a heartbeat every interval
+// meanwhile. It returns early with the context's error once the client is
+// gone.
+func (c streamConfig) next(
+	ctx context.Context,
+	w http.ResponseWriter,
+	results <-chan streamResult,
+) (goproto.Message, error) {
+	var tick <-chan time.Time
+	if c.interval > 0 && c.heartbeat != nil {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case r := <-results:
+			return r.msg, r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-tick:
+			if _, err := w.Write(c.heartbeat); err != nil {
+				grpclog.Infof("Failed to send heartbeat: %v", err)
+				continue
+			}
+
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
 }
 
 func handleForwardResponseServerMetadata(w http.ResponseWriter, md runtime.ServerMetadata) {
@@ -114,8 +364,80 @@ func handleForwardResponseOptions(
 	return nil
 }
 
-func handleForwardResponseStreamError(marshaler runtime.Marshaler, w http.ResponseWriter, err error) {
-	buf, merr := marshaler.Marshal(streamChunk(nil, err))
+// marshalChunks marshals the results as an array, wrapping each of them for
+// JSON marshalers when the envelope has a result key.
+func (c streamConfig) marshalChunks(marshaler runtime.Marshaler, chunks []goproto.Message) ([]byte, error) {
+	if c.envelope.ResultKey == "" || !strings.Contains(marshaler.ContentType(), "json") {
+		return marshaler.Marshal(chunks)
+	}
+
+	// JSONPb renders slices of maps with encoding/json, so each chunk is
+	// marshaled on its own to keep the protobuf JSON mapping.
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, chunk := range chunks {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		b, err := marshaler.Marshal(c.envelope.wrap(chunk, nil, c.httpStatus))
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(b)
+	}
+	buf.WriteByte(']')
+
+	return buf.Bytes(), nil
+}
+
+// writeRecord writes v followed by the marshaler's delimiter and flushes it.
+func (c streamConfig) writeRecord(marshaler runtime.Marshaler, w http.ResponseWriter, v interface{}) error {
+	buf, err := marshaler.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append(buf, delimiter(marshaler)...)); err != nil {
+		return err
+	}
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return nil
+}
+
+// delimiter returns the delimiter of the marshaler's records, a newline by
+// default.
+func delimiter(marshaler runtime.Marshaler) []byte {
+	if d, ok := marshaler.(runtime.Delimited); ok {
+		return d.Delimiter()
+	}
+
+	return []byte("\n")
+}
+
+// wrap returns the result or the error in the envelope.
+func (e StreamEnvelope) wrap(result proto.Message, err error, httpStatus func(codes.Code) int) interface{} {
+	chunk := streamChunk(result, err, httpStatus)
+
+	key, msg := e.ResultKey, chunk["result"]
+	if err != nil || msg == nil {
+		key, msg = e.ErrorKey, chunk["error"]
+	}
+
+	if key == "" {
+		return msg
+	}
+
+	return map[string]proto.Message{key: msg}
+}
+
+func handleForwardResponseStreamError(cfg streamConfig, marshaler runtime.Marshaler, w http.ResponseWriter, err error) {
+	buf, merr := marshaler.Marshal(cfg.envelope.wrap(nil, err, cfg.httpStatus))
 	if merr != nil {
 		grpclog.Infof("Failed to marshal an error: %v", merr)
 		return
@@ -126,7 +448,12 @@ func handleForwardResponseStreamError(marshaler runtime.Marshaler, w http.Respon
 		s = status.New(codes.Unknown, err.Error())
 	}
 
-	w.WriteHeader(runtime.HTTPStatusFromCode(s.Code()))
+	w.WriteHeader(cfg.httpStatus(s.Code()))
+
+	// The error is the last record of delimited streams.
+	if cfg.delimited {
+		buf = append(buf, delimiter(marshaler)...)
+	}
 
 	if _, werr := w.Write(buf); werr != nil {
 		grpclog.Infof("Failed to notify error to client: %v", werr)
@@ -134,7 +461,7 @@ func handleForwardResponseStreamError(marshaler runtime.Marshaler, w http.Respon
 	}
 }
 
-func streamChunk(result proto.Message, err error) map[string]proto.Message {
+func streamChunk(result proto.Message, err error, httpStatus func(codes.Code) int) map[string]proto.Message {
 	if err != nil {
 		grpcCode := codes.Unknown
 		grpcMessage := err.Error()
@@ -156,7 +483,7 @@ func streamChunk(result proto.Message, err error) map[string]proto.Message {
 			}
 		}
 
-		httpCode := runtime.HTTPStatusFromCode(grpcCode)
+		httpCode := httpStatus(grpcCode)
 
 		return map[string]proto.Message{
 			"error": &StreamError{
@@ -170,8 +497,69 @@ func streamChunk(result proto.Message, err error) map[string]proto.Message {
 	}
 
 	if result == nil {
-		return streamChunk(nil, fmt.Errorf("empty response"))
+		return streamChunk(nil, fmt.Errorf("empty response"), httpStatus)
 	}
 
 	return map[string]proto.Message{"result": result}
 }
+
+// streamErrorJSON is the JSON shape of a StreamError with its details
+// already rendered.
+type streamErrorJSON struct {
+	GrpcCode   int32             `json:"grpc_code,omitempty"`
+	HttpCode   int32             `json:"http_code,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	HttpStatus string            `json:"http_status,omitempty"`
+	Details    []json.RawMessage `json:"details,omitempty"`
+}
+
+// MarshalJSON renders the error envelope, decoding any details whose type is
+// known (e.g. google.rpc.BadRequest) into readable JSON.
+func (m *StreamError) MarshalJSON() ([]byte, error) {
+	return m.marshalJSON(&jsonpb.Marshaler{OrigName: true})
+}
+
+// MarshalJSONPB satisfies jsonpb.JSONPBMarshaler so the gateway's JSONPb
+// marshaler renders the details the same way as MarshalJSON.
+func (m *StreamError) MarshalJSONPB(jm *jsonpb.Marshaler) ([]byte, error) {
+	return m.marshalJSON(jm)
+}
+
+func (m *StreamError) marshalJSON(jm *jsonpb.Marshaler) ([]byte, error) {
+	out := streamErrorJSON{
+		GrpcCode:   m.GetGrpcCode(),
+		HttpCode:   m.GetHttpCode(),
+		Message:    m.GetMessage(),
+		HttpStatus: m.GetHttpStatus(),
+	}
+
+	for _, d := range m.GetDetails() {
+		buf, err := marshalDetail(jm, d)
+		if err != nil {
+			return nil, err
+		}
+
+		out.Details = append(out.Details, buf)
+	}
+
+	return json.Marshal(out)
+}
+
+// marshalDetail resolves a status detail into its JSON form. Details whose
+// type isn't registered fall back to the raw Any representation.
+func marshalDetail(jm *jsonpb.Marshaler, d *types.Any) (json.RawMessage, error) {
+	a := &any.Any{
+		TypeUrl: d.GetTypeUrl(),
+		Value:   d.GetValue(),
+	}
+
+	var msg ptypes.DynamicAny
+	if err := ptypes.UnmarshalAny(a, &msg); err == nil {
+		s, err := jm.MarshalToString(a)
+		if err == nil {
+			return json.RawMessage(s), nil
+		}
+	}
+
+	return json.Marshal(d)
+}
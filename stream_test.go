@@ -0,0 +1,390 @@
+package drudge
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	goproto "github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+// fakeStream returns the messages, then err, or io.EOF when it's nil. It
+// fails the test when it's read concurrently or after its error.
+type fakeStream struct {
+	t       *testing.T
+	msgs    []string
+	err     error
+	delay   time.Duration
+	reading int32
+	done    int32
+}
+
+func (s *fakeStream) recv() (goproto.Message, error) {
+	if atomic.AddInt32(&s.reading, 1) != 1 {
+		s.t.Error("recv called concurrently")
+	}
+	defer atomic.AddInt32(&s.reading, -1)
+
+	if atomic.LoadInt32(&s.done) != 0 {
+		s.t.Error("recv called after the stream's error")
+	}
+
+	time.Sleep(s.delay)
+
+	if len(s.msgs) == 0 {
+		atomic.StoreInt32(&s.done, 1)
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+
+	msg := &wrappers.StringValue{Value: s.msgs[0]}
+	s.msgs = s.msgs[1:]
+
+	return msg, nil
+}
+
+func TestForwardResponseStream(t *testing.T) {
+	notFound := status.Error(codes.NotFound, "gone")
+
+	tests := []struct {
+		name     string
+		opts     StreamOptions
+		msgs     []string
+		err      error
+		delay    time.Duration
+		mapper   func(codes.Code) int
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "array",
+			msgs:     []string{"a", "b"},
+			wantCode: http.StatusOK,
+			wantBody: `["a","b"]`,
+		},
+		{
+			name:     "empty",
+			wantCode: http.StatusOK,
+			wantBody: `[]`,
+		},
+		{
+			name:     "error",
+			msgs:     []string{"a"},
+			err:      notFound,
+			wantCode: http.StatusNotFound,
+			wantBody: `{"error":{"grpc_code":5,"http_code":404,"message":"gone","http_status":"Not Found"}}`,
+		},
+		{
+			name:     "mapped error",
+			err:      notFound,
+			mapper:   func(c codes.Code) int { return http.StatusGone },
+			wantCode: http.StatusGone,
+			wantBody: `{"error":{"grpc_code":5,"http_code":410,"message":"gone","http_status":"Gone"}}`,
+		},
+		{
+			name:     "error of another kind",
+			err:      io.ErrUnexpectedEOF,
+			wantCode: http.StatusInternalServerError,
+			wantBody: `{"error":{"grpc_code":2,"http_code":500,"message":"unexpected EOF","http_status":"Internal Server Error"}}`,
+		},
+		{
+			name:     "result key",
+			opts:     StreamOptions{Envelope: &StreamEnvelope{ResultKey: "result", ErrorKey: "error"}},
+			msgs:     []string{"a", "b"},
+			wantCode: http.StatusOK,
+			wantBody: `[{"result":"a"},{"result":"b"}]`,
+		},
+		{
+			name:     "bare error",
+			opts:     StreamOptions{Envelope: &StreamEnvelope{}},
+			err:      notFound,
+			wantCode: http.StatusNotFound,
+			wantBody: `{"grpc_code":5,"http_code":404,"message":"gone","http_status":"Not Found"}`,
+		},
+		{
+			name:     "delimited",
+			opts:     StreamOptions{Delimited: true},
+			msgs:     []string{"a", "b"},
+			wantCode: http.StatusOK,
+			wantBody: "\"a\"\n\"b\"\n",
+		},
+		{
+			name:     "delimited error",
+			opts:     StreamOptions{Delimited: true},
+			msgs:     []string{"a"},
+			err:      notFound,
+			wantCode: http.StatusOK,
+			wantBody: "\"a\"\n" + `{"error":{"grpc_code":5,"http_code":404,"message":"gone","http_status":"Not Found"}}` + "\n",
+		},
+		{
+			name:     "delimited error only",
+			opts:     StreamOptions{Delimited: true},
+			err:      notFound,
+			wantCode: http.StatusNotFound,
+			wantBody: `{"error":{"grpc_code":5,"http_code":404,"message":"gone","http_status":"Not Found"}}` + "\n",
+		},
+		{
+			name:     "heartbeat",
+			opts:     StreamOptions{Heartbeat: 5 * time.Millisecond},
+			msgs:     []string{"a"},
+			delay:    30 * time.Millisecond,
+			wantCode: http.StatusOK,
+			wantBody: `["a"]`,
+		},
+		{
+			name:     "heartbeat before the error",
+			opts:     StreamOptions{Heartbeat: 5 * time.Millisecond},
+			err:      notFound,
+			delay:    30 * time.Millisecond,
+			wantCode: http.StatusOK,
+			wantBody: `{"error":{"grpc_code":5,"http_code":404,"message":"gone","http_status":"Not Found"}}`,
+		},
+	}
+
+	marshaler := &gwruntime.JSONPb{OrigName: true}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/stream", nil)
+			if tt.mapper != nil {
+				r = r.WithContext(context.WithValue(r.Context(), statusMapperKey{}, tt.mapper))
+			}
+
+			ctx := gwruntime.NewServerMetadataContext(r.Context(), gwruntime.ServerMetadata{})
+			s := &fakeStream{t: t, msgs: tt.msgs, err: tt.err, delay: tt.delay}
+			w := httptest.NewRecorder()
+
+			ForwardResponseStreamWith(tt.opts)(ctx, gwruntime.NewServeMux(), marshaler, w, r, s.recv)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			body := w.Body.String()
+			if tt.opts.Heartbeat > 0 {
+				if !strings.HasPrefix(body, "\n") {
+					t.Errorf("body %q doesn't start with a heartbeat", body)
+				}
+				body = strings.TrimLeft(body, "\n")
+			}
+
+			if body != tt.wantBody {
+				t.Errorf("body = %s, want %s", body, tt.wantBody)
+			}
+
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+		})
+	}
+}
+
+func TestForwardResponseStreamDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/v1/stream", nil).WithContext(ctx)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	recv := func() (goproto.Message, error) {
+		cancel()
+		<-release
+		return nil, io.EOF
+	}
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ForwardResponseStream(
+			gwruntime.NewServerMetadataContext(ctx, gwruntime.ServerMetadata{}),
+			gwruntime.NewServeMux(), &gwruntime.JSONPb{}, w, r, recv,
+		)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the forwarder didn't stop once the client was gone")
+	}
+
+	if w.Body.Len() != 0 {
+		t.Errorf("body = %q, want none", w.Body)
+	}
+}
+
+func TestStreamErrorDetails(t *testing.T) {
+	s, err := status.New(codes.InvalidArgument, "bad").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "name", Description: "required"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := streamChunk(nil, s.Err(), gwruntime.HTTPStatusFromCode)
+	b, err := json.Marshal(chunk["error"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		GrpcCode int `json:"grpc_code"`
+		HttpCode int `json:"http_code"`
+		Details  []struct {
+			Type            string `json:"@type"`
+			FieldViolations []struct {
+				Field string `json:"field"`
+			} `json:"field_violations"`
+		} `json:"details"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+
+	if got.GrpcCode != int(codes.InvalidArgument) || got.HttpCode != http.StatusBadRequest {
+		t.Errorf("codes = %d, %d", got.GrpcCode, got.HttpCode)
+	}
+
+	if len(got.Details) != 1 || len(got.Details[0].FieldViolations) != 1 || got.Details[0].FieldViolations[0].Field != "name" {
+		t.Errorf("details = %s", b)
+	}
+}
+
+func TestHeartbeatFrame(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{contentType: "text/event-stream", want: ": heartbeat\n\n"},
+		{contentType: "application/json", want: "\n"},
+		{contentType: "application/x-ndjson", want: "\n"},
+		{contentType: "application/x-protobuf", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := string(heartbeatFrame(tt.contentType)); got != tt.want {
+				t.Errorf("heartbeatFrame() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// uploads sums the sizes of the payloads streamed by the client.
+type uploads struct {
+	testpb.TestServiceServer
+}
+
+func (uploads) StreamingInputCall(stream testpb.TestService_StreamingInputCallServer) error {
+	var size int32
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&testpb.StreamingInputCallResponse{AggregatedPayloadSize: size})
+		}
+		if err != nil {
+			return err
+		}
+
+		size += int32(len(req.GetPayload().GetBody()))
+	}
+}
+
+// uploadHandler serves StreamingInputCall at POST /v1/upload, sending each
+// message of the request body, as a generated gateway handler does.
+func uploadHandler(ctx context.Context, mux *gwruntime.ServeMux, conn *grpc.ClientConn) error {
+	client := testpb.NewTestServiceClient(conn)
+	pattern := gwruntime.MustPattern(gwruntime.NewPattern(1, []int{2, 0, 2, 1}, []string{"v1", "upload"}, ""))
+
+	mux.Handle(http.MethodPost, pattern, func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		inbound, outbound := gwruntime.MarshalerForRequest(mux, r)
+		ctx, err := gwruntime.AnnotateContext(r.Context(), mux, r)
+		if err != nil {
+			gwruntime.HTTPError(r.Context(), mux, outbound, w, r, err)
+			return
+		}
+
+		resp, err := func() (*testpb.StreamingInputCallResponse, error) {
+			stream, err := client.StreamingInputCall(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			dec := inbound.NewDecoder(r.Body)
+			for {
+				req := &testpb.StreamingInputCallRequest{}
+				if err := dec.Decode(req); err == io.EOF {
+					break
+				} else if err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+				}
+
+				if err := stream.Send(req); err != nil {
+					return nil, err
+				}
+			}
+
+			return stream.CloseAndRecv()
+		}()
+		if err != nil {
+			gwruntime.HTTPError(ctx, mux, outbound, w, r, err)
+			return
+		}
+
+		gwruntime.ForwardResponseMessage(ctx, mux, outbound, w, r, resp, mux.GetForwardResponseOptions()...)
+	})
+
+	return nil
+}
+
+func TestClientStreamUpload(t *testing.T) {
+	s := startServer(t, Options{
+		OnRegister: func(s *grpc.Server) error {
+			testpb.RegisterTestServiceServer(s, uploads{})
+			return nil
+		},
+		Handlers: []Handler{uploadHandler},
+	})
+	defer s.Stop(context.Background())
+
+	// "a", "bb" and "ccc".
+	body := `{"payload":{"body":"YQ=="}}
+{"payload":{"body":"YmI="}}
+{"payload":{"body":"Y2Nj"}}
+`
+
+	resp, err := http.Post("http://"+s.Addr().String()+"/v1/upload", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	got := &testpb.StreamingInputCallResponse{}
+	if err := jsonpb.Unmarshal(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.AggregatedPayloadSize != 6 {
+		t.Errorf("aggregated payload size = %d, want the 6 bytes of the three messages", got.AggregatedPayloadSize)
+	}
+}
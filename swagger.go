@@ -0,0 +1,173 @@
+package drudge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// missingWarnInterval is how often missing swagger files are warned about.
+const missingWarnInterval = time.Minute
+
+// swaggerServer returns swagger specification files located under "/openapi/".
+// Files are read once, then served from memory with an ETag for conditional
+// requests and gzip compressed for the clients accepting it. Requests are
+// logged at Debug level, UIs polling the specs would flood the logs.
+func swaggerServer(lg *zap.Logger, fs http.FileSystem) http.HandlerFunc {
+	assets := &assetCache{fs: fs, assets: map[string]*asset{}}
+	files := http.StripPrefix("/openapi", http.FileServer(fs))
+	missing := &missingFiles{lg: lg, interval: missingWarnInterval}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		lg.Debug("Serving swagger", zap.String("path", r.URL.Path))
+		p := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/openapi/"))
+
+		a, err := assets.get(p)
+		switch {
+		case os.IsNotExist(err):
+			missing.warn(p)
+			http.NotFound(w, r)
+			return
+		case err != nil:
+			lg.Error("failed to read swagger file", zap.String("path", p), zap.Error(err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		case a == nil:
+			// Directories keep their listing and index.html.
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		body, etag := a.data, a.etag
+		if a.gzipped != nil && acceptsGzip(r) {
+			body, etag = a.gzipped, a.gzippedETag
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+
+		w.Header().Set("Cache-Control", "public, no-cache")
+		w.Header().Set("Content-Type", a.contentType)
+		w.Header().Set("ETag", etag)
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		http.ServeContent(w, r, p, a.modTime, bytes.NewReader(body))
+	}
+}
+
+// missingFiles warns about the requested swagger files not found, at most
+// once per interval, counting the ones left out in between.
+type missingFiles struct {
+	lg       *zap.Logger
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func (m *missingFiles) warn(p string) {
+	m.mu.Lock()
+	if time.Since(m.last) < m.interval {
+		m.suppressed++
+		m.mu.Unlock()
+		return
+	}
+
+	suppressed := m.suppressed
+	m.last, m.suppressed = time.Now(), 0
+	m.mu.Unlock()
+
+	m.lg.Warn("swagger file not found", zap.String("path", p), zap.Int("suppressed", suppressed))
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// asset is a file held in memory, along with its gzip compressed version
+// when compressing it pays off.
+type asset struct {
+	data        []byte
+	etag        string
+	gzipped     []byte
+	gzippedETag string
+	contentType string
+	modTime     time.Time
+}
+
+type assetCache struct {
+	fs http.FileSystem
+
+	mu     sync.Mutex
+	assets map[string]*asset
+}
+
+// get returns the asset of the file at p, it's nil for directories.
+func (c *assetCache) get(p string) (*asset, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if a, ok := c.assets[p]; ok {
+		return a, nil
+	}
+
+	f, err := c.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	tag := hex.EncodeToString(sum[:16])
+
+	a := &asset{
+		data:        data,
+		etag:        `"` + tag + `"`,
+		contentType: mime.TypeByExtension(path.Ext(p)),
+		modTime:     fi.ModTime(),
+	}
+	if a.contentType == "" {
+		a.contentType = http.DetectContentType(data)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err == nil && gz.Close() == nil && buf.Len() < len(data) {
+		a.gzipped = buf.Bytes()
+		a.gzippedETag = `"` + tag + `-gzip"`
+	}
+
+	c.assets[p] = a
+
+	return a, nil
+}
@@ -0,0 +1,224 @@
+package drudge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSwaggerServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swagger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := `{"swagger":"2.0","paths":{` + strings.Repeat(`"/v1/users":{},`, 50) + `"/v1/groups":{}}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "users.swagger.json"), []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "tiny.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := swaggerServer(zap.NewNop(), http.Dir(dir))
+
+	tests := []struct {
+		name         string
+		path         string
+		headers      map[string]string
+		wantStatus   int
+		wantEncoding string
+		wantType     string
+	}{
+		{name: "plain", path: "/openapi/users.swagger.json", wantStatus: http.StatusOK, wantType: "application/json"},
+		{
+			name:         "gzip",
+			path:         "/openapi/users.swagger.json",
+			headers:      map[string]string{"Accept-Encoding": "br, gzip;q=0.8"},
+			wantStatus:   http.StatusOK,
+			wantEncoding: "gzip",
+			wantType:     "application/json",
+		},
+		{
+			name:       "not worth compressing",
+			path:       "/openapi/tiny.json",
+			headers:    map[string]string{"Accept-Encoding": "gzip"},
+			wantStatus: http.StatusOK,
+			wantType:   "application/json",
+		},
+		{name: "missing", path: "/openapi/nope.json", wantStatus: http.StatusNotFound},
+		{name: "escaping", path: "/openapi/../../etc/passwd", wantStatus: http.StatusNotFound},
+		{name: "directory", path: "/openapi/", wantStatus: http.StatusOK, wantType: "text/html; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.URL.Path = tt.path
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			if tt.wantType != "" && w.Header().Get("Content-Type") != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", w.Header().Get("Content-Type"), tt.wantType)
+			}
+
+			if tt.wantEncoding == "gzip" {
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				body, err := ioutil.ReadAll(gz)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(body) != spec {
+					t.Errorf("decompressed body = %s", body)
+				}
+			}
+		})
+	}
+}
+
+func TestSwaggerServerETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swagger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := bytes.Repeat([]byte(`{"swagger":"2.0"}`), 20)
+	if err := ioutil.WriteFile(filepath.Join(dir, "users.json"), spec, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := swaggerServer(zap.NewNop(), http.Dir(dir))
+
+	etag := func(encoding string) string {
+		r := httptest.NewRequest(http.MethodGet, "/openapi/users.json", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w.Header().Get("ETag")
+	}
+
+	plain, gzipped := etag(""), etag("gzip")
+	if plain == "" || plain == gzipped {
+		t.Fatalf("ETags = %q and %q", plain, gzipped)
+	}
+
+	tests := []struct {
+		name       string
+		match      string
+		encoding   string
+		wantStatus int
+	}{
+		{name: "match", match: plain, wantStatus: http.StatusNotModified},
+		{name: "gzip match", match: gzipped, encoding: "gzip", wantStatus: http.StatusNotModified},
+		{name: "other encoding", match: plain, encoding: "gzip", wantStatus: http.StatusOK},
+		{name: "changed", match: `"old"`, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/openapi/users.json", nil)
+			r.Header.Set("If-None-Match", tt.match)
+			r.Header.Set("Accept-Encoding", tt.encoding)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMissingFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		warns    int
+		want     []int64
+	}{
+		{name: "once per interval", interval: time.Hour, warns: 3, want: []int64{0}},
+		{name: "no interval", interval: 0, warns: 2, want: []int64{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			m := &missingFiles{lg: zap.New(core), interval: tt.interval}
+
+			for i := 0; i < tt.warns; i++ {
+				m.warn("/nope.json")
+			}
+
+			entries := logs.All()
+			if len(entries) != len(tt.want) {
+				t.Fatalf("%d warnings, want %d", len(entries), len(tt.want))
+			}
+
+			for i, e := range entries {
+				if got := e.ContextMap()["suppressed"]; got != tt.want[i] {
+					t.Errorf("warning %d: suppressed = %v, want %d", i, got, tt.want[i])
+				}
+			}
+
+			if tt.interval > 0 && m.suppressed != tt.warns-1 {
+				t.Errorf("suppressed = %d, want %d", m.suppressed, tt.warns-1)
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: "gzip", want: true},
+		{header: "deflate, gzip;q=0.5", want: true},
+		{header: "br", want: false},
+		{header: "gzipped", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", tt.header)
+
+			if got := acceptsGzip(r); got != tt.want {
+				t.Errorf("acceptsGzip() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,20 @@
 package drudge
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	jaegercensus "contrib.go.opencensus.io/exporter/jaeger"
+	datadog "github.com/DataDog/opencensus-go-exporter-datadog"
+	goproto "github.com/golang/protobuf/proto"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/pkg/errors"
@@ -14,9 +23,15 @@ import (
 	jaegerlog "github.com/uber/jaeger-client-go/log"
 	"github.com/uber/jaeger-lib/metrics/prometheus"
 	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -28,6 +43,29 @@ var (
 	ServiceTag, _  = tag.NewKey("service")
 
 	LatencyDistribution = view.Distribution(25, 50, 75, 100, 200, 400, 600, 800, 1000, 2000, 4000, 6000)
+	SizeDistribution    = view.Distribution(0, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216)
+
+	HTTPRequestBytes  = stats.Int64("drudge/http/request_bytes", "Size of HTTP request bodies", stats.UnitBytes)
+	HTTPResponseBytes = stats.Int64("drudge/http/response_bytes", "Size of HTTP response bodies", stats.UnitBytes)
+
+	// HTTPSizeViews aggregate the HTTP payload sizes by method. They are
+	// registered by New unless Options.DisableMetrics is set.
+	HTTPSizeViews = []*view.View{
+		{
+			Name:        HTTPRequestBytes.Name(),
+			Measure:     HTTPRequestBytes,
+			Description: HTTPRequestBytes.Description(),
+			Aggregation: SizeDistribution,
+			TagKeys:     []tag.Key{MethodTag},
+		},
+		{
+			Name:        HTTPResponseBytes.Name(),
+			Measure:     HTTPResponseBytes,
+			Description: HTTPResponseBytes.Description(),
+			Aggregation: SizeDistribution,
+			TagKeys:     []tag.Key{MethodTag},
+		},
+	}
 )
 
 type TraceExporter func(interface{}) (func(), error)
@@ -104,23 +142,380 @@ func Jaeger(c interface{}) (func(), error) {
 	}, nil
 }
 
+// DefaultSpanMetadata are the incoming metadata keys attached to server spans
+// when no allowlist is given.
+var DefaultSpanMetadata = []string{"user-agent", ":authority"}
+
+// DefaultTraceSkipPaths are the paths served without spans, along with the
+// paths below them, when no list is given.
+var DefaultTraceSkipPaths = []string{"/metrics", "/healthz", "/readyz", "/openapi/"}
+
+// DatadogConfig configures the Datadog exporter. Empty addresses fall back to
+// the exporter's local agent defaults.
+type DatadogConfig struct {
+	ServiceName string
+	Env         string
+
+	// TraceAddr is the host:port of the agent's trace endpoint.
+	TraceAddr string
+
+	// StatsAddr is the host:port of the agent's DogStatsD endpoint.
+	StatsAddr string
+
+	// SampleRate is the fraction of traces sampled, zero samples everything.
+	SampleRate float64
+}
+
+func Datadog(c interface{}) (func(), error) {
+	var cfg DatadogConfig
+	switch v := c.(type) {
+	case DatadogConfig:
+		cfg = v
+	case *DatadogConfig:
+		if v == nil {
+			return nil, errors.New("configuration was nil")
+		}
+
+		cfg = *v
+	default:
+		return nil, errors.Errorf("expected Datadog config, received '%T'", c)
+	}
+
+	opts := datadog.Options{
+		Service:   cfg.ServiceName,
+		TraceAddr: cfg.TraceAddr,
+		StatsAddr: cfg.StatsAddr,
+	}
+	if cfg.Env != "" {
+		opts.GlobalTags = map[string]interface{}{"env": cfg.Env}
+	}
+
+	de, err := datadog.NewExporter(opts)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create the Datadog exporter")
+	}
+
+	sampler := trace.AlwaysSample()
+	if cfg.SampleRate > 0 && cfg.SampleRate < 1 {
+		sampler = trace.ProbabilitySampler(cfg.SampleRate)
+	}
+
+	trace.RegisterExporter(de)
+	view.RegisterExporter(de)
+	trace.ApplyConfig(trace.Config{DefaultSampler: sampler})
+
+	// Register the views to collect server request count.
+	if err := view.Register(ocgrpc.DefaultServerViews...); err != nil {
+		return nil, errors.WithMessage(err, "failed to register server metric views")
+	}
+
+	return func() {
+		trace.UnregisterExporter(de)
+		view.UnregisterExporter(de)
+		de.Stop()
+	}, nil
+}
+
+// ExporterConfig pairs a TraceExporter with its configuration for Multi.
+type ExporterConfig struct {
+	Exporter TraceExporter
+	Config   interface{}
+}
+
+// Multi registers every exporter of a []ExporterConfig, spans are exported
+// to all of them. The cleanups run in reverse order, and the exporters
+// registered before a failing one are cleaned up. Each exporter applies its
+// sampler, the last one wins.
+func Multi(c interface{}) (func(), error) {
+	var exporters []ExporterConfig
+	switch v := c.(type) {
+	case []ExporterConfig:
+		exporters = v
+	case ExporterConfig:
+		exporters = []ExporterConfig{v}
+	default:
+		return nil, errors.Errorf("expected []ExporterConfig, received '%T'", c)
+	}
+
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	for i, e := range exporters {
+		if e.Exporter == nil {
+			cleanup()
+			return nil, errors.Errorf("exporter %d is nil", i)
+		}
+
+		flush, err := e.Exporter(e.Config)
+		if err != nil {
+			cleanup()
+			return nil, errors.WithMessagef(err, "failed to register exporter %d", i)
+		}
+
+		if flush != nil {
+			cleanups = append(cleanups, flush)
+		}
+	}
+
+	return cleanup, nil
+}
+
+// StdoutConfig configures the exporter writing spans as JSON, meant for
+// development.
+type StdoutConfig struct {
+	// Writer receives one JSON document per span, defaulting to os.Stdout.
+	Writer io.Writer
+
+	// Logger, when set, logs the spans at Debug level instead of writing
+	// them to Writer.
+	Logger *zap.Logger
+
+	// PrettyPrint indents the JSON, spans are written compactly otherwise.
+	PrettyPrint bool
+
+	// KeepSampler leaves the global sampler alone instead of sampling every
+	// span, e.g. when another exporter given to Multi configures it.
+	KeepSampler bool
+}
+
+func Stdout(c interface{}) (func(), error) {
+	var cfg StdoutConfig
+	switch v := c.(type) {
+	case nil:
+	case StdoutConfig:
+		cfg = v
+	case *StdoutConfig:
+		if v != nil {
+			cfg = *v
+		}
+	default:
+		return nil, errors.Errorf("expected Stdout config, received '%T'", c)
+	}
+
+	if cfg.Writer == nil {
+		cfg.Writer = os.Stdout
+	}
+
+	e := &writerExporter{
+		w:      cfg.Writer,
+		lg:     cfg.Logger,
+		pretty: cfg.PrettyPrint,
+	}
+
+	trace.RegisterExporter(e)
+	if !cfg.KeepSampler {
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	}
+
+	return func() {
+		trace.UnregisterExporter(e)
+	}, nil
+}
+
+// writerExporter writes every span it receives as JSON.
+type writerExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	lg     *zap.Logger
+	pretty bool
+}
+
+// exportedSpan is the JSON representation of a span, with hex encoded IDs.
+type exportedSpan struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	StartTime    time.Time              `json:"start_time"`
+	EndTime      time.Time              `json:"end_time"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Code         int32                  `json:"code"`
+	Message      string                 `json:"message,omitempty"`
+}
+
+func (e *writerExporter) ExportSpan(s *trace.SpanData) {
+	span := exportedSpan{
+		TraceID:    s.TraceID.String(),
+		SpanID:     s.SpanID.String(),
+		Name:       s.Name,
+		StartTime:  s.StartTime,
+		EndTime:    s.EndTime,
+		Attributes: s.Attributes,
+		Code:       s.Code,
+		Message:    s.Message,
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+
+	if e.lg != nil {
+		e.lg.Debug("span", zap.String("name", s.Name), zap.Reflect("span", span))
+		return
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if e.pretty {
+		b, err = json.MarshalIndent(span, "", "  ")
+	} else {
+		b, err = json.Marshal(span)
+	}
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, _ = e.w.Write(append(b, '\n'))
+}
+
+// UnaryServerInterceptor starts a span named after the invoked RPC method and
+// records the resulting gRPC status code on it. The caller's peer address and
+// the allowlisted metadata keys are added as attributes, falling back to
+// DefaultSpanMetadata.
+func UnaryServerInterceptor(metadataKeys ...string) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		ctx, span := trace.StartSpan(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		span.AddAttributes(peerAttributes(ctx, metadataKeys)...)
+		if m, ok := req.(goproto.Message); ok {
+			span.AddAttributes(trace.Int64Attribute("grpc.request_size", int64(goproto.Size(m))))
+		}
+
+		resp, err := handler(ctx, req)
+		setSpanStatus(span, err)
+
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor starts a span named after the invoked RPC method
+// and records the resulting gRPC status code on it, along with the same
+// caller attributes as UnaryServerInterceptor.
+func StreamServerInterceptor(metadataKeys ...string) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		ctx, span := trace.StartSpan(ss.Context(), info.FullMethod, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		span.AddAttributes(peerAttributes(ctx, metadataKeys)...)
+
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = ctx
+
+		err := handler(srv, wrapped)
+		setSpanStatus(span, err)
+
+		return err
+	}
+}
+
+// peerAttributes describes the caller of an RPC. Only the allowlisted
+// metadata keys are included to avoid leaking credentials.
+func peerAttributes(ctx context.Context, keys []string) []trace.Attribute {
+	var attrs []trace.Attribute
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		attrs = append(attrs, trace.StringAttribute("net.peer.address", p.Addr.String()))
+	}
+
+	if len(keys) == 0 {
+		keys = DefaultSpanMetadata
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, k := range keys {
+		if v := md.Get(k); len(v) > 0 {
+			attrs = append(attrs, trace.StringAttribute("grpc.metadata."+strings.ToLower(k), strings.Join(v, ",")))
+		}
+	}
+
+	return attrs
+}
+
+// setSpanStatus records the handler's gRPC status on the span, marking the
+// span as errored when the handler failed.
+func setSpanStatus(span *trace.Span, err error) {
+	s, _ := status.FromError(err)
+	span.AddAttributes(trace.StringAttribute("grpc.status_code", s.Code().String()))
+
+	if err != nil {
+		span.SetStatus(trace.Status{
+			Code:    int32(s.Code()),
+			Message: s.Message(),
+		})
+	}
+}
+
 var drudgeTag = opentracing.Tag{Key: string(ext.Component), Value: "drudge"}
 
-func tracingWrapper(h http.Handler) http.Handler {
+// skipTracing routes requests for one of the paths, or below, straight to
+// untraced, bypassing span creation entirely, falling back to
+// DefaultTraceSkipPaths.
+func skipTracing(paths []string, traced, untraced http.Handler) http.Handler {
+	if len(paths) == 0 {
+		paths = DefaultTraceSkipPaths
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/metrics" {
-			h.ServeHTTP(w, r)
-			return
+		for _, p := range paths {
+			if underPath(r.URL.Path, p) {
+				untraced.ServeHTTP(w, r)
+				return
+			}
 		}
 
-		spanName := fmt.Sprintf("http.%s.[%s]", r.Method, r.URL.Path)
+		traced.ServeHTTP(w, r)
+	})
+}
+
+// underPath reports whether path is p or below it. A "/metrics" p doesn't
+// match "/metricsfoo", a gateway route.
+func underPath(path, p string) bool {
+	if strings.HasSuffix(p, "/") {
+		return strings.HasPrefix(path, p)
+	}
+
+	return path == p || strings.HasPrefix(path, p+"/")
+}
+
+// SpanAttributes returns the attributes added to the spans of an HTTP request
+// once served with status. Values other than strings, bools, integers and
+// floats are formatted.
+type SpanAttributes func(r *http.Request, status int) map[string]interface{}
+
+// tracingWrapper starts the server spans for an HTTP request, named after
+// its method and route template, e.g. "http.GET.[/v1/users/{id}]", and
+// enriched by attrs when set. The request context is only ever derived from
+// r.Context(), so a client disconnect still cancels the gRPC call forwarded
+// by the gateway.
+func tracingWrapper(tracer opentracing.Tracer, attrs SpanAttributes, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spanName := fmt.Sprintf("http.%s.[%s]", r.Method, routeLabel(r.Context()))
 
-		parentSpanContext, err := opentracing.GlobalTracer().Extract(
+		parentSpanContext, err := tracer.Extract(
 			opentracing.HTTPHeaders,
 			opentracing.HTTPHeadersCarrier(r.Header),
 		)
 		if err == nil || err == opentracing.ErrSpanContextNotFound {
-			serverSpan := opentracing.GlobalTracer().StartSpan(
+			serverSpan := tracer.StartSpan(
 				spanName,
 				ext.RPCServerOption(parentSpanContext),
 				drudgeTag,
@@ -133,6 +528,99 @@ func tracingWrapper(h http.Handler) http.Handler {
 		defer span.End()
 		r = r.WithContext(ctx)
 
-		h.ServeHTTP(w, r)
+		if route := RouteFromContext(ctx); route != "" {
+			setSpanRoute(ctx, route)
+		}
+
+		trw := &traceableResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(trw, r)
+
+		span.AddAttributes(
+			trace.Int64Attribute("http.request_content_length", r.ContentLength),
+			trace.Int64Attribute("http.response_size", trw.written),
+		)
+
+		sp := opentracing.SpanFromContext(ctx)
+		if sp != nil {
+			sp.SetTag("http.request_content_length", r.ContentLength)
+			sp.SetTag("http.response_size", trw.written)
+		}
+
+		if ip := ClientIP(ctx); ip != nil {
+			span.AddAttributes(trace.StringAttribute("http.client_ip", ip.String()))
+			if sp != nil {
+				sp.SetTag("http.client_ip", ip.String())
+			}
+		}
+
+		if attrs != nil {
+			status := trw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			for k, v := range attrs(r, status) {
+				span.AddAttributes(spanAttribute(k, v))
+				if sp != nil {
+					sp.SetTag(k, v)
+				}
+			}
+		}
 	})
 }
+
+// spanAttribute converts v to the OpenCensus attribute of its type.
+func spanAttribute(k string, v interface{}) trace.Attribute {
+	switch v := v.(type) {
+	case string:
+		return trace.StringAttribute(k, v)
+	case bool:
+		return trace.BoolAttribute(k, v)
+	case int:
+		return trace.Int64Attribute(k, int64(v))
+	case int32:
+		return trace.Int64Attribute(k, int64(v))
+	case int64:
+		return trace.Int64Attribute(k, v)
+	case float32:
+		return trace.Float64Attribute(k, float64(v))
+	case float64:
+		return trace.Float64Attribute(k, v)
+	default:
+		return trace.StringAttribute(k, fmt.Sprint(v))
+	}
+}
+
+// traceableResponseWriter records what's written to the response so it can
+// be attached to the request's span.
+type traceableResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (trw *traceableResponseWriter) WriteHeader(code int) {
+	if trw.status == 0 {
+		trw.status = code
+	}
+
+	trw.ResponseWriter.WriteHeader(code)
+}
+
+func (trw *traceableResponseWriter) Write(b []byte) (int, error) {
+	if trw.status == 0 {
+		trw.status = http.StatusOK
+	}
+
+	n, err := trw.ResponseWriter.Write(b)
+	trw.written += int64(n)
+
+	return n, err
+}
+
+// Flush passes through to the underlying writer when it supports flushing.
+func (trw *traceableResponseWriter) Flush() {
+	if f, ok := trw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
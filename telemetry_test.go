@@ -0,0 +1,784 @@
+package drudge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/pkg/errors"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// spanRecorder keeps the spans exported while it's registered.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = append(r.spans, s)
+}
+
+// recordSpan runs f below a sampled span and returns the exported span
+// named name.
+func recordSpan(t *testing.T, name string, f func(ctx context.Context)) *trace.SpanData {
+	t.Helper()
+
+	rec := &spanRecorder{}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+
+	ctx, parent := trace.StartSpan(context.Background(), "parent", trace.WithSampler(trace.AlwaysSample()))
+	f(ctx)
+	parent.End()
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	for _, s := range rec.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+
+	t.Fatalf("no span %q exported", name)
+
+	return nil
+}
+
+// waitSpan waits for rec to export the span of the trace named name.
+func waitSpan(t *testing.T, rec *spanRecorder, traceID trace.TraceID, name string) *trace.SpanData {
+	t.Helper()
+
+	find := func() *trace.SpanData {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		for _, s := range rec.spans {
+			if s.TraceID == traceID && s.Name == name {
+				return s
+			}
+		}
+
+		return nil
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s := find(); s != nil {
+			return s
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("no span %q exported in trace %s", name, traceID)
+
+	return nil
+}
+
+func TestExporterConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter TraceExporter
+		config   interface{}
+	}{
+		{name: "jaeger type", exporter: Jaeger, config: "localhost"},
+		{name: "jaeger nil", exporter: Jaeger, config: (*jaegercfg.Configuration)(nil)},
+		{name: "datadog type", exporter: Datadog, config: JaegerConfig{}},
+		{name: "datadog nil", exporter: Datadog, config: (*DatadogConfig)(nil)},
+		{name: "stdout type", exporter: Stdout, config: 1},
+		{name: "multi type", exporter: Multi, config: "stdout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.exporter(tt.config); err == nil {
+				t.Error("exporter succeeded")
+			}
+		})
+	}
+}
+
+func TestMulti(t *testing.T) {
+	fail := errors.New("unreachable")
+
+	tests := []struct {
+		name      string
+		exporters []string
+		wantErr   bool
+		wantCalls []string
+	}{
+		{name: "none", wantCalls: nil},
+		{name: "cleanup order", exporters: []string{"a", "b", "c"}, wantCalls: []string{"c", "b", "a"}},
+		{name: "no cleanup", exporters: []string{"a", "-", "c"}, wantCalls: []string{"c", "a"}},
+		{name: "failing", exporters: []string{"a", "b", "!"}, wantErr: true, wantCalls: []string{"b", "a"}},
+		{name: "nil", exporters: []string{"a", ""}, wantErr: true, wantCalls: []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+
+			var configs []ExporterConfig
+			for _, name := range tt.exporters {
+				name := name
+
+				var e TraceExporter
+				switch name {
+				case "":
+				case "!":
+					e = func(interface{}) (func(), error) { return nil, fail }
+				case "-":
+					e = func(interface{}) (func(), error) { return nil, nil }
+				default:
+					e = func(c interface{}) (func(), error) {
+						if c != name {
+							t.Errorf("config = %v, want %s", c, name)
+						}
+
+						return func() { calls = append(calls, name) }, nil
+					}
+				}
+
+				configs = append(configs, ExporterConfig{Exporter: e, Config: name})
+			}
+
+			cleanup, err := Multi(configs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Multi() = %v, want error %t", err, tt.wantErr)
+			}
+
+			if cleanup != nil {
+				cleanup()
+			}
+
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("cleanups = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	span := &trace.SpanData{
+		SpanContext:  trace.SpanContext{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}},
+		ParentSpanID: trace.SpanID{3},
+		Name:         "/pkg.Users/Get",
+		Attributes:   map[string]interface{}{"grpc.status_code": "OK"},
+		Status:       trace.Status{Code: int32(codes.NotFound), Message: "no such user"},
+	}
+	root := &trace.SpanData{SpanContext: span.SpanContext, Name: "root"}
+
+	tests := []struct {
+		name       string
+		span       *trace.SpanData
+		pretty     bool
+		wantParent string
+	}{
+		{name: "compact", span: span, wantParent: "0300000000000000"},
+		{name: "pretty", span: span, pretty: true, wantParent: "0300000000000000"},
+		{name: "root", span: root},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			e := &writerExporter{w: &buf, pretty: tt.pretty}
+			e.ExportSpan(tt.span)
+
+			out := buf.String()
+			if !strings.HasSuffix(out, "\n") || (strings.Count(out, "\n") > 1) != tt.pretty {
+				t.Errorf("output = %q, pretty %t", out, tt.pretty)
+			}
+
+			var got exportedSpan
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.TraceID != tt.span.TraceID.String() || got.SpanID != tt.span.SpanID.String() || got.Name != tt.span.Name {
+				t.Errorf("span = %+v", got)
+			}
+
+			if got.ParentSpanID != tt.wantParent {
+				t.Errorf("parent = %q, want %q", got.ParentSpanID, tt.wantParent)
+			}
+
+			if got.Code != tt.span.Code || got.Message != tt.span.Message {
+				t.Errorf("status = %d %q", got.Code, got.Message)
+			}
+		})
+	}
+}
+
+func TestWriterExporterLogger(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+
+	var buf bytes.Buffer
+	e := &writerExporter{w: &buf, lg: zap.New(core)}
+	e.ExportSpan(&trace.SpanData{Name: "root"})
+
+	if buf.Len() != 0 {
+		t.Errorf("written %q", buf.String())
+	}
+
+	if entries := logs.All(); len(entries) != 1 || entries[0].ContextMap()["name"] != "root" {
+		t.Errorf("logged %v", entries)
+	}
+}
+
+func TestServerInterceptors(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4321}
+
+	tests := []struct {
+		name      string
+		keys      []string
+		md        metadata.MD
+		err       error
+		wantAttrs map[string]interface{}
+		wantCode  int32
+	}{
+		{
+			name: "default metadata",
+			md:   metadata.Pairs("user-agent", "grpc-go", "authorization", "Bearer t"),
+			wantAttrs: map[string]interface{}{
+				"net.peer.address":         "10.0.0.1:4321",
+				"grpc.metadata.user-agent": "grpc-go",
+				"grpc.status_code":         "OK",
+			},
+		},
+		{
+			name: "allowlist",
+			keys: []string{"X-Tenant"},
+			md:   metadata.Pairs("user-agent", "grpc-go", "x-tenant", "a", "x-tenant", "b"),
+			wantAttrs: map[string]interface{}{
+				"net.peer.address":       "10.0.0.1:4321",
+				"grpc.metadata.x-tenant": "a,b",
+				"grpc.status_code":       "OK",
+			},
+		},
+		{
+			name: "error",
+			err:  status.Error(codes.NotFound, "no such user"),
+			wantAttrs: map[string]interface{}{
+				"net.peer.address": "10.0.0.1:4321",
+				"grpc.status_code": "NotFound",
+			},
+			wantCode: int32(codes.NotFound),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			incoming := func(ctx context.Context) context.Context {
+				ctx = peer.NewContext(ctx, &peer.Peer{Addr: addr})
+				return metadata.NewIncomingContext(ctx, tt.md)
+			}
+
+			unary := recordSpan(t, "/pkg.Users/Get", func(ctx context.Context) {
+				_, _ = UnaryServerInterceptor(tt.keys...)(incoming(ctx), &wrappers.StringValue{Value: "abc"}, &grpc.UnaryServerInfo{FullMethod: "/pkg.Users/Get"},
+					func(ctx context.Context, req interface{}) (interface{}, error) {
+						return nil, tt.err
+					})
+			})
+
+			want := map[string]interface{}{"grpc.request_size": int64(5)}
+			for k, v := range tt.wantAttrs {
+				want[k] = v
+			}
+
+			if !reflect.DeepEqual(unary.Attributes, want) {
+				t.Errorf("unary attributes = %v, want %v", unary.Attributes, want)
+			}
+
+			if unary.Code != tt.wantCode {
+				t.Errorf("unary code = %d, want %d", unary.Code, tt.wantCode)
+			}
+
+			stream := recordSpan(t, "/pkg.Users/Watch", func(ctx context.Context) {
+				_ = StreamServerInterceptor(tt.keys...)(nil, &contextStream{ctx: incoming(ctx)}, &grpc.StreamServerInfo{FullMethod: "/pkg.Users/Watch"},
+					func(srv interface{}, ss grpc.ServerStream) error {
+						if trace.FromContext(ss.Context()) == nil {
+							t.Error("no span in the stream context")
+						}
+
+						return tt.err
+					})
+			})
+
+			if !reflect.DeepEqual(stream.Attributes, tt.wantAttrs) {
+				t.Errorf("stream attributes = %v, want %v", stream.Attributes, tt.wantAttrs)
+			}
+
+			if stream.Code != tt.wantCode {
+				t.Errorf("stream code = %d, want %d", stream.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestSkipTracing(t *testing.T) {
+	tests := []struct {
+		name   string
+		paths  []string
+		path   string
+		traced bool
+	}{
+		{name: "default metrics", path: "/metrics", traced: false},
+		{name: "default below openapi", path: "/openapi/users.json", traced: false},
+		{name: "default prefix only", path: "/metricsfoo", traced: true},
+		{name: "default route", path: "/v1/users", traced: true},
+		{name: "custom", paths: []string{"/v1/ping"}, path: "/v1/ping", traced: false},
+		{name: "custom below", paths: []string{"/v1/ping"}, path: "/v1/ping/1", traced: false},
+		{name: "custom replaces the defaults", paths: []string{"/v1/ping"}, path: "/metrics", traced: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var traced bool
+			h := skipTracing(tt.paths,
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { traced = true }),
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+			)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if traced != tt.traced {
+				t.Errorf("traced = %t, want %t", traced, tt.traced)
+			}
+		})
+	}
+}
+
+func TestSpanAttribute(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want interface{}
+	}{
+		{name: "string", v: "a", want: "a"},
+		{name: "bool", v: true, want: true},
+		{name: "int", v: 1, want: int64(1)},
+		{name: "int32", v: int32(2), want: int64(2)},
+		{name: "int64", v: int64(3), want: int64(3)},
+		{name: "float32", v: float32(0.5), want: 0.5},
+		{name: "float64", v: 1.5, want: 1.5},
+		{name: "other", v: []int{1, 2}, want: "[1 2]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := recordSpan(t, "attr", func(ctx context.Context) {
+				_, span := trace.StartSpan(ctx, "attr")
+				span.AddAttributes(spanAttribute("k", tt.v))
+				span.End()
+			})
+
+			if got := s.Attributes["k"]; got != tt.want {
+				t.Errorf("attribute = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTracingWrapper(t *testing.T) {
+	tests := []struct {
+		name      string
+		route     string
+		ip        string
+		attrs     SpanAttributes
+		handler   http.HandlerFunc
+		wantName  string
+		wantAttrs map[string]interface{}
+	}{
+		{
+			name:     "unmatched",
+			handler:  func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("hello")) },
+			wantName: "http.GET.[unmatched]",
+			wantAttrs: map[string]interface{}{
+				"http.request_content_length": int64(0),
+				"http.response_size":          int64(5),
+			},
+		},
+		{
+			name:     "route",
+			route:    "/v1/users/{id}",
+			ip:       "10.0.0.1",
+			handler:  func(w http.ResponseWriter, r *http.Request) {},
+			wantName: "http.GET.[/v1/users/{id}]",
+			wantAttrs: map[string]interface{}{
+				"http.route":                  "/v1/users/{id}",
+				"http.client_ip":              "10.0.0.1",
+				"http.request_content_length": int64(0),
+				"http.response_size":          int64(0),
+			},
+		},
+		{
+			name: "attributes",
+			attrs: func(r *http.Request, status int) map[string]interface{} {
+				return map[string]interface{}{"http.status": status, "tenant": "acme"}
+			},
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) },
+			wantName: "http.GET.[unmatched]",
+			wantAttrs: map[string]interface{}{
+				"http.request_content_length": int64(0),
+				"http.response_size":          int64(0),
+				"http.status":                 int64(http.StatusTeapot),
+				"tenant":                      "acme",
+			},
+		},
+		{
+			name: "implicit OK",
+			attrs: func(r *http.Request, status int) map[string]interface{} {
+				return map[string]interface{}{"http.status": status}
+			},
+			handler:  func(w http.ResponseWriter, r *http.Request) {},
+			wantName: "http.GET.[unmatched]",
+			wantAttrs: map[string]interface{}{
+				"http.request_content_length": int64(0),
+				"http.response_size":          int64(0),
+				"http.status":                 int64(http.StatusOK),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer := mocktracer.New()
+
+			s := recordSpan(t, tt.wantName, func(ctx context.Context) {
+				if tt.route != "" {
+					ctx = context.WithValue(ctx, routeKey{}, tt.route)
+				}
+				if tt.ip != "" {
+					ctx = context.WithValue(ctx, clientIPKey{}, net.ParseIP(tt.ip))
+				}
+
+				r := httptest.NewRequest(http.MethodGet, "/v1/users/1", nil).WithContext(ctx)
+				tracingWrapper(tracer, tt.attrs, tt.handler).ServeHTTP(httptest.NewRecorder(), r)
+			})
+
+			if !reflect.DeepEqual(s.Attributes, tt.wantAttrs) {
+				t.Errorf("attributes = %v, want %v", s.Attributes, tt.wantAttrs)
+			}
+
+			finished := tracer.FinishedSpans()
+			if len(finished) != 1 {
+				t.Fatalf("%d OpenTracing spans", len(finished))
+			}
+
+			if finished[0].OperationName != tt.wantName || finished[0].Tag("component") != "drudge" {
+				t.Errorf("OpenTracing span = %s %v", finished[0].OperationName, finished[0].Tags())
+			}
+
+			for k := range tt.wantAttrs {
+				if finished[0].Tag(k) == nil {
+					t.Errorf("OpenTracing span misses tag %q", k)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceableResponseWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		write       func(w http.ResponseWriter)
+		wantStatus  int
+		wantWritten int64
+	}{
+		{name: "nothing"},
+		{name: "write", write: func(w http.ResponseWriter) { _, _ = w.Write([]byte("abc")) }, wantStatus: http.StatusOK, wantWritten: 3},
+		{
+			name: "first status",
+			write: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusNotFound)
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte("a"))
+			},
+			wantStatus:  http.StatusNotFound,
+			wantWritten: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			trw := &traceableResponseWriter{ResponseWriter: rec}
+			if tt.write != nil {
+				tt.write(trw)
+			}
+			trw.Flush()
+
+			if trw.status != tt.wantStatus || trw.written != tt.wantWritten {
+				t.Errorf("status %d, written %d, want %d and %d", trw.status, trw.written, tt.wantStatus, tt.wantWritten)
+			}
+
+			if !rec.Flushed {
+				t.Error("not flushed")
+			}
+		})
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	rec := &spanRecorder{}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+
+	s := startOperations(t, &operations{}, Options{})
+	defer s.Stop(context.Background())
+
+	r, err := http.NewRequest(http.MethodGet, "http://"+s.Addr().String()+"/v1/operations/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	traceID := trace.TraceID{0x0a, 0xf7, 0x65, 0x19, 0x16, 0xcd, 0x43, 0xdd, 0x84, 0x48, 0xeb, 0x21, 0x1c, 0x80, 0x31, 0x9c}
+	span := waitSpan(t, rec, traceID, "/v1/{name=operations/**}")
+
+	if want := (trace.SpanID{0xb7, 0xad, 0x6b, 0x71, 0x69, 0x20, 0x33, 0x31}); span.ParentSpanID != want || !span.HasRemoteParent {
+		t.Errorf("server span parent = %s, remote %t, want %s", span.ParentSpanID, span.HasRemoteParent, want)
+	}
+}
+
+func TestDisabledTelemetry(t *testing.T) {
+	rec := &spanRecorder{}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+
+	tracer := mocktracer.New()
+	s := startOperations(t, &operations{}, Options{DisableTracing: true, DisableMetrics: true, Tracer: tracer})
+	addr := s.Addr().String()
+
+	r, err := http.NewRequest(http.MethodGet, "http://"+addr+"/v1/operations/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get("http://" + addr + DefaultMetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("%s status = %d, want %d", DefaultMetricsPath, resp.StatusCode, http.StatusNotFound)
+	}
+
+	// Stopping waits for the requests, whose spans would have ended.
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	traceID := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	for _, span := range rec.spans {
+		if span.TraceID == traceID {
+			t.Errorf("span %q exported", span.Name)
+		}
+	}
+
+	if spans := tracer.FinishedSpans(); len(spans) != 0 {
+		t.Errorf("%d opentracing spans finished", len(spans))
+	}
+}
+
+func TestInjectedTracer(t *testing.T) {
+	global := mocktracer.New()
+	opentracing.SetGlobalTracer(global)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	tracer := mocktracer.New()
+	s := startOperations(t, &operations{}, Options{Tracer: tracer})
+	getOperation(t, http.DefaultClient, s.Addr().String(), "a")
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, span := range tracer.FinishedSpans() {
+		got = append(got, span.OperationName)
+	}
+	sort.Strings(got)
+
+	want := []string{
+		"/google.longrunning.Operations/GetOperation",
+		"/google.longrunning.Operations/GetOperation",
+		"http.GET.[/v1/{name=operations/**}]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("injected tracer spans = %q, want %q", got, want)
+	}
+
+	if spans := global.FinishedSpans(); len(spans) != 0 {
+		t.Errorf("%d spans finished on the global tracer", len(spans))
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	rec := &spanRecorder{}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+
+	s := startOperations(t, &operations{}, Options{TracePropagation: &b3.HTTPFormat{}})
+	defer s.Stop(context.Background())
+
+	r, err := http.NewRequest(http.MethodGet, "http://"+s.Addr().String()+"/v1/operations/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-B3-TraceId", "463ac35c9f6413ad48485a3953bb6124")
+	r.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	r.Header.Set("X-B3-Sampled", "1")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	traceID := trace.TraceID{0x46, 0x3a, 0xc3, 0x5c, 0x9f, 0x64, 0x13, 0xad, 0x48, 0x48, 0x5a, 0x39, 0x53, 0xbb, 0x61, 0x24}
+	span := waitSpan(t, rec, traceID, "/v1/{name=operations/**}")
+
+	if want := (trace.SpanID{0xa2, 0xfb, 0x4a, 0x1d, 0x1a, 0x96, 0xd3, 0x12}); span.ParentSpanID != want {
+		t.Errorf("server span parent = %s, want %s", span.ParentSpanID, want)
+	}
+
+	// The trace continues to the gRPC server through the gateway.
+	waitSpan(t, rec, traceID, "/google.longrunning.Operations/GetOperation")
+}
+
+func TestTraceRelocatedMetrics(t *testing.T) {
+	rec := &spanRecorder{}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+
+	s := startOperations(t, &operations{}, Options{BasePath: "/api", MetricsPath: "/internal/metrics"})
+	addr := s.Addr().String()
+
+	get := func(path, traceparent string) int {
+		r, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("traceparent", traceparent)
+
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	if got := get("/api/internal/metrics", "00-11111111111111111111111111111111-1111111111111111-01"); got != http.StatusOK {
+		t.Errorf("relocated metrics status = %d", got)
+	}
+
+	if got := get("/api/v1/operations/a", "00-22222222222222222222222222222222-2222222222222222-01"); got != http.StatusOK {
+		t.Errorf("gateway status = %d", got)
+	}
+
+	// Stopping waits for the requests, whose spans would have ended.
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	traced := false
+	for _, span := range rec.spans {
+		switch span.TraceID {
+		case trace.TraceID{0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11}:
+			t.Errorf("relocated metrics traced in span %q", span.Name)
+		case trace.TraceID{0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22}:
+			traced = true
+		}
+	}
+
+	if !traced {
+		t.Error("the gateway request under the base path wasn't traced")
+	}
+}
+
+func TestHTTPSpanName(t *testing.T) {
+	rec := &spanRecorder{}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+
+	s := startOperations(t, &operations{}, Options{
+		HTTPSpanAttributes: func(r *http.Request, status int) map[string]interface{} {
+			return map[string]interface{}{"tenant": r.Header.Get("X-Tenant")}
+		},
+	})
+	defer s.Stop(context.Background())
+
+	r, err := http.NewRequest(http.MethodGet, "http://"+s.Addr().String()+"/v1/operations/a/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("traceparent", "00-33333333333333333333333333333333-3333333333333333-01")
+	r.Header.Set("X-Tenant", "acme")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	traceID := trace.TraceID{0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33}
+	span := waitSpan(t, rec, traceID, "http.GET.[/v1/{name=operations/**}]")
+
+	if got := span.Attributes["http.route"]; got != "/v1/{name=operations/**}" {
+		t.Errorf("http.route = %v", got)
+	}
+
+	if got := span.Attributes["tenant"]; got != "acme" {
+		t.Errorf("tenant = %v, want acme", got)
+	}
+}
@@ -0,0 +1,271 @@
+package drudge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMaxTenants is the number of tenants labeling metrics when
+// Options.MaxTenants isn't set.
+const DefaultMaxTenants = 100
+
+const (
+	// noTenantLabel labels the calls without a tenant.
+	noTenantLabel = "none"
+
+	// otherTenantLabel labels the calls of the tenants over
+	// Options.MaxTenants.
+	otherTenantLabel = "other"
+)
+
+// TenantExtractor returns the tenant of a gRPC call, the gateway's included,
+// or "" when it has none.
+type TenantExtractor func(ctx context.Context) string
+
+type tenantKey struct{}
+
+// TenantFromContext returns the tenant of the call extracted by
+// Options.TenantExtractor, in gRPC handlers.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// TenantFromHeader extracts the tenant from the metadata key, e.g.
+// "x-tenant-id". The gateway forwards it from the Grpc-Metadata-X-Tenant-Id
+// header, or the X-Tenant-Id one when matched by the Mux options.
+func TenantFromHeader(key string) TenantExtractor {
+	key = strings.ToLower(key)
+
+	return func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(key); len(values) > 0 {
+			return values[len(values)-1]
+		}
+
+		return ""
+	}
+}
+
+// TenantFromSubdomain extracts the tenant from the label of the host right
+// below domain, "acme" for "acme.example.com" and "www.acme.example.com".
+// Gateway requests use the host the gateway received.
+func TenantFromSubdomain(domain string) TenantExtractor {
+	suffix := "." + strings.TrimPrefix(strings.ToLower(domain), ".")
+
+	return func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+
+		var host string
+		for _, key := range []string{"x-forwarded-host", ":authority"} {
+			if values := md.Get(key); len(values) > 0 {
+				host = values[len(values)-1]
+				break
+			}
+		}
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		host = strings.ToLower(host)
+		if !strings.HasSuffix(host, suffix) {
+			return ""
+		}
+
+		sub := strings.TrimSuffix(host, suffix)
+		if i := strings.LastIndex(sub, "."); i >= 0 {
+			sub = sub[i+1:]
+		}
+
+		return sub
+	}
+}
+
+// TenantFromClaim extracts the tenant from the claim of the token verified by
+// JWTAuth, which must be Options.AuthFunc. Claims other than strings are
+// formatted.
+func TenantFromClaim(claim string) TenantExtractor {
+	return func(ctx context.Context) string {
+		claims, ok := ClaimsFromContext(ctx)
+		if !ok {
+			return ""
+		}
+
+		switch v := claims.Raw[claim].(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+}
+
+// tenantLabels bounds the cardinality of the tenant label: the first max
+// tenants seen label their calls, the others share otherTenantLabel.
+type tenantLabels struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newTenantLabels(max int) *tenantLabels {
+	if max <= 0 {
+		max = DefaultMaxTenants
+	}
+
+	return &tenantLabels{max: max, seen: map[string]struct{}{}}
+}
+
+func (l *tenantLabels) label(tenant string) string {
+	if tenant == "" {
+		return noTenantLabel
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[tenant]; ok {
+		return tenant
+	}
+
+	if len(l.seen) >= l.max {
+		return otherTenantLabel
+	}
+
+	l.seen[tenant] = struct{}{}
+
+	return tenant
+}
+
+// tenantMetrics are the Prometheus metrics of the gRPC calls by tenant.
+type tenantMetrics struct {
+	labels   *tenantLabels
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+func newTenantMetrics(max int) *tenantMetrics {
+	return &tenantMetrics{
+		labels: newTenantLabels(max),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "drudge_tenant_requests_total",
+			Help: "Total number of gRPC calls by tenant, gateway requests included.",
+		}, []string{"tenant", "grpc_method", "grpc_code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "drudge_tenant_request_duration_seconds",
+			Help:    "Latency of the gRPC calls by tenant, gateway requests included.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"tenant", "grpc_method"}),
+	}
+}
+
+// register adds the metrics to r, reusing the ones registered by a previous
+// server of the process.
+func (m *tenantMetrics) register(r prometheus.Registerer) error {
+	if err := r.Register(m.requests); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return errors.Wrap(err, "failed to register the tenant request counter")
+		}
+
+		m.requests = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+
+	if err := r.Register(m.latency); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return errors.Wrap(err, "failed to register the tenant latency histogram")
+		}
+
+		m.latency = are.ExistingCollector.(*prometheus.HistogramVec)
+	}
+
+	return nil
+}
+
+func (m *tenantMetrics) observe(tenant, method string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	label := m.labels.label(tenant)
+	m.requests.WithLabelValues(label, method, status.Code(err).String()).Inc()
+	m.latency.WithLabelValues(label, method).Observe(time.Since(start).Seconds())
+}
+
+// tenantUnary adds the tenant of the call to its context, tags and span, and
+// records it in m when set.
+func tenantUnary(extract TenantExtractor, m *tenantMetrics) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		start := time.Now()
+		ctx, tenant := withTenant(ctx, extract)
+
+		resp, err := handler(ctx, req)
+		m.observe(tenant, info.FullMethod, start, err)
+
+		return resp, err
+	}
+}
+
+// tenantStream is the stream counterpart of tenantUnary.
+func tenantStream(extract TenantExtractor, m *tenantMetrics) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		start := time.Now()
+		wrapped := grpc_middleware.WrapServerStream(ss)
+
+		var tenant string
+		wrapped.WrappedContext, tenant = withTenant(ss.Context(), extract)
+
+		err := handler(srv, wrapped)
+		m.observe(tenant, info.FullMethod, start, err)
+
+		return err
+	}
+}
+
+func withTenant(ctx context.Context, extract TenantExtractor) (context.Context, string) {
+	tenant := extract(ctx)
+	if tenant == "" {
+		return ctx, ""
+	}
+
+	grpc_ctxtags.Extract(ctx).Set("tenant", tenant)
+
+	if span := trace.FromContext(ctx); span != nil {
+		span.AddAttributes(trace.StringAttribute("tenant", tenant))
+	}
+
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		sp.SetTag("tenant", tenant)
+	}
+
+	return context.WithValue(ctx, tenantKey{}, tenant), tenant
+}
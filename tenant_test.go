@@ -0,0 +1,152 @@
+package drudge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTenantExtractors(t *testing.T) {
+	tests := []struct {
+		name    string
+		extract TenantExtractor
+		md      metadata.MD
+		claims  *Claims
+		want    string
+	}{
+		{name: "header", extract: TenantFromHeader("X-Tenant-Id"), md: metadata.Pairs("x-tenant-id", "acme"), want: "acme"},
+		{name: "header, last value", extract: TenantFromHeader("x-tenant-id"), md: metadata.Pairs("x-tenant-id", "a", "x-tenant-id", "b"), want: "b"},
+		{name: "no header", extract: TenantFromHeader("x-tenant-id")},
+		{name: "subdomain", extract: TenantFromSubdomain("example.com"), md: metadata.Pairs(":authority", "acme.example.com:8443"), want: "acme"},
+		{name: "nested subdomain", extract: TenantFromSubdomain(".Example.com"), md: metadata.Pairs(":authority", "www.ACME.example.com"), want: "acme"},
+		{
+			name:    "forwarded host first",
+			extract: TenantFromSubdomain("example.com"),
+			md:      metadata.Pairs("x-forwarded-host", "acme.example.com", ":authority", "gateway.internal"),
+			want:    "acme",
+		},
+		{name: "other domain", extract: TenantFromSubdomain("example.com"), md: metadata.Pairs(":authority", "acme.example.org")},
+		{name: "apex", extract: TenantFromSubdomain("example.com"), md: metadata.Pairs(":authority", "example.com")},
+		{name: "claim", extract: TenantFromClaim("org"), claims: &Claims{Raw: map[string]interface{}{"org": "acme"}}, want: "acme"},
+		{name: "number claim", extract: TenantFromClaim("org"), claims: &Claims{Raw: map[string]interface{}{"org": float64(42)}}, want: "42"},
+		{name: "missing claim", extract: TenantFromClaim("org"), claims: &Claims{Raw: map[string]interface{}{}}},
+		{name: "no claims", extract: TenantFromClaim("org")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tt.md)
+			}
+			if tt.claims != nil {
+				ctx = context.WithValue(ctx, claimsKey{}, tt.claims)
+			}
+
+			if got := tt.extract(ctx); got != tt.want {
+				t.Errorf("tenant = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTenantLabels(t *testing.T) {
+	l := newTenantLabels(2)
+
+	tests := []struct {
+		tenant string
+		want   string
+	}{
+		{tenant: "", want: noTenantLabel},
+		{tenant: "a", want: "a"},
+		{tenant: "b", want: "b"},
+		{tenant: "c", want: otherTenantLabel},
+		{tenant: "a", want: "a"},
+	}
+
+	for _, tt := range tests {
+		if got := l.label(tt.tenant); got != tt.want {
+			t.Errorf("label(%q) = %q, want %q", tt.tenant, got, tt.want)
+		}
+	}
+
+	if got := newTenantLabels(0).max; got != DefaultMaxTenants {
+		t.Errorf("default max = %d, want %d", got, DefaultMaxTenants)
+	}
+}
+
+func TestTenantInterceptors(t *testing.T) {
+	tests := []struct {
+		name      string
+		md        metadata.MD
+		err       error
+		want      string
+		wantLabel string
+		wantCode  string
+	}{
+		{name: "tenant", md: metadata.Pairs("x-tenant-id", "acme"), want: "acme", wantLabel: "acme", wantCode: "OK"},
+		{name: "no tenant", wantLabel: noTenantLabel, wantCode: "OK"},
+		{name: "error", md: metadata.Pairs("x-tenant-id", "acme"), err: status.Error(codes.NotFound, ""), want: "acme", wantLabel: "acme", wantCode: "NotFound"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTenantMetrics(10)
+			if err := m.register(prometheus.NewRegistry()); err != nil {
+				t.Fatal(err)
+			}
+
+			extract := TenantFromHeader("x-tenant-id")
+			ctx := context.Background()
+			if tt.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tt.md)
+			}
+
+			var unaryTenant, unaryTag, streamTenant string
+			unary := grpc_middleware.ChainUnaryServer(grpc_ctxtags.UnaryServerInterceptor(), tenantUnary(extract, m))
+			_, err := unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Unary"},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					unaryTenant = TenantFromContext(ctx)
+					unaryTag, _ = grpc_ctxtags.Extract(ctx).Values()["tenant"].(string)
+					return nil, tt.err
+				})
+			if err != tt.err {
+				t.Fatalf("unary error = %v, want %v", err, tt.err)
+			}
+
+			stream := grpc_middleware.ChainStreamServer(grpc_ctxtags.StreamServerInterceptor(), tenantStream(extract, m))
+			err = stream(nil, &contextStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: "/pkg.Service/Stream"},
+				func(srv interface{}, ss grpc.ServerStream) error {
+					streamTenant = TenantFromContext(ss.Context())
+					return tt.err
+				})
+			if err != tt.err {
+				t.Fatalf("stream error = %v, want %v", err, tt.err)
+			}
+
+			if unaryTenant != tt.want || unaryTag != tt.want || streamTenant != tt.want {
+				t.Errorf("tenant = %q, tag %q, stream %q, want %q", unaryTenant, unaryTag, streamTenant, tt.want)
+			}
+
+			for _, method := range []string{"/pkg.Service/Unary", "/pkg.Service/Stream"} {
+				if got := testutil.ToFloat64(m.requests.WithLabelValues(tt.wantLabel, method, tt.wantCode)); got != 1 {
+					t.Errorf("requests{%s, %s, %s} = %v, want 1", tt.wantLabel, method, tt.wantCode, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTenantMetricsNil(t *testing.T) {
+	var m *tenantMetrics
+	m.observe("acme", "/pkg.Service/Unary", time.Now(), nil)
+}
@@ -0,0 +1,218 @@
+package drudge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+type peerCertificateKey struct{}
+
+// serverTLSConfig builds the TLS configuration of the HTTP server serving the
+// certificates, it's nil when no certificate is configured.
+func (o Options) serverTLSConfig(certs *certReloader) *tls.Config {
+	if certs == nil {
+		return nil
+	}
+
+	c := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		ClientCAs:      o.ClientCAs,
+		// gRPC clients reaching the HTTP port require HTTP/2.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	switch {
+	case o.RequireClientCert:
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	case o.ClientCAs != nil:
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return c
+}
+
+// gatewayTLSConfig secures the gateway's connection to the gRPC server, which
+// serves the same certificate. It's pinned rather than verified against a
+// CA, and presented as the client certificate when one is required.
+func (o Options) gatewayTLSConfig(certs *certReloader) *tls.Config {
+	c := &tls.Config{
+		// The served certificate is pinned by VerifyPeerCertificate instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			cert, _ := certs.GetCertificate(nil)
+			if len(raw) == 0 || cert == nil || len(cert.Certificate) == 0 || !bytes.Equal(raw[0], cert.Certificate[0]) {
+				return errors.New("the gRPC server presented an unexpected certificate")
+			}
+
+			return nil
+		},
+	}
+
+	if o.RequireClientCert {
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.GetCertificate(nil)
+		}
+	}
+
+	return c
+}
+
+// certReloader serves a certificate pair from disk, reloading it when either
+// file changes so rotated certificates are picked up without a restart.
+type certReloader struct {
+	lg       *zap.Logger
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(lg *zap.Logger, certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		lg:       lg,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A failed reload, such
+// as a key not yet matching its rotated certificate, keeps serving the
+// previous certificate and is retried on the next handshake.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	mod, err := c.modified()
+
+	c.mu.RLock()
+	stale := err == nil && !mod.Equal(c.modTime)
+	c.mu.RUnlock()
+
+	if stale {
+		if err := c.reload(); err != nil {
+			c.lg.Error("failed to reload the TLS certificate", zap.Error(err))
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+func (c *certReloader) reload() error {
+	mod, err := c.modified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load the TLS certificate")
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = mod
+	c.mu.Unlock()
+
+	c.lg.Info("loaded TLS certificate", zap.String("certificate", c.certFile))
+
+	return nil
+}
+
+// modified returns the latest modification time of the pair.
+func (c *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "failed to stat the TLS certificate")
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// reloadOnHangup reloads the certificate when SIGHUP is received, even if
+// the files' modification times didn't change. The returned function removes
+// the signal handler.
+func (c *certReloader) reloadOnHangup() func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				if err := c.reload(); err != nil {
+					c.lg.Error("failed to reload the TLS certificate", zap.Error(err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// PeerCertificate returns the verified client certificate of the caller, for
+// both HTTP handlers and gRPC calls made directly over TLS.
+func PeerCertificate(ctx context.Context) (*x509.Certificate, bool) {
+	if c, ok := ctx.Value(peerCertificateKey{}).(*x509.Certificate); ok {
+		return c, true
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return nil, false
+	}
+
+	return info.State.VerifiedChains[0][0], true
+}
+
+// withPeerCertificate adds the verified client certificate to the context of
+// the request, see PeerCertificate.
+func withPeerCertificate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			ctx := context.WithValue(r.Context(), peerCertificateKey{}, r.TLS.VerifiedChains[0][0])
+			r = r.WithContext(ctx)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
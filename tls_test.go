@@ -0,0 +1,403 @@
+package drudge
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// writeCertificate writes a self-signed certificate pair for cn under dir,
+// returning the parsed certificate.
+func writeCertificate(t *testing.T, dir, cn string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	pool := x509.NewCertPool()
+
+	tests := []struct {
+		name     string
+		opts     Options
+		certs    *certReloader
+		wantNil  bool
+		wantAuth tls.ClientAuthType
+	}{
+		{name: "no certificate", wantNil: true},
+		{name: "no client certificate", certs: &certReloader{}, wantAuth: tls.NoClientCert},
+		{name: "client CAs", opts: Options{ClientCAs: pool}, certs: &certReloader{}, wantAuth: tls.VerifyClientCertIfGiven},
+		{
+			name:     "required",
+			opts:     Options{ClientCAs: pool, RequireClientCert: true},
+			certs:    &certReloader{},
+			wantAuth: tls.RequireAndVerifyClientCert,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.opts.serverTLSConfig(tt.certs)
+			if (c == nil) != tt.wantNil {
+				t.Fatalf("serverTLSConfig() = %v", c)
+			}
+
+			if c == nil {
+				return
+			}
+
+			if c.ClientAuth != tt.wantAuth {
+				t.Errorf("ClientAuth = %v, want %v", c.ClientAuth, tt.wantAuth)
+			}
+
+			if len(c.NextProtos) == 0 || c.NextProtos[0] != "h2" {
+				t.Errorf("NextProtos = %v", c.NextProtos)
+			}
+		})
+	}
+}
+
+func TestGatewayTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	served := writeCertificate(t, dir, "server")
+	certs, err := newCertReloader(zap.NewNop(), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other)
+
+	impostor := writeCertificate(t, other, "impostor")
+
+	tests := []struct {
+		name           string
+		opts           Options
+		raw            [][]byte
+		wantErr        bool
+		wantClientCert bool
+	}{
+		{name: "pinned", raw: [][]byte{served.Raw}},
+		{name: "other certificate", raw: [][]byte{impostor.Raw}, wantErr: true},
+		{name: "no certificate", wantErr: true},
+		{name: "client certificate", opts: Options{RequireClientCert: true}, raw: [][]byte{served.Raw}, wantClientCert: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.opts.gatewayTLSConfig(certs)
+
+			if err := c.VerifyPeerCertificate(tt.raw, nil); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyPeerCertificate() = %v, want error %t", err, tt.wantErr)
+			}
+
+			if (c.GetClientCertificate != nil) != tt.wantClientCert {
+				t.Fatalf("GetClientCertificate set = %t", c.GetClientCertificate != nil)
+			}
+
+			if c.GetClientCertificate != nil {
+				cert, err := c.GetClientCertificate(nil)
+				if err != nil || cert == nil || string(cert.Certificate[0]) != string(served.Raw) {
+					t.Errorf("GetClientCertificate() = %v, %v", cert, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate func(t *testing.T, dir string)
+		wantCN string
+	}{
+		{name: "unchanged", rotate: func(t *testing.T, dir string) {}, wantCN: "first"},
+		{
+			name: "rotated",
+			rotate: func(t *testing.T, dir string) {
+				writeCertificate(t, dir, "second")
+				later := time.Now().Add(time.Minute)
+				for _, f := range []string{"cert.pem", "key.pem"} {
+					if err := os.Chtimes(filepath.Join(dir, f), later, later); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			wantCN: "second",
+		},
+		{
+			name: "mismatched key",
+			rotate: func(t *testing.T, dir string) {
+				if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("garbage"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				later := time.Now().Add(time.Minute)
+				if err := os.Chtimes(filepath.Join(dir, "key.pem"), later, later); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCN: "first",
+		},
+		{
+			name: "removed",
+			rotate: func(t *testing.T, dir string) {
+				if err := os.Remove(filepath.Join(dir, "cert.pem")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCN: "first",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tls")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			writeCertificate(t, dir, "first")
+
+			c, err := newCertReloader(zap.NewNop(), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.rotate(t, dir)
+
+			cert, err := c.GetCertificate(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if leaf.Subject.CommonName != tt.wantCN {
+				t.Errorf("serving %q, want %q", leaf.Subject.CommonName, tt.wantCN)
+			}
+		})
+	}
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCertificate(t, dir, "server")
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.pem"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+	}{
+		{name: "missing certificate", certFile: "nope.pem", keyFile: "key.pem"},
+		{name: "missing key", certFile: "cert.pem", keyFile: "nope.pem"},
+		{name: "invalid key", certFile: "cert.pem", keyFile: "bad.pem"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newCertReloader(zap.NewNop(), filepath.Join(dir, tt.certFile), filepath.Join(dir, tt.keyFile)); err == nil {
+				t.Error("newCertReloader() succeeded")
+			}
+		})
+	}
+}
+
+func TestPeerCertificate(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+	chains := [][]*x509.Certificate{{cert}}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		wantOK bool
+	}{
+		{name: "none", ctx: context.Background()},
+		{name: "HTTP", ctx: context.WithValue(context.Background(), peerCertificateKey{}, cert), wantOK: true},
+		{
+			name: "gRPC",
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: chains}},
+			}),
+			wantOK: true,
+		},
+		{
+			name: "gRPC unverified",
+			ctx:  peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}}),
+		},
+		{name: "gRPC insecure", ctx: peer.NewContext(context.Background(), &peer.Peer{})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := PeerCertificate(tt.ctx)
+			if ok != tt.wantOK {
+				t.Fatalf("PeerCertificate() found = %t, want %t", ok, tt.wantOK)
+			}
+
+			if ok && got != cert {
+				t.Errorf("PeerCertificate() = %v", got.Subject)
+			}
+		})
+	}
+}
+
+func TestWithPeerCertificate(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+
+	tests := []struct {
+		name   string
+		state  *tls.ConnectionState
+		wantOK bool
+	}{
+		{name: "plain"},
+		{name: "unverified", state: &tls.ConnectionState{}},
+		{name: "verified", state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.TLS = tt.state
+
+			var ok bool
+			withPeerCertificate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, ok = PeerCertificate(r.Context())
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if ok != tt.wantOK {
+				t.Errorf("certificate found = %t, want %t", ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRPCTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(writeCertificate(t, dir, "drudge"))
+
+	tests := []struct {
+		name     string
+		insecure bool
+		creds    grpc.DialOption
+		wantErr  bool
+	}{
+		{name: "TLS", creds: grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pool}))},
+		{name: "plaintext", creds: grpc.WithInsecure(), wantErr: true},
+		{name: "insecure RPC", insecure: true, creds: grpc.WithInsecure()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := startOperations(t, &operations{}, Options{
+				Listener:       list,
+				Certificate:    filepath.Join(dir, "cert.pem"),
+				CertificateKey: filepath.Join(dir, "key.pem"),
+				InsecureRPC:    tt.insecure,
+			})
+			defer s.Stop(context.Background())
+
+			conn, err := grpc.Dial(list.Addr().String(), tt.creds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			req := &longrunning.GetOperationRequest{Name: "operations/a"}
+			if _, err := longrunning.NewOperationsClient(conn).GetOperation(ctx, req); (err != nil) != tt.wantErr {
+				t.Errorf("GetOperation() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
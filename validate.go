@@ -0,0 +1,145 @@
+package drudge
+
+import (
+	"context"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validator is implemented by messages with generated validation, such as
+// protoc-gen-validate or go-proto-validators.
+type validator interface {
+	Validate() error
+}
+
+// allValidator is implemented by messages able to report every violation
+// instead of the first, such as protoc-gen-validate's ValidateAll.
+type allValidator interface {
+	ValidateAll() error
+}
+
+// fieldError is implemented by validation errors naming the offending
+// field, nested message errors are reachable through Cause.
+type fieldError interface {
+	Field() string
+	Reason() string
+}
+
+type causer interface {
+	Cause() error
+}
+
+// multiError is implemented by validation errors collecting several
+// violations.
+type multiError interface {
+	AllErrors() []error
+}
+
+// validateUnary rejects invalid requests with InvalidArgument before they
+// reach the handler. With all set, every violation is reported when the
+// message supports it.
+func validateUnary(all bool) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if err := validate(req, all); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// validateStream rejects invalid messages with InvalidArgument as they're
+// received, see validateUnary.
+func validateStream(all bool) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &validatingStream{ServerStream: ss, all: all})
+	}
+}
+
+type validatingStream struct {
+	grpc.ServerStream
+	all bool
+}
+
+func (s *validatingStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	return validate(m, s.all)
+}
+
+// validate returns an InvalidArgument status for invalid messages, with a
+// BadRequest detail listing the field violations when the error names them,
+// which the gateway renders in the body of its 400 response.
+func validate(m interface{}, all bool) error {
+	var err error
+	if v, ok := m.(allValidator); ok && all {
+		err = v.ValidateAll()
+	} else if v, ok := m.(validator); ok {
+		err = v.Validate()
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	st := status.New(codes.InvalidArgument, err.Error())
+
+	violations := fieldViolations(err)
+	if len(violations) == 0 {
+		return st.Err()
+	}
+
+	ds, derr := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if derr != nil {
+		return st.Err()
+	}
+
+	return ds.Err()
+}
+
+func fieldViolations(err error) []*errdetails.BadRequest_FieldViolation {
+	switch e := err.(type) {
+	case multiError:
+		var violations []*errdetails.BadRequest_FieldViolation
+		for _, err := range e.AllErrors() {
+			violations = append(violations, fieldViolations(err)...)
+		}
+
+		return violations
+	case fieldError:
+		// Nested messages report their own fields within the parent's.
+		if c, ok := e.(causer); ok {
+			if nested := fieldViolations(c.Cause()); len(nested) > 0 {
+				for _, v := range nested {
+					v.Field = e.Field() + "." + v.Field
+				}
+
+				return nested
+			}
+		}
+
+		return []*errdetails.BadRequest_FieldViolation{{
+			Field:       e.Field(),
+			Description: e.Reason(),
+		}}
+	case causer:
+		return fieldViolations(e.Cause())
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package drudge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testFieldError mimics the field errors generated by protoc-gen-validate.
+type testFieldError struct {
+	field  string
+	reason string
+	cause  error
+}
+
+func (e testFieldError) Error() string  { return "invalid " + e.field + ": " + e.reason }
+func (e testFieldError) Field() string  { return e.field }
+func (e testFieldError) Reason() string { return e.reason }
+func (e testFieldError) Cause() error   { return e.cause }
+
+// testMultiError mimics the errors of protoc-gen-validate's ValidateAll.
+type testMultiError []error
+
+func (e testMultiError) Error() string      { return "invalid message" }
+func (e testMultiError) AllErrors() []error { return e }
+
+// validated returns its first error from Validate, all of them from
+// ValidateAll.
+type validated struct{ errs []error }
+
+func (m validated) Validate() error {
+	if len(m.errs) == 0 {
+		return nil
+	}
+
+	return m.errs[0]
+}
+
+func (m validated) ValidateAll() error {
+	if len(m.errs) == 0 {
+		return nil
+	}
+
+	return testMultiError(m.errs)
+}
+
+// validatedFirst has no ValidateAll.
+type validatedFirst struct{ err error }
+
+func (m validatedFirst) Validate() error { return m.err }
+
+func TestValidate(t *testing.T) {
+	name := testFieldError{field: "name", reason: "required"}
+	age := testFieldError{field: "age", reason: "must be positive"}
+
+	tests := []struct {
+		name       string
+		msg        interface{}
+		all        bool
+		wantCode   codes.Code
+		wantFields []string
+	}{
+		{name: "no validation", msg: struct{}{}, wantCode: codes.OK},
+		{name: "valid", msg: validated{}, wantCode: codes.OK},
+		{name: "first", msg: validated{errs: []error{name, age}}, wantCode: codes.InvalidArgument, wantFields: []string{"name"}},
+		{name: "all", msg: validated{errs: []error{name, age}}, all: true, wantCode: codes.InvalidArgument, wantFields: []string{"name", "age"}},
+		{name: "all unsupported", msg: validatedFirst{err: age}, all: true, wantCode: codes.InvalidArgument, wantFields: []string{"age"}},
+		{
+			name:       "nested",
+			msg:        validatedFirst{err: testFieldError{field: "address", reason: "invalid", cause: testFieldError{field: "zip", reason: "too short"}}},
+			wantCode:   codes.InvalidArgument,
+			wantFields: []string{"address.zip"},
+		},
+		{name: "no field", msg: validatedFirst{err: errors.New("invalid")}, wantCode: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(tt.msg, tt.all)
+
+			st := status.Convert(err)
+			if st.Code() != tt.wantCode {
+				t.Fatalf("code = %s, want %s", st.Code(), tt.wantCode)
+			}
+
+			var fields []string
+			for _, d := range st.Details() {
+				if br, ok := d.(*errdetails.BadRequest); ok {
+					for _, v := range br.FieldViolations {
+						fields = append(fields, v.Field)
+					}
+				}
+			}
+
+			if len(fields) != len(tt.wantFields) {
+				t.Fatalf("fields = %v, want %v", fields, tt.wantFields)
+			}
+
+			for i := range fields {
+				if fields[i] != tt.wantFields[i] {
+					t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+				}
+			}
+		})
+	}
+}
+
+// recvStream receives msg.
+type recvStream struct {
+	contextStream
+	msg validatedFirst
+}
+
+func (s *recvStream) RecvMsg(m interface{}) error {
+	*(m.(*validatedFirst)) = s.msg
+	return nil
+}
+
+func TestValidateInterceptors(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      validatedFirst
+		wantCode codes.Code
+	}{
+		{name: "valid", wantCode: codes.OK},
+		{name: "invalid", msg: validatedFirst{err: errors.New("invalid")}, wantCode: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			_, err := validateUnary(false)(context.Background(), tt.msg, &grpc.UnaryServerInfo{},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					called = true
+					return nil, nil
+				})
+
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("unary code = %s, want %s", status.Code(err), tt.wantCode)
+			}
+
+			if called != (tt.wantCode == codes.OK) {
+				t.Errorf("handler called = %t", called)
+			}
+
+			ss := &recvStream{contextStream: contextStream{ctx: context.Background()}, msg: tt.msg}
+			err = validateStream(false)(nil, ss, &grpc.StreamServerInfo{},
+				func(srv interface{}, ss grpc.ServerStream) error {
+					var m validatedFirst
+					return ss.RecvMsg(&m)
+				})
+
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("stream code = %s, want %s", status.Code(err), tt.wantCode)
+			}
+		})
+	}
+}
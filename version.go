@@ -0,0 +1,72 @@
+package drudge
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// BuildInfo describes the deployed build, typically set through -ldflags.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+}
+
+// Module is a dependency compiled into the binary.
+type Module struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// VersionInfo is the payload served by the version endpoint.
+type VersionInfo struct {
+	BuildInfo
+	GoVersion string   `json:"go_version"`
+	Main      Module   `json:"main"`
+	Modules   []Module `json:"modules"`
+}
+
+// newVersionInfo combines the caller's build information with the module
+// versions recorded by the Go toolchain.
+func newVersionInfo(b BuildInfo) VersionInfo {
+	info := VersionInfo{
+		BuildInfo: b,
+		GoVersion: runtime.Version(),
+		Modules:   []Module{},
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info.Main = Module{Path: bi.Main.Path, Version: bi.Main.Version}
+
+	for _, d := range bi.Deps {
+		m := d
+		if d.Replace != nil {
+			m = d.Replace
+		}
+
+		info.Modules = append(info.Modules, Module{Path: d.Path, Version: m.Version})
+	}
+
+	return info
+}
+
+// versionHandler serves the build information as JSON.
+func versionHandler(b BuildInfo) http.HandlerFunc {
+	info := newVersionInfo(b)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			http.Error(w, errors.Wrap(err, "failed to encode version").Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
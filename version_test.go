@@ -0,0 +1,47 @@
+package drudge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		build BuildInfo
+	}{
+		{name: "unset"},
+		{name: "set", build: BuildInfo{Version: "v1.2.3", Commit: "abc123", BuildTime: "2019-10-01T00:00:00Z"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			versionHandler(tt.build)(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+
+			var got VersionInfo
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.BuildInfo != tt.build {
+				t.Errorf("BuildInfo = %+v, want %+v", got.BuildInfo, tt.build)
+			}
+
+			if got.GoVersion != runtime.Version() {
+				t.Errorf("GoVersion = %s, want %s", got.GoVersion, runtime.Version())
+			}
+
+			if got.Modules == nil {
+				t.Error("modules = null, want a list")
+			}
+		})
+	}
+}